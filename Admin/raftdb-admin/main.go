@@ -0,0 +1,206 @@
+package main
+
+import (
+	"RaftDB/Custom/Communicate/RPC"
+	"RaftDB/Custom/Store/Commenfile"
+	"RaftDB/Custom/Store/Encrypt"
+	"RaftDB/Kernel/Bottom"
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Pipe/Order"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+检查、修复、备份和恢复节点的存储，除了backup之外节点必须已经停止。
+日志的位置统一使用全局下标，key写成term,index。
+设置了RAFTDB_KEY_FILE或RAFTDB_KEYS时读写加密的存储，同时设置RAFTDB_ALLOW_PLAINTEXT=1时可以读取明文，用reencrypt加密旧数据，设置了RAFTDB_TLS_CERT、RAFTDB_TLS_KEY和RAFTDB_TLS_CA时用双向TLS连接节点。
+*/
+
+const usage = `usage:
+  raftdb-admin meta [conf]                                show the persisted meta
+  raftdb-admin dump [conf] [log] [from] [to]              dump logs whose global index is in [from, to] as JSON
+  raftdb-admin verify [conf] [log]                        verify ordering and commit consistency
+  raftdb-admin truncate [conf] [log] [term] [index] [-f]  remove logs after the key, -f to remove committed logs
+  raftdb-admin diff [conf] [log] [conf] [log]             find where two nodes' logs diverge
+  raftdb-admin backup [addr] [name] [term] [index]        ask a running node to back up to the file name in its
+                                                          backupDir, up to the committed key by default
+  raftdb-admin restore [archive] [conf] [log] [id] [dns]  bootstrap a node from a backup, dns like a:1,b:2,
+                                                          by default the members in the backup
+  raftdb-admin keygen [id]                                print a new key line for the key file
+  raftdb-admin reencrypt [conf] [log]                     re-encrypt all files with the current (last) key`
+
+type entry struct {
+	Term  int    `json:"term"`
+	Index int    `json:"index"`
+	I     int    `json:"global"`
+	V     string `json:"value"`
+}
+
+func toEntry(v Log.Log) entry {
+	return entry{Term: v.K.Term, Index: v.K.Index, I: v.I, V: v.V}
+}
+
+var medium = Encrypt.FromEnv(&Commenfile.CommonFile{})
+
+func open(confPath string, filePath string) *Bottom.Offline {
+	o, err := Bottom.OpenOffline(confPath, filePath, medium, nil)
+	if err != nil {
+		log.Fatalf("open %s %s: %v\n", confPath, filePath, err)
+	}
+	return o
+}
+
+func atoi(s string) int {
+	res, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatalf("input error: %q is not a number\n%s\n", s, usage)
+	}
+	return res
+}
+
+func printJSON(v interface{}) {
+	res, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(res))
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+	switch {
+	case args[0] == "meta" && len(args) == 2:
+		meta, err := Bottom.ReadMeta(args[1], medium, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printJSON(meta)
+	case args[0] == "dump" && len(args) >= 3 && len(args) <= 5:
+		o := open(args[1], args[2])
+		from, to := 0, -1
+		if len(args) >= 4 {
+			from = atoi(args[3])
+		}
+		if len(args) == 5 {
+			to = atoi(args[4])
+		}
+		n := 0
+		err := o.Range(from, to, func(v Log.Log) error { // 逐条输出，和printJSON输出的数组格式相同
+			res, err := json.MarshalIndent(toEntry(v), "  ", "  ")
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				fmt.Print("[\n  ")
+			} else {
+				fmt.Print(",\n  ")
+			}
+			fmt.Print(string(res))
+			n++
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("%v, last global index is %d\n", err, o.Logs().GetLastIndex())
+		}
+		if n == 0 {
+			fmt.Println("[]")
+		} else {
+			fmt.Println("\n]")
+		}
+	case args[0] == "verify" && len(args) == 3:
+		o, err := Bottom.CheckOffline(args[1], args[2], medium, nil) // 无法解析的行由Verify报告
+		if err != nil {
+			log.Fatalf("open %s %s: %v\n", args[1], args[2], err)
+		}
+		problems := o.Verify()
+		for _, v := range problems {
+			fmt.Println(v)
+		}
+		if len(problems) != 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("ok: %d logs, committed key %v, term %d\n",
+			o.Logs().GetLastIndex()+1, o.Logs().GetCommitted(), o.Meta().Term)
+	case args[0] == "truncate" && (len(args) == 5 || len(args) == 6 && args[5] == "-f"):
+		o := open(args[1], args[2])
+		removed, err := o.Truncate(Log.Key{Term: atoi(args[3]), Index: atoi(args[4])}, len(args) == 6)
+		for _, v := range removed {
+			fmt.Printf("removed #%d %v %s\n", v.I, v.K, v.V)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("last log %v#%d, committed key %v\n",
+			o.Logs().GetLast(), o.Logs().GetLastIndex(), o.Logs().GetCommitted())
+	case args[0] == "diff" && len(args) == 5:
+		a, b := open(args[1], args[2]), open(args[3], args[4])
+		i, differ := Bottom.Diff(a.Logs(), b.Logs())
+		if !differ {
+			fmt.Printf("same %d logs\n", i)
+			return
+		}
+		fmt.Printf("diverge at global index %d\n", i)
+		for _, o := range []*Bottom.Offline{a, b} {
+			if v, err := o.Logs().GetByIndex(i); err == nil {
+				printJSON(toEntry(v))
+			} else {
+				fmt.Printf("no log, last global index is %d\n", o.Logs().GetLastIndex())
+			}
+		}
+		os.Exit(1)
+	case args[0] == "backup" && (len(args) == 3 || len(args) == 5):
+		msg := Order.Message{Log: args[2], LastLogKey: Log.Key{Term: -1, Index: -1}}
+		if len(args) == 5 {
+			msg.LastLogKey = Log.Key{Term: atoi(args[3]), Index: atoi(args[4])}
+		}
+		client, err := RPC.Dial(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+		var res string
+		if err := client.Call("RPC.Backup", msg, &res); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(res)
+	case args[0] == "restore" && (len(args) == 5 || len(args) == 6):
+		var dns []string
+		if len(args) == 6 {
+			dns = strings.Split(args[5], ",")
+		}
+		if err := Bottom.Restore(args[1], args[2], args[3], medium, nil, atoi(args[4]), dns); err != nil {
+			log.Fatal(err)
+		}
+		o := open(args[2], args[3])
+		fmt.Printf("restored %d logs, committed key %v, members %v\n",
+			o.Logs().GetLastIndex()+1, o.Logs().GetCommitted(), o.Meta().Dns[:o.Meta().Num])
+	case args[0] == "keygen" && len(args) == 2:
+		key, err := Encrypt.NewKey(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(key)
+	case args[0] == "reencrypt" && len(args) == 3:
+		m, ok := medium.(*Encrypt.EncryptedMedium)
+		if !ok {
+			log.Fatalf("set %s or %s first\n", Encrypt.KeyFileEnv, Encrypt.KeysEnv)
+		}
+		o := open(args[1], args[2])
+		for _, v := range o.Paths() {
+			if err := m.Reencrypt(v); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("re-encrypted %s\n", v)
+		}
+	default:
+		log.Fatal(usage)
+	}
+}
@@ -0,0 +1,233 @@
+package Cluster
+
+import (
+	"RaftDB/Custom/Communicate/Channel"
+	"RaftDB/Custom/Communicate/Fault"
+	"RaftDB/Custom/Store/Memory"
+	"RaftDB/Kernel/Bottom"
+	"RaftDB/Kernel/Crown"
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Meta"
+	"RaftDB/Kernel/Node"
+	"RaftDB/Kernel/Pipe/Client"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+/*
+进程内集群，所有节点使用MemoryMedium存储、ChannelCable通讯，不占用端口和文件。
+每个节点有自己独立的内存磁盘，Kill后磁盘保留，Restart时从磁盘恢复，用于测试Logic层在宕机、重启下的行为。
+每个节点的ChannelCable外面包装了一层FaultCable，故障规则在节点重启后保留。
+节点使用很小的DiskLogSet窗口和段文件，测试时大部分已提交的日志都要从磁盘读取。
+*/
+
+type Cluster struct {
+	Network *Channel.Network
+	num     int
+	mediums []*Memory.MemoryMedium
+	cables  []*Channel.ChannelCable
+	faults  []*Fault.FaultCable
+	nodes   []*Node.Node
+	newApp  func() Crown.App // 每次启动节点都会新建一个App，由日志恢复状态
+	m       sync.Mutex
+}
+
+const (
+	confPath = "raftdb.conf"
+	logPath  = "raftdb.log"
+)
+
+/*
+新建一个num个节点的集群，写好每个节点的配置文件和空日志，但不启动节点。
+*/
+
+func New(num int, newApp func() Crown.App) (*Cluster, error) {
+	c := &Cluster{
+		Network: Channel.NewNetwork(),
+		num:     num,
+		mediums: make([]*Memory.MemoryMedium, num),
+		cables:  make([]*Channel.ChannelCable, num),
+		faults:  make([]*Fault.FaultCable, num),
+		nodes:   make([]*Node.Node, num),
+		newApp:  newApp,
+	}
+	dns := make([]string, num)
+	for i := 0; i < num; i++ {
+		dns[i] = fmt.Sprintf("node%d", i)
+	}
+	for i := 0; i < num; i++ {
+		meta := Meta.Meta{
+			Id:                      i,
+			Num:                     num,
+			Term:                    0,
+			CommittedKeyTerm:        -1,
+			CommittedKeyIndex:       -1,
+			Dns:                     dns,
+			LeaderHeartbeat:         10,
+			FollowerTimeout:         50,
+			CandidatePreVoteTimeout: 40,
+			CandidateVoteTimeout:    40,
+			LogSegmentSize:          8,
+			LogCodec:                "flate",
+			MsgCodec:                "flate",
+		}
+		conf, err := json.Marshal(meta)
+		if err != nil {
+			return nil, err
+		}
+		c.mediums[i] = &Memory.MemoryMedium{}
+		c.faults[i] = &Fault.FaultCable{}
+		if err = c.mediums[i].Write(confPath, string(conf)); err != nil {
+			return nil, err
+		}
+		if err = c.mediums[i].Write(logPath, ""); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+/*
+启动全部节点。
+*/
+
+func (c *Cluster) Start() {
+	for i := 0; i < c.num; i++ {
+		c.Restart(i)
+	}
+}
+
+/*
+启动（重启）第i个节点，节点使用自己原来的内存磁盘。节点已经在运行时不做任何事。
+*/
+
+func (c *Cluster) Restart(i int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.nodes[i] != nil {
+		return
+	}
+	node := &Node.Node{LogSet: Log.NewDiskLogSet(4, 2)}
+	c.cables[i] = &Channel.ChannelCable{Network: c.Network}
+	c.faults[i].Inner = c.cables[i]
+	node.Init(confPath, logPath, c.mediums[i], c.faults[i], c.newApp())
+	node.Run()
+	c.nodes[i] = node
+}
+
+/*
+杀死第i个节点，先把它从网络中摘除再停止它，内存磁盘保留。
+*/
+
+func (c *Cluster) Kill(i int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.nodes[i] == nil {
+		return
+	}
+	c.Network.Disconnect(fmt.Sprintf("node%d", i))
+	c.nodes[i].Stop()
+	c.nodes[i] = nil
+}
+
+/*
+停止全部节点。
+*/
+
+func (c *Cluster) Shutdown() {
+	for i := 0; i < c.num; i++ {
+		c.Kill(i)
+	}
+}
+
+func (c *Cluster) Alive(i int) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.nodes[i] != nil
+}
+
+/*
+以客户端身份向第i个节点发送一个请求，没有给出版本时使用当前版本，节点不在线时报错，请求一定没有执行。
+*/
+
+func (c *Cluster) Do(i int, req Client.Request) (Client.Response, error) {
+	c.m.Lock()
+	cable := c.cables[i]
+	alive := c.nodes[i] != nil
+	c.m.Unlock()
+	if !alive {
+		return Client.Response{}, fmt.Errorf("node %d is unreachable", i)
+	}
+	if req.Version == 0 {
+		req.Version = Client.Version
+	}
+	return cable.Do(req), nil
+}
+
+/*
+在第i个节点上在线备份到当前已提交的key，备份写在它的内存磁盘中的path，返回备份的内容。
+*/
+
+func (c *Cluster) Backup(i int, path string) (string, error) {
+	c.m.Lock()
+	node := c.nodes[i]
+	c.m.Unlock()
+	if node == nil {
+		return "", fmt.Errorf("node %d is not running", i)
+	}
+	if _, err := node.Bottom.Backup(path, Log.Key{Term: -1, Index: -1}); err != nil {
+		return "", err
+	}
+	var res string
+	err := c.mediums[i].Read(path, &res)
+	return res, err
+}
+
+/*
+用备份的内容初始化全部节点的内存磁盘，集群成员换成这个集群的节点，必须在Start之前调用。
+*/
+
+func (c *Cluster) Restore(archive string) error {
+	dns := make([]string, c.num)
+	for i := range dns {
+		dns[i] = fmt.Sprintf("node%d", i)
+	}
+	for i, m := range c.mediums {
+		if err := m.Write("backup", archive); err != nil {
+			return err
+		}
+		if err := Bottom.Restore("backup", confPath, logPath, m, nil, i, dns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+第i个节点的故障注入信道，可以单独设置它的链路规则。
+*/
+
+func (c *Cluster) Fault(i int) *Fault.FaultCable {
+	return c.faults[i]
+}
+
+/*
+在所有节点上设置分区，组与组之间双向断开。
+*/
+
+func (c *Cluster) Partition(groups ...[]int) {
+	for _, f := range c.faults {
+		f.Partition(groups...)
+	}
+}
+
+/*
+清除所有节点的故障规则。
+*/
+
+func (c *Cluster) Heal() {
+	for _, f := range c.faults {
+		f.Heal()
+	}
+}
@@ -0,0 +1,373 @@
+package Cluster
+
+import (
+	"RaftDB/Custom/DB/KVDB"
+	"RaftDB/Kernel/Crown"
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Pipe/Client"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+找到一个能够完成同步写入的节点，也就是当前的leader。
+*/
+
+func writeToLeader(t *testing.T, c *Cluster, content string) int {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for i := 0; i < c.num; i++ {
+			if res, err := c.Do(i, Client.Request{Op: Client.Write, Timeout: 500, Command: content}); err == nil && res.Code == Client.OK {
+				return i
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("no leader accepts %s", content)
+	return -1
+}
+
+func waitRead(t *testing.T, c *Cluster, i int, content string, want string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		req := Client.Request{Op: Client.Read, Consistency: Client.Local, Timeout: 500, Command: content}
+		if res, err := c.Do(i, req); err == nil && res.Code == Client.OK && res.Result == want {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("node %d never reads %s for %s", i, want, content)
+}
+
+func TestKillAndRestart(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	c, err := New(5, func() Crown.App { return &KVDB.KVDB{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	defer c.Shutdown()
+	leader := writeToLeader(t, c, "write'a'1")
+	c.Kill(leader)
+	next := writeToLeader(t, c, "write'b'2")
+	if next == leader {
+		t.Fatalf("killed node %d still accepts writes", leader)
+	}
+	c.Restart(leader)
+	waitRead(t, c, leader, "read'a", "1")
+	waitRead(t, c, leader, "read'b", "2")
+}
+
+func TestPartitionLeader(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	c, err := New(5, func() Crown.App { return &KVDB.KVDB{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	defer c.Shutdown()
+	leader := writeToLeader(t, c, "write'a'1")
+	var others []int
+	for i := 0; i < 5; i++ {
+		if i != leader {
+			others = append(others, i)
+		}
+	}
+	c.Partition([]int{leader}, others)
+	if res, _ := c.Do(leader, Client.Request{Op: Client.Write, Timeout: 300, Command: "write'b'0"}); res.Code == Client.OK {
+		t.Fatal("isolated leader commits a write")
+	}
+	next := writeToLeader(t, c, "write'b'2")
+	if next == leader {
+		t.Fatal("isolated leader commits a write")
+	}
+	c.Heal()
+	waitRead(t, c, leader, "read'b", "2")
+}
+
+/*
+在leader上在线备份，分别恢复出单节点集群和三节点集群，新集群从备份的状态继续运行。
+*/
+
+func TestBackupAndRestore(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	newKVDB := func() Crown.App { return &KVDB.KVDB{} }
+	c, err := New(3, newKVDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	defer c.Shutdown()
+	for i := 0; i < 20; i++ {
+		writeToLeader(t, c, fmt.Sprintf("write'k%d'%d", i%3, i))
+	}
+	leader := writeToLeader(t, c, "write'a'1")
+	archive, err := c.Backup(leader, "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeToLeader(t, c, "write'a'2")
+	for _, num := range []int{1, 3} {
+		r, err := New(num, newKVDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Restore(archive); err != nil {
+			t.Fatal(err)
+		}
+		r.Start()
+		for i := 0; i < num; i++ {
+			waitRead(t, r, i, "read'a", "1")
+			waitRead(t, r, i, "read'k1", "19")
+		}
+		writeToLeader(t, r, "write'a'3")
+		for i := 0; i < num; i++ {
+			waitRead(t, r, i, "read'a", "3")
+		}
+		r.Shutdown()
+	}
+}
+
+/*
+同一个客户端会话的重试返回第一次执行的回复，不再执行；重启节点或者从备份恢复之后仍然如此。
+*/
+
+func TestExactlyOnce(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	newKVDB := func() Crown.App { return &KVDB.KVDB{} }
+	c, err := New(3, newKVDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	defer c.Shutdown()
+	send := func(c *Cluster, seq int, content string, want string) {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			for i := 0; i < c.num; i++ {
+				req := Client.Request{Op: Client.Write, Timeout: 500, Client: "c", Seq: seq, Command: content}
+				if res, err := c.Do(i, req); err == nil && res.Code == Client.OK {
+					if res.Result != want {
+						t.Fatalf("request %d replies %q, want %q", seq, res.Result, want)
+					}
+					return
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("no leader accepts request %d", seq)
+	}
+	send(c, 1, "write'a'1", "write successfully: a, 1")
+	send(c, 2, "write'a'2", "write successfully: a, 2")
+	send(c, 1, "write'a'1", "write successfully: a, 1")
+	for i := 0; i < 3; i++ {
+		waitRead(t, c, i, "read'a", "2")
+	}
+	forged := Client.Request{Op: Client.Read, Consistency: Client.Local, Timeout: 500, Command: "@session'c'1'0'read'a"}
+	if res, err := c.Do(0, forged); err != nil || res.Code != Client.Rejected {
+		t.Fatalf("forged session header: %+v, %v", res, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		c.Kill(i)
+	}
+	for i := 0; i < 3; i++ {
+		c.Restart(i)
+	}
+	send(c, 2, "write'a'2", "write successfully: a, 2")
+	send(c, 3, "write'b'3", "write successfully: b, 3")
+	send(c, 4, "write'b'4", "write successfully: b, 4")
+	leader := writeToLeader(t, c, "write'x'0")
+	archive, err := c.Backup(leader, "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(archive, "@sessions:") {
+		t.Fatal("the snapshot has no session table")
+	}
+	r, err := New(1, newKVDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Restore(archive); err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+	defer r.Shutdown()
+	send(r, 3, "write'b'3", "write successfully: b, 3")
+	waitRead(t, r, 0, "read'b", "4")
+	waitRead(t, c, leader, "read'a", "2")
+}
+
+/*
+线性一致的读只能在leader上完成，回复的key在之前写入的key之后；有界陈旧的读可以在跟得上的follower上完成，
+follower被隔离之后只有时间界限的有界陈旧读被拒绝，本地读仍然可以完成；leader被隔离之后租约过期，有界陈旧读也被拒绝。
+*/
+
+func TestReadConsistency(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	c, err := New(3, func() Crown.App { return &KVDB.KVDB{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	defer c.Shutdown()
+	leader := writeToLeader(t, c, "write'a'0")
+	written, err := c.Do(leader, Client.Request{Op: Client.Write, Timeout: 500, Command: "write'a'1"})
+	if err != nil || written.Code != Client.OK || written.Key.Index < 0 {
+		t.Fatalf("write: %+v, %v", written, err)
+	}
+	res, err := c.Do(leader, Client.Request{Op: Client.Read, Timeout: 500, Command: "read'a"})
+	if err != nil || res.Code != Client.OK || res.Result != "1" {
+		t.Fatalf("linearizable read: %+v, %v", res, err)
+	}
+	if res.Key.Term < written.Key.Term || res.Key.Term == written.Key.Term && res.Key.Index <= written.Key.Index {
+		t.Fatalf("linearizable read served at %v before the write at %v", res.Key, written.Key)
+	}
+	follower := (leader + 1) % 3
+	if res, _ := c.Do(follower, Client.Request{Op: Client.Read, Timeout: 500, Command: "read'a"}); res.Code != Client.NotLeader || res.Leader != leader {
+		t.Fatalf("linearizable read on a follower: %+v", res)
+	}
+	bounded := Client.Request{Op: Client.Read, Consistency: Client.Bounded, MaxLag: Client.Lag(0), MaxStale: 2000, Timeout: 500, Command: "read'a"}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		res, err := c.Do(follower, bounded)
+		if err == nil && res.Code == Client.OK && res.Result == "1" {
+			if res.Key.Index < written.Key.Index {
+				t.Fatalf("bounded read served at %v before the write at %v", res.Key, written.Key)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("follower never serves the bounded read: %+v, %v", res, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	var others []int
+	for i := 0; i < 3; i++ {
+		if i != follower {
+			others = append(others, i)
+		}
+	}
+	c.Partition([]int{follower}, others)
+	writeToLeader(t, c, "write'a'2")
+	bounded.MaxStale = 200 // 被隔离的节点不知道leader后来的日志，超过一个选举超时之后日志条数的界限也不再成立
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		res, err := c.Do(follower, bounded)
+		if err == nil && res.Code == Client.Stale {
+			break
+		}
+		if err == nil && res.Code == Client.OK && res.Result != "1" {
+			t.Fatalf("isolated follower reads %q", res.Result)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("isolated follower keeps serving bounded reads: %+v, %v", res, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	local := Client.Request{Op: Client.Read, Consistency: Client.Local, Timeout: 500, Command: "read'a"}
+	if res, err := c.Do(follower, local); err != nil || res.Code != Client.OK || res.Result != "1" {
+		t.Fatalf("local read on the isolated follower: %+v, %v", res, err)
+	}
+	c.Heal()
+	waitRead(t, c, follower, "read'a", "2")
+
+	leader = writeToLeader(t, c, "write'a'3")
+	others = others[:0]
+	for i := 0; i < 3; i++ {
+		if i != leader {
+			others = append(others, i)
+		}
+	}
+	waitFor := func(code Client.Code) {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			res, err := c.Do(leader, bounded)
+			if err == nil && res.Code == code {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("leader %d never replies %v to bounded reads: %+v, %v", leader, code, res, err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	waitFor(Client.OK)
+	c.Partition([]int{leader}, others)
+	waitFor(Client.Stale)
+	c.Heal()
+}
+
+/*
+流式监听从follower开始，leader宕机之后客户端带着最后收到的版本换一个节点重新创建监听，不丢失也不重复事件。
+前缀监听持续收到多个key的改变和旧值，取消之后不能再轮询。
+*/
+
+func TestStreamingWatch(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	c, err := New(3, func() Crown.App { return &KVDB.KVDB{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	defer c.Shutdown()
+	leader := writeToLeader(t, c, "write'a'1")
+	follow := func(i int, command string, from Log.Key, want ...string) (int64, Log.Key) {
+		req := Client.Request{Op: Client.Stream, Timeout: 500, From: &from, Command: command}
+		deadline := time.Now().Add(10 * time.Second)
+		for len(want) > 0 && time.Now().Before(deadline) {
+			res, err := c.Do(i, req)
+			if err != nil || res.Code != Client.OK {
+				t.Fatalf("stream on node %d: %+v, %v", i, res, err)
+			}
+			req.WatchId = res.WatchId
+			after := from
+			for _, e := range res.Events { // 事务的多个事件在同一个版本
+				if got := e.Key + "=" + e.Old + ">" + e.Value; got != want[0] || !e.Revision.Greater(after) {
+					t.Fatalf("node %d streams %s at %v after %v, want %s", i, got, e.Revision, after, want[0])
+				}
+				want, from = want[1:], e.Revision
+			}
+		}
+		if len(want) > 0 {
+			t.Fatalf("node %d never streams %v", i, want)
+		}
+		return req.WatchId, from
+	}
+	follower := (leader + 1) % 3
+	_, last := follow(follower, "watch'write'a", Log.Key{Term: -1, Index: -1}, "a=>1")
+	c.Kill(leader)
+	writeToLeader(t, c, "write'a'2")
+	writeToLeader(t, c, "write'b'0")
+	writeToLeader(t, c, "write'a'3")
+	writeToLeader(t, c, "delete'b")
+	writeToLeader(t, c, "cas'a'3'4")
+	writeToLeader(t, c, `txn'{"then":[{"type":"write","key":"c","value":"1"},{"type":"delete","key":"a"}]}`)
+	other := (leader + 2) % 3
+	follow(other, "watch'write'a", last, "a=1>2", "a=2>3", "a=3>4", "a=4>")
+	id, _ := follow(other, "watch'prefix'", last, "a=1>2", "b=>0", "a=2>3", "b=0>", "a=3>4", "c=>1", "a=4>")
+	if res, _ := c.Do(other, Client.Request{Op: Client.Cancel, WatchId: id}); res.Code != Client.OK {
+		t.Fatalf("cancel: %+v", res)
+	}
+	if res, _ := c.Do(other, Client.Request{Op: Client.Stream, Timeout: 100, WatchId: id}); res.Code != Client.Gone {
+		t.Fatalf("poll a cancelled watch: %+v", res)
+	}
+	if res, _ := c.Do(other, Client.Request{Op: Client.Stream, Timeout: 100, Command: "read'a"}); res.Code != Client.Rejected {
+		t.Fatalf("stream a read: %+v", res)
+	}
+	if res, _ := c.Do(other, Client.Request{Op: Client.Read, Consistency: Client.Local, Command: "read'a'4"}); res.Code != Client.OK || res.Result != "3" {
+		t.Fatalf("read a at the revision of its third write: %+v", res)
+	}
+}
@@ -0,0 +1,166 @@
+package Channel
+
+import (
+	"RaftDB/Kernel/Pipe/Client"
+	"RaftDB/Kernel/Pipe/Order"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+进程内的网络实体，节点之间通过Go管道直接投递Order.Message，用于不占用端口的集群测试。
+所有接入同一个Network的ChannelCable互相可达，Network以Meta.Dns中的地址作为节点的标识。
+*/
+
+/*
+	type Cable interface {
+		Init(cableParam interface{}, alwaysIp []string) error
+		ReplyNode(addr string, msg interface{}) error
+		Listen(addr string) error
+		ReplyClient(msg interface{}) error
+		ChangeNetworkDelay(delay int, random bool)
+	}
+*/
+
+type Network struct {
+	nodes map[string]chan<- Order.Order // 地址 -> 该节点发往Logic层的管道
+	m     sync.RWMutex
+}
+
+func NewNetwork() *Network {
+	return &Network{nodes: map[string]chan<- Order.Order{}}
+}
+
+func (n *Network) connect(addr string, ch chan<- Order.Order) {
+	n.m.Lock()
+	n.nodes[addr] = ch
+	n.m.Unlock()
+}
+
+/*
+把一个节点从网络中摘除，之后发往它的消息全部丢失，用于模拟节点宕机。
+*/
+
+func (n *Network) Disconnect(addr string) {
+	n.m.Lock()
+	delete(n.nodes, addr)
+	n.m.Unlock()
+}
+
+/*
+投递消息，对方管道满了直接丢弃，不能阻塞发送方。
+*/
+
+func (n *Network) deliver(addr string, order Order.Order) error {
+	n.m.RLock()
+	ch, has := n.nodes[addr]
+	n.m.RUnlock()
+	if !has {
+		return errors.New("Channel: unreachable " + addr)
+	}
+	select {
+	case ch <- order:
+		return nil
+	default:
+		return errors.New("Channel: " + addr + " is busy, drop the message")
+	}
+}
+
+type ChannelCable struct {
+	Network     *Network // 所属的网络，必须在交给Gogo之前设置
+	replyChan   chan<- Order.Order
+	clientChans sync.Map
+	num         atomic.Int32
+	delay       atomic.Int64
+	source      Client.Source // 流式监听的事件来源，节点启动之前设置
+}
+
+func (c *ChannelCable) Init(replyChan interface{}, _ []string) error {
+	if x, ok := replyChan.(chan Order.Order); !ok {
+		return errors.New("Channel: Init need a reply chan")
+	} else {
+		c.replyChan = x
+	}
+	if c.Network == nil {
+		return errors.New("Channel: Init need a network")
+	}
+	c.clientChans = sync.Map{}
+	return nil
+}
+
+func (c *ChannelCable) ReplyNode(addr string, msg interface{}) error {
+	if x, ok := msg.(Order.Message); !ok {
+		return errors.New("Channel: ReplyNode need a Order.Message")
+	} else {
+		order := Order.Order{Type: Order.FromNode, Msg: x}
+		if delay := time.Duration(c.delay.Load()); delay > 0 {
+			time.AfterFunc(delay, func() { _ = c.Network.deliver(addr, order) })
+			return nil
+		}
+		return c.Network.deliver(addr, order)
+	}
+}
+
+/*
+接入网络后立即返回，不占用监听协程。
+*/
+
+func (c *ChannelCable) Listen(addr string) error {
+	c.Network.connect(addr, c.replyChan)
+	return nil
+}
+
+func (c *ChannelCable) ChangeNetworkDelay(delay int, random bool) {
+	if !random {
+		c.delay.Store(int64(time.Duration(delay) * time.Millisecond))
+	} else {
+		c.delay.Store(int64(time.Duration(rand.Intn(delay)) * time.Millisecond))
+	}
+}
+
+func (c *ChannelCable) ReplyClient(msg interface{}) error {
+	if x, ok := msg.(Order.Message); !ok {
+		return errors.New("Channel: ReplyClient need a Order.Message")
+	} else {
+		ch, ok := c.clientChans.Load(x.From)
+		if ok {
+			select {
+			case ch.(chan Order.Message) <- x:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+func (c *ChannelCable) SetWatchSource(source Client.Source) {
+	c.source = source
+}
+
+/*
+进程内客户端的请求入口，语义和RPC.Do一致。
+*/
+
+func (c *ChannelCable) Do(req Client.Request) Client.Response {
+	if err := req.Check(); err != nil {
+		return Client.Fail(req, Client.BadRequest, err.Error())
+	}
+	if req.Streaming() {
+		return Client.Follow(req, c.source)
+	}
+	rec := req.Message()
+	rec.From = int(c.num.Add(1))
+	ch := make(chan Order.Message, 1)
+	c.clientChans.Store(rec.From, ch)
+	defer c.clientChans.Delete(rec.From)
+	c.replyChan <- Order.Order{Type: Order.FromClient, Msg: rec}
+	select {
+	case msg := <-ch:
+		return Client.Reply(req, msg)
+	case <-time.After(req.Duration()):
+		return Client.Reply(req, Order.Message{From: rec.From, Leader: -1, Log: Order.Timeout})
+	}
+}
@@ -0,0 +1,469 @@
+package Fault
+
+import (
+	"RaftDB/Kernel/Bottom"
+	"RaftDB/Kernel/Meta"
+	"RaftDB/Kernel/Pipe/Client"
+	"RaftDB/Kernel/Pipe/Order"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+故障注入网络实体，包装任意一个Bottom.Cable，对节点之间的消息按链路施加丢包、重复、乱序、延迟和分区。
+出方向的规则在ReplyNode时生效，入方向的规则在消息送往Logic层之前生效，所以只在一个节点上设置规则也可以制造双向分区。
+客户端消息不受影响。
+*/
+
+const (
+	Constant    LatencyKind = iota // 固定延迟Base
+	Uniform                        // [Base, Base+Jitter)均匀分布
+	Normal                         // 均值Base，标准差Jitter的正态分布，小于0取0
+	Exponential                    // Base加上均值为Jitter的指数分布
+)
+
+type LatencyKind int
+
+var latencyKinds = []string{"constant", "uniform", "normal", "exponential"}
+
+type Latency struct {
+	Kind   LatencyKind
+	Base   time.Duration
+	Jitter time.Duration
+}
+
+/*
+一条链路上的故障规则，概率取值[0, 1]。
+Reorder是消息被额外延迟一个ReorderWindow内随机时间的概率，被延迟的消息会被之后发送的消息超过。
+*/
+
+type Rule struct {
+	Drop          float64
+	Duplicate     float64
+	Reorder       float64
+	ReorderWindow time.Duration
+	Latency       Latency
+	Blocked       bool // 链路断开，消息全部丢弃
+}
+
+type FaultCable struct {
+	Inner Bottom.Cable // 被包装的信道，必须在交给Gogo之前设置
+	Seed  int64        // 随机种子，为0时使用当前时间
+	inner Bottom.Cable // Init时的Inner，重启时Inner可以被替换，而旧节点延迟投递的消息仍在使用它
+	dns   []string
+	id    int
+	def   Rule         // 没有单独设置的链路使用的规则
+	out   map[int]Rule // 发往某个节点的规则
+	in    map[int]Rule // 来自某个节点的规则
+	rand  *rand.Rand
+	done  chan struct{} // 关闭时停止上一次Init启动的转发协程
+	m     sync.Mutex
+}
+
+/*
+初始化时在Logic层管道和内部信道之间插入一个管道，用来施加入方向的规则。已经设置的规则在重新Init之后保留，
+上一次Init的转发协程停止，还没有投递的消息丢弃。
+*/
+
+func (f *FaultCable) Init(replyChan interface{}, alwaysIp []string) error {
+	x, ok := replyChan.(chan Order.Order)
+	if !ok {
+		return errors.New("Fault: Init need a reply chan")
+	}
+	if f.Inner == nil {
+		return errors.New("Fault: Init need an inner cable")
+	}
+	f.m.Lock()
+	f.inner, f.dns, f.id = f.Inner, alwaysIp, -1
+	if f.out == nil {
+		f.out, f.in = map[int]Rule{}, map[int]Rule{}
+	}
+	if f.rand == nil {
+		seed := f.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		f.rand = rand.New(rand.NewSource(seed))
+	}
+	if f.done != nil {
+		close(f.done)
+	}
+	f.done = make(chan struct{})
+	done := f.done
+	f.m.Unlock()
+	ch := make(chan Order.Order, cap(x))
+	go f.forward(ch, x, done)
+	return f.Inner.Init(ch, alwaysIp)
+}
+
+func (f *FaultCable) forward(from <-chan Order.Order, to chan<- Order.Order, done <-chan struct{}) {
+	for {
+		var order Order.Order
+		select {
+		case order = <-from:
+		case <-done:
+			return
+		}
+		deliver := func() error {
+			select {
+			case to <- order:
+			case <-done:
+			}
+			return nil
+		}
+		if order.Type != Order.FromNode {
+			_ = deliver()
+			continue
+		}
+		_ = f.apply(f.rule(true, order.Msg.From), deliver)
+	}
+}
+
+func (f *FaultCable) ReplyNode(addr string, msg interface{}) error {
+	to, inner := f.index(addr), f.current()
+	return f.apply(f.rule(false, to), func() error { return inner.ReplyNode(addr, msg) })
+}
+
+func (f *FaultCable) Listen(addr string) error {
+	f.m.Lock()
+	for i, v := range f.dns {
+		if v == addr {
+			f.id = i
+		}
+	}
+	f.m.Unlock()
+	return f.current().Listen(addr)
+}
+
+func (f *FaultCable) ReplyClient(msg interface{}) error {
+	return f.current().ReplyClient(msg)
+}
+
+/*
+配置交给被包装的信道。
+*/
+
+func (f *FaultCable) Configure(meta Meta.Meta) error {
+	if x, ok := f.current().(Bottom.Configurable); ok {
+		return x.Configure(meta)
+	}
+	return nil
+}
+
+/*
+管理命令不受故障规则影响，直接交给被包装的信道。
+*/
+
+func (f *FaultCable) SetAdmin(admin Bottom.Admin) {
+	if x, ok := f.current().(Bottom.Administrable); ok {
+		x.SetAdmin(admin)
+	}
+}
+
+/*
+流式监听不受故障规则影响，事件来源直接交给被包装的信道。
+*/
+
+func (f *FaultCable) SetWatchSource(source Client.Source) {
+	if x, ok := f.current().(Bottom.Watchable); ok {
+		x.SetWatchSource(source)
+	}
+}
+
+/*
+模拟网络延迟，random为真时每条消息都在[0, delay)内重新取样，而不是只取样一次。
+*/
+
+func (f *FaultCable) ChangeNetworkDelay(delay int, random bool) {
+	f.m.Lock()
+	if random {
+		f.def.Latency = Latency{Kind: Uniform, Jitter: time.Duration(delay) * time.Millisecond}
+	} else {
+		f.def.Latency = Latency{Kind: Constant, Base: time.Duration(delay) * time.Millisecond}
+	}
+	f.m.Unlock()
+}
+
+/*
+设置发往to的链路规则，to为-1时设置默认规则。
+*/
+
+func (f *FaultCable) SetOutbound(to int, rule Rule) {
+	f.m.Lock()
+	if to == -1 {
+		f.def = rule
+	} else {
+		f.out[to] = rule
+	}
+	f.m.Unlock()
+}
+
+func (f *FaultCable) SetInbound(from int, rule Rule) {
+	f.m.Lock()
+	f.in[from] = rule
+	f.m.Unlock()
+}
+
+/*
+分区：自己所在的组与其他组之间双向断开，不在任何组内的节点不受影响。
+*/
+
+func (f *FaultCable) Partition(groups ...[]int) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	mine := -1
+	for g, members := range groups {
+		for _, v := range members {
+			if v == f.id {
+				mine = g
+			}
+		}
+	}
+	if mine == -1 {
+		return
+	}
+	for g, members := range groups {
+		if g == mine {
+			continue
+		}
+		for _, v := range members {
+			r := f.out[v]
+			r.Blocked = true
+			f.out[v] = r
+			r = f.in[v]
+			r.Blocked = true
+			f.in[v] = r
+		}
+	}
+}
+
+/*
+单向断开：发往这些节点的消息全部丢弃，来自它们的消息照常接收，用于制造非对称分区。
+*/
+
+func (f *FaultCable) Cut(to ...int) {
+	f.m.Lock()
+	for _, v := range to {
+		r := f.out[v]
+		r.Blocked = true
+		f.out[v] = r
+	}
+	f.m.Unlock()
+}
+
+/*
+清除所有规则。
+*/
+
+func (f *FaultCable) Heal() {
+	f.m.Lock()
+	f.def, f.out, f.in = Rule{}, map[int]Rule{}, map[int]Rule{}
+	f.m.Unlock()
+}
+
+/*
+Monitor的故障注入命令，参数按逗号切分：
+	partition,0|1,2|3|4                              自己所在组与其他组双向断开
+	cut,2|3                                          单向断开发往2和3的链路
+	link,[to|*],[drop],[dup],[reorder],[kind],[base ms],[jitter ms]  设置发往to的链路规则，*为默认规则
+	heal                                             清除所有规则
+*/
+
+func (f *FaultCable) InjectFault(order []string) (string, error) {
+	if len(order) == 0 {
+		return "", errors.New("Fault: empty order")
+	}
+	switch order[0] {
+	case "partition":
+		if len(order) < 3 {
+			return "", errors.New("Fault: partition needs at least two groups")
+		}
+		var groups [][]int
+		for _, v := range order[1:] {
+			group, err := parseIds(v)
+			if err != nil {
+				return "", err
+			}
+			groups = append(groups, group)
+		}
+		f.Partition(groups...)
+		return fmt.Sprintf("partitioned %v", groups), nil
+	case "cut":
+		if len(order) != 2 {
+			return "", errors.New("Fault: cut needs one group")
+		}
+		to, err := parseIds(order[1])
+		if err != nil {
+			return "", err
+		}
+		f.Cut(to...)
+		return fmt.Sprintf("cut %v", to), nil
+	case "link":
+		if len(order) != 8 {
+			return "", errors.New("Fault: link needs 7 params")
+		}
+		to := -1
+		if order[1] != "*" {
+			x, err := strconv.Atoi(order[1])
+			if err != nil {
+				return "", err
+			}
+			to = x
+		}
+		var rule Rule
+		var err error
+		if rule.Drop, err = strconv.ParseFloat(order[2], 64); err != nil {
+			return "", err
+		}
+		if rule.Duplicate, err = strconv.ParseFloat(order[3], 64); err != nil {
+			return "", err
+		}
+		if rule.Reorder, err = strconv.ParseFloat(order[4], 64); err != nil {
+			return "", err
+		}
+		rule.Latency.Kind = -1
+		for i, v := range latencyKinds {
+			if v == order[5] {
+				rule.Latency.Kind = LatencyKind(i)
+			}
+		}
+		if rule.Latency.Kind == -1 {
+			return "", errors.New("Fault: unknown latency kind " + order[5])
+		}
+		base, err := strconv.Atoi(order[6])
+		if err != nil {
+			return "", err
+		}
+		jitter, err := strconv.Atoi(order[7])
+		if err != nil {
+			return "", err
+		}
+		rule.Latency.Base, rule.Latency.Jitter = time.Duration(base)*time.Millisecond, time.Duration(jitter)*time.Millisecond
+		rule.ReorderWindow = rule.Latency.Base + rule.Latency.Jitter + 10*time.Millisecond
+		f.SetOutbound(to, rule)
+		return fmt.Sprintf("link %s: %+v", order[1], rule), nil
+	case "heal":
+		f.Heal()
+		return "healed", nil
+	}
+	return "", errors.New("Fault: unknown order " + order[0])
+}
+
+func (f *FaultCable) ToString() string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	res := fmt.Sprintf("==== FAULT ====\nid: %d\ndefault: %+v\n", f.id, f.def)
+	for i := range f.dns {
+		if r, has := f.out[i]; has {
+			res += fmt.Sprintf("	-> %d: %+v\n", i, r)
+		}
+		if r, has := f.in[i]; has {
+			res += fmt.Sprintf("	<- %d: %+v\n", i, r)
+		}
+	}
+	res += "==== FAULT ===="
+	if x, ok := f.inner.(Bottom.Reporter); ok {
+		res += "\n" + x.ToString()
+	}
+	return res
+}
+
+func (f *FaultCable) index(addr string) int {
+	f.m.Lock()
+	defer f.m.Unlock()
+	for i, v := range f.dns {
+		if v == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *FaultCable) current() Bottom.Cable {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.inner
+}
+
+func (f *FaultCable) rule(inbound bool, peer int) Rule {
+	f.m.Lock()
+	defer f.m.Unlock()
+	rules := f.out
+	if inbound {
+		rules = f.in
+	}
+	if r, has := rules[peer]; has {
+		return r
+	}
+	return f.def
+}
+
+/*
+按规则投递一条消息，没有延迟时直接投递以保持顺序，有延迟时由计时器协程投递，不阻塞调用方。
+直接投递时返回被包装的信道的错误；丢弃的消息和延迟投递的消息返回nil，和网络上丢失的消息一样。
+*/
+
+func (f *FaultCable) apply(rule Rule, deliver func() error) error {
+	f.m.Lock()
+	if rule.Blocked || f.rand.Float64() < rule.Drop {
+		f.m.Unlock()
+		return nil
+	}
+	times := 1
+	if f.rand.Float64() < rule.Duplicate {
+		times = 2
+	}
+	delays := make([]time.Duration, times)
+	for i := range delays {
+		delays[i] = rule.Latency.sample(f.rand)
+		if rule.ReorderWindow > 0 && f.rand.Float64() < rule.Reorder {
+			delays[i] += time.Duration(f.rand.Int63n(int64(rule.ReorderWindow)))
+		}
+	}
+	f.m.Unlock()
+	var err error
+	for _, d := range delays {
+		if d > 0 {
+			time.AfterFunc(d, func() { _ = deliver() })
+		} else if e := deliver(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (l Latency) sample(r *rand.Rand) time.Duration {
+	var d float64
+	switch l.Kind {
+	case Uniform:
+		d = float64(l.Base)
+		if l.Jitter > 0 {
+			d += float64(r.Int63n(int64(l.Jitter)))
+		}
+	case Normal:
+		d = float64(l.Base) + r.NormFloat64()*float64(l.Jitter)
+	case Exponential:
+		d = float64(l.Base) + r.ExpFloat64()*float64(l.Jitter)
+	default:
+		d = float64(l.Base)
+	}
+	return time.Duration(math.Max(d, 0))
+}
+
+func parseIds(group string) ([]int, error) {
+	var res []int
+	for _, v := range strings.Split(group, "|") {
+		x, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, x)
+	}
+	return res, nil
+}
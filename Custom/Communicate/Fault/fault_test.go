@@ -0,0 +1,173 @@
+package Fault
+
+import (
+	"RaftDB/Kernel/Pipe/Order"
+	"errors"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	m    sync.Mutex
+	sent map[string]int
+	fail error // ReplyNode返回的错误
+}
+
+func (r *recorder) Init(interface{}, []string) error { r.sent = map[string]int{}; return nil }
+func (r *recorder) Listen(string) error              { return nil }
+func (r *recorder) ReplyClient(interface{}) error    { return nil }
+func (r *recorder) ChangeNetworkDelay(int, bool)     {}
+func (r *recorder) ReplyNode(addr string, _ interface{}) error {
+	r.m.Lock()
+	r.sent[addr]++
+	r.m.Unlock()
+	return r.fail
+}
+
+func (r *recorder) count(addr string) int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.sent[addr]
+}
+
+func newFault(t *testing.T) (*FaultCable, *recorder, chan Order.Order) {
+	inner := &recorder{}
+	f := &FaultCable{Inner: inner, Seed: 1}
+	ch := make(chan Order.Order, 10)
+	if err := f.Init(ch, []string{"a", "b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Listen("a"); err != nil {
+		t.Fatal(err)
+	}
+	return f, inner, ch
+}
+
+func TestPartitionAndHeal(t *testing.T) {
+	f, inner, _ := newFault(t)
+	if _, err := f.InjectFault([]string{"partition", "0", "1|2"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.ReplyNode("b", Order.Message{})
+	if inner.count("b") != 0 {
+		t.Fatal("message crossed the partition")
+	}
+	if _, err := f.InjectFault([]string{"heal"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.ReplyNode("b", Order.Message{})
+	if inner.count("b") != 1 {
+		t.Fatal("message lost after heal")
+	}
+}
+
+/*
+直接投递时调用方能看到被包装的信道的错误。
+*/
+
+func TestReplyNodeError(t *testing.T) {
+	f, inner, _ := newFault(t)
+	inner.fail = errors.New("down")
+	if err := f.ReplyNode("b", Order.Message{}); err != inner.fail {
+		t.Fatalf("send error %v", err)
+	}
+	f.Cut(1)
+	if err := f.ReplyNode("b", Order.Message{}); err != nil {
+		t.Fatalf("dropped message error %v", err)
+	}
+}
+
+/*
+重新Init之后上一次的转发协程退出。
+*/
+
+func TestReinitStopsForwarder(t *testing.T) {
+	f, _, _ := newFault(t)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		if err := f.Init(make(chan Order.Order, 10), []string{"a", "b", "c"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Fatalf("%d goroutines before re-initialising, %d after", before, after)
+	}
+}
+
+func TestInboundPartition(t *testing.T) {
+	f, _, ch := newFault(t)
+	f.Partition([]int{0}, []int{1, 2})
+	forward := make(chan Order.Order, 10)
+	done := make(chan struct{})
+	defer close(done)
+	go f.forward(forward, ch, done)
+	forward <- Order.Order{Type: Order.FromNode, Msg: Order.Message{From: 1}}
+	forward <- Order.Order{Type: Order.FromClient, Msg: Order.Message{From: 1}}
+	select {
+	case order := <-ch:
+		if order.Type != Order.FromClient {
+			t.Fatal("node message crossed the partition")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client message is blocked")
+	}
+}
+
+func TestAsymmetricCut(t *testing.T) {
+	f, inner, _ := newFault(t)
+	if _, err := f.InjectFault([]string{"cut", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.ReplyNode("b", Order.Message{})
+	_ = f.ReplyNode("c", Order.Message{})
+	if inner.count("b") != 1 || inner.count("c") != 0 {
+		t.Fatal("cut should only drop messages to 2")
+	}
+	if f.rule(true, 2).Blocked {
+		t.Fatal("cut should not block inbound messages")
+	}
+}
+
+func TestDropAndDuplicate(t *testing.T) {
+	f, inner, _ := newFault(t)
+	if _, err := f.InjectFault([]string{"link", "1", "1", "0", "0", "constant", "0", "0"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.InjectFault([]string{"link", "2", "0", "1", "0", "constant", "0", "0"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.ReplyNode("b", Order.Message{})
+	_ = f.ReplyNode("c", Order.Message{})
+	if inner.count("b") != 0 || inner.count("c") != 2 {
+		t.Fatalf("want 0 and 2 deliveries, got %d and %d", inner.count("b"), inner.count("c"))
+	}
+	if _, err := f.InjectFault([]string{"link", "1", "x", "0", "0", "constant", "0", "0"}); err == nil {
+		t.Fatal("illegal probability accepted")
+	}
+	if _, err := f.InjectFault([]string{"link", "1", "0", "0", "0", "pareto", "0", "0"}); err == nil {
+		t.Fatal("unknown latency kind accepted")
+	}
+}
+
+func TestLatencyIsSampledPerMessage(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	l := Latency{Kind: Uniform, Jitter: time.Second}
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 10; i++ {
+		d := l.sample(r)
+		if d < 0 || d >= time.Second {
+			t.Fatalf("latency %v out of range", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) == 1 {
+		t.Fatal("latency sampled only once")
+	}
+	if d := (Latency{Kind: Normal, Base: 0, Jitter: time.Second}).sample(r); d < 0 {
+		t.Fatal("negative latency")
+	}
+}
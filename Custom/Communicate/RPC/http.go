@@ -0,0 +1,298 @@
+package RPC
+
+import (
+	"RaftDB/Kernel/Feed"
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Pipe/Client"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+HTTP/JSON网关，请求转换成Client.Request，和RPC.Do一样交给Logic层，同样会被拒绝、超时或者回滚：
+	PUT /kv/{key}     正文是{"value": "..."}，写入，只有leader能处理。
+	DELETE /kv/{key}  删除，只有leader能处理，key不存在时也返回200。
+	GET /kv/{key}     读取，默认线性一致，key不存在时返回404。查询参数consistency=local时任何节点都能处理；
+	                  consistency=bounded时落后leader不超过maxLag条日志或者maxStale毫秒内收到过leader消息的节点才能处理，
+	                  至少给出其中一个，leader只在maxStale毫秒内被多数派确认过时处理，否则按不是leader处理。成功时servedAt是读取所在的日志key。查询参数rev是数据的版本时读取那个版本的值，
+	                  版本被压缩了时返回410，还没有到时返回422。
+	GET /watch/{key}  监听key的改变，以SSE的形式持续推送put和delete事件，正文带有key、新值、旧值和数据的版本rev，事件id是版本term.index，
+	                  没有改变时定期发送注释保持连接，监听被拒绝时推送一个error事件后结束。查询参数prefix=true时监听以key开头的key，
+	                  end不为空时监听[key, end)中的key。事件来自已提交的日志，任何节点都能处理；断线重连时用Last-Event-ID头部
+	                  或者查询参数from给出最后收到的版本，从它之后继续推送，不会丢失改变。连接关闭时取消监听。
+查询参数timeout是每次请求的超时毫秒数（监听时是一次长轮询的时间），client和seq是写入的会话。状态码：
+	200 成功；400 请求或者命令不合法；404 key不存在；405 方法不支持；410 读取的版本已经被压缩；422 数据库拒绝执行；
+	307 本节点不是leader并且知道leader的网关地址，Location指向leader；503 不知道leader或者操作被回滚；504 超时。
+*/
+
+const watchTimeout = 15000 // 监听时一次长轮询的毫秒数，没有事件时发送一次保活注释再继续
+
+type httpReply struct {
+	Key      string   `json:"key,omitempty"`
+	Revision string   `json:"revision,omitempty"` // 监听事件的版本
+	Rev      int64    `json:"rev,omitempty"`      // 监听事件的数据版本
+	Value    string   `json:"value,omitempty"`
+	Old      string   `json:"old,omitempty"` // 监听事件中改变之前的值
+	Error    string   `json:"error,omitempty"`
+	Leader   int      `json:"leader"`             // 回复时已知的leader，-1表示不知道
+	ServedAt *Log.Key `json:"servedAt,omitempty"` // 成功时读取或者写入所在的日志key
+}
+
+func (r *RPC) listenHTTP(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: r.httpHandler()}
+	if r.clientTLS != nil {
+		server.TLSConfig = r.clientTLS
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
+}
+
+func (r *RPC) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv/", r.handleKV)
+	mux.HandleFunc("/watch/", r.handleWatch)
+	return mux
+}
+
+/*
+从路径中取出key，key不能为空，也不能包含命令的分隔符。
+*/
+
+func httpKey(w http.ResponseWriter, req *http.Request, prefix string) (string, bool) {
+	key := strings.TrimPrefix(req.URL.Path, prefix)
+	if key == "" || strings.Contains(key, "'") {
+		writeJSON(w, http.StatusBadRequest, httpReply{Key: key, Error: "illegal key", Leader: -1})
+		return "", false
+	}
+	return key, true
+}
+
+/*
+从查询参数中取出请求的公共部分，数字参数不合法时写回400，第二个返回值为假。
+*/
+
+func httpRequest(w http.ResponseWriter, req *http.Request, key string, op Client.Op, command string) (Client.Request, bool) {
+	q := req.URL.Query()
+	res := Client.Request{Version: Client.Version, Op: op, Command: command, Client: q.Get("client")}
+	number := func(name string, v *int) bool {
+		if q.Get(name) == "" {
+			return true
+		}
+		n, err := strconv.Atoi(q.Get(name))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, httpReply{Key: key, Error: "illegal " + name, Leader: -1})
+			return false
+		}
+		*v = n
+		return true
+	}
+	if !number("timeout", &res.Timeout) || !number("seq", &res.Seq) {
+		return res, false
+	}
+	switch q.Get("consistency") {
+	case Client.Local.String():
+		res.Consistency = Client.Local
+	case Client.Bounded.String():
+		res.Consistency = Client.Bounded
+		if q.Get("maxLag") != "" {
+			res.MaxLag = new(int)
+			if !number("maxLag", res.MaxLag) {
+				return res, false
+			}
+		}
+		if !number("maxStale", &res.MaxStale) {
+			return res, false
+		}
+	}
+	return res, true
+}
+
+func (r *RPC) handleKV(w http.ResponseWriter, req *http.Request) {
+	key, ok := httpKey(w, req, "/kv/")
+	if !ok {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		command := "read'" + key
+		if rev := req.URL.Query().Get("rev"); rev != "" {
+			if _, err := strconv.ParseInt(rev, 10, 64); err != nil {
+				writeJSON(w, http.StatusBadRequest, httpReply{Key: key, Error: "illegal revision", Leader: -1})
+				return
+			}
+			command += "'" + rev
+		}
+		read, ok := httpRequest(w, req, key, Client.Read, command)
+		if !ok {
+			return
+		}
+		res := r.do(read)
+		r.respond(w, req, key, res.Result, res)
+	case http.MethodPut:
+		var body struct {
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || strings.Contains(body.Value, "'") {
+			writeJSON(w, http.StatusBadRequest, httpReply{Key: key, Error: "illegal value", Leader: -1})
+			return
+		}
+		write, ok := httpRequest(w, req, key, Client.Write, "write'"+key+"'"+body.Value)
+		if !ok {
+			return
+		}
+		r.respond(w, req, key, body.Value, r.do(write))
+	case http.MethodDelete:
+		remove, ok := httpRequest(w, req, key, Client.Write, "delete'"+key)
+		if !ok {
+			return
+		}
+		r.respond(w, req, key, "", r.do(remove))
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, httpReply{Key: key, Error: "method not allowed", Leader: -1})
+	}
+}
+
+/*
+把Logic层的回复翻译成状态码，成功时返回value。
+*/
+
+func (r *RPC) respond(w http.ResponseWriter, req *http.Request, key string, value string, res Client.Response) {
+	rep := httpReply{Key: key, Leader: res.Leader}
+	switch res.Code {
+	case Client.OK:
+		rep.Value, rep.ServedAt = value, &res.Key
+		writeJSON(w, http.StatusOK, rep)
+	case Client.Timeout:
+		rep.Error = res.Result
+		writeJSON(w, http.StatusGatewayTimeout, rep)
+	case Client.NotFound:
+		rep.Error = "not found"
+		writeJSON(w, http.StatusNotFound, rep)
+	case Client.BadRequest:
+		rep.Error = res.Result
+		writeJSON(w, http.StatusBadRequest, rep)
+	case Client.Compacted:
+		rep.Error = res.Result
+		writeJSON(w, http.StatusGone, rep)
+	case Client.NotLeader, Client.Unsynced, Client.RolledBack, Client.Stale:
+		rep.Error = res.Result
+		if addr := r.leaderHTTP(res.Leader); addr != "" {
+			scheme := "http"
+			if r.clientTLS != nil {
+				scheme = "https"
+			}
+			w.Header().Set("Location", scheme+"://"+addr+req.URL.RequestURI())
+			writeJSON(w, http.StatusTemporaryRedirect, rep)
+			return
+		}
+		writeJSON(w, http.StatusServiceUnavailable, rep)
+	default:
+		rep.Error = res.Result
+		writeJSON(w, http.StatusUnprocessableEntity, rep)
+	}
+}
+
+/*
+leader的网关地址，不知道leader、leader就是自己或者leader没有配置网关时为空。
+*/
+
+func (r *RPC) leaderHTTP(leader int) string {
+	if leader < 0 || leader == r.id || leader >= len(r.httpDns) {
+		return ""
+	}
+	return r.httpDns[leader]
+}
+
+func (r *RPC) handleWatch(w http.ResponseWriter, req *http.Request) {
+	key, ok := httpKey(w, req, "/watch/")
+	if !ok {
+		return
+	}
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed, httpReply{Key: key, Error: "method not allowed", Leader: -1})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, httpReply{Key: key, Error: "streaming is not supported", Leader: -1})
+		return
+	}
+	command := "watch'write'" + key
+	if q := req.URL.Query(); q.Get("prefix") == "true" {
+		command = "watch'prefix'" + key
+	} else if end := q.Get("end"); end != "" {
+		command = "watch'range'" + key + "'" + end
+	}
+	watch, ok := httpRequest(w, req, key, Client.Stream, command)
+	if !ok {
+		return
+	}
+	if watch.Timeout <= 0 {
+		watch.Timeout = watchTimeout
+	}
+	from := req.Header.Get("Last-Event-ID")
+	if from == "" {
+		from = req.URL.Query().Get("from")
+	}
+	if from != "" {
+		revision, err := Feed.ParseRevision(from)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, httpReply{Key: key, Error: err.Error(), Leader: -1})
+			return
+		}
+		watch.From = &revision
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	defer func() {
+		if watch.WatchId != 0 {
+			r.do(Client.Request{Version: Client.Version, Op: Client.Cancel, WatchId: watch.WatchId})
+		}
+	}()
+	for req.Context().Err() == nil {
+		res := r.do(watch)
+		if res.Code != Client.OK {
+			data, _ := json.Marshal(httpReply{Key: key, Error: res.Result, Leader: res.Leader})
+			_, _ = fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		watch.WatchId = res.WatchId
+		var err error
+		for _, e := range res.Events {
+			revision := Feed.FormatRevision(e.Revision)
+			data, _ := json.Marshal(httpReply{Key: e.Key, Value: e.Value, Old: e.Old, Revision: revision, Rev: e.Rev, Leader: -1})
+			if _, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", revision, e.Type, data); err != nil {
+				break
+			}
+		}
+		if len(res.Events) == 0 {
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, rep httpReply) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(rep); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,194 @@
+package RPC
+
+import (
+	"RaftDB/Kernel/Pipe/Order"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+到一个节点的连接管理：每个节点一个有界的发送队列和一个发送协程，消息按照发送顺序逐条推送，
+一个慢节点最多占用一个协程和queueSize条消息，队列满时新消息直接丢弃（Raft会重发）。
+连接断开或者调用失败时关闭连接，按指数退避重连，退避期间的消息丢弃，不阻塞队列。
+*/
+
+const (
+	queueSize   = 256
+	minBackoff  = 10 * time.Millisecond
+	maxBackoff  = 2 * time.Second
+	callTimeout = 2 * time.Second // 一次推送超过这个时间没有返回时认为连接已经损坏
+)
+
+const (
+	Connecting = iota // 正在连接：还没有推送过，或者退避结束后重新拨号，之后的推送还没有结果
+	Healthy           // 最近一次推送成功
+	Broken            // 最近一次连接或推送失败，正在退避
+)
+
+var healthNames = []string{"connecting", "healthy", "broken"}
+
+type peer struct {
+	r       *RPC
+	id      int
+	addr    string
+	queue   chan Order.Message
+	done    chan struct{}
+	client  *rpc.Client
+	backoff time.Duration
+	retryAt time.Time // 退避结束的时间，之前不重连
+	m       sync.Mutex
+	health  Health
+}
+
+/*
+一个节点连接的健康状态，供Monitor查看。
+*/
+
+type Health struct {
+	State   int
+	Sent    int    // 推送成功的消息数
+	Dropped int    // 队列满或者退避期间丢弃的消息数
+	Failed  int    // 连续失败次数，成功后清零
+	LastErr string // 最近一次失败的原因
+}
+
+func newPeer(r *RPC, id int, addr string) *peer {
+	p := &peer{r: r, id: id, addr: addr, queue: make(chan Order.Message, queueSize), done: make(chan struct{})}
+	go p.run()
+	return p
+}
+
+/*
+把消息放进队列，队列满时丢弃并报错，不阻塞调用方。
+*/
+
+func (p *peer) send(msg Order.Message) error {
+	select {
+	case p.queue <- msg:
+		return nil
+	default:
+		p.m.Lock()
+		p.health.Dropped++
+		p.m.Unlock()
+		return fmt.Errorf("RPC: the queue to %s is full, drop the message", p.addr)
+	}
+}
+
+func (p *peer) stop() {
+	close(p.done)
+}
+
+func (p *peer) run() {
+	for {
+		select {
+		case <-p.done:
+			if p.client != nil {
+				_ = p.client.Close()
+			}
+			return
+		case msg := <-p.queue:
+			p.push(msg)
+		}
+	}
+}
+
+func (p *peer) push(msg Order.Message) {
+	if p.client == nil {
+		if time.Now().Before(p.retryAt) {
+			p.m.Lock()
+			p.health.Dropped++
+			p.m.Unlock()
+			return
+		}
+		p.m.Lock()
+		p.health.State = Connecting
+		p.m.Unlock()
+		client, err := p.r.dial(p.id, p.addr)
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		p.client = client
+	}
+	time.Sleep(p.r.delay)
+	call := p.client.Go("RPC.Push", msg, nil, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(callTimeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			p.fail(call.Error)
+			return
+		}
+	case <-timer.C:
+		p.fail(errors.New("RPC: push timeout"))
+		return
+	}
+	p.m.Lock()
+	p.backoff, p.health.State, p.health.Failed = 0, Healthy, 0
+	p.health.Sent++
+	p.m.Unlock()
+}
+
+/*
+关闭损坏的连接，退避时间从minBackoff开始每次翻倍，最多maxBackoff。
+*/
+
+func (p *peer) fail(err error) {
+	if p.client != nil {
+		_ = p.client.Close()
+		p.client = nil
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.backoff = p.backoff * 2; p.backoff < minBackoff {
+		p.backoff = minBackoff
+	} else if p.backoff > maxBackoff {
+		p.backoff = maxBackoff
+	}
+	p.retryAt = time.Now().Add(p.backoff)
+	p.health.State, p.health.LastErr = Broken, err.Error()
+	p.health.Failed++
+}
+
+func (p *peer) getHealth() Health {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.health
+}
+
+/*
+全部节点连接的健康状态，下标是节点id，自己的位置为空。
+*/
+
+func (r *RPC) Health() []*Health {
+	res := make([]*Health, len(r.dns))
+	for i, v := range r.dns {
+		if p, has := r.peers[v]; has && v != r.self {
+			h := p.getHealth()
+			res[i] = &h
+		}
+	}
+	return res
+}
+
+func (r *RPC) ToString() string {
+	var res strings.Builder
+	res.WriteString("==== peers ====\n")
+	for i, h := range r.Health() {
+		if h == nil {
+			continue
+		}
+		fmt.Fprintf(&res, "%d %s: %s, sent %d, dropped %d, failed %d", i, r.dns[i], healthNames[h.State], h.Sent, h.Dropped, h.Failed)
+		if h.LastErr != "" {
+			fmt.Fprintf(&res, ", last error: %s", h.LastErr)
+		}
+		res.WriteString("\n")
+	}
+	res.WriteString("==== peers ====")
+	return res.String()
+}
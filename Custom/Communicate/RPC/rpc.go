@@ -1,12 +1,19 @@
 package RPC
 
 import (
+	"RaftDB/Kernel/Bottom"
+	"RaftDB/Kernel/Meta"
+	"RaftDB/Kernel/Pipe/Client"
 	"RaftDB/Kernel/Pipe/Order"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"net/rpc"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -30,11 +37,25 @@ import (
 */
 
 type RPC struct {
-	clientChans     sync.Map
-	replyChan       chan<- Order.Order
-	delay           time.Duration
-	num             atomic.Int32
-	alwaysConnPools map[string]*sync.Pool
+	clientChans sync.Map
+	replyChan   chan<- Order.Order
+	delay       time.Duration
+	num         atomic.Int32
+	peers       map[string]*peer // 到每个节点的连接管理
+	self        string
+	admin       Bottom.Admin
+	tls         *tls.Config // 节点地址的TLS配置，为空时不加密也不认证
+	nodeName    string      // 节点证书中的DNS名称格式
+	dns         []string
+	clientAddr  string        // 客户端地址，为空时和节点地址共用
+	clientTLS   *tls.Config   // 客户端地址的TLS配置
+	peerLimit   int           // 节点地址上的最大连接数，为0时不限制
+	clientLimit int           // 客户端地址上的最大连接数，为0时不限制
+	id          int           // 本节点的id
+	httpAddr    string        // HTTP网关地址，为空时不开启
+	httpDns     []string      // 每个节点的HTTP网关地址，用于把请求重定向到leader
+	source      Client.Source // 流式监听的事件来源，为空时不支持流式监听
+	backupDir   string        // 远程备份写入的目录，为空时不接受远程备份
 }
 
 func (r *RPC) Init(replyChan interface{}, alwaysIp []string) error {
@@ -45,26 +66,81 @@ func (r *RPC) Init(replyChan interface{}, alwaysIp []string) error {
 	}
 	r.clientChans = sync.Map{}
 	r.ChangeNetworkDelay(0, false)
-	if err := rpc.RegisterName("RPC", r); err != nil {
+	r.dns, r.tls, r.clientTLS, r.clientAddr = alwaysIp, nil, nil, ""
+	r.id, r.httpAddr, r.httpDns, r.backupDir = -1, "", nil, ""
+	for _, p := range r.peers {
+		p.stop()
+	}
+	r.peers = map[string]*peer{}
+	for i, v := range alwaysIp {
+		r.peers[v] = newPeer(r, i, v)
+	}
+	return nil
+}
+
+/*
+配置中给出了证书、私钥和CA时开启双向TLS，只给出一部分时报错。
+配置了单独的客户端地址时，客户端地址有自己的连接数限制和TLS配置，没有给出客户端证书时使用节点证书。
+配置了HTTP网关地址时，网关和客户端地址使用相同的TLS配置。
+*/
+
+func (r *RPC) Configure(meta Meta.Meta) error {
+	var err error
+	if r.tls, err = loadTLS(meta.TLSCert, meta.TLSKey, meta.TLSCA, "tlsCert, tlsKey and tlsCA"); err != nil {
 		return err
 	}
-	r.alwaysConnPools = map[string]*sync.Pool{}
-	for _, v := range alwaysIp {
-		ip := v
-		r.alwaysConnPools[v] = &sync.Pool{
-			New: func() interface{} {
-				client, err := rpc.Dial("tcp", ip)
-				if err != nil {
-					return err
-				} else {
-					return client
-				}
-			},
-		}
+	if r.clientTLS, err = loadTLS(meta.ClientTLSCert, meta.ClientTLSKey, meta.ClientTLSCA,
+		"clientTlsCert, clientTlsKey and clientTlsCA"); err != nil {
+		return err
+	}
+	if r.clientTLS == nil {
+		r.clientTLS = r.tls
+	}
+	r.nodeName = meta.TLSNodeName
+	if r.nodeName == "" {
+		r.nodeName = DefaultNodeName
+	}
+	if meta.Id < len(meta.ClientDns) && meta.Id < len(meta.Dns) && meta.ClientDns[meta.Id] != meta.Dns[meta.Id] {
+		r.clientAddr = meta.ClientDns[meta.Id]
+	}
+	r.peerLimit, r.clientLimit = meta.PeerMaxConns, meta.ClientMaxConns
+	if meta.Id < len(meta.Dns) {
+		r.self = meta.Dns[meta.Id]
+	}
+	r.id, r.httpDns, r.backupDir = meta.Id, meta.HttpDns, meta.BackupDir
+	if meta.Id < len(meta.HttpDns) {
+		r.httpAddr = meta.HttpDns[meta.Id]
 	}
 	return nil
 }
 
+func loadTLS(certFile string, keyFile string, caFile string, names string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("RPC: TLS needs " + names)
+	}
+	return LoadTLS(certFile, keyFile, caFile)
+}
+
+/*
+连接节点id，开启TLS时验证对方的证书属于这个节点。
+*/
+
+func (r *RPC) dial(id int, addr string) (*rpc.Client, error) {
+	if r.tls == nil {
+		return rpc.Dial("tcp", addr)
+	}
+	config := r.tls.Clone()
+	config.ServerName = fmt.Sprintf(r.nodeName, id)
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
 func (r *RPC) ReplyNode_old_version(addr string, msg interface{}) error {
 	if x, ok := msg.(Order.Message); !ok {
 		return errors.New("RPC: ReplyNode need a Order.Message")
@@ -82,40 +158,162 @@ func (r *RPC) ReplyNode_old_version(addr string, msg interface{}) error {
 	return nil
 }
 
+/*
+消息放进发往addr的队列后立即返回，由这个节点的发送协程按顺序推送。
+*/
+
 func (r *RPC) ReplyNode(addr string, msg interface{}) error {
-	if x, ok := msg.(Order.Message); !ok {
+	x, ok := msg.(Order.Message)
+	if !ok {
 		return errors.New("RPC: ReplyNode need a Order.Message")
-	} else {
-		if pool, has := r.alwaysConnPools[addr]; has {
-			if client, ok := pool.Get().(*rpc.Client); !ok {
-				return errors.New("lose connect")
-			} else {
-				time.Sleep(r.delay)
-				if err := client.Call("RPC.Push", x, nil); err != nil {
-					return err
-				}
-				pool.Put(client)
-			}
-		} else {
-			panic("error a new node ip")
-		}
 	}
-	return nil
+	p, has := r.peers[addr]
+	if !has {
+		return errors.New("RPC: unknown node " + addr)
+	}
+	return p.send(x)
 }
 
 func (r *RPC) Listen(addr string) error {
+	errs := make(chan error, 3)
+	if r.httpAddr != "" {
+		go func() {
+			errs <- r.listenHTTP(r.httpAddr)
+		}()
+	}
+	if r.clientAddr == "" {
+		go func() {
+			errs <- r.listen(addr, r.tls, r.peerLimit, func(s session) interface{} { return &sharedSession{s} })
+		}()
+		return <-errs
+	}
+	go func() {
+		errs <- r.listen(addr, r.tls, r.peerLimit, func(s session) interface{} { return &peerSession{s} })
+	}()
+	go func() {
+		errs <- r.listen(r.clientAddr, r.clientTLS, r.clientLimit, func(s session) interface{} { return &clientSession{s} })
+	}()
+	return <-errs
+}
+
+/*
+超过limit的新连接直接关闭。
+*/
+
+func (r *RPC) listen(addr string, config *tls.Config, limit int, receiver func(s session) interface{}) error {
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 	defer listener.Close()
+	var conns chan struct{}
+	if limit > 0 {
+		conns = make(chan struct{}, limit)
+	}
 	for {
-		if conn, err := listener.Accept(); err != nil {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if conns == nil {
+			go r.serve(conn, config, receiver)
+			continue
+		}
+		select {
+		case conns <- struct{}{}:
+			go func() {
+				r.serve(conn, config, receiver)
+				<-conns
+			}()
+		default:
+			log.Printf("RPC: %s has %d connections, refuse %s\n", addr, limit, conn.RemoteAddr())
+			_ = conn.Close()
+		}
+	}
+}
+
+/*
+每个连接使用自己的rpc.Server，开启TLS时先在handshakeTimeout内握手，连接上的Push只接受对方证书证明的节点id发出的消息。
+*/
+
+func (r *RPC) serve(conn net.Conn, config *tls.Config, receiver func(s session) interface{}) {
+	s := session{r: r}
+	if config != nil {
+		tlsConn := tls.Server(conn, config)
+		_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
 			log.Println(err)
-		} else {
-			go rpc.ServeConn(conn)
+			_ = conn.Close()
+			return
 		}
+		_ = conn.SetDeadline(time.Time{})
+		cert := tlsConn.ConnectionState().PeerCertificates[0]
+		s.ids, s.admin = nodeIds(cert, r.nodeName, len(r.dns)), isAdmin(cert)
+		conn = tlsConn
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("RPC", receiver(s)); err != nil {
+		log.Println(err)
+		_ = conn.Close()
+		return
+	}
+	server.ServeConn(conn)
+}
+
+/*
+一个连接上对外提供的RPC方法，ids是对方证书证明的节点id，admin表示对方出示了管理证书，没有开启TLS时ids为空，不检查。
+节点地址、客户端地址和共用的地址分别注册不同的方法集合。
+*/
+
+type session struct {
+	r     *RPC
+	ids   map[int]bool
+	admin bool
+}
+
+type peerSession struct{ session }
+
+type clientSession struct{ session }
+
+type sharedSession struct{ session }
+
+func (s *session) push(rec Order.Message, rep *string) error {
+	if s.ids != nil && !s.ids[rec.From] {
+		return fmt.Errorf("RPC: the certificate is not node %d's", rec.From)
 	}
+	return s.r.Push(rec, rep)
+}
+
+func (s *peerSession) Push(rec Order.Message, rep *string) error {
+	return s.push(rec, rep)
+}
+
+func (s *session) backup(rec Order.Message, rep *string) error {
+	if s.ids != nil && len(s.ids) == 0 && !s.admin {
+		return errors.New("RPC: backup needs a node or admin certificate")
+	}
+	return s.r.Backup(rec, rep)
+}
+
+func (s *peerSession) Backup(rec Order.Message, rep *string) error {
+	return s.backup(rec, rep)
+}
+
+func (s *clientSession) Do(req Client.Request, rep *Client.Response) error {
+	return s.r.Do(req, rep)
+}
+
+func (s *sharedSession) Push(rec Order.Message, rep *string) error {
+	return s.push(rec, rep)
+}
+
+func (s *sharedSession) Do(req Client.Request, rep *Client.Response) error {
+	return s.r.Do(req, rep)
+}
+
+func (s *sharedSession) Backup(rec Order.Message, rep *string) error {
+	return s.backup(rec, rep)
 }
 
 func (r *RPC) ChangeNetworkDelay(delay int, random bool) {
@@ -141,25 +339,70 @@ func (r *RPC) ReplyClient(msg interface{}) error {
 	return nil
 }
 
+func (r *RPC) SetAdmin(admin Bottom.Admin) {
+	r.admin = admin
+}
+
+func (r *RPC) SetWatchSource(source Client.Source) {
+	r.source = source
+}
+
+/*
+管理命令：在线备份，rec.Log是备份文件名，写在配置的backupDir中，rec.LastLogKey是要备份到的key，-1-1表示当前已提交的key。
+文件名只能是不含目录的名字，所以远程调用不能覆盖备份目录之外的文件。
+*/
+
+func (r *RPC) Backup(rec Order.Message, rep *string) error {
+	if r.admin == nil || r.backupDir == "" {
+		return errors.New("RPC: admin commands are not available")
+	}
+	name := rec.Log
+	if name == "" || name == "." || name == ".." || filepath.IsAbs(name) || strings.ContainsAny(name, `/\`) ||
+		filepath.Base(name) != name {
+		return fmt.Errorf("RPC: illegal backup file name %q", name)
+	}
+	key, err := r.admin.Backup(filepath.Join(r.backupDir, name), rec.LastLogKey)
+	if err != nil {
+		return err
+	}
+	*rep = fmt.Sprintf("backup at %v", key)
+	return nil
+}
+
 func (r *RPC) Push(rec Order.Message, _ *string) error {
 	time.Sleep(r.delay)
 	r.replyChan <- Order.Order{Type: Order.FromNode, Msg: rec}
 	return nil
 }
 
-func (r *RPC) Write(rec Order.Message, rep *string) error {
+/*
+客户端请求，不合法的请求直接回复BadRequest，不交给Logic层。RPC和HTTP的客户端请求都从这里进入。
+*/
+
+func (r *RPC) Do(req Client.Request, rep *Client.Response) error {
+	*rep = r.do(req)
+	return nil
+}
+
+func (r *RPC) do(req Client.Request) Client.Response {
+	if err := req.Check(); err != nil {
+		return Client.Fail(req, Client.BadRequest, err.Error())
+	}
+	if req.Streaming() {
+		return Client.Follow(req, r.source)
+	}
+	rec := req.Message()
 	rec.From = int(r.num.Add(1))
-	ch := make(chan Order.Message, 0)
+	ch := make(chan Order.Message, 1)
 	r.clientChans.Store(rec.From, ch)
+	defer r.clientChans.Delete(rec.From)
 	r.replyChan <- Order.Order{Type: Order.FromClient, Msg: rec}
-	timer := time.After(time.Duration(rec.Term) * time.Millisecond)
+	timer := time.NewTimer(req.Duration())
+	defer timer.Stop()
 	select {
 	case msg := <-ch:
-		*rep = msg.Log
-	case <-timer:
-		*rep = "timeout"
+		return Client.Reply(req, msg)
+	case <-timer.C:
+		return Client.Reply(req, Order.Message{From: rec.From, Leader: -1, Log: Order.Timeout})
 	}
-	close(ch)
-	r.clientChans.Delete(rec.From)
-	return nil
 }
@@ -0,0 +1,776 @@
+package RPC
+
+import (
+	"RaftDB/Kernel/Feed"
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Meta"
+	"RaftDB/Kernel/Pipe/Client"
+	"RaftDB/Kernel/Pipe/Order"
+	"RaftDB/Kernel/Pipe/Something"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type pki struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func writePEM(t *testing.T, path string, kind string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newCA(t *testing.T) *pki {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "raftdb ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	p := &pki{dir: t.TempDir(), cert: cert, key: key}
+	writePEM(t, filepath.Join(p.dir, "ca.pem"), "CERTIFICATE", der)
+	return p
+}
+
+/*
+签发一个证书，返回证书和私钥文件的位置。
+*/
+
+func (p *pki) issue(t *testing.T, name string, dnsNames ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.cert, &key.PublicKey, p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(p.dir, name+".pem"), filepath.Join(p.dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func newNode(t *testing.T, p *pki, id int, dns []string, ch chan Order.Order) *RPC {
+	r := &RPC{}
+	if err := r.Init(ch, dns); err != nil {
+		t.Fatal(err)
+	}
+	cert, key := p.issue(t, fmt.Sprint("node", id), fmt.Sprintf(DefaultNodeName, id))
+	if err := r.Configure(Meta.Meta{TLSCert: cert, TLSKey: key, TLSCA: filepath.Join(p.dir, "ca.pem")}); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+/*
+节点只能用自己证书证明的id发送消息，客户端证书只能调用Write，不能在共用的地址上备份，没有证书的连接无法调用任何方法。
+*/
+
+func TestMutualTLS(t *testing.T) {
+	p := newCA(t)
+	dns := []string{freeAddr(t), freeAddr(t)}
+	ch := make(chan Order.Order, 10)
+	r0 := newNode(t, p, 0, dns, ch)
+	r1 := newNode(t, p, 1, dns, make(chan Order.Order, 10))
+	go func() {
+		_ = r0.Listen(dns[0])
+	}()
+	received := false
+	for i := 0; i < 100 && !received; i++ {
+		_ = r1.ReplyNode(dns[0], Order.Message{Type: Order.Heartbeat, From: 1, Term: 3})
+		select {
+		case order := <-ch:
+			if order.Type != Order.FromNode || order.Msg.From != 1 || order.Msg.Term != 3 {
+				t.Fatalf("received %+v", order)
+			}
+			received = true
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	if !received {
+		t.Fatalf("node 0 receives nothing: %s", r1.ToString())
+	}
+	waitHealth(t, r1, 0, Healthy)
+	_ = r1.ReplyNode(dns[0], Order.Message{Type: Order.Heartbeat, From: 0})
+	waitHealth(t, r1, 0, Broken)
+	if h := r1.Health()[0]; !strings.Contains(h.LastErr, "not node 0's") || len(ch) != 0 {
+		t.Fatalf("node 1 pushes a message from node 0: %s", r1.ToString())
+	}
+
+	cert, key := p.issue(t, "client")
+	t.Setenv(CertEnv, cert)
+	t.Setenv(KeyEnv, key)
+	t.Setenv(CAEnv, filepath.Join(p.dir, "ca.pem"))
+	client, err := Dial(dns[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Call("RPC.Push", Order.Message{From: 1}, nil); err == nil {
+		t.Fatal("client pushes a message from node 1")
+	}
+	var res Client.Response
+	if err := client.Call("RPC.Do", Client.Request{Version: Client.Version, Timeout: 10}, &res); err != nil || res.Code != Client.Timeout {
+		t.Fatalf("client request: %+v, %v", res, err)
+	}
+	if order := <-ch; order.Type != Order.FromClient {
+		t.Fatalf("received %+v", order)
+	}
+	var rep string
+	if err := client.Call("RPC.Backup", Order.Message{Log: "b"}, &rep); err == nil || !strings.Contains(err.Error(), "node or admin certificate") {
+		t.Fatalf("client backs up on the shared address: %v", err)
+	}
+
+	plain, err := rpc.Dial("tcp", dns[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if err := plain.Call("RPC.Push", Order.Message{From: 1}, nil); err == nil {
+		t.Fatal("push without TLS")
+	}
+	other := newCA(t)
+	cert, key = other.issue(t, "node1", "node1.raftdb")
+	t.Setenv(CertEnv, cert)
+	t.Setenv(KeyEnv, key)
+	t.Setenv(CAEnv, filepath.Join(other.dir, "ca.pem"))
+	if c, err := Dial(dns[0]); err == nil {
+		if err := c.Call("RPC.Push", Order.Message{From: 1}, nil); err == nil {
+			t.Fatal("push with a certificate from another CA")
+		}
+		c.Close()
+	}
+}
+
+/*
+单独的客户端地址只能调用Write，节点地址不能调用Write；超过连接数限制的新连接被关闭。
+*/
+
+func TestSeparateListeners(t *testing.T) {
+	dns, clientDns := []string{freeAddr(t)}, []string{freeAddr(t)}
+	ch := make(chan Order.Order, 10)
+	r := &RPC{}
+	if err := r.Init(ch, dns); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Configure(Meta.Meta{Dns: dns, ClientDns: clientDns, ClientMaxConns: 1}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = r.Listen(dns[0])
+	}()
+	var client, peer *rpc.Client
+	var err error
+	for i := 0; i < 100; i++ {
+		if client, err = rpc.Dial("tcp", clientDns[0]); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var res Client.Response
+	if err := client.Call("RPC.Do", Client.Request{Version: Client.Version, Timeout: 10}, &res); err != nil || res.Code != Client.Timeout {
+		t.Fatalf("client request: %+v, %v", res, err)
+	}
+	<-ch
+	if err := client.Call("RPC.Do", Client.Request{Version: Client.Version + 1}, &res); err != nil || res.Code != Client.BadRequest {
+		t.Fatalf("request of another version: %+v, %v", res, err)
+	}
+	if err := client.Call("RPC.Push", Order.Message{From: 0}, nil); err == nil {
+		t.Fatal("push on the client address")
+	}
+	var rep string
+	if err := client.Call("RPC.Backup", Order.Message{}, &rep); err == nil {
+		t.Fatal("backup on the client address")
+	}
+	for i := 0; i < 100; i++ {
+		if peer, err = rpc.Dial("tcp", dns[0]); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if err := peer.Call("RPC.Do", Client.Request{Version: Client.Version, Timeout: 10}, &res); err == nil {
+		t.Fatal("client request on the peer address")
+	}
+	if err := peer.Call("RPC.Push", Order.Message{From: 0, Term: 4}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if order := <-ch; order.Type != Order.FromNode || order.Msg.Term != 4 {
+		t.Fatalf("received %+v", order)
+	}
+	if second, err := rpc.Dial("tcp", clientDns[0]); err == nil {
+		if err := second.Call("RPC.Do", Client.Request{Version: Client.Version, Timeout: 10}, &res); err == nil {
+			t.Fatal("client request on a connection over the limit")
+		}
+		second.Close()
+	}
+}
+
+type counter struct {
+	ch chan Order.Message
+}
+
+func (c *counter) Push(rec Order.Message, _ *string) error {
+	c.ch <- rec
+	return nil
+}
+
+/*
+在addr上启动一个只接收Push的节点，返回关闭它和它的全部连接的函数，用来模拟节点重启。
+*/
+
+func fakePeer(t *testing.T, addr string, ch chan Order.Message) func() {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("RPC", &counter{ch: ch}); err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	var m sync.Mutex
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			m.Lock()
+			conns = append(conns, conn)
+			m.Unlock()
+			go server.ServeConn(conn)
+		}
+	}()
+	return func() {
+		_ = listener.Close()
+		m.Lock()
+		for _, v := range conns {
+			_ = v.Close()
+		}
+		m.Unlock()
+	}
+}
+
+func waitHealth(t *testing.T, r *RPC, id int, state int) {
+	for i := 0; i < 200 && r.Health()[id].State != state; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.Health()[id].State != state {
+		t.Fatalf("node %d is not %s: %s", id, healthNames[state], r.ToString())
+	}
+}
+
+/*
+一直发送直到对方收到一条消息。
+*/
+
+func sendUntilReceived(t *testing.T, r *RPC, addr string, ch chan Order.Message) {
+	for i := 0; i < 300; i++ {
+		_ = r.ReplyNode(addr, Order.Message{From: 0, Term: i})
+		select {
+		case <-ch:
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	t.Fatalf("%s never receives a message: %s", addr, r.ToString())
+}
+
+/*
+对方没有启动或者重启时连接断开，之后重连成功；对方不回应时队列有界，多余的消息被丢弃。
+*/
+
+func TestReconnect(t *testing.T) {
+	dns := []string{freeAddr(t), freeAddr(t)}
+	r := &RPC{}
+	if err := r.Init(make(chan Order.Order, 10), dns); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Configure(Meta.Meta{Id: 0, Dns: dns}); err != nil {
+		t.Fatal(err)
+	}
+	_ = r.ReplyNode(dns[1], Order.Message{From: 0})
+	waitHealth(t, r, 1, Broken)
+	if h := r.Health(); h[0] != nil || h[1].Failed == 0 {
+		t.Fatalf("health without peer: %s", r.ToString())
+	}
+	ch := make(chan Order.Message, 1000)
+	stop := fakePeer(t, dns[1], ch)
+	sendUntilReceived(t, r, dns[1], ch)
+	waitHealth(t, r, 1, Healthy)
+	stop()
+	stop = fakePeer(t, dns[1], ch)
+	defer stop()
+	sendUntilReceived(t, r, dns[1], ch)
+
+	blackhole, err := net.Listen("tcp", freeAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+	go func() {
+		for {
+			if _, err := blackhole.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	dns = []string{dns[0], blackhole.Addr().String()}
+	if err := r.Init(make(chan Order.Order, 10), dns); err != nil {
+		t.Fatal(err)
+	}
+	dropped := 0
+	for i := 0; i < 2*queueSize; i++ {
+		if err := r.ReplyNode(dns[1], Order.Message{From: 0}); err != nil {
+			dropped++
+		}
+	}
+	if dropped < queueSize-1 || r.Health()[1].Dropped != dropped {
+		t.Fatalf("%d of %d messages are dropped: %s", dropped, 2*queueSize, r.ToString())
+	}
+}
+
+/*
+HTTP网关把请求交给Logic层，按回复给出状态码：不是leader时重定向到leader的网关，超时返回504，监听以SSE推送写入。
+*/
+
+func TestHTTPGateway(t *testing.T) {
+	ch := make(chan Order.Order, 10)
+	r := &RPC{}
+	if err := r.Init(ch, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Configure(Meta.Meta{Id: 0, Dns: []string{"a", "b"}, HttpDns: []string{"h0:80", "h1:80"}}); err != nil {
+		t.Fatal(err)
+	}
+	leader := 1
+	go func() {
+		for order := range ch {
+			msg := Order.Message{From: order.Msg.From, Leader: leader}
+			switch {
+			case order.Msg.Log == "read'slow":
+				continue
+			case order.Msg.Bound != nil:
+				msg.Log = Order.Stale
+			case order.Msg.Log == "read'none":
+				msg.Log, msg.Agree, msg.Result = "(empty)", true, Something.Missing
+			case order.Msg.Log == "read'empty": // 存储的值恰好是"(empty)"
+				msg.Log, msg.Agree = "(empty)", true
+			case order.Msg.Log == "read'k'1":
+				msg.Log, msg.Result = "db: revision 1 is compacted", Something.Expired
+			case order.Msg.Log == "read'illegal":
+				msg.Log, msg.Result = "db: illegal operation", Something.Illegal
+			case strings.HasPrefix(order.Msg.Log, "watch'write'"):
+				msg.Log, msg.Agree = "v", true
+			case order.Msg.Log == "read'k'99":
+				msg.Log = "db: revision 99 is in the future"
+			case strings.HasPrefix(order.Msg.Log, "write'"):
+				msg.Log = Order.Refused
+			default:
+				msg.Log, msg.Agree = "v", true
+			}
+			_ = r.ReplyClient(msg)
+		}
+	}()
+	server := httptest.NewServer(r.httpHandler())
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	do := func(method string, path string, body string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"GET", "/kv/k", "", http.StatusOK},
+		{"GET", "/kv/none", "", http.StatusNotFound},
+		{"GET", "/kv/empty", "", http.StatusOK},
+		{"GET", "/kv/illegal", "", http.StatusBadRequest},
+		{"GET", "/kv/slow?timeout=10", "", http.StatusGatewayTimeout},
+		{"GET", "/kv/a'b", "", http.StatusBadRequest},
+		{"PUT", "/kv/k", `{"value":"v"}`, http.StatusTemporaryRedirect},
+		{"PUT", "/kv/k", `not json`, http.StatusBadRequest},
+		{"DELETE", "/kv/k", "", http.StatusOK},
+		{"POST", "/kv/k", "", http.StatusMethodNotAllowed},
+		{"GET", "/kv/k?consistency=bounded&maxLag=1&maxStale=100", "", http.StatusTemporaryRedirect},
+		{"GET", "/kv/k?consistency=bounded&maxLag=1", "", http.StatusTemporaryRedirect},
+		{"GET", "/kv/k?consistency=bounded", "", http.StatusBadRequest},
+		{"GET", "/kv/k?consistency=bounded&maxStale=100", "", http.StatusTemporaryRedirect},
+		{"GET", "/kv/k?consistency=bounded&maxLag=x&maxStale=100", "", http.StatusBadRequest},
+		{"GET", "/kv/k?consistency=bounded&maxLag=1&maxStale=1s", "", http.StatusBadRequest},
+		{"GET", "/kv/k?consistency=bounded&maxLag=-1", "", http.StatusBadRequest},
+		{"GET", "/kv/k?timeout=abc", "", http.StatusBadRequest},
+		{"PUT", "/kv/k?seq=1.5", `{"value":"v"}`, http.StatusBadRequest},
+		{"GET", "/watch/k?timeout=-", "", http.StatusBadRequest},
+		{"GET", "/kv/k?rev=3", "", http.StatusOK},
+		{"GET", "/kv/k?rev=1", "", http.StatusGone},
+		{"GET", "/kv/k?rev=99", "", http.StatusUnprocessableEntity},
+		{"GET", "/kv/k?rev=x", "", http.StatusBadRequest},
+	} {
+		res := do(c.method, c.path, c.body)
+		res.Body.Close()
+		if res.StatusCode != c.status {
+			t.Fatalf("%s %s: %d", c.method, c.path, res.StatusCode)
+		}
+		if res.StatusCode == http.StatusTemporaryRedirect && res.Header.Get("Location") != "http://h1:80"+c.path {
+			t.Fatalf("redirect to %q", res.Header.Get("Location"))
+		}
+	}
+	leader = -1
+	if res := do("PUT", "/kv/k", `{"value":"v"}`); res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("put without a leader: %d", res.StatusCode)
+	}
+
+	if res := do("GET", "/watch/k", ""); res.StatusCode != http.StatusOK || !strings.Contains(readAll(res), "event: error") {
+		t.Fatal("watch without a source")
+	}
+	source := &fakeSource{events: []Feed.Event{
+		{Change: Feed.Change{Type: Feed.Put, Key: "k", Value: "v1"}, Revision: Log.Key{Term: 1, Index: 1}},
+		{Change: Feed.Change{Type: Feed.Put, Key: "k", Value: "v2", Old: "v1", HasOld: true, Rev: 7}, Revision: Log.Key{Term: 1, Index: 2}},
+	}}
+	r.SetWatchSource(source)
+	if res := do("GET", "/watch/k?from=bad", ""); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("watch from a broken revision: %d", res.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", server.URL+"/watch/k?timeout=50", nil)
+	req.Header.Set("Last-Event-ID", "1.1")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("watch: %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	want := "id: 1.2\nevent: put\ndata: "
+	buf := make([]byte, 128)
+	n, err := io.ReadAtLeast(res.Body, buf, len(want))
+	if err != nil || !strings.HasPrefix(string(buf[:n]), want) || !strings.Contains(string(buf[:n]), `"old":"v1"`) || !strings.Contains(string(buf[:n]), `"rev":7`) {
+		t.Fatalf("watch event %q, %v", buf[:n], err)
+	}
+	res.Body.Close()
+	server.Close()
+	if !source.cancelled.Load() {
+		t.Fatal("the watch is not cancelled after the stream closes")
+	}
+}
+
+/*
+只有一个监听的事件来源，监听从after之后返回全部事件。
+*/
+
+type fakeSource struct {
+	events    []Feed.Event
+	after     *Log.Key
+	cancelled atomic.Bool
+}
+
+func (f *fakeSource) Create(command string, after *Log.Key) (int64, error) {
+	f.after = after
+	return 1, nil
+}
+
+func (f *fakeSource) Poll(id int64, limit int, wait time.Duration) ([]Feed.Event, Log.Key, error) {
+	for i, e := range f.events {
+		if f.after == nil || e.Revision.Greater(*f.after) {
+			last := f.events[len(f.events)-1].Revision
+			f.after = &last
+			return f.events[i:], last, nil
+		}
+	}
+	time.Sleep(wait)
+	return nil, *f.after, nil
+}
+
+func (f *fakeSource) Cancel(id int64) bool {
+	return f.cancelled.CompareAndSwap(false, true)
+}
+
+func readAll(res *http.Response) string {
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return string(b)
+}
+
+type fakeAdmin struct {
+	path string
+}
+
+func (a *fakeAdmin) Backup(path string, key Log.Key) (Log.Key, error) {
+	a.path = path
+	return key, nil
+}
+
+/*
+远程备份只接受不含目录的文件名，写在配置的备份目录中；没有配置备份目录时不接受远程备份。
+*/
+
+func TestBackupPath(t *testing.T) {
+	r, admin := &RPC{}, &fakeAdmin{}
+	if err := r.Init(make(chan Order.Order, 1), []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	r.SetAdmin(admin)
+	var rep string
+	if err := r.Backup(Order.Message{Log: "b1"}, &rep); err == nil {
+		t.Fatal("backup without a backup directory")
+	}
+	dir := t.TempDir()
+	if err := r.Configure(Meta.Meta{Dns: []string{"a"}, BackupDir: dir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Backup(Order.Message{Log: "b1"}, &rep); err != nil || admin.path != filepath.Join(dir, "b1") {
+		t.Fatalf("backup to %q: %v", admin.path, err)
+	}
+	for _, name := range []string{"", ".", "..", "../raftdb.conf", "/etc/passwd", "logs/segment", `..\raftdb.conf`} {
+		if err := r.Backup(Order.Message{Log: name}, &rep); err == nil {
+			t.Fatalf("backup to %q", name)
+		}
+	}
+}
+
+/*
+用name的证书连接addr，等待节点开始监听。
+*/
+
+func dialAs(t *testing.T, p *pki, addr string, name string, dnsNames ...string) *rpc.Client {
+	cert, key := p.issue(t, name, dnsNames...)
+	t.Setenv(CertEnv, cert)
+	t.Setenv(KeyEnv, key)
+	t.Setenv(CAEnv, filepath.Join(p.dir, "ca.pem"))
+	var client *rpc.Client
+	var err error
+	for i := 0; i < 100; i++ {
+		if client, err = Dial(addr); err == nil {
+			return client
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(err)
+	return nil
+}
+
+/*
+开启TLS时，节点地址上的备份只接受节点证书和管理证书，客户端证书不能备份。
+*/
+
+func TestBackupIdentity(t *testing.T) {
+	p := newCA(t)
+	dns, clientDns := []string{freeAddr(t), freeAddr(t)}, []string{freeAddr(t), freeAddr(t)}
+	r, admin := &RPC{}, &fakeAdmin{}
+	if err := r.Init(make(chan Order.Order, 10), dns); err != nil {
+		t.Fatal(err)
+	}
+	cert, key := p.issue(t, "node0", fmt.Sprintf(DefaultNodeName, 0))
+	if err := r.Configure(Meta.Meta{Dns: dns, ClientDns: clientDns, BackupDir: t.TempDir(),
+		TLSCert: cert, TLSKey: key, TLSCA: filepath.Join(p.dir, "ca.pem")}); err != nil {
+		t.Fatal(err)
+	}
+	r.SetAdmin(admin)
+	go func() {
+		_ = r.Listen(dns[0])
+	}()
+	var rep string
+	for _, c := range []struct {
+		name, dnsName string
+		ok            bool
+	}{{"client", "", false}, {"admin", AdminName, true}, {"node1", fmt.Sprintf(DefaultNodeName, 1), true}} {
+		var client *rpc.Client
+		if c.dnsName == "" {
+			client = dialAs(t, p, dns[0], c.name)
+		} else {
+			client = dialAs(t, p, dns[0], c.name, c.dnsName)
+		}
+		err := client.Call("RPC.Backup", Order.Message{Log: "b"}, &rep)
+		if (err == nil) != c.ok || err != nil && !strings.Contains(err.Error(), "node or admin certificate") {
+			t.Fatalf("%s backs up: %v", c.name, err)
+		}
+		client.Close()
+	}
+}
+
+/*
+客户端只连接出示节点证书的地址，同一个CA签发的客户端证书不能冒充节点。
+*/
+
+func TestDialNodeCertificate(t *testing.T) {
+	p := newCA(t)
+	for _, c := range []struct {
+		name, dnsName string
+		ok            bool
+	}{{"impostor", "", false}, {"admin", AdminName, false}, {"node0", fmt.Sprintf(DefaultNodeName, 0), true}} {
+		dns := []string{freeAddr(t), freeAddr(t)}
+		r := &RPC{}
+		if err := r.Init(make(chan Order.Order, 10), dns); err != nil {
+			t.Fatal(err)
+		}
+		var cert, key string
+		if c.dnsName == "" {
+			cert, key = p.issue(t, c.name)
+		} else {
+			cert, key = p.issue(t, c.name, c.dnsName)
+		}
+		if err := r.Configure(Meta.Meta{Dns: dns, TLSCert: cert, TLSKey: key, TLSCA: filepath.Join(p.dir, "ca.pem")}); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_ = r.Listen(dns[0])
+		}()
+		for i := 0; i < 100; i++ {
+			if conn, err := net.Dial("tcp", dns[0]); err == nil {
+				conn.Close()
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if c.ok {
+			dialAs(t, p, dns[0], "client").Close()
+			continue
+		}
+		clientCert, clientKey := p.issue(t, "client")
+		t.Setenv(CertEnv, clientCert)
+		t.Setenv(KeyEnv, clientKey)
+		t.Setenv(CAEnv, filepath.Join(p.dir, "ca.pem"))
+		client, err := Dial(dns[0])
+		if err == nil {
+			client.Close()
+		}
+		if err == nil || !strings.Contains(err.Error(), "node certificate") {
+			t.Fatalf("dial %s: %v", c.name, err)
+		}
+	}
+}
+
+/*
+不发送握手的连接在handshakeTimeout后被关闭，不会一直占用连接数。
+*/
+
+func TestHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { handshakeTimeout = timeout }(handshakeTimeout)
+	handshakeTimeout = 100 * time.Millisecond
+	p := newCA(t)
+	dns := []string{freeAddr(t), freeAddr(t)}
+	r := &RPC{}
+	if err := r.Init(make(chan Order.Order, 10), dns); err != nil {
+		t.Fatal(err)
+	}
+	cert, key := p.issue(t, "node0", fmt.Sprintf(DefaultNodeName, 0))
+	if err := r.Configure(Meta.Meta{Dns: dns, PeerMaxConns: 1,
+		TLSCert: cert, TLSKey: key, TLSCA: filepath.Join(p.dir, "ca.pem")}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = r.Listen(dns[0])
+	}()
+	var silent net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if silent, err = net.Dial("tcp", dns[0]); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	dialAs(t, p, dns[0], "client").Close()
+}
+
+/*
+失败之后重新拨号时状态是Connecting，直到推送有了结果。
+*/
+
+func TestConnectingWhileRedialing(t *testing.T) {
+	dns := []string{freeAddr(t), freeAddr(t)}
+	r := &RPC{}
+	if err := r.Init(make(chan Order.Order, 10), dns); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Configure(Meta.Meta{Id: 0, Dns: dns}); err != nil {
+		t.Fatal(err)
+	}
+	_ = r.ReplyNode(dns[1], Order.Message{From: 0})
+	waitHealth(t, r, 1, Broken)
+	blackhole, err := net.Listen("tcp", dns[1]) // 接受连接但不回应，推送在callTimeout之后才失败
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+	for i := 0; i < 100 && r.Health()[1].State != Connecting; i++ {
+		_ = r.ReplyNode(dns[1], Order.Message{From: 0})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.Health()[1].State != Connecting {
+		t.Fatalf("node 1 is not connecting while redialing: %s", r.ToString())
+	}
+}
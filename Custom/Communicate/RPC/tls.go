@@ -0,0 +1,123 @@
+package RPC
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"os"
+	"time"
+)
+
+/*
+双向TLS：全部节点和客户端的证书由同一个CA签发，连接的两端都必须出示证书。
+节点证书的DNS名称按照nodeName格式写出节点id（默认node%d.raftdb），节点id由证书证明，
+所以声称From为3的Push消息必须来自持有node3.raftdb证书的连接；客户端证书不含节点名称，只能调用Do。
+管理命令（Backup）只接受节点证书或者DNS名称中有AdminName的管理证书。
+*/
+
+const (
+	DefaultNodeName = "node%d.raftdb"
+	AdminName       = "admin.raftdb"         // 管理证书中的DNS名称
+	CertEnv         = "RAFTDB_TLS_CERT"      // 客户端和管理工具的证书文件
+	KeyEnv          = "RAFTDB_TLS_KEY"       // 客户端和管理工具的私钥文件
+	CAEnv           = "RAFTDB_TLS_CA"        // CA证书文件
+	NodeNameEnv     = "RAFTDB_TLS_NODE_NAME" // 节点证书中的DNS名称格式，和节点的tlsNodeName相同，为空时是DefaultNodeName
+	maxDialNodes    = 1024                   // 客户端不知道集群的大小，只接受id小于它的节点证书
+)
+
+var handshakeTimeout = 5 * time.Second // 对方超过这个时间没有完成握手时关闭连接，不能一直占用连接数
+
+/*
+加载证书、私钥和CA，返回同时可以用于监听和拨号的配置。拨号时还需要设置要验证的对方名称。
+*/
+
+func LoadTLS(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("RPC: no certificate in " + caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+/*
+证书证明的节点id，证书中没有节点名称时为空。
+*/
+
+func nodeIds(cert *x509.Certificate, nodeName string, num int) map[int]bool {
+	res := map[int]bool{}
+	for _, name := range cert.DNSNames {
+		for i := 0; i < num; i++ {
+			if name == fmt.Sprintf(nodeName, i) {
+				res[i] = true
+			}
+		}
+	}
+	return res
+}
+
+func isAdmin(cert *x509.Certificate) bool {
+	for _, name := range cert.DNSNames {
+		if name == AdminName {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+客户端和管理工具连接节点：设置了RAFTDB_TLS_CERT、RAFTDB_TLS_KEY和RAFTDB_TLS_CA时使用双向TLS，
+对方可以是集群中的任何一个节点，不要求名称等于addr，但证书必须由CA签发并且带有节点名称（见RAFTDB_TLS_NODE_NAME），
+客户端证书和管理证书不能冒充节点；没有设置时使用明文TCP。
+*/
+
+func Dial(addr string) (*rpc.Client, error) {
+	if os.Getenv(CertEnv) == "" {
+		return rpc.Dial("tcp", addr)
+	}
+	config, err := LoadTLS(os.Getenv(CertEnv), os.Getenv(KeyEnv), os.Getenv(CAEnv))
+	if err != nil {
+		return nil, err
+	}
+	nodeName := os.Getenv(NodeNameEnv)
+	if nodeName == "" {
+		nodeName = DefaultNodeName
+	}
+	config.InsecureSkipVerify = true // 由VerifyConnection验证，不要求对方名称等于addr
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("RPC: no server certificate")
+		}
+		options := x509.VerifyOptions{Roots: config.RootCAs, Intermediates: x509.NewCertPool()}
+		for _, v := range state.PeerCertificates[1:] {
+			options.Intermediates.AddCert(v)
+		}
+		if _, err := state.PeerCertificates[0].Verify(options); err != nil {
+			return err
+		}
+		if len(nodeIds(state.PeerCertificates[0], nodeName, maxDialNodes)) == 0 {
+			return errors.New("RPC: the server does not present a node certificate")
+		}
+		return nil
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
@@ -0,0 +1,109 @@
+package Stream
+
+import (
+	"RaftDB/Kernel/Pipe/Client"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+)
+
+/*
+流式信道的客户端连接，一条连接上可以并发发出多个请求，回复按请求Id交给对应的调用方。
+*/
+
+type Conn struct {
+	conn    net.Conn
+	w       *bufio.Writer
+	next    uint64
+	pending map[uint64]chan Client.Response
+	err     error // 连接断开的原因，之后的请求直接返回它
+	m       sync.Mutex
+}
+
+func Dial(addr string) (*Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: conn, w: bufio.NewWriter(conn), pending: map[uint64]chan Client.Response{}}
+	if err := writeFrame(c.w, []byte{helloClient}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	go c.read()
+	return c, nil
+}
+
+func (c *Conn) read() {
+	r := bufio.NewReader(c.conn)
+	var err error
+	for {
+		var frame []byte
+		if frame, err = readFrame(r, maxFrame); err != nil {
+			break
+		}
+		var res Client.Response
+		if err = json.Unmarshal(frame, &res); err != nil {
+			err = errors.New("Stream: broken reply")
+			break
+		}
+		c.m.Lock()
+		if ch, has := c.pending[res.Id]; has {
+			ch <- res
+			delete(c.pending, res.Id)
+		}
+		c.m.Unlock()
+	}
+	c.m.Lock()
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	c.m.Unlock()
+}
+
+/*
+发出一个客户端请求并等待回复，请求的Id由连接分配，没有给出版本时使用当前版本。
+*/
+
+func (c *Conn) Do(req Client.Request) (Client.Response, error) {
+	ch := make(chan Client.Response, 1)
+	if req.Version == 0 {
+		req.Version = Client.Version
+	}
+	c.m.Lock()
+	if c.err != nil {
+		c.m.Unlock()
+		return Client.Response{}, c.err
+	}
+	c.next++
+	req.Id = c.next
+	c.pending[req.Id] = ch
+	frame, err := json.Marshal(req)
+	if err == nil {
+		err = writeFrame(c.w, frame)
+	}
+	if err == nil {
+		err = c.w.Flush()
+	}
+	if err != nil {
+		delete(c.pending, req.Id)
+		c.m.Unlock()
+		return Client.Response{}, err
+	}
+	c.m.Unlock()
+	res, ok := <-ch
+	if !ok {
+		c.m.Lock()
+		defer c.m.Unlock()
+		return Client.Response{}, c.err
+	}
+	return res, nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
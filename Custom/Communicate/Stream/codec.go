@@ -0,0 +1,154 @@
+package Stream
+
+import (
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Pipe/Order"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/*
+帧格式：4字节大端长度加上正文，正文不超过读取方给出的上限：握手帧不超过maxHelloFrame，
+没有认证的客户端连接上的请求不超过maxClientFrame，节点消息和给客户端的回复不超过maxFrame。
+消息的二进制编码：整数都是varint，依次是Type、From、To的长度和每个元素、Term、Agree（1字节）、
+LastLogKey、SecondLastLogKey、LastLogIndex、SecondLastLogIndex、Leader、Seq，最后是Codec、Log和Client，字符串写成长度加内容。
+*/
+
+const (
+	maxFrame       = 64 << 20
+	maxHelloFrame  = 1 << 10
+	maxClientFrame = 1 << 20
+)
+
+func writeFrame(w *bufio.Writer, payload []byte) error {
+	var head [4]byte
+	binary.BigEndian.PutUint32(head[:], uint32(len(payload)))
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r *bufio.Reader, limit uint32) ([]byte, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(head[:])
+	if n > limit {
+		return nil, errors.New("Stream: frame is too large")
+	}
+	res := make([]byte, n)
+	_, err := io.ReadFull(r, res)
+	return res, err
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func encode(buf []byte, msg Order.Message) []byte {
+	buf = binary.AppendVarint(buf, int64(msg.Type))
+	buf = binary.AppendVarint(buf, int64(msg.From))
+	buf = binary.AppendUvarint(buf, uint64(len(msg.To)))
+	for _, v := range msg.To {
+		buf = binary.AppendVarint(buf, int64(v))
+	}
+	buf = binary.AppendVarint(buf, int64(msg.Term))
+	if msg.Agree {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	for _, v := range []int{msg.LastLogKey.Term, msg.LastLogKey.Index, msg.SecondLastLogKey.Term, msg.SecondLastLogKey.Index,
+		msg.LastLogIndex, msg.SecondLastLogIndex, msg.Leader, msg.Seq} {
+		buf = binary.AppendVarint(buf, int64(v))
+	}
+	buf = appendString(buf, string(msg.Codec))
+	buf = appendString(buf, msg.Log)
+	return appendString(buf, msg.Client)
+}
+
+/*
+按顺序读取encode写入的字段，数据不完整或者有多余内容时报错。
+*/
+
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) int() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errors.New("Stream: broken message")
+		return 0
+	}
+	d.data = d.data[n:]
+	return int(v)
+}
+
+func (d *decoder) string() string {
+	if d.err != nil {
+		return ""
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 || v > uint64(len(d.data)-n) {
+		d.err = errors.New("Stream: broken message")
+		return ""
+	}
+	res := string(d.data[n : n+int(v)])
+	d.data = d.data[n+int(v):]
+	return res
+}
+
+func (d *decoder) bool() bool {
+	if d.err != nil {
+		return false
+	}
+	if len(d.data) == 0 || d.data[0] > 1 {
+		d.err = errors.New("Stream: broken message")
+		return false
+	}
+	res := d.data[0] == 1
+	d.data = d.data[1:]
+	return res
+}
+
+func decode(data []byte) (Order.Message, error) {
+	d := &decoder{data: data}
+	var msg Order.Message
+	msg.Type = Order.MsgType(d.int())
+	msg.From = d.int()
+	if v, n := binary.Uvarint(d.data); n <= 0 || v > uint64(len(d.data)) {
+		return msg, errors.New("Stream: broken message")
+	} else {
+		d.data = d.data[n:]
+		if v > 0 {
+			msg.To = make([]int, v)
+		}
+		for i := range msg.To {
+			msg.To[i] = d.int()
+		}
+	}
+	msg.Term = d.int()
+	msg.Agree = d.bool()
+	msg.LastLogKey = Log.Key{Term: d.int(), Index: d.int()}
+	msg.SecondLastLogKey = Log.Key{Term: d.int(), Index: d.int()}
+	msg.LastLogIndex, msg.SecondLastLogIndex = d.int(), d.int()
+	msg.Leader, msg.Seq = d.int(), d.int()
+	msg.Codec = Log.Codec(d.string())
+	msg.Log = d.string()
+	msg.Client = d.string()
+	if d.err == nil && len(d.data) != 0 {
+		d.err = errors.New("Stream: broken message")
+	}
+	return msg, d.err
+}
@@ -0,0 +1,415 @@
+package Stream
+
+import (
+	"RaftDB/Kernel/Meta"
+	"RaftDB/Kernel/Pipe/Client"
+	"RaftDB/Kernel/Pipe/Order"
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+流式网络实体：到每个节点保持一条长连接，消息编码成带长度前缀的二进制帧，按发送顺序连续写出，不等待对方回应，
+所以发往同一个节点的消息保持顺序。连接的第一帧是握手，说明对方是节点还是客户端：
+	节点连接：单向，之后每一帧是一条消息。只接受来自dns中节点所在主机的连接，配置了clusterSecret时握手还要带上相同的密钥。
+	客户端连接：双向，客户端每一帧是JSON编码的Client.Request，节点回复JSON编码的Client.Response，
+	回复按请求的Id对应，一条连接上可以同时有多个请求。客户端连接没有认证，请求帧的大小和同时保持的连接数都有上限。
+连接没有加密，密钥只防止同一网络中的其他进程冒充节点，需要TLS时使用RPC信道。
+*/
+
+/*
+	type Cable interface {
+		Init(cableParam interface{}, alwaysIp []string) error
+		ReplyNode(addr string, msg interface{}) error
+		Listen(addr string) error
+		ReplyClient(msg interface{}) error
+		ChangeNetworkDelay(delay int, random bool)
+	}
+*/
+
+const (
+	helloNode   = 'N'
+	helloClient = 'C'
+	queueSize   = 1024
+	minBackoff  = 10 * time.Millisecond
+	maxBackoff  = 2 * time.Second
+	timeout     = 2 * time.Second // 写入超过这个时间没有完成时认为连接已经损坏
+)
+
+type StreamCable struct {
+	replyChan chan<- Order.Order
+	dns       []string
+	peers     map[string]*peer
+	clients   sync.Map // 客户端消息的From -> *request
+	num       atomic.Int32
+	delay     atomic.Int64
+	source    Client.Source // 流式监听的事件来源，为空时不支持流式监听
+	secret    atomic.Value  // 节点连接握手时携带的共享密钥，[]byte
+	conns     atomic.Int32  // 当前的客户端连接数
+	limit     atomic.Int32  // 最大客户端连接数，为0时不限制
+}
+
+/*
+一个等待回复的客户端请求。
+*/
+
+type request struct {
+	conn *clientConn
+	req  Client.Request
+	done atomic.Bool // 已经回复过（结果或者超时），之后的回复丢弃
+}
+
+type clientConn struct {
+	w *bufio.Writer
+	m sync.Mutex
+}
+
+func (s *StreamCable) Init(replyChan interface{}, alwaysIp []string) error {
+	if x, ok := replyChan.(chan Order.Order); !ok {
+		return errors.New("Stream: Init need a reply chan")
+	} else {
+		s.replyChan = x
+	}
+	for _, p := range s.peers {
+		p.stop()
+	}
+	s.dns, s.peers, s.clients = alwaysIp, map[string]*peer{}, sync.Map{}
+	for _, v := range alwaysIp {
+		s.peers[v] = newPeer(s, v)
+	}
+	return nil
+}
+
+/*
+消息放进发往addr的队列后立即返回，队列满时丢弃。
+*/
+
+func (s *StreamCable) ReplyNode(addr string, msg interface{}) error {
+	x, ok := msg.(Order.Message)
+	if !ok {
+		return errors.New("Stream: ReplyNode need a Order.Message")
+	}
+	p, has := s.peers[addr]
+	if !has {
+		return errors.New("Stream: unknown node " + addr)
+	}
+	select {
+	case p.queue <- x:
+		return nil
+	default:
+		p.dropped.Add(1)
+		return fmt.Errorf("Stream: the queue to %s is full, drop the message", addr)
+	}
+}
+
+/*
+设置节点连接的共享密钥和最大客户端连接数（clientMaxConns），在Init之后调用，连接时使用最新的配置。
+*/
+
+func (s *StreamCable) Configure(meta Meta.Meta) error {
+	s.secret.Store([]byte(meta.ClusterSecret))
+	s.limit.Store(int32(meta.ClientMaxConns))
+	return nil
+}
+
+/*
+节点连接的握手帧是helloNode加上共享密钥。
+*/
+
+func (s *StreamCable) hello() []byte {
+	secret, _ := s.secret.Load().([]byte)
+	return append([]byte{helloNode}, secret...)
+}
+
+/*
+对方的IP必须是dns中某个节点的主机（主机名解析后比较），握手中的密钥必须和自己的相同。
+*/
+
+func (s *StreamCable) trusted(conn net.Conn, hello []byte) bool {
+	if subtle.ConstantTimeCompare(hello, s.hello()) != 1 {
+		return false
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, v := range s.dns {
+		host, _, err := net.SplitHostPort(v)
+		if err != nil {
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(addr.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *StreamCable) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	for {
+		if conn, err := listener.Accept(); err != nil {
+			log.Println(err)
+		} else {
+			go s.serve(conn)
+		}
+	}
+}
+
+/*
+握手要在timeout内完成；超过最大客户端连接数的客户端连接直接关闭。
+*/
+
+func (s *StreamCable) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	hello, err := readFrame(r, maxHelloFrame)
+	if err != nil || len(hello) == 0 {
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	switch hello[0] {
+	case helloNode:
+		if !s.trusted(conn, hello) {
+			log.Printf("Stream: refuse node connection from %s\n", conn.RemoteAddr())
+			return
+		}
+		for {
+			frame, err := readFrame(r, maxFrame)
+			if err != nil {
+				return
+			}
+			msg, err := decode(frame)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			s.replyChan <- Order.Order{Type: Order.FromNode, Msg: msg}
+		}
+	case helloClient:
+		defer s.conns.Add(-1)
+		if limit := s.limit.Load(); s.conns.Add(1) > limit && limit > 0 {
+			log.Printf("Stream: %d client connections, refuse %s\n", limit, conn.RemoteAddr())
+			return
+		}
+		c := &clientConn{w: bufio.NewWriter(conn)}
+		for {
+			frame, err := readFrame(r, maxClientFrame)
+			if err != nil {
+				return
+			}
+			var req Client.Request
+			if err := json.Unmarshal(frame, &req); err != nil {
+				log.Println(err)
+				return
+			}
+			s.do(c, req)
+		}
+	}
+}
+
+/*
+客户端请求的语义和RPC.Do一致，超时后回复Timeout。
+*/
+
+func (s *StreamCable) do(c *clientConn, req Client.Request) {
+	if err := req.Check(); err != nil {
+		s.send(c, Client.Fail(req, Client.BadRequest, err.Error()))
+		return
+	}
+	if req.Streaming() { // 长轮询会阻塞，不能占用读取连接的协程
+		go func() {
+			s.send(c, Client.Follow(req, s.source))
+		}()
+		return
+	}
+	rec := req.Message()
+	rec.From = int(s.num.Add(1))
+	s.clients.Store(rec.From, &request{conn: c, req: req})
+	s.replyChan <- Order.Order{Type: Order.FromClient, Msg: rec}
+	from := rec.From
+	time.AfterFunc(req.Duration(), func() {
+		s.reply(from, Order.Message{From: from, Leader: -1, Log: Order.Timeout})
+	})
+}
+
+func (s *StreamCable) reply(from int, msg Order.Message) {
+	x, has := s.clients.LoadAndDelete(from)
+	if !has {
+		return
+	}
+	req := x.(*request)
+	if !req.done.CompareAndSwap(false, true) {
+		return
+	}
+	s.send(req.conn, Client.Reply(req.req, msg))
+}
+
+func (s *StreamCable) send(c *clientConn, res Client.Response) {
+	frame, err := json.Marshal(res)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err := writeFrame(c.w, frame); err == nil {
+		_ = c.w.Flush()
+	}
+}
+
+func (s *StreamCable) ReplyClient(msg interface{}) error {
+	x, ok := msg.(Order.Message)
+	if !ok {
+		return errors.New("Stream: ReplyClient need a Order.Message")
+	}
+	s.reply(x.From, x)
+	return nil
+}
+
+func (s *StreamCable) SetWatchSource(source Client.Source) {
+	s.source = source
+}
+
+func (s *StreamCable) ChangeNetworkDelay(delay int, random bool) {
+	if !random {
+		s.delay.Store(int64(time.Duration(delay) * time.Millisecond))
+	} else {
+		s.delay.Store(int64(time.Duration(rand.Intn(delay)) * time.Millisecond))
+	}
+}
+
+func (s *StreamCable) ToString() string {
+	var res strings.Builder
+	res.WriteString("==== streams ====\n")
+	for i, v := range s.dns {
+		if p, has := s.peers[v]; has {
+			fmt.Fprintf(&res, "%d %s: connected %v, sent %d, dropped %d, reconnects %d\n",
+				i, v, p.connected.Load(), p.sent.Load(), p.dropped.Load(), p.reconnects.Load())
+		}
+	}
+	res.WriteString("==== streams ====")
+	return res.String()
+}
+
+/*
+到一个节点的发送队列和发送协程：没有连接时按指数退避重连，退避期间的消息丢弃；
+队列中还有消息时连续写入缓冲区，队列空了才刷新，所以消息是流水线发送的。写入失败或超时时关闭连接，之后重连。
+握手立即刷新，握手或者一次刷新成功后就认为已经连接，不等队列清空。
+*/
+
+type peer struct {
+	s          *StreamCable
+	addr       string
+	queue      chan Order.Message
+	done       chan struct{}
+	connected  atomic.Bool
+	sent       atomic.Int64
+	dropped    atomic.Int64
+	reconnects atomic.Int64
+}
+
+func newPeer(s *StreamCable, addr string) *peer {
+	p := &peer{s: s, addr: addr, queue: make(chan Order.Message, queueSize), done: make(chan struct{})}
+	go p.run()
+	return p
+}
+
+func (p *peer) stop() {
+	close(p.done)
+}
+
+func (p *peer) run() {
+	var conn net.Conn
+	var w *bufio.Writer
+	var retryAt time.Time
+	backoff := time.Duration(0)
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+	fail := func(err error) {
+		log.Printf("Stream: %s: %v\n", p.addr, err)
+		if conn != nil {
+			_ = conn.Close()
+			conn = nil
+		}
+		p.connected.Store(false)
+		if backoff *= 2; backoff < minBackoff {
+			backoff = minBackoff
+		} else if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		retryAt = time.Now().Add(backoff)
+	}
+	for {
+		var msg Order.Message
+		select {
+		case <-p.done:
+			return
+		case msg = <-p.queue:
+		}
+		if conn == nil {
+			if time.Now().Before(retryAt) {
+				p.dropped.Add(1)
+				continue
+			}
+			var err error
+			if conn, err = net.Dial("tcp", p.addr); err != nil {
+				fail(err)
+				p.dropped.Add(1)
+				continue
+			}
+			p.reconnects.Add(1)
+			w = bufio.NewWriter(conn)
+			_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+			if err = writeFrame(w, p.s.hello()); err == nil {
+				err = w.Flush()
+			}
+			if err != nil {
+				fail(err)
+				p.dropped.Add(1)
+				continue
+			}
+			p.connected.Store(true)
+		}
+		time.Sleep(time.Duration(p.s.delay.Load()))
+		_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+		if err := writeFrame(w, encode(nil, msg)); err != nil {
+			fail(err)
+			p.dropped.Add(1)
+			continue
+		}
+		p.sent.Add(1)
+		if len(p.queue) == 0 {
+			if err := w.Flush(); err != nil {
+				fail(err)
+				continue
+			}
+			p.connected.Store(true)
+			backoff = 0
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package Stream
+
+import (
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Meta"
+	"RaftDB/Kernel/Pipe/Client"
+	"RaftDB/Kernel/Pipe/Order"
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+编码后一定能解码回原样；任意字节序列解码时不会崩溃。
+*/
+
+func FuzzMessageCodec(f *testing.F) {
+	f.Add(1, 2, 3, true, 4, 5, 6, 7, "z", "value", []byte{1, 2})
+	f.Add(-1, -1, 0, false, -1, -1, -1, -1, "", "", []byte{})
+	f.Fuzz(func(t *testing.T, typ int, from int, term int, agree bool, a int, b int, c int, d int,
+		codec string, v string, raw []byte) {
+		msg := Order.Message{Type: Order.MsgType(typ), From: from, Term: term, Agree: agree,
+			LastLogKey: Log.Key{Term: a, Index: b}, SecondLastLogKey: Log.Key{Term: c, Index: d},
+			LastLogIndex: a + 1, SecondLastLogIndex: c - 1, Leader: b - d, Seq: d, Codec: Log.Codec(codec), Log: v, Client: codec + v}
+		for _, x := range raw {
+			msg.To = append(msg.To, int(x))
+		}
+		res, err := decode(encode(nil, msg))
+		if err != nil || !reflect.DeepEqual(res, msg) {
+			t.Fatalf("%+v round trips to %+v, %v", msg, res, err)
+		}
+		_, _ = decode(raw)
+	})
+}
+
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func newCable(t *testing.T, dns []string, id int) (*StreamCable, chan Order.Order) {
+	ch := make(chan Order.Order, 2000)
+	s := &StreamCable{}
+	if err := s.Init(ch, dns); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = s.Listen(dns[id])
+	}()
+	return s, ch
+}
+
+/*
+连接建立之后，发往同一个节点的消息按发送顺序全部到达。
+*/
+
+func TestOrdered(t *testing.T) {
+	dns := []string{freeAddr(t), freeAddr(t)}
+	a, _ := newCable(t, dns, 0)
+	_, ch := newCable(t, dns, 1)
+	connected := false
+	for i := 0; i < 200 && !connected; i++ {
+		_ = a.ReplyNode(dns[1], Order.Message{Type: Order.Heartbeat, From: 0, Term: -1})
+		select {
+		case <-ch:
+			connected = true
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	if !connected {
+		t.Fatalf("never connected: %s", a.ToString())
+	}
+	for len(ch) > 0 {
+		<-ch
+	}
+	const n = 1000
+	for i := 0; i < n; i++ {
+		if err := a.ReplyNode(dns[1], Order.Message{Type: Order.AppendLog, From: 0, Term: i, Log: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case order := <-ch:
+			if order.Type != Order.FromNode || order.Msg.Term != i || order.Msg.Log != fmt.Sprint(i) {
+				t.Fatalf("message %d is %+v", i, order.Msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d is lost: %s", i, a.ToString())
+		}
+	}
+}
+
+/*
+一条客户端连接上的并发请求各自收到自己的回复，没有回复的请求超时。
+*/
+
+func TestClient(t *testing.T) {
+	dns := []string{freeAddr(t)}
+	s, ch := newCable(t, dns, 0)
+	go func() {
+		for order := range ch {
+			if order.Msg.Log != "slow" {
+				order.Msg.Log, order.Msg.Agree = "ok "+order.Msg.Log, true
+				_ = s.ReplyClient(order.Msg)
+			}
+		}
+	}()
+	var c *Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if c, err = Dial(dns[0]); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := c.Do(Client.Request{Op: Client.Read, Consistency: Client.Local, Timeout: 5000, Command: fmt.Sprint(i)})
+			if err != nil || res.Code != Client.OK || res.Result != fmt.Sprint("ok ", i) {
+				t.Errorf("request %d: %+v, %v", i, res, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if res, err := c.Do(Client.Request{Timeout: 20, Command: "slow"}); err != nil || res.Code != Client.Timeout {
+		t.Fatalf("slow request: %+v, %v", res, err)
+	}
+	if res, err := c.Do(Client.Request{Version: Client.Version + 1}); err != nil || res.Code != Client.BadRequest {
+		t.Fatalf("request of another version: %+v, %v", res, err)
+	}
+}
+
+/*
+只有来自dns中的主机、握手密钥相同的节点连接才能送入消息。
+*/
+
+func TestNodeHandshake(t *testing.T) {
+	send := func(addr string, hello []byte) {
+		var conn net.Conn
+		var err error
+		for i := 0; i < 100; i++ {
+			if conn, err = net.Dial("tcp", addr); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		w := bufio.NewWriter(conn)
+		_ = writeFrame(w, hello)
+		_ = writeFrame(w, encode(nil, Order.Message{Type: Order.Heartbeat, From: 0, Term: 1}))
+		_ = w.Flush()
+	}
+	received := func(ch chan Order.Order) bool {
+		select {
+		case <-ch:
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}
+	dns := []string{freeAddr(t)}
+	s, ch := newCable(t, dns, 0)
+	_ = s.Configure(Meta.Meta{ClusterSecret: "secret"})
+	if send(dns[0], []byte{helloNode}); received(ch) {
+		t.Fatal("a node without the secret is accepted")
+	}
+	if send(dns[0], append([]byte{helloNode}, "wrong"...)); received(ch) {
+		t.Fatal("a node with a wrong secret is accepted")
+	}
+	if send(dns[0], append([]byte{helloNode}, "secret"...)); !received(ch) {
+		t.Fatal("a node with the secret is refused")
+	}
+	ch = make(chan Order.Order, 10)
+	x := &StreamCable{}
+	if err := x.Init(ch, []string{"192.0.2.1:1"}); err != nil { // 本机不在dns中
+		t.Fatal(err)
+	}
+	addr := freeAddr(t)
+	go func() {
+		_ = x.Listen(addr)
+	}()
+	if send(addr, []byte{helloNode}); received(ch) {
+		t.Fatal("a node from a host outside dns is accepted")
+	}
+}
+
+/*
+客户端连接超过clientMaxConns时被关闭，关闭一条之后可以再连接；超过maxClientFrame的请求帧会关闭连接。
+*/
+
+func TestClientLimits(t *testing.T) {
+	dns := []string{freeAddr(t)}
+	s, ch := newCable(t, dns, 0)
+	_ = s.Configure(Meta.Meta{ClientMaxConns: 1})
+	go func() {
+		for order := range ch {
+			order.Msg.Agree = true
+			_ = s.ReplyClient(order.Msg)
+		}
+	}()
+	dial := func() *Conn {
+		for i := 0; i < 100; i++ {
+			if c, err := Dial(dns[0]); err == nil {
+				if _, err := c.Do(Client.Request{Timeout: 1000, Command: "x"}); err == nil {
+					return c
+				}
+				c.Close()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("can not connect")
+		return nil
+	}
+	first := dial()
+	second, err := Dial(dns[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.Do(Client.Request{Timeout: 1000, Command: "x"}); err == nil {
+		t.Fatal("a connection over clientMaxConns is accepted")
+	}
+	second.Close()
+	first.Close()
+	third := dial()
+	defer third.Close()
+	large := make([]byte, maxClientFrame)
+	if _, err := third.Do(Client.Request{Timeout: 1000, Command: string(large)}); err == nil {
+		t.Fatal("a frame over maxClientFrame is accepted")
+	}
+}
+
+/*
+握手发出后就认为已经连接，不等队列中的消息写完。
+*/
+
+func TestConnectedAfterHello(t *testing.T) {
+	dns := []string{freeAddr(t), freeAddr(t)}
+	a, _ := newCable(t, dns, 0)
+	newCable(t, dns, 1)
+	a.ChangeNetworkDelay(2000, false) // 握手之后，写入第一条消息之前等待
+	for i := 0; i < 100 && !a.peers[dns[1]].connected.Load(); i++ {
+		if i%10 == 0 {
+			_ = a.ReplyNode(dns[1], Order.Message{Type: Order.Heartbeat, From: 0, Term: -1})
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !a.peers[dns[1]].connected.Load() {
+		t.Fatalf("not connected after the hello: %s", a.ToString())
+	}
+}
@@ -1,21 +1,59 @@
 package KVDB
 
 import (
+	"RaftDB/Kernel/Crown"
+	"RaftDB/Kernel/Feed"
+	"RaftDB/Kernel/Pipe/Something"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 /*
-随便写了一个键值数据库
+随便写了一个键值数据库，数据按key有序存放在跳表中。命令：
+	read'k  write'k'v  delete'k  exists'k  watch'write'k
+	read'k'R               k在版本R时的值
+	list'p[limit['next]]   以p开头的key，最多limit个，从next开始（分页）
+	scan'a'b[limit]        [a, b)中的key和值，b为空时一直到最后；下一页用回复中的next作为a
+	count[p]               以p开头的key的个数，没有p时是全部key的个数
+	version'k              k的版本
+	cas'k'old'new          k的值是old时写入new
+	txn'{...}              事务，内容是Txn的JSON
+	revision               当前的版本和压缩到的版本
+	compact'R              丢弃早于版本R的历史
+list、scan、txn和revision的回复是JSON，next是下一页的第一个key，为空表示没有更多。
+
+多版本：数据有一个全局的版本号（revision），从0开始，每条改变了数据的命令（写入、删除存在的key、有写入的cas和事务）加一，
+一条命令中的改变属于同一个版本。每个key保存历史上的值，可以读取任何没有被压缩的版本时的值。
+版本号随日志确定地增长，每个节点上相同；压缩也是一条日志，所以每个节点压缩到相同的版本。
 */
 
 const (
 	write = iota
 	read
 	watch
+	remove
+	exists
+	list
+	scan
+	count
+	versionOf
+	cas
+	txn
+	revisionOf
+	compact
+)
+
+const (
+	defaultLimit = 100  // list和scan没有给出limit时使用
+	maxLimit     = 1000 // list和scan一次最多返回的个数
+	maxTxnOps    = 128  // 一个事务中条件和操作的总数
 )
 
 type kvData struct {
@@ -26,8 +64,90 @@ type kvData struct {
 type op struct { // 原神怎么你了
 	opType int
 	data   kvData
+	end    string // scan的结束key，不包括
+	limit  int
+	txn    *Txn  // cas和txn的内容
+	rev    int64 // 历史读和压缩的版本，-1表示读当前的值
+}
+
+type item struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type listReply struct {
+	Keys []string `json:"keys"`
+	Next string   `json:"next"`
+}
+
+type scanReply struct {
+	Items []item `json:"items"`
+	Next  string `json:"next"`
+}
+
+/*
+事务：If中的条件都成立时执行Then，否则执行Else，整个事务是一条日志，原子地执行，回复中有每个操作的结果。
+条件比较key的值或者版本。版本是key被写入的次数，删除之后重新从1开始；不存在的key版本是0，和任何值比较都不成立。
+*/
+
+type Txn struct {
+	If   []Compare `json:"if,omitempty"`
+	Then []TxnOp   `json:"then,omitempty"`
+	Else []TxnOp   `json:"else,omitempty"`
+}
+
+type Compare struct {
+	Key     string `json:"key"`
+	Target  string `json:"target"` // value或者version
+	Result  string `json:"result"` // =、!=、<或者>
+	Value   string `json:"value,omitempty"`
+	Version int    `json:"version,omitempty"`
+}
+
+type TxnOp struct {
+	Type  string `json:"type"` // read、write或者delete
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+type TxnReply struct {
+	Succeeded bool     `json:"succeeded"`
+	Results   []string `json:"results"`
+}
+
+type revisionReply struct {
+	Revision  int64 `json:"revision"`
+	Compacted int64 `json:"compacted"`
 }
 
+/*
+key在一个版本中的值，Deleted为真时key在这个版本被删除。
+*/
+
+type kvRevision struct {
+	Rev     int64  `json:"rev"`
+	Value   string `json:"value,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+type undoRecord struct { // 一次写入之前key的状态，用于撤销
+	key     string
+	val     string
+	version int
+	existed bool
+	history int // 写入之前key的历史长度，-1表示没有改变历史
+}
+
+type undoEntry struct { // 一条命令的全部写入
+	cmd       string
+	records   []undoRecord
+	rev       int64                   // 命令之前的版本
+	compacted int64                   // 压缩之前压缩到的版本
+	dropped   map[string][]kvRevision // 压缩丢弃的历史
+}
+
+const maxUndo = 100000 // 只有还没提交的日志会被撤销，保留最近的写入记录就够了
+
 /*
 type App interface {
 	Process(in string) (out string, agreeNext bool, err error)
@@ -39,12 +159,17 @@ type App interface {
 */
 
 type KVDB struct {
-	data  map[string]string
-	delay time.Duration
+	data      *skipList
+	undo      []undoEntry             // 按执行顺序记录的命令，撤销时从最新的开始弹出
+	rev       int64                   // 当前的版本
+	compacted int64                   // 早于这个版本的历史已经丢弃
+	history   map[string][]kvRevision // 每个key按版本排序的历史，包括当前的值
+	delay     time.Duration
 }
 
 func (k *KVDB) Init() func(string) (bool, string, string) {
-	k.data = map[string]string{}
+	k.data, k.undo = newSkipList(), nil
+	k.rev, k.compacted, k.history = 0, 0, map[string][]kvRevision{}
 	k.ChangeProcessDelay(0, false)
 	return func(order string) (bool, string, string) {
 		if op, ok := k.parser(order); ok && op.opType == write {
@@ -53,45 +178,472 @@ func (k *KVDB) Init() func(string) (bool, string, string) {
 		return false, "", ""
 	}
 }
+
+/*
+实现Crown.Resulter：非法命令、读取被压缩的版本和读取不存在的key带上结果代码，回复和Process相同。
+*/
+
+func (k *KVDB) ProcessResult(in string) (out string, result Something.Result, agree bool, watching bool, err error) {
+	x, legal := k.parser(in)
+	switch {
+	case !legal:
+		result = Something.Illegal
+	case x.opType == read && x.rev >= 0 && x.rev < k.compacted:
+		result = Something.Expired
+	case x.opType == read && x.rev >= 0 && x.rev <= k.rev:
+		if _, ok := k.valueAt(x.data.key, x.rev); !ok {
+			result = Something.Missing
+		}
+	case x.opType == read && x.rev < 0:
+		if _, _, ok := k.data.Get(x.data.key); !ok {
+			result = Something.Missing
+		}
+	}
+	out, agree, watching, err = k.Process(in)
+	return
+}
+
 func (k *KVDB) Process(in string) (out string, agree bool, watching bool, err error) {
 	log.Printf("KVDB: process: %s\n", in)
 	time.Sleep(k.delay)
-	if x, legal := k.parser(in); !legal {
+	x, legal := k.parser(in)
+	if !legal {
 		return "db: illegal operation", false, false, nil
-	} else {
-		if x.opType == read {
-			if res, ok := k.data[x.data.key]; ok {
-				return res, true, false, nil
-			} else {
-				return "(empty)", true, false, nil
+	}
+	switch x.opType {
+	case read:
+		if x.rev >= 0 {
+			return k.readAt(x.data.key, x.rev)
+		}
+		return k.exec(x.single(), nil), true, false, nil
+	case write, remove:
+		var undo []undoRecord
+		out = k.exec(x.single(), &undo)
+		k.commit(in, undo)
+		return out, true, false, nil
+	case cas, txn:
+		var undo []undoRecord
+		succeeded, ops := k.branch(x.txn)
+		rep := TxnReply{Succeeded: succeeded, Results: []string{}}
+		for _, v := range ops {
+			rep.Results = append(rep.Results, k.exec(v, &undo))
+		}
+		k.commit(in, undo)
+		if x.opType == txn {
+			return marshal(rep)
+		}
+		if succeeded {
+			return "cas successfully: " + x.data.key + ", " + x.data.val, true, false, nil
+		}
+		if val, _, ok := k.data.Get(x.data.key); ok {
+			return "cas failed: " + x.data.key + " is " + val, true, false, nil
+		}
+		return "cas failed: " + x.data.key + " does not exist", true, false, nil
+	case exists:
+		_, _, ok := k.data.Get(x.data.key)
+		return strconv.FormatBool(ok), true, false, nil
+	case versionOf:
+		_, version, _ := k.data.Get(x.data.key)
+		return strconv.Itoa(version), true, false, nil
+	case revisionOf:
+		return marshal(revisionReply{Revision: k.rev, Compacted: k.compacted})
+	case compact:
+		return k.compact(in, x.rev)
+	case list:
+		rep, start := listReply{Keys: []string{}}, x.data.key
+		if x.data.val > start {
+			start = x.data.val
+		}
+		k.data.Ascend(start, func(key string, _ string) bool {
+			if !strings.HasPrefix(key, x.data.key) {
+				return false
+			}
+			if len(rep.Keys) == x.limit {
+				rep.Next = key
+				return false
 			}
-		} else if x.opType == write {
-			k.data[x.data.key] = x.data.val
-			return "write successfully: " + x.data.key + ", " + x.data.val, true, false, nil
-		} else if x.opType == watch {
-			return x.data.key, true, true, nil
+			rep.Keys = append(rep.Keys, key)
+			return true
+		})
+		return marshal(rep)
+	case scan:
+		rep := scanReply{Items: []item{}}
+		k.data.Ascend(x.data.key, func(key string, val string) bool {
+			if x.end != "" && key >= x.end {
+				return false
+			}
+			if len(rep.Items) == x.limit {
+				rep.Next = key
+				return false
+			}
+			rep.Items = append(rep.Items, item{Key: key, Value: val})
+			return true
+		})
+		return marshal(rep)
+	case count:
+		if x.data.key == "" {
+			return strconv.Itoa(k.data.Len()), true, false, nil
 		}
+		n := 0
+		k.data.Ascend(x.data.key, func(key string, _ string) bool {
+			if strings.HasPrefix(key, x.data.key) {
+				n++
+				return true
+			}
+			return false
+		})
+		return strconv.Itoa(n), true, false, nil
+	case watch:
+		return x.data.key, true, true, nil
 	}
 	return in, false, false, nil
 }
 
+func marshal(v interface{}) (string, bool, bool, error) {
+	res, err := json.Marshal(v)
+	if err != nil {
+		return "", false, false, err
+	}
+	return string(res), true, false, nil
+}
+
+/*
+执行一个读、写或者删除，写入之前key的状态加入undo，读的时候undo可以为空。
+写入和删除的历史属于下一个版本，命令执行完之后由commit增加版本。
+*/
+
+func (k *KVDB) exec(o TxnOp, undo *[]undoRecord) string {
+	switch o.Type {
+	case "write":
+		_, version, _ := k.data.Get(o.Key)
+		old, _, existed := k.data.Set(o.Key, o.Value, version+1)
+		*undo = append(*undo, undoRecord{key: o.Key, val: old, version: version, existed: existed, history: len(k.history[o.Key])})
+		k.history[o.Key] = append(k.history[o.Key], kvRevision{Rev: k.rev + 1, Value: o.Value})
+		return "write successfully: " + o.Key + ", " + o.Value
+	case "delete":
+		old, version, existed := k.data.Delete(o.Key)
+		if !existed {
+			*undo = append(*undo, undoRecord{key: o.Key, history: -1})
+			return "delete: " + o.Key + " does not exist"
+		}
+		*undo = append(*undo, undoRecord{key: o.Key, val: old, version: version, existed: existed, history: len(k.history[o.Key])})
+		k.history[o.Key] = append(k.history[o.Key], kvRevision{Rev: k.rev + 1, Deleted: true})
+		return "delete successfully: " + o.Key
+	}
+	if res, _, ok := k.data.Get(o.Key); ok {
+		return res
+	}
+	return "(empty)"
+}
+
+/*
+判断事务的条件，返回是否成立以及要执行的操作，不改变数据。
+*/
+
+func (k *KVDB) branch(t *Txn) (bool, []TxnOp) {
+	for _, c := range t.If {
+		val, version, existed := k.data.Get(c.Key)
+		if !c.holds(val, version, existed) {
+			return false, t.Else
+		}
+	}
+	return true, t.Then
+}
+
+func (c Compare) holds(val string, version int, existed bool) bool {
+	res := 0
+	if c.Target == "value" {
+		if !existed {
+			return false
+		}
+		res = strings.Compare(val, c.Value)
+	} else if version < c.Version {
+		res = -1
+	} else if version > c.Version {
+		res = 1
+	}
+	switch c.Result {
+	case "=":
+		return res == 0
+	case "!=":
+		return res != 0
+	case "<":
+		return res < 0
+	}
+	return res > 0
+}
+
+func (t *Txn) valid() bool {
+	if len(t.If)+len(t.Then)+len(t.Else) > maxTxnOps {
+		return false
+	}
+	for _, c := range t.If {
+		if c.Target != "value" && c.Target != "version" ||
+			c.Result != "=" && c.Result != "!=" && c.Result != "<" && c.Result != ">" {
+			return false
+		}
+	}
+	for _, v := range append(append([]TxnOp{}, t.Then...), t.Else...) {
+		if v.Type != "read" && v.Type != "write" && v.Type != "delete" {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+read、write和delete命令对应的事务操作。
+*/
+
+func (x op) single() TxnOp {
+	switch x.opType {
+	case write:
+		return TxnOp{Type: "write", Key: x.data.key, Value: x.data.val}
+	case remove:
+		return TxnOp{Type: "delete", Key: x.data.key}
+	}
+	return TxnOp{Type: "read", Key: x.data.key}
+}
+
+/*
+记录一条写入命令，命令改变了数据时版本加一。
+*/
+
+func (k *KVDB) commit(cmd string, records []undoRecord) {
+	k.record(undoEntry{cmd: cmd, records: records, rev: k.rev})
+	for _, r := range records {
+		if r.history >= 0 {
+			k.rev++
+			return
+		}
+	}
+}
+
+/*
+key在版本rev时的值：历史中最后一个不晚于rev的值。rev被压缩了或者还没有到时拒绝。
+*/
+
+func (k *KVDB) readAt(key string, rev int64) (string, bool, bool, error) {
+	if rev > k.rev {
+		return fmt.Sprintf("db: revision %d is in the future, the current revision is %d", rev, k.rev), false, false, nil
+	}
+	if rev < k.compacted {
+		return fmt.Sprintf("db: revision %d is compacted, the oldest revision is %d", rev, k.compacted), false, false, nil
+	}
+	if v, ok := k.valueAt(key, rev); ok {
+		return v, true, false, nil
+	}
+	return "(empty)", true, false, nil
+}
+
+/*
+key在没有被压缩的版本rev时的值，那时key不存在时第二个返回值为假。
+*/
+
+func (k *KVDB) valueAt(key string, rev int64) (string, bool) {
+	h := k.history[key]
+	i := sort.Search(len(h), func(i int) bool { return h[i].Rev > rev })
+	if i == 0 || h[i-1].Deleted {
+		return "", false
+	}
+	return h[i-1].Value, true
+}
+
+/*
+压缩到版本rev：每个key只保留在rev时的值和之后的历史，rev时已经删除的key不再保留历史。
+*/
+
+func (k *KVDB) compact(cmd string, rev int64) (string, bool, bool, error) {
+	if rev > k.rev {
+		return fmt.Sprintf("db: revision %d is in the future, the current revision is %d", rev, k.rev), false, false, nil
+	}
+	u := undoEntry{cmd: cmd, rev: k.rev, compacted: k.compacted, dropped: map[string][]kvRevision{}}
+	if rev > k.compacted {
+		for key, h := range k.history {
+			i := sort.Search(len(h), func(i int) bool { return h[i].Rev > rev })
+			if i > 0 && !h[i-1].Deleted {
+				i--
+			}
+			if i == 0 {
+				continue
+			}
+			u.dropped[key] = h[:i]
+			if i == len(h) {
+				delete(k.history, key)
+			} else {
+				k.history[key] = h[i:]
+			}
+		}
+		k.compacted = rev
+	}
+	k.record(u)
+	return fmt.Sprintf("compacted to revision %d", k.compacted), true, false, nil
+}
+
+func (k *KVDB) record(u undoEntry) {
+	if len(k.undo) == maxUndo {
+		k.undo = append(k.undo[:0], k.undo[maxUndo/2:]...)
+	}
+	k.undo = append(k.undo, u)
+}
+
+/*
+撤销一条已经执行过的命令，in是"!"加上原命令。日志总是从最新的开始撤销，所以命令按后进先出的顺序恢复，
+一条命令中的写入也从最后一个开始恢复。
+*/
+
 func (k *KVDB) UndoProcess(in string) (out string, agree bool, err error) {
-	fmt.Printf("!! redo %s\n", in)
+	log.Printf("KVDB: undo: %s\n", in)
+	cmd := strings.TrimPrefix(in, "!")
+	x, legal := k.parser(cmd)
+	if !legal || x.opType != write && x.opType != remove && x.opType != cas && x.opType != txn && x.opType != compact {
+		return in, true, nil
+	}
+	if len(k.undo) == 0 || k.undo[len(k.undo)-1].cmd != cmd {
+		return in, false, errors.New("KVDB: undo a command that is not the latest one")
+	}
+	u := k.undo[len(k.undo)-1]
+	k.undo = k.undo[:len(k.undo)-1]
+	for i := len(u.records) - 1; i >= 0; i-- {
+		r := u.records[i]
+		if r.existed {
+			k.data.Set(r.key, r.val, r.version)
+		} else {
+			k.data.Delete(r.key)
+		}
+		if r.history == 0 {
+			delete(k.history, r.key)
+		} else if r.history > 0 {
+			k.history[r.key] = k.history[r.key][:r.history]
+		}
+	}
+	for key, h := range u.dropped {
+		k.history[key] = append(append([]kvRevision{}, h...), k.history[key]...)
+	}
+	k.rev, k.compacted = u.rev, u.compacted
 	return in, true, nil
 }
 
+/*
+流式监听：写入和删除改变一个key，cas和事务按顺序改变执行的分支中写入和删除的key；
+监听命令是watch'write'key（一个key）、watch'prefix'p（以p开头的key）和watch'range'a'b（[a, b)中的key），
+后两种只能用于流式监听。一次性的监听只由write触发。事件带有改变所在的版本，可以用来读取那时的数据。
+*/
+
+func (k *KVDB) Changes(command string) []Feed.Change {
+	x, ok := k.parser(command)
+	if !ok {
+		return nil
+	}
+	var ops []TxnOp
+	switch x.opType {
+	case write, remove:
+		ops = []TxnOp{x.single()}
+	case cas, txn:
+		_, ops = k.branch(x.txn)
+	}
+	var res []Feed.Change
+	written := map[string]undoRecord{} // 事务中已经写入或者删除过的key的当前状态
+	for _, v := range ops {
+		cur, has := written[v.Key]
+		if !has {
+			cur.val, _, cur.existed = k.data.Get(v.Key)
+		}
+		switch {
+		case v.Type == "write":
+			res = append(res, Feed.Change{Type: Feed.Put, Key: v.Key, Value: v.Value, Old: cur.val, HasOld: cur.existed, Rev: k.rev + 1})
+			written[v.Key] = undoRecord{val: v.Value, existed: true}
+		case v.Type == "delete" && cur.existed:
+			res = append(res, Feed.Change{Type: Feed.Delete, Key: v.Key, Old: cur.val, HasOld: true, Rev: k.rev + 1})
+			written[v.Key] = undoRecord{}
+		}
+	}
+	return res
+}
+
+func (k *KVDB) WatchFilter(command string) (Feed.Filter, bool) {
+	res := strings.Split(command, "'")
+	switch {
+	case len(res) == 3 && res[0] == "watch" && res[1] == "write":
+		return Feed.Filter{Key: res[2]}, true
+	case len(res) == 3 && res[0] == "watch" && res[1] == "prefix":
+		return Feed.Filter{Key: res[2], Prefix: true}, true
+	case len(res) == 4 && res[0] == "watch" && res[1] == "range" && res[2] < res[3]:
+		return Feed.Filter{Key: res[2], End: res[3]}, true
+	}
+	return Feed.Filter{}, false
+}
+
 func (k *KVDB) parser(order string) (op, bool) {
+	if strings.HasPrefix(order, "txn'") {
+		t := &Txn{}
+		if err := json.Unmarshal([]byte(order[len("txn'"):]), t); err != nil || !t.valid() {
+			return op{}, false
+		}
+		return op{opType: txn, txn: t}, true
+	}
 	res := strings.Split(order, "'")
-	if len(res) == 2 && res[0] == "read" {
-		return op{opType: read, data: kvData{key: res[1]}}, true
-	} else if len(res) == 3 && res[0] == "write" {
+	switch {
+	case len(res) == 2 && res[0] == "read":
+		return op{opType: read, data: kvData{key: res[1]}, rev: -1}, true
+	case len(res) == 3 && res[0] == "read":
+		x := op{opType: read, data: kvData{key: res[1]}}
+		return x, parseRevision(res[2], &x.rev)
+	case len(res) == 1 && res[0] == "revision":
+		return op{opType: revisionOf}, true
+	case len(res) == 2 && res[0] == "compact":
+		x := op{opType: compact}
+		return x, parseRevision(res[1], &x.rev)
+	case len(res) == 3 && res[0] == "write":
 		return op{opType: write, data: kvData{key: res[1], val: res[2]}}, true
-	} else if len(res) == 3 && res[0] == "watch" && res[1] == "write" {
+	case len(res) == 3 && res[0] == "watch" && res[1] == "write":
 		return op{opType: watch, data: kvData{key: res[1] + res[2]}}, true
+	case len(res) == 2 && res[0] == "delete":
+		return op{opType: remove, data: kvData{key: res[1]}}, true
+	case len(res) == 2 && res[0] == "exists":
+		return op{opType: exists, data: kvData{key: res[1]}}, true
+	case len(res) >= 2 && len(res) <= 4 && res[0] == "list":
+		x := op{opType: list, data: kvData{key: res[1]}, limit: defaultLimit}
+		if len(res) == 4 {
+			x.data.val = res[3]
+		}
+		return x, len(res) == 2 || parseLimit(res[2], &x.limit)
+	case len(res) >= 3 && len(res) <= 4 && res[0] == "scan":
+		x := op{opType: scan, data: kvData{key: res[1]}, end: res[2], limit: defaultLimit}
+		return x, len(res) == 3 || parseLimit(res[3], &x.limit)
+	case len(res) == 1 && res[0] == "count":
+		return op{opType: count}, true
+	case len(res) == 2 && res[0] == "count":
+		return op{opType: count, data: kvData{key: res[1]}}, true
+	case len(res) == 2 && res[0] == "version":
+		return op{opType: versionOf, data: kvData{key: res[1]}}, true
+	case len(res) == 4 && res[0] == "cas":
+		return op{opType: cas, data: kvData{key: res[1], val: res[3]}, txn: &Txn{
+			If:   []Compare{{Key: res[1], Target: "value", Result: "=", Value: res[2]}},
+			Then: []TxnOp{{Type: "write", Key: res[1], Value: res[3]}},
+		}}, true
 	}
 	return op{}, false
 }
 
+func parseLimit(s string, limit *int) bool {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 || n > maxLimit {
+		return false
+	}
+	*limit = n
+	return true
+}
+
+func parseRevision(s string, rev *int64) bool {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return false
+	}
+	*rev = n
+	return true
+}
+
 func (k *KVDB) ChangeProcessDelay(delay int, random bool) {
 	if !random {
 		k.delay = time.Duration(delay) * time.Millisecond
@@ -101,11 +653,84 @@ func (k *KVDB) ChangeProcessDelay(delay int, random bool) {
 }
 
 func (k *KVDB) ToString() string {
-	u := fmt.Sprintf("kvdb: %d", len(k.data))
-	for i, v := range k.data {
-		u += fmt.Sprintf("\nk: %s v: %s", i, v)
-	}
+	u := fmt.Sprintf("kvdb: %d", k.data.Len())
+	k.data.Ascend("", func(key string, val string) bool {
+		u += fmt.Sprintf("\nk: %s v: %s", key, val)
+		return true
+	})
 	return u
 }
 
+/*
+快照只包括数据，快照总是在已提交的日志处生成，之后的日志才可能被撤销，所以不需要撤销记录。
+快照包括当前的数据、版本号和没有压缩的历史；也能恢复之前的两种快照：key到值和版本的JSON对象，以及没有版本时
+key到值的JSON对象（这时每个key的版本是1），它们的数据都在版本0。
+*/
+
+const snapshotFormat = 2
+
+type snapshotEntry struct {
+	Value   string `json:"value"`
+	Version int    `json:"version"`
+}
+
+type kvSnapshot struct {
+	Format    int                      `json:"format"`
+	Rev       int64                    `json:"rev"`
+	Compacted int64                    `json:"compacted"`
+	Data      map[string]snapshotEntry `json:"data"`
+	History   map[string][]kvRevision  `json:"history"`
+}
+
+func (k *KVDB) Fork() Crown.App {
+	return &KVDB{}
+}
+
+func (k *KVDB) Snapshot() (string, error) {
+	s := kvSnapshot{Format: snapshotFormat, Rev: k.rev, Compacted: k.compacted,
+		Data: make(map[string]snapshotEntry, k.data.Len()), History: k.history}
+	k.data.Ascend("", func(key string, val string) bool {
+		_, version, _ := k.data.Get(key)
+		s.Data[key] = snapshotEntry{Value: val, Version: version}
+		return true
+	})
+	res, err := json.Marshal(s)
+	return string(res), err
+}
+
+func (k *KVDB) Restore(snapshot string) error {
+	s := kvSnapshot{}
+	if err := json.Unmarshal([]byte(snapshot), &s); err != nil || s.Format != snapshotFormat {
+		if s, err = oldSnapshot(snapshot); err != nil {
+			return err
+		}
+	}
+	if s.History == nil {
+		s.History = map[string][]kvRevision{}
+	}
+	k.data, k.undo = newSkipList(), nil
+	k.rev, k.compacted, k.history = s.Rev, s.Compacted, s.History
+	for key, v := range s.Data {
+		k.data.Set(key, v.Value, v.Version)
+	}
+	return nil
+}
+
+func oldSnapshot(snapshot string) (kvSnapshot, error) {
+	s := kvSnapshot{Data: map[string]snapshotEntry{}, History: map[string][]kvRevision{}}
+	if err := json.Unmarshal([]byte(snapshot), &s.Data); err != nil {
+		old := map[string]string{}
+		if json.Unmarshal([]byte(snapshot), &old) != nil {
+			return s, err
+		}
+		for key, val := range old {
+			s.Data[key] = snapshotEntry{Value: val, Version: 1}
+		}
+	}
+	for key, v := range s.Data {
+		s.History[key] = []kvRevision{{Rev: 0, Value: v.Value}}
+	}
+	return s, nil
+}
+
 // 可以从日志中恢复
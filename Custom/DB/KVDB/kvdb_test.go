@@ -1,7 +1,12 @@
 package KVDB
 
 import (
+	"RaftDB/Kernel/Pipe/Something"
 	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -12,3 +17,273 @@ func TestKvdb(t *testing.T) {
 	fmt.Println(x.Process("write hello world"))
 	fmt.Println(x.Process("read hello"))
 }
+
+func TestKvdbUndo(t *testing.T) {
+	var x KVDB
+	x.Init()
+	x.Process("write'a'1")
+	x.Process("write'a'2")
+	x.Process("write'b'3")
+	for _, v := range []string{"!write'b'3", "!read'a", "!write'a'2"} {
+		if _, _, err := x.UndoProcess(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res, _, _, _ := x.Process("read'a"); res != "1" {
+		t.Fatalf("a should be 1, got %s", res)
+	}
+	if res, _, _, _ := x.Process("read'b"); res != "(empty)" {
+		t.Fatalf("b should be empty, got %s", res)
+	}
+	if _, _, err := x.UndoProcess("!write'b'3"); err == nil {
+		t.Fatal("undo a write that never happened")
+	}
+}
+
+func TestKvdbSnapshot(t *testing.T) {
+	var x KVDB
+	x.Init()
+	x.Process("write'a'1")
+	x.Process("write'b'2")
+	snapshot, err := x.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	y := x.Fork().(*KVDB)
+	y.Init()
+	if err := y.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	x.Process("write'a'3")
+	if res, _, _, _ := y.Process("read'a"); res != "1" {
+		t.Fatalf("a should be 1 in the restored db, got %s", res)
+	}
+	if _, _, err := y.UndoProcess("!write'b'2"); err == nil {
+		t.Fatal("undo a write before the snapshot")
+	}
+	if err := y.Restore("broken"); err == nil {
+		t.Fatal("restore a broken snapshot")
+	}
+}
+
+func TestKvdbScan(t *testing.T) {
+	var x KVDB
+	x.Init()
+	for _, v := range []string{"write'b'2", "write'a'1", "write'ab'3", "write'c'4", "write'abc'5"} {
+		x.Process(v)
+	}
+	for _, c := range []struct{ in, want string }{
+		{"exists'a", "true"},
+		{"exists'z", "false"},
+		{"count", "5"},
+		{"count'a", "3"},
+		{"list'a", `{"keys":["a","ab","abc"],"next":""}`},
+		{"list'a'2", `{"keys":["a","ab"],"next":"abc"}`},
+		{"list'a'2'abc", `{"keys":["abc"],"next":""}`},
+		{"list'", `{"keys":["a","ab","abc","b","c"],"next":""}`},
+		{"scan'ab'c", `{"items":[{"key":"ab","value":"3"},{"key":"abc","value":"5"},{"key":"b","value":"2"}],"next":""}`},
+		{"scan'a''2", `{"items":[{"key":"a","value":"1"},{"key":"ab","value":"3"}],"next":"abc"}`},
+		{"list'a'0", "db: illegal operation"},
+		{"scan'a'b'x", "db: illegal operation"},
+	} {
+		if res, _, _, _ := x.Process(c.in); res != c.want {
+			t.Fatalf("%s: %s, want %s", c.in, res, c.want)
+		}
+	}
+	if res, agree, _, _ := x.Process("delete'ab"); !agree || res != "delete successfully: ab" {
+		t.Fatalf("delete: %s", res)
+	}
+	if res, agree, _, _ := x.Process("delete'ab"); !agree || res != "delete: ab does not exist" {
+		t.Fatalf("delete twice: %s", res)
+	}
+	for _, v := range []string{"!delete'ab", "!delete'ab"} {
+		if _, _, err := x.UndoProcess(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res, _, _, _ := x.Process("read'ab"); res != "3" {
+		t.Fatalf("ab should be 3 after undoing the delete, got %s", res)
+	}
+}
+
+func TestKvdbTxn(t *testing.T) {
+	var x KVDB
+	x.Init()
+	x.Process("write'a'1")
+	x.Process("write'a'2")
+	for _, c := range []struct{ in, want string }{
+		{"version'a", "2"},
+		{"version'b", "0"},
+		{"cas'a'1'3", "cas failed: a is 2"},
+		{"cas'b'1'3", "cas failed: b does not exist"},
+		{"cas'a'2'3", "cas successfully: a, 3"},
+		{`txn'{"if":[{"key":"a","target":"version","result":"=","version":3},{"key":"b","target":"version","result":"=","version":0}],` +
+			`"then":[{"type":"write","key":"b","value":"x"},{"type":"delete","key":"a"},{"type":"read","key":"b"}],"else":[{"type":"read","key":"a"}]}`,
+			`{"succeeded":true,"results":["write successfully: b, x","delete successfully: a","x"]}`},
+		{`txn'{"if":[{"key":"a","target":"value","result":"!=","value":"3"}],"else":[{"type":"read","key":"b"}]}`,
+			`{"succeeded":false,"results":["x"]}`},
+		{"version'a", "0"},
+		{`txn'{"if":[{"key":"a","target":"size","result":"=","value":"3"}]}`, "db: illegal operation"},
+		{`txn'{"then":[{"type":"count","key":"a"}]}`, "db: illegal operation"},
+		{"txn'broken", "db: illegal operation"},
+	} {
+		if res, _, _, _ := x.Process(c.in); res != c.want {
+			t.Fatalf("%s: %s, want %s", c.in, res, c.want)
+		}
+	}
+	in := `txn'{"then":[{"type":"write","key":"c","value":"1"},{"type":"write","key":"c","value":"2"},{"type":"delete","key":"b"}]}`
+	var got []string
+	for _, c := range x.Changes(in) {
+		got = append(got, c.Type+" "+c.Key+" "+c.Old+">"+c.Value)
+	}
+	if strings.Join(got, ",") != "put c >1,put c 1>2,delete b x>" {
+		t.Fatalf("changes %v", got)
+	}
+	x.Process(in)
+	if _, _, err := x.UndoProcess("!cas'a'2'3"); err == nil {
+		t.Fatal("undo a cas before the latest transaction")
+	}
+	undo := []string{
+		"!" + in,
+		`!txn'{"if":[{"key":"a","target":"value","result":"!=","value":"3"}],"else":[{"type":"read","key":"b"}]}`,
+		"!read'a",
+		`!txn'{"if":[{"key":"a","target":"version","result":"=","version":3},{"key":"b","target":"version","result":"=","version":0}],` +
+			`"then":[{"type":"write","key":"b","value":"x"},{"type":"delete","key":"a"},{"type":"read","key":"b"}],"else":[{"type":"read","key":"a"}]}`,
+	}
+	for _, v := range undo {
+		if _, _, err := x.UndoProcess(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct{ in, want string }{{"read'a", "3"}, {"version'a", "3"}, {"exists'b", "false"}} {
+		if res, _, _, _ := x.Process(c.in); res != c.want {
+			t.Fatalf("after undo %s: %s, want %s", c.in, res, c.want)
+		}
+	}
+	snapshot, _ := x.Snapshot()
+	y := x.Fork().(*KVDB)
+	y.Init()
+	if err := y.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if res, _, _, _ := y.Process("version'a"); res != "3" {
+		t.Fatalf("version after restore: %s", res)
+	}
+	if err := y.Restore(`{"a":"1"}`); err != nil {
+		t.Fatal(err)
+	}
+	if res, _, _, _ := y.Process("version'a"); res != "1" {
+		t.Fatalf("version after restoring an old snapshot: %s", res)
+	}
+}
+
+func TestKvdbRevision(t *testing.T) {
+	var x KVDB
+	x.Init()
+	for _, v := range []string{"write'a'1", "write'b'1", "delete'z", "write'a'2", "delete'b", "cas'a'9'3",
+		`txn'{"then":[{"type":"write","key":"a","value":"3"},{"type":"write","key":"a","value":"4"},{"type":"write","key":"b","value":"5"}]}`} {
+		x.Process(v)
+	}
+	check := func(x *KVDB, cases ...string) {
+		for i := 0; i < len(cases); i += 2 {
+			if res, _, _, _ := x.Process(cases[i]); res != cases[i+1] {
+				t.Fatalf("%s: %s, want %s", cases[i], res, cases[i+1])
+			}
+		}
+	}
+	check(&x, "revision", `{"revision":5,"compacted":0}`,
+		"read'a'0", "(empty)", "read'a'1", "1", "read'b'2", "1", "read'a'3", "2", "read'b'4", "(empty)",
+		"read'a'5", "4", "read'b'5", "5", "read'a'6", "db: revision 6 is in the future, the current revision is 5")
+	if c := x.Changes("write'c'1"); len(c) != 1 || c[0].Rev != 6 {
+		t.Fatalf("changes %+v", c)
+	}
+	check(&x, "compact'3", "compacted to revision 3",
+		"read'a'2", "db: revision 2 is compacted, the oldest revision is 3", "read'a'3", "2", "read'b'3", "1", "read'b'4", "(empty)", "read'b'5", "5")
+	if len(x.history["a"]) != 3 || len(x.history["b"]) != 3 {
+		t.Fatalf("history after compaction %v", x.history)
+	}
+	snapshot, _ := x.Snapshot()
+	y := x.Fork().(*KVDB)
+	y.Init()
+	if err := y.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	check(y, "revision", `{"revision":5,"compacted":3}`, "read'a'3", "2", "read'a'2", "db: revision 2 is compacted, the oldest revision is 3")
+	for _, v := range []string{"!compact'3", "!" + `txn'{"then":[{"type":"write","key":"a","value":"3"},{"type":"write","key":"a","value":"4"},{"type":"write","key":"b","value":"5"}]}`,
+		"!cas'a'9'3", "!delete'b"} {
+		if _, _, err := x.UndoProcess(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(&x, "revision", `{"revision":3,"compacted":0}`, "read'a'1", "1", "read'b'3", "1", "read'a'3", "2",
+		"write'b'6", "write successfully: b, 6", "read'b'4", "6", "read'b'3", "1")
+	if err := y.Restore(`{"a":"1"}`); err != nil {
+		t.Fatal(err)
+	}
+	check(y, "revision", `{"revision":0,"compacted":0}`, "read'a'0", "1")
+}
+
+/*
+结果代码不看回复的内容：值恰好是"(empty)"的key存在，不存在的key、被压缩的版本和非法命令各有自己的代码。
+*/
+
+func TestKvdbResult(t *testing.T) {
+	var x KVDB
+	x.Init()
+	for _, c := range []struct {
+		in     string
+		result Something.Result
+	}{
+		{"write'a'(empty)", Something.Done},
+		{"read'a", Something.Done},
+		{"read'z", Something.Missing},
+		{"read'a'0", Something.Missing},
+		{"read'a'1", Something.Done},
+		{"compact'1", Something.Done},
+		{"read'a'0", Something.Expired},
+		{"read'a'9", Something.Done}, // 还没有到的版本被拒绝，没有更具体的结果
+		{"read", Something.Illegal},
+	} {
+		if _, result, _, _, err := x.ProcessResult(c.in); err != nil || result != c.result {
+			t.Fatalf("%s: %v, %v, want %v", c.in, result, err, c.result)
+		}
+	}
+}
+
+func TestSkipList(t *testing.T) {
+	s, want := newSkipList(), map[string]string{}
+	r := rand.New(rand.NewSource(7))
+	for i := 0; i < 5000; i++ {
+		key := strconv.Itoa(r.Intn(500))
+		if r.Intn(3) == 0 {
+			old, _, existed := s.Delete(key)
+			if v, has := want[key]; has != existed || v != old {
+				t.Fatalf("delete %s: %s %v, want %s %v", key, old, existed, v, has)
+			}
+			delete(want, key)
+		} else {
+			val := strconv.Itoa(i)
+			old, _, existed := s.Set(key, val, i)
+			if v, has := want[key]; has != existed || v != old {
+				t.Fatalf("set %s: %s %v, want %s %v", key, old, existed, v, has)
+			}
+			want[key] = val
+		}
+	}
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var got []string
+	s.Ascend("", func(key string, val string) bool {
+		if want[key] != val {
+			t.Fatalf("%s = %s, want %s", key, val, want[key])
+		}
+		got = append(got, key)
+		return true
+	})
+	if s.Len() != len(keys) || strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("%d keys in order %v, want %d", s.Len(), got, len(keys))
+	}
+}
@@ -0,0 +1,130 @@
+package KVDB
+
+import "math/rand"
+
+/*
+按key有序的跳表，用于前缀列举和范围扫描。只在Crown的协程中访问，不需要加锁。
+*/
+
+const (
+	maxLevel = 32
+	branch   = 4 // 每一层大约有下一层1/branch的节点
+)
+
+type node struct {
+	key     string
+	val     string
+	version int
+	next    []*node
+}
+
+type skipList struct {
+	head  *node
+	level int
+	size  int
+	rand  *rand.Rand
+}
+
+func newSkipList() *skipList {
+	return &skipList{head: &node{next: make([]*node, maxLevel)}, level: 1, rand: rand.New(rand.NewSource(1))}
+}
+
+/*
+每一层中最后一个key小于key的节点。
+*/
+
+func (s *skipList) path(key string) [maxLevel]*node {
+	var res [maxLevel]*node
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		res[i] = x
+	}
+	return res
+}
+
+/*
+第一个不小于key的节点。
+*/
+
+func (s *skipList) seek(key string) *node {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+	}
+	return x.next[0]
+}
+
+/*
+key的值和版本，key不存在时第三个返回值为假。
+*/
+
+func (s *skipList) Get(key string) (string, int, bool) {
+	if x := s.seek(key); x != nil && x.key == key {
+		return x.val, x.version, true
+	}
+	return "", 0, false
+}
+
+/*
+写入key的值和版本，返回之前的值和版本。
+*/
+
+func (s *skipList) Set(key string, val string, version int) (string, int, bool) {
+	path := s.path(key)
+	if x := path[0].next[0]; x != nil && x.key == key {
+		old, oldVersion := x.val, x.version
+		x.val, x.version = val, version
+		return old, oldVersion, true
+	}
+	level := 1
+	for level < maxLevel && s.rand.Intn(branch) == 0 {
+		level++
+	}
+	for ; s.level < level; s.level++ {
+		path[s.level] = s.head
+	}
+	x := &node{key: key, val: val, version: version, next: make([]*node, level)}
+	for i := 0; i < level; i++ {
+		x.next[i], path[i].next[i] = path[i].next[i], x
+	}
+	s.size++
+	return "", 0, false
+}
+
+/*
+删除key，返回之前的值和版本，key不存在时第三个返回值为假。
+*/
+
+func (s *skipList) Delete(key string) (string, int, bool) {
+	path := s.path(key)
+	x := path[0].next[0]
+	if x == nil || x.key != key {
+		return "", 0, false
+	}
+	for i := 0; i < len(x.next); i++ {
+		path[i].next[i] = x.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.size--
+	return x.val, x.version, true
+}
+
+func (s *skipList) Len() int {
+	return s.size
+}
+
+/*
+按顺序访问不小于start的key，f返回假时停止。
+*/
+
+func (s *skipList) Ascend(start string, f func(key string, val string) bool) {
+	for x := s.seek(start); x != nil && f(x.key, x.val); x = x.next[0] {
+	}
+}
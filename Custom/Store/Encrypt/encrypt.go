@@ -0,0 +1,289 @@
+package Encrypt
+
+import (
+	"RaftDB/Kernel/Bottom"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/*
+静态加密的存储介质，包装任意一个Bottom.Medium，用AES-GCM加密写入的内容，读取时解密。
+Append追加的每一块内容单独加密成一行"@密钥id:base64(nonce+密文)"，所以追加不需要读出整个文件。
+每一块的附加认证数据是文件名（不含目录）和这一块在文件中的序号，块被移到别的文件、调换顺序或者删掉中间的块时无法解密；
+整个目录可以移动，但文件不能改名，文件末尾被截掉的块无法发现。
+默认不以@开头的行是错误。迁移没有加密过的旧文件时打开AllowPlaintext（或者设置RAFTDB_ALLOW_PLAINTEXT=1），
+这时明文行原样返回，之后追加的内容被加密，用Reencrypt重新加密之后整个文件都是密文，然后关闭这个选项。
+
+密钥写成"id:base64(16、24或32字节)"，多个密钥用换行或者逗号分隔，最后一个是当前密钥，新写入的内容都用它加密，
+其余的密钥只用来解密旧内容。轮换密钥时在最后加入新密钥，停止节点后用Reencrypt重新加密全部文件，之后删除旧密钥。
+*/
+
+const (
+	KeyFileEnv = "RAFTDB_KEY_FILE"        // 密钥文件路径的环境变量
+	KeysEnv    = "RAFTDB_KEYS"            // 直接给出密钥的环境变量，KeyFile和RAFTDB_KEY_FILE都没有设置时使用
+	PlainEnv   = "RAFTDB_ALLOW_PLAINTEXT" // 为1时FromEnv打开AllowPlaintext，只在迁移明文文件时使用
+	prefix     = "@"
+)
+
+type EncryptedMedium struct {
+	Inner          Bottom.Medium // 被包装的存储介质，必须在交给Gogo之前设置
+	KeyFile        string        // 密钥文件，为空时使用环境变量
+	AllowPlaintext bool          // 读取时接受没有加密的行，只在迁移明文文件时打开
+	keys           map[string]cipher.AEAD
+	current        string
+	blocks         map[string]int // 路径 -> 文件中已有的加密块数，追加的块用它作为序号
+	m              sync.Mutex
+}
+
+/*
+设置了密钥环境变量时用加密介质包装inner，否则原样返回inner。
+*/
+
+func FromEnv(inner Bottom.Medium) Bottom.Medium {
+	if os.Getenv(KeyFileEnv) == "" && os.Getenv(KeysEnv) == "" {
+		return inner
+	}
+	return &EncryptedMedium{Inner: inner, AllowPlaintext: os.Getenv(PlainEnv) == "1"}
+}
+
+/*
+加载密钥之后初始化内部介质，每次Init都重新加载密钥。
+*/
+
+func (e *EncryptedMedium) Init(mediumParam interface{}) error {
+	if e.Inner == nil {
+		return errors.New("Encrypt: Init need an inner medium")
+	}
+	keys, err := e.loadKeys()
+	if err != nil {
+		return err
+	}
+	if err := e.parseKeys(keys); err != nil {
+		return err
+	}
+	e.blocks = map[string]int{}
+	return e.Inner.Init(mediumParam)
+}
+
+func (e *EncryptedMedium) loadKeys() (string, error) {
+	path := e.KeyFile
+	if path == "" {
+		path = os.Getenv(KeyFileEnv)
+	}
+	if path != "" {
+		res, err := os.ReadFile(path)
+		return string(res), err
+	}
+	if keys := os.Getenv(KeysEnv); keys != "" {
+		return keys, nil
+	}
+	return "", fmt.Errorf("Encrypt: no key, set KeyFile, %s or %s", KeyFileEnv, KeysEnv)
+}
+
+func (e *EncryptedMedium) parseKeys(keys string) error {
+	e.keys, e.current = map[string]cipher.AEAD{}, ""
+	for _, v := range strings.FieldsFunc(keys, func(r rune) bool { return r == '\n' || r == '\r' || r == ',' }) {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		tmp := strings.SplitN(v, ":", 2)
+		if len(tmp) != 2 || tmp[0] == "" {
+			return errors.New("Encrypt: a key should be id:base64")
+		}
+		raw, err := base64.StdEncoding.DecodeString(tmp[1])
+		if err != nil {
+			return fmt.Errorf("Encrypt: key %s: %v", tmp[0], err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return fmt.Errorf("Encrypt: key %s: %v", tmp[0], err)
+		}
+		if e.keys[tmp[0]], err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+		e.current = tmp[0]
+	}
+	if e.current == "" {
+		return errors.New("Encrypt: no key")
+	}
+	return nil
+}
+
+/*
+生成一个新的AES-256密钥，返回可以直接写入密钥文件的一行。
+*/
+
+func NewKey(id string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(raw), nil
+}
+
+/*
+一块的附加认证数据：文件名和块的序号。
+*/
+
+func additional(path string, index int) []byte {
+	return []byte(fmt.Sprintf("%s#%d", filepath.Base(path), index))
+}
+
+/*
+用当前密钥加密文件path中序号为index的一块内容，空内容不加密。
+*/
+
+func (e *EncryptedMedium) seal(path string, index int, content string) (string, error) {
+	if content == "" {
+		return "", nil
+	}
+	aead := e.keys[e.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	// nonce随机，所以同样的内容每次密文不同
+	res := aead.Seal(nonce, nonce, []byte(content), additional(path, index))
+	return prefix + e.current + ":" + base64.StdEncoding.EncodeToString(res) + "\n", nil
+}
+
+func (e *EncryptedMedium) open(path string, index int, line string) (string, error) {
+	tmp := strings.SplitN(strings.TrimPrefix(line, prefix), ":", 2)
+	if len(tmp) != 2 {
+		return "", errors.New("Encrypt: broken block")
+	}
+	aead, has := e.keys[tmp[0]]
+	if !has {
+		return "", fmt.Errorf("Encrypt: unknown key %s", tmp[0])
+	}
+	raw, err := base64.StdEncoding.DecodeString(tmp[1])
+	if err != nil {
+		return "", err
+	}
+	if len(raw) < aead.NonceSize() {
+		return "", errors.New("Encrypt: broken block")
+	}
+	res, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], additional(path, index))
+	if err != nil {
+		return "", fmt.Errorf("Encrypt: block %d with key %s: %v", index, tmp[0], err)
+	}
+	return string(res), nil
+}
+
+/*
+逐行解密，以@开头的行是加密的块，按出现的顺序编号。其余的行是明文，只有打开AllowPlaintext时原样返回，否则报错。
+任何一块无法解密都报错，不会返回部分内容。
+*/
+
+func (e *EncryptedMedium) Read(path string, content *string) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	res, err := e.read(path)
+	if err != nil {
+		return err
+	}
+	*content = res
+	return nil
+}
+
+func (e *EncryptedMedium) read(path string) (string, error) {
+	var str string
+	if err := e.Inner.Read(path, &str); err != nil {
+		return "", err
+	}
+	var res strings.Builder
+	index := 0
+	for _, line := range strings.SplitAfter(str, "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, prefix) {
+			if !e.AllowPlaintext {
+				return "", fmt.Errorf("%s: Encrypt: plaintext after %d blocks, set AllowPlaintext or %s=1 to migrate it",
+					path, index, PlainEnv)
+			}
+			res.WriteString(line)
+			continue
+		}
+		v, err := e.open(path, index, strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", path, err)
+		}
+		res.WriteString(v)
+		index++
+	}
+	e.blocks[path] = index
+	return res.String(), nil
+}
+
+func (e *EncryptedMedium) Write(path string, content string) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	res, err := e.seal(path, 0, content)
+	if err != nil {
+		return err
+	}
+	if err := e.Inner.Write(path, res); err != nil {
+		delete(e.blocks, path)
+		return err
+	}
+	e.blocks[path] = 0
+	if res != "" {
+		e.blocks[path] = 1
+	}
+	return nil
+}
+
+/*
+追加的块的序号是文件中已有的块数，第一次追加一个文件时读出它数一遍。
+*/
+
+func (e *EncryptedMedium) Append(path string, content string) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	index, has := e.blocks[path]
+	if !has {
+		var str string
+		if err := e.Inner.Read(path, &str); err == nil {
+			for _, line := range strings.SplitAfter(str, "\n") {
+				if strings.HasPrefix(line, prefix) {
+					index++
+				}
+			}
+		}
+	}
+	res, err := e.seal(path, index, content)
+	if err != nil {
+		return err
+	}
+	if err := e.Inner.Append(path, res); err != nil {
+		delete(e.blocks, path)
+		return err
+	}
+	if res != "" {
+		index++
+	}
+	e.blocks[path] = index
+	return nil
+}
+
+/*
+用当前密钥重新加密一个文件，打开AllowPlaintext时明文文件也会被加密。文件先整体解密，所以任何一块无法解密时不会改写文件。
+*/
+
+func (e *EncryptedMedium) Reencrypt(path string) error {
+	var str string
+	if err := e.Read(path, &str); err != nil {
+		return err
+	}
+	return e.Write(path, str)
+}
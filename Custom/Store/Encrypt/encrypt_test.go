@@ -0,0 +1,161 @@
+package Encrypt
+
+import (
+	"RaftDB/Custom/Store/Memory"
+	"RaftDB/Kernel/Bottom"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newKey(t *testing.T, id string) string {
+	key, err := NewKey(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+/*
+用环境变量中的密钥包装inner。
+*/
+
+func newMedium(t *testing.T, inner *Memory.MemoryMedium, keys ...string) *EncryptedMedium {
+	t.Setenv(KeyFileEnv, "")
+	t.Setenv(KeysEnv, strings.Join(keys, ","))
+	e, ok := FromEnv(inner).(*EncryptedMedium)
+	if !ok {
+		t.Fatal("no encrypted medium with keys in env")
+	}
+	if err := e.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func read(t *testing.T, m Bottom.Medium, path string) string {
+	var res string
+	if err := m.Read(path, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+/*
+写入和追加的内容在内部介质中是密文，读取时还原；没有加密过的旧内容只有打开AllowPlaintext时才能读取。
+*/
+
+func TestReadWriteAppend(t *testing.T) {
+	inner := &Memory.MemoryMedium{}
+	_ = inner.Init(nil)
+	_ = inner.Write("log", "1$0^plain\n")
+	e := newMedium(t, inner, newKey(t, "k1"))
+	if err := e.Read("log", new(string)); err == nil {
+		t.Fatal("plaintext is read without AllowPlaintext")
+	}
+	t.Setenv(PlainEnv, "1")
+	e = newMedium(t, inner, strings.Split(os.Getenv(KeysEnv), ",")...)
+	if !e.AllowPlaintext {
+		t.Fatalf("%s does not allow plaintext", PlainEnv)
+	}
+	if err := e.Append("log", "1$1^secret\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Append("log", "1$2^secret\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Write("conf", `{"id":0}`); err != nil {
+		t.Fatal(err)
+	}
+	if raw := read(t, inner, "log") + read(t, inner, "conf"); strings.Contains(raw, "secret") || strings.Contains(raw, "id") {
+		t.Fatalf("plain text in the inner medium: %q", raw)
+	}
+	if v := read(t, e, "log"); v != "1$0^plain\n1$1^secret\n1$2^secret\n" {
+		t.Fatalf("log is %q", v)
+	}
+	if v := read(t, e, "conf"); v != `{"id":0}` {
+		t.Fatalf("conf is %q", v)
+	}
+	if err := e.Write("empty", ""); err != nil || read(t, e, "empty") != "" {
+		t.Fatalf("empty file: %v", err)
+	}
+	raw := read(t, inner, "conf")
+	_ = inner.Write("conf", raw[:len(raw)-5]+"AAAA\n")
+	var v string
+	if err := e.Read("conf", &v); err == nil {
+		t.Fatalf("tampered conf decrypts to %q", v)
+	}
+}
+
+/*
+加入新密钥后旧内容仍然可读，重新加密之后只需要新密钥。
+*/
+
+func TestRotate(t *testing.T) {
+	inner := &Memory.MemoryMedium{}
+	_ = inner.Init(nil)
+	k1, k2 := newKey(t, "k1"), newKey(t, "k2")
+	old := newMedium(t, inner, k1)
+	_ = old.Write("log", "1$0^a\n")
+	_ = old.Append("log", "1$1^b\n")
+	e := newMedium(t, inner, k1, k2)
+	if v := read(t, e, "log"); v != "1$0^a\n1$1^b\n" {
+		t.Fatalf("log with old key is %q", v)
+	}
+	if err := e.Reencrypt("log"); err != nil {
+		t.Fatal(err)
+	}
+	if raw := read(t, inner, "log"); strings.Contains(raw, "@k1:") || !strings.HasPrefix(raw, "@k2:") {
+		t.Fatalf("log is still encrypted by k1: %q", raw)
+	}
+	e = newMedium(t, inner, k2)
+	if v := read(t, e, "log"); v != "1$0^a\n1$1^b\n" {
+		t.Fatalf("log with new key is %q", v)
+	}
+	if err := old.Read("log", new(string)); err == nil {
+		t.Fatal("read with the old key after rotation")
+	}
+	t.Setenv(KeysEnv, "k3:short")
+	if err := (&EncryptedMedium{Inner: inner}).Init(nil); err == nil {
+		t.Fatal("init with an illegal key")
+	}
+}
+
+/*
+块和文件名、块的序号绑定：调换块的顺序、删掉中间的块、把块或者文件换到别的文件名下都无法解密；第一次追加时从已有的块数开始编号。
+*/
+
+func TestBlockBinding(t *testing.T) {
+	inner := &Memory.MemoryMedium{}
+	_ = inner.Init(nil)
+	key := newKey(t, "k1")
+	e := newMedium(t, inner, key)
+	_ = e.Write("log.1", "a\n")
+	for _, v := range []string{"b\n", "c\n"} {
+		if err := e.Append("log.1", v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = e.Write("log.2", "d\n")
+	e = newMedium(t, inner, key) // 新的介质不知道已有的块数
+	_ = e.Append("log.2", "e\n")
+	if v := read(t, e, "log.2"); v != "d\ne\n" {
+		t.Fatalf("log.2 is %q", v)
+	}
+	blocks := strings.SplitAfter(read(t, inner, "log.1"), "\n")
+	for name, raw := range map[string]string{
+		"swapped":  blocks[1] + blocks[0] + blocks[2],
+		"dropped":  blocks[0] + blocks[2],
+		"moved in": blocks[0] + blocks[1] + blocks[2] + strings.SplitAfter(read(t, inner, "log.2"), "\n")[1],
+	} {
+		_ = inner.Write("log.1", raw)
+		var v string
+		if err := e.Read("log.1", &v); err == nil {
+			t.Fatalf("%s blocks decrypt to %q", name, v)
+		}
+	}
+	_ = inner.Write("log.3", blocks[0]+blocks[1]+blocks[2])
+	if err := e.Read("log.3", new(string)); err == nil {
+		t.Fatal("a renamed file decrypts")
+	}
+}
@@ -0,0 +1,74 @@
+package Memory
+
+import (
+	"errors"
+	"sync"
+)
+
+/*
+type Medium interface {
+	Init(mediumParam interface{}) error
+	Read(path string, content *string) error
+	Write(path string, content string) error
+	Append(path string, content string) error
+}
+*/
+
+/*
+内存存储介质，用map模拟文件系统，用于不依赖磁盘的测试。
+Init不会清空已有的内容，所以节点停止后用同一个MemoryMedium重新启动，相当于带着原来的磁盘重启。
+*/
+
+type MemoryMedium struct {
+	files map[string]string
+	m     sync.RWMutex
+}
+
+func (mm *MemoryMedium) Init(interface{}) error {
+	mm.m.Lock()
+	if mm.files == nil {
+		mm.files = map[string]string{}
+	}
+	mm.m.Unlock()
+	return nil
+}
+
+/*
+和普通文件一样，读取不存在的文件报错。
+*/
+
+func (mm *MemoryMedium) Read(path string, content *string) error {
+	mm.m.RLock()
+	defer mm.m.RUnlock()
+	v, has := mm.files[path]
+	if !has {
+		return errors.New("memory: no such file " + path)
+	}
+	*content = v
+	return nil
+}
+
+func (mm *MemoryMedium) Write(path string, content string) error {
+	mm.m.Lock()
+	if mm.files == nil {
+		mm.files = map[string]string{}
+	}
+	mm.files[path] = content
+	mm.m.Unlock()
+	return nil
+}
+
+/*
+和普通文件一样，追加写不存在的文件报错。
+*/
+
+func (mm *MemoryMedium) Append(path string, content string) error {
+	mm.m.Lock()
+	defer mm.m.Unlock()
+	v, has := mm.files[path]
+	if !has {
+		return errors.New("memory: no such file " + path)
+	}
+	mm.files[path] = v + content
+	return nil
+}
@@ -0,0 +1,235 @@
+package Bottom
+
+import (
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Meta"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+备份文件的内容：备份到的已提交key，持久化的元数据（已提交的key改为备份的key），不大于key的全部日志和可选的App快照。
+不大于key的日志已经提交，之后不会再改变，所以备份不需要停止节点。在线备份时日志逐块追加到备份文件，不会全部放进内存。
+*/
+
+type Archive struct {
+	Key      Log.Key       `json:"key"`
+	Meta     Meta.Meta     `json:"meta"`
+	Logs     []string      `json:"logs"`
+	Snapshot *Log.Snapshot `json:"snapshot,omitempty"`
+}
+
+/*
+生成App在key处快照的接口，由Crown实现，从不大于key的base开始重放日志，base为空时从头重放。App不支持快照时第二个返回值为假。
+*/
+
+type SnapshotSource interface {
+	Snapshot(logSet Log.LogSet, base *Log.Snapshot, key Log.Key) (string, bool, error)
+}
+
+var backupChunk = 1 << 20 // 在线备份时每次追加到备份文件的字节数，测试时调小
+
+func (b *Bottom) SetSnapshotSource(source SnapshotSource) {
+	b.snapshots = source
+}
+
+/*
+最近保存的App快照：启动时从快照文件加载，之后每次在线备份都会更新，没有时为空。
+*/
+
+func (b *Bottom) Snapshot() *Log.Snapshot {
+	b.store.m.Lock()
+	defer b.store.m.Unlock()
+	return b.store.snapshot
+}
+
+/*
+在线备份到path，key为-1-1时备份到当前已提交的key，key没有提交或者不在日志中时报错，返回备份到的key。
+App快照从最近保存的快照开始重放，生成之后也保存为节点的快照，下一次备份和节点重启都从它开始。
+日志通过迭代器逐条读取、逐块追加到备份文件，可以在任何协程中调用，不阻塞Raft层；只有读写文件时和写盘互斥。
+*/
+
+func (b *Bottom) Backup(path string, key Log.Key) (Log.Key, error) {
+	committed := b.logs.GetCommitted()
+	if key.Equals(Log.Key{Term: -1, Index: -1}) {
+		key = committed
+	}
+	if key.Equals(Log.Key{Term: -1, Index: -1}) || key.Greater(committed) {
+		return key, fmt.Errorf("error: %v is not committed, the committed key is %v", key, committed)
+	}
+	it := b.logs.Iterator()
+	defer it.Close()
+	it.Seek(key)
+	last, ok := it.Next()
+	if !ok || !last.K.Equals(key) {
+		return key, fmt.Errorf("error: %v is not in logs", key)
+	}
+	archive := Archive{Key: key}
+	if b.snapshots != nil {
+		base := b.Snapshot()
+		if base != nil && base.K.Greater(key) {
+			base = nil
+		}
+		content, ok, err := b.snapshots.Snapshot(b.logs, base, key)
+		if err != nil {
+			return key, err
+		}
+		if ok {
+			archive.Snapshot = &Log.Snapshot{K: key, I: last.I, V: content}
+		}
+	}
+	it.Seek(Log.Key{Term: -1, Index: -1})
+	if err := b.store.backup(path, &archive, it); err != nil {
+		return key, err
+	}
+	if archive.Snapshot != nil {
+		return key, b.store.saveSnapshot(archive.Snapshot)
+	}
+	return key, nil
+}
+
+/*
+写备份文件：先写入key、元数据和快照，再从迭代器读出不大于key的日志，攒够backupChunk字节追加一次，最后补上结尾。
+*/
+
+func (s *Store) backup(path string, archive *Archive, it Log.Iterator) error {
+	s.m.Lock()
+	err := s.getMeta(s.confPath, &archive.Meta)
+	s.m.Unlock()
+	if err != nil {
+		return err
+	}
+	archive.Meta.CommittedKeyTerm, archive.Meta.CommittedKeyIndex = archive.Key.Term, archive.Key.Index
+	key, err := json.Marshal(archive.Key)
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(archive.Meta)
+	if err != nil {
+		return err
+	}
+	var chunk strings.Builder
+	chunk.WriteString(`{"key":` + string(key) + `,"meta":` + string(meta))
+	if archive.Snapshot != nil {
+		snapshot, err := json.Marshal(archive.Snapshot)
+		if err != nil {
+			return err
+		}
+		chunk.WriteString(`,"snapshot":` + string(snapshot))
+	}
+	chunk.WriteString(`,"logs":[`)
+	write := s.medium.Write
+	flush := func() error {
+		s.m.Lock()
+		defer s.m.Unlock()
+		err := write(path, chunk.String())
+		chunk.Reset()
+		write = s.medium.Append
+		return err
+	}
+	first := true
+	for v, ok := it.Next(); ok && !v.K.Greater(archive.Key); v, ok = it.Next() {
+		res, err := json.Marshal(Log.LogToString(v))
+		if err != nil {
+			return err
+		}
+		if !first {
+			chunk.WriteByte(',')
+		}
+		chunk.Write(res)
+		first = false
+		if chunk.Len() >= backupChunk {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	chunk.WriteString("]}")
+	return flush()
+}
+
+/*
+用备份文件初始化一个新节点的配置文件、段文件和快照文件，节点启动后从备份的key继续运行。
+dns为空时使用备份中的集群成员，给出dns时清除备份中的客户端地址；恢复单节点集群时给出一个地址，恢复整个集群时每个节点用同一个备份和各自的id恢复。
+已有的多余段文件和快照文件会被清空，配置文件最后写入。
+*/
+
+func Restore(archivePath string, confPath string, filePath string, medium Medium, mediumParam interface{},
+	id int, dns []string) error {
+
+	if err := medium.Init(mediumParam); err != nil {
+		return err
+	}
+	var str string
+	if err := medium.Read(archivePath, &str); err != nil {
+		return err
+	}
+	var archive Archive
+	if err := json.Unmarshal([]byte(str), &archive); err != nil {
+		return err
+	}
+	meta := archive.Meta
+	if len(dns) > 0 {
+		meta.Dns, meta.Num, meta.ClientDns, meta.HttpDns = dns, len(dns), nil, nil
+	}
+	if id < 0 || id >= meta.Num || meta.Num > len(meta.Dns) {
+		return fmt.Errorf("error: illegal id %d of %d members %v", id, meta.Num, meta.Dns)
+	}
+	meta.Id = id
+	meta.CommittedKeyTerm, meta.CommittedKeyIndex = archive.Key.Term, archive.Key.Index
+	if meta.Term < archive.Key.Term {
+		meta.Term = archive.Key.Term
+	}
+	s := Store{medium: medium, confPath: confPath, filePath: filePath, segmentSize: meta.LogSegmentSize}
+	if s.segmentSize <= 0 {
+		s.segmentSize = defaultSegmentSize
+	}
+	var segment strings.Builder
+	for i, v := range archive.Logs {
+		if _, err := Log.StringToLog(v); err != nil {
+			return fmt.Errorf("error: log %d in the archive: %v", i, err)
+		}
+		if i > 0 && i%s.segmentSize == 0 {
+			if err := medium.Write(s.segmentPath(i/s.segmentSize-1), segment.String()); err != nil {
+				return err
+			}
+			segment.Reset()
+		}
+		segment.WriteString(v + "\n")
+	}
+	last := 0
+	if len(archive.Logs) > 0 {
+		last = (len(archive.Logs) - 1) / s.segmentSize
+	}
+	if err := medium.Write(s.segmentPath(last), segment.String()); err != nil {
+		return err
+	}
+	for i := last + 1; medium.Read(s.segmentPath(i), &str) == nil; i++ {
+		if err := medium.Write(s.segmentPath(i), ""); err != nil {
+			return err
+		}
+	}
+	if archive.Snapshot != nil {
+		if !archive.Snapshot.K.Equals(archive.Key) {
+			return errors.New("error: the snapshot in the archive is not at the archive key")
+		}
+		res, err := json.Marshal(archive.Snapshot)
+		if err != nil {
+			return err
+		}
+		if err := medium.Write(s.snapshotPath(), string(res)); err != nil {
+			return err
+		}
+	} else if medium.Read(s.snapshotPath(), &str) == nil {
+		if err := medium.Write(s.snapshotPath(), ""); err != nil {
+			return err
+		}
+	}
+	conf, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return medium.Write(confPath, string(conf))
+}
@@ -0,0 +1,82 @@
+package Bottom
+
+import (
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Meta"
+	"fmt"
+	"testing"
+)
+
+/*
+快照内容是重放的起点和key，可以看出备份从哪个快照开始重放。
+*/
+
+type fakeSource struct{}
+
+func (fakeSource) Snapshot(_ Log.LogSet, base *Log.Snapshot, key Log.Key) (string, bool, error) {
+	if base != nil {
+		return base.V + ">" + fmt.Sprint(key), true, nil
+	}
+	return fmt.Sprint(key), true, nil
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	m := newMedium()
+	var b Bottom
+	var meta Meta.Meta
+	logs := &Log.MemoryLogSet{}
+	if err := b.store.initAndLoad("conf", "log", &meta, logs, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	logs.Init(meta.CommittedKeyTerm, meta.CommittedKeyIndex)
+	b.logs = logs
+	b.SetSnapshotSource(fakeSource{})
+	if _, err := b.Backup("backup", Log.Key{Term: 2, Index: 2}); err == nil {
+		t.Fatal("back up logs that are not committed")
+	}
+	if _, err := b.Backup("backup", Log.Key{Term: 1, Index: 5}); err == nil {
+		t.Fatal("back up a key that is not in logs")
+	}
+	defer func(size int) { backupChunk = size }(backupChunk)
+	backupChunk = 8 // 每条日志追加一次
+	if key, err := b.Backup("backup", Log.Key{Term: 1, Index: 1}); err != nil || b.Snapshot() == nil || b.Snapshot().K != key {
+		t.Fatalf("backup at %v, %v, saved snapshot %v", key, err, b.Snapshot())
+	}
+	key, err := b.Backup("backup", Log.Key{Term: -1, Index: -1})
+	if err != nil || key != (Log.Key{Term: 2, Index: 1}) {
+		t.Fatalf("backup at %v, %v", key, err)
+	}
+	if s := b.Snapshot(); s == nil || s.K != key || s.V != "{1 1}>{2 1}" || m["log.snapshot"] == "" {
+		t.Fatalf("the second backup does not replay from the saved snapshot: %v", s)
+	}
+	m["new.2"] = "9$9^stale\n"
+	m["new.snapshot"] = "stale"
+	if err := Restore("backup", "new.conf", "new", m, nil, 1, []string{"x"}); err == nil {
+		t.Fatal("restore node 1 of a single node cluster")
+	}
+	if err := Restore("backup", "new.conf", "new", m, nil, 0, []string{"x"}); err != nil {
+		t.Fatal(err)
+	}
+	if m["new.2"] != "" {
+		t.Fatalf("stale segment is %q", m["new.2"])
+	}
+	o, err := OpenOffline("new.conf", "new", m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := o.Verify(); len(problems) != 0 {
+		t.Fatalf("problems after restore: %v", problems)
+	}
+	restored := o.Meta()
+	if restored.Num != 1 || restored.Dns[0] != "x" || restored.CommittedKeyTerm != 2 || restored.CommittedKeyIndex != 1 ||
+		o.Logs().GetLastIndex() != 3 {
+		t.Fatalf("restored meta %+v and %d logs", restored, o.Logs().GetLastIndex()+1)
+	}
+	if s := o.store.snapshot; s == nil || s.K != key || s.I != 3 || s.V != "{1 1}>{2 1}" {
+		t.Fatalf("restored snapshot is %v", s)
+	}
+	m["new.snapshot"] = `{"key":{"Term":2,"Index":2},"index":4,"value":"x"}`
+	if o, _ = OpenOffline("new.conf", "new", m, nil); o.store.snapshot != nil {
+		t.Fatalf("load a snapshot that is not in logs: %v", o.store.snapshot)
+	}
+}
@@ -3,6 +3,7 @@ package Bottom
 import (
 	"RaftDB/Kernel/Log"
 	"RaftDB/Kernel/Meta"
+	"RaftDB/Kernel/Pipe/Client"
 	"RaftDB/Kernel/Pipe/Order"
 	"log"
 )
@@ -10,9 +11,11 @@ import (
 type Bottom struct {
 	communicate   Communicate
 	store         Store
-	logs          *Log.LogSet
+	logs          Log.LogSet
 	fromLogicChan <-chan Order.Order // 接收me消息的管道
 	toLogicChan   chan<- Order.Order // 发送消息给me的管道
+	done          chan struct{}      // 关闭后Run退出，用于停止节点
+	snapshots     SnapshotSource     // 备份时生成App快照，为空时备份中没有快照
 }
 
 /*
@@ -24,25 +27,38 @@ bottom初始化，它需要完成：
 一旦初始化为正确执行，Panic结束。
 */
 
-func (b *Bottom) Init(confPath string, filePath string, meta *Meta.Meta, logs *Log.LogSet,
+func (b *Bottom) Init(confPath string, filePath string, meta *Meta.Meta, logs Log.LogSet,
 	medium Medium, cable Cable, fromLogicChan <-chan Order.Order, toLogicChan chan<- Order.Order,
 	mediumParam interface{}, cableParam interface{}) {
 
 	b.store, b.logs = Store{}, logs
 	b.fromLogicChan, b.toLogicChan = fromLogicChan, toLogicChan
+	b.done = make(chan struct{})
 	if err := b.store.initAndLoad(confPath, filePath, meta, logs, medium, mediumParam); err != nil {
 		panic(err)
 	}
-	if err := b.communicate.init(cable, meta.Dns[meta.Id], meta.Dns[0:meta.Num], cableParam); err != nil {
+	codec, err := Log.ParseCodec(meta.MsgCodec)
+	if err != nil {
 		panic(err)
 	}
+	if err := b.communicate.init(cable, meta.Dns[meta.Id], meta.Dns[0:meta.Num], codec, cableParam); err != nil {
+		panic(err)
+	}
+	if x, ok := cable.(Configurable); ok {
+		if err := x.Configure(*meta); err != nil {
+			panic(err)
+		}
+	}
+	if x, ok := cable.(Administrable); ok {
+		x.SetAdmin(b)
+	}
 	logs.Init(meta.CommittedKeyTerm, meta.CommittedKeyIndex)
 }
 
 /*
 运行期间不断收取Logic层传过来的信息，进行处理。
 如果一开始连接不可用说明系统无法启动，Panic处理。
-在执行过程中发现通讯管道关闭，Panic返回。
+在执行过程中发现通讯管道关闭，Panic返回；调用Stop后正常返回。
 communicate.listen()函数具有往toLogicChan里写入数据的权限。
 */
 
@@ -55,10 +71,11 @@ func (b *Bottom) Run() {
 	}()
 	for {
 		select {
+		case <-b.done:
+			return
 		case order, opened := <-b.fromLogicChan:
 			if !opened {
 				panic("logic chan is closed")
-				return
 			}
 			if order.Type == Order.Store {
 				if order.Msg.Agree {
@@ -68,8 +85,7 @@ func (b *Bottom) Run() {
 					}
 				} else {
 					log.Printf("Bottom: write log from %d to %d\n", order.Msg.SecondLastLogKey, order.Msg.LastLogKey)
-					contents := b.logs.GetLogsByRange(order.Msg.SecondLastLogKey, order.Msg.LastLogKey)
-					if err := b.store.appendLogs(&contents); err != nil {
+					if err := b.store.appendLogs(order.Msg.SecondLastLogKey, order.Msg.LastLogKey); err != nil {
 						log.Println(err)
 					}
 				}
@@ -88,6 +104,40 @@ func (b *Bottom) Run() {
 	}
 }
 
+/*
+停止底座，Run返回后不再写盘也不再发送消息，只能调用一次。
+*/
+
+func (b *Bottom) Stop() {
+	close(b.done)
+}
+
+/*
+把流式监听的事件来源交给信道，信道不支持时不做任何事。
+*/
+
+func (b *Bottom) SetWatchSource(source Client.Source) {
+	if x, ok := b.communicate.cable.(Watchable); ok {
+		x.SetWatchSource(source)
+	}
+}
+
 func (b *Bottom) ChangeNetworkDelay(delay int, random bool) {
 	b.communicate.ChangeNetworkDelay(delay, random)
 }
+
+/*
+信道的状态，信道不支持时报错。
+*/
+
+func (b *Bottom) CableStatus() (string, error) {
+	return b.communicate.status()
+}
+
+/*
+向信道下发故障注入命令，信道不支持时报错。
+*/
+
+func (b *Bottom) InjectFault(order []string) (string, error) {
+	return b.communicate.injectFault(order)
+}
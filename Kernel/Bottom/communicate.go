@@ -1,17 +1,23 @@
 package Bottom
 
 import (
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Meta"
+	"RaftDB/Kernel/Pipe/Client"
 	"RaftDB/Kernel/Pipe/Order"
+	"errors"
 )
 
 type Communicate struct {
 	cable Cable
 	dns   []string
 	addr  string
+	codec Log.Codec // AppendLog消息正文的压缩方式
 }
 
 /*
 信道接口，实现的通信信道需要实现初始化、回应客户端信息，回复服务节点信息，模拟网络延迟的功能。
+ReplyNode在Bottom的主循环中同步调用，不能阻塞，需要等待的发送应该放进信道自己的队列。
 */
 
 type Cable interface {
@@ -22,21 +28,70 @@ type Cable interface {
 	ChangeNetworkDelay(delay int, random bool)
 }
 
+/*
+可选的故障注入接口，信道实现了它之后，Monitor可以在运行时下发分区、丢包、延迟等故障规则。
+*/
+
+type FaultInjector interface {
+	InjectFault(order []string) (string, error)
+}
+
+/*
+可选的状态接口，信道实现了它之后，Monitor可以查看信道的状态（比如到每个节点的连接是否健康）。
+*/
+
+type Reporter interface {
+	ToString() string
+}
+
+/*
+可选的管理接口，信道实现了它之后，Bottom在初始化时把自己交给信道，信道可以对外提供管理命令（比如在线备份）。
+*/
+
+type Administrable interface {
+	SetAdmin(admin Admin)
+}
+
+/*
+可选的配置接口，信道实现了它之后，Bottom在初始化信道之后把配置交给信道（比如证书位置），配置错误时报错。
+*/
+
+type Configurable interface {
+	Configure(meta Meta.Meta) error
+}
+
+/*
+可选的流式监听接口，信道实现了它之后，Bottom把流式监听的事件来源交给信道，信道不经过Logic层直接处理流式监听请求。
+*/
+
+type Watchable interface {
+	SetWatchSource(source Client.Source)
+}
+
+type Admin interface {
+	Backup(path string, key Log.Key) (Log.Key, error)
+}
+
 /*
 通讯系统初始化，实例化自己的信道类型，保存本机的addr和所有通讯节点的映射信息；将上层传过来的信道实例初始化。失败报错。
 */
 
-func (c *Communicate) init(cable Cable, addr string, dns []string, cableParam interface{}) error {
-	c.cable, c.addr, c.dns = cable, addr, dns
+func (c *Communicate) init(cable Cable, addr string, dns []string, codec Log.Codec, cableParam interface{}) error {
+	c.cable, c.addr, c.dns, c.codec = cable, addr, dns, codec
 	return c.cable.Init(cableParam, dns)
 }
 
+/*
+AppendLog消息的正文按照codec压缩，接收方的Logic层根据消息中的Codec解压。
+*/
+
 func (c *Communicate) replyNode(msg Order.Message) error {
+	if msg.Type == Order.AppendLog && msg.Codec == Log.Plain {
+		msg.Codec, msg.Log = Log.Compress(msg.Log, c.codec)
+	}
 	for _, v := range msg.To {
 		if addr := c.dns[v]; addr != c.addr {
-			go func() {
-				_ = c.cable.ReplyNode(addr, msg)
-			}()
+			_ = c.cable.ReplyNode(addr, msg) // 发送失败由信道处理，Raft会重发
 		}
 	}
 	return nil
@@ -58,6 +113,20 @@ func (c *Communicate) ReplyClient(msg Order.Message) error {
 	return c.cable.ReplyClient(msg)
 }
 
+func (c *Communicate) injectFault(order []string) (string, error) {
+	if x, ok := c.cable.(FaultInjector); ok {
+		return x.InjectFault(order)
+	}
+	return "", errors.New("error: cable does not support fault injection")
+}
+
+func (c *Communicate) status() (string, error) {
+	if x, ok := c.cable.(Reporter); ok {
+		return x.ToString(), nil
+	}
+	return "", errors.New("error: cable does not report its status")
+}
+
 /*
 回复服务节点，回复不了报错。
 */
@@ -0,0 +1,278 @@
+package Bottom
+
+import (
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Meta"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+/*
+离线访问节点的存储，只在节点没有运行时使用（比如raftdb-admin），不启动Bottom，直接通过Store读写配置文件和段文件。
+和运行的节点一样使用磁盘日志系统，内存中只保留最近的日志，更早的日志按需从段文件中读取，所以日志很多时也可以打开。
+*/
+
+type Offline struct {
+	store Store
+	meta  Meta.Meta
+	logs  *Log.DiskLogSet
+}
+
+const (
+	offlineWindow = 1024 // 内存中至少保留的日志条数
+	offlineCache  = 2    // 缓存的段文件个数
+)
+
+/*
+读取配置文件中持久化的元数据，日志文件损坏或者丢失时也可以使用。
+*/
+
+func ReadMeta(confPath string, medium Medium, mediumParam interface{}) (Meta.Meta, error) {
+	var meta Meta.Meta
+	if err := medium.Init(mediumParam); err != nil {
+		return meta, err
+	}
+	s := Store{medium: medium}
+	return meta, s.getMeta(confPath, &meta)
+}
+
+/*
+打开节点的存储，和节点启动时一样加载配置和全部段文件，有无法解析的行时报错。
+*/
+
+func OpenOffline(confPath string, filePath string, medium Medium, mediumParam interface{}) (*Offline, error) {
+	return openOffline(confPath, filePath, medium, mediumParam, false)
+}
+
+/*
+为检查打开节点的存储：无法解析的行不会让打开失败，加载时跳过，由Verify报告，其他操作使用OpenOffline。
+*/
+
+func CheckOffline(confPath string, filePath string, medium Medium, mediumParam interface{}) (*Offline, error) {
+	return openOffline(confPath, filePath, medium, mediumParam, true)
+}
+
+func openOffline(confPath string, filePath string, medium Medium, mediumParam interface{}, lenient bool) (*Offline, error) {
+	o := &Offline{logs: Log.NewDiskLogSet(offlineWindow, offlineCache)}
+	o.store.lenient = lenient
+	if err := o.store.initAndLoad(confPath, filePath, &o.meta, o.logs, medium, mediumParam); err != nil {
+		return nil, err
+	}
+	o.logs.Init(o.meta.CommittedKeyTerm, o.meta.CommittedKeyIndex)
+	return o, nil
+}
+
+func (o *Offline) Meta() Meta.Meta {
+	return o.meta
+}
+
+func (o *Offline) Logs() Log.LogSet {
+	return o.logs
+}
+
+/*
+节点存储的全部文件：配置文件、段文件和存在时的快照文件，比如用来重新加密。
+*/
+
+func (o *Offline) Paths() []string {
+	res := []string{o.store.confPath}
+	var str string
+	for i := 0; o.store.medium.Read(o.store.segmentPath(i), &str) == nil; i++ {
+		res = append(res, o.store.segmentPath(i))
+	}
+	if o.store.medium.Read(o.store.snapshotPath(), &str) == nil {
+		res = append(res, o.store.snapshotPath())
+	}
+	return res
+}
+
+/*
+段文件中的一行，line从1开始，log解析失败时err不为空。
+*/
+
+type line struct {
+	segment int
+	line    int
+	text    string
+	log     Log.Log
+	err     error
+}
+
+/*
+逐行读取全部段文件，不经过日志系统，所以不会跳过乱序、重复和无法解析的行。
+每次只读取一个段文件交给f，f返回错误时停止并返回这个错误。
+*/
+
+func (o *Offline) scan(f func(lines []line) error) error {
+	for i := 0; ; i++ {
+		var str string
+		if err := o.store.medium.Read(o.store.segmentPath(i), &str); err != nil {
+			return nil
+		}
+		var lines []line
+		for j, v := range strings.Split(str, "\n") {
+			if v == "" {
+				continue
+			}
+			content, err := Log.StringToLog(v)
+			lines = append(lines, line{segment: i, line: j + 1, text: v, log: content, err: err})
+		}
+		if err := f(lines); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+检查段文件和元数据是否一致，返回发现的全部问题，没有问题时返回空：
+每一行都能解析，key严格递增，记录的全局下标等于日志的位置，段文件不超过segmentSize条；
+已提交的key在日志中，只有已提交的日志才会持久化，所以日志不能比已提交的key大，也不能比当前任期大。
+*/
+
+func (o *Offline) Verify() []string {
+	var problems []string
+	report := func(l line, format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s:%d: ", o.store.segmentPath(l.segment), l.line)+fmt.Sprintf(format, a...))
+	}
+	committed := Log.Key{Term: o.meta.CommittedKeyTerm, Index: o.meta.CommittedKeyIndex}
+	previous, position, found := Log.Key{Term: -1, Index: -1}, 0, committed.Equals(Log.Key{Term: -1, Index: -1})
+	o.scan(func(lines []line) error {
+		if len(lines) > o.store.segmentSize {
+			report(lines[len(lines)-1], "segment has %d logs, more than %d", len(lines), o.store.segmentSize)
+		}
+		for _, l := range lines {
+			if l.err != nil {
+				report(l, "can not parse %q", l.text)
+				continue
+			}
+			if !previous.Less(l.log.K) {
+				report(l, "key %v is not greater than the previous key %v", l.log.K, previous)
+				continue
+			}
+			if l.log.I != -1 && l.log.I != position {
+				report(l, "key %v is stored with global index %d, but it is log %d", l.log.K, l.log.I, position)
+			}
+			if l.log.K.Greater(committed) {
+				report(l, "key %v is persisted but greater than the committed key %v", l.log.K, committed)
+			}
+			if l.log.K.Term > o.meta.Term {
+				report(l, "key %v is greater than the term %d", l.log.K, o.meta.Term)
+			}
+			found = found || l.log.K.Equals(committed)
+			previous, position = l.log.K, position+1
+		}
+		return nil
+	})
+	if !found {
+		problems = append(problems, fmt.Sprintf("%s: committed key %v is not in logs", o.store.confPath, committed))
+	}
+	if committed.Term > o.meta.Term {
+		problems = append(problems, fmt.Sprintf("%s: committed key %v is greater than the term %d", o.store.confPath, committed, o.meta.Term))
+	}
+	return problems
+}
+
+/*
+删除key之后的全部日志：重写key所在的段文件，清空之后的段文件，返回被删除的日志。
+要删除已提交的日志时必须指定force，这时已提交的key也退回到保留的最后一条日志，并写回配置文件。
+*/
+
+func (o *Offline) Truncate(key Log.Key, force bool) ([]Log.Log, error) {
+	committed := o.logs.GetCommitted()
+	if committed.Greater(key) && !force {
+		return nil, fmt.Errorf("error: logs after %v are committed until %v", key, committed)
+	}
+	var removed []Log.Log
+	err := o.scan(func(lines []line) error {
+		var kept strings.Builder
+		cut := false
+		for _, l := range lines {
+			if l.err == nil && l.log.K.Greater(key) {
+				removed, cut = append(removed, l.log), true
+			} else {
+				kept.WriteString(l.text + "\n")
+			}
+		}
+		if cut {
+			return o.store.medium.Write(o.store.segmentPath(lines[0].segment), kept.String())
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+	logs := Log.NewDiskLogSet(offlineWindow, offlineCache)
+	logs.SetReader(o.store.medium)
+	if err := o.store.loadFrom0(logs); err != nil {
+		return removed, err
+	}
+	if committed.Greater(key) {
+		o.meta.CommittedKeyTerm, o.meta.CommittedKeyIndex = logs.GetLast().Term, logs.GetLast().Index
+		metaTmp, err := json.Marshal(o.meta)
+		if err != nil {
+			return removed, err
+		}
+		if err := o.store.updateMeta(string(metaTmp)); err != nil {
+			return removed, err
+		}
+	}
+	logs.Init(o.meta.CommittedKeyTerm, o.meta.CommittedKeyIndex)
+	o.logs, o.store.logs = logs, logs
+	return removed, nil
+}
+
+/*
+比较两份日志，返回第一条不同的日志的全局下标，一份是另一份的前缀时返回较短的那份的长度，完全相同时第二个返回值为假。
+*/
+
+func Diff(a Log.LogSet, b Log.LogSet) (int, bool) {
+	x, y := a.Iterator(), b.Iterator()
+	defer x.Close()
+	defer y.Close()
+	for i := 0; ; i++ {
+		u, ok1 := x.Next()
+		v, ok2 := y.Next()
+		if !ok1 && !ok2 {
+			return i, false
+		}
+		if ok1 != ok2 || !u.K.Equals(v.K) || u.V != v.V {
+			return i, true
+		}
+	}
+}
+
+/*
+按顺序把全局下标在[from, to]内的日志交给f，to为-1时到最后一条。日志通过迭代器逐条读取，不会一次把整个范围读进内存。
+范围超出日志时在调用f之前返回错误，f返回错误时停止并返回这个错误。
+*/
+
+func (o *Offline) Range(from int, to int, f func(v Log.Log) error) error {
+	last := o.logs.GetLastIndex()
+	if to == -1 {
+		to = last
+	}
+	if from > to {
+		return nil
+	}
+	if from < 0 || to > last {
+		return fmt.Errorf("error: logs [%d, %d] are out of range", from, to)
+	}
+	first, err := o.logs.GetByIndex(from)
+	if err != nil {
+		return err
+	}
+	it := o.logs.Iterator()
+	defer it.Close()
+	it.Seek(first.K)
+	for i := from; i <= to; i++ {
+		v, ok := it.Next()
+		if !ok {
+			return fmt.Errorf("error: can not read log %d", i)
+		}
+		if err := f(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
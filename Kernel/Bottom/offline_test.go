@@ -0,0 +1,185 @@
+package Bottom
+
+import (
+	"RaftDB/Kernel/Log"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type mapMedium map[string]string
+
+func (m mapMedium) Init(interface{}) error {
+	return nil
+}
+
+func (m mapMedium) Read(path string, content *string) error {
+	if v, has := m[path]; has {
+		*content = v
+		return nil
+	}
+	return errors.New("no such file " + path)
+}
+
+func (m mapMedium) Write(path string, content string) error {
+	m[path] = content
+	return nil
+}
+
+func (m mapMedium) Append(path string, content string) error {
+	if _, has := m[path]; !has {
+		return errors.New("no such file " + path)
+	}
+	m[path] += content
+	return nil
+}
+
+/*
+两个段文件，每段3条，第一段是没有全局下标的旧格式，已提交到{2 1}。
+*/
+
+func newMedium() mapMedium {
+	m := mapMedium{
+		"conf": `{"id":0,"num":1,"term":2,"ckt":2,"cki":1,"dns":["a"],"logSegmentSize":3}`,
+		"log":  "1$0^a\n1$1^b\n2$0^c\n",
+		"log.1": Log.LogToString(Log.Log{K: Log.Key{Term: 2, Index: 1}, I: 3, V: "d"}) + "\n" +
+			Log.LogToString(Log.Log{K: Log.Key{Term: 2, Index: 2}, I: 4, V: "e"}) + "\n",
+	}
+	return m
+}
+
+func TestOfflineRangeAndVerify(t *testing.T) {
+	o, err := OpenOffline("conf", "log", newMedium(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs []Log.Log
+	err = o.Range(1, 3, func(v Log.Log) error {
+		logs = append(logs, v)
+		return nil
+	})
+	if err != nil || len(logs) != 3 || logs[0].V != "b" || logs[2].I != 3 || logs[2].V != "d" {
+		t.Fatalf("range [1, 3] is %v, %v", logs, err)
+	}
+	called := false
+	if err := o.Range(4, 5, func(v Log.Log) error { called = true; return nil }); err == nil || called {
+		t.Fatal("range beyond the last log")
+	}
+	problems := o.Verify()
+	if len(problems) != 1 || !strings.Contains(problems[0], "log.1:2") {
+		t.Fatalf("problems are %v, want {2 2} greater than the committed key", problems)
+	}
+	m := newMedium()
+	m["log.1"] = "2$0#3^x\n2$3#9^y\nbroken\n1$1^z\n"
+	if _, err := OpenOffline("conf", "log", m, nil); err == nil || !strings.Contains(err.Error(), "log.1:3") {
+		t.Fatalf("open a broken segment: %v", err)
+	}
+	if o, err = CheckOffline("conf", "log", m, nil); err != nil {
+		t.Fatal(err)
+	}
+	problems = o.Verify()
+	for _, want := range []string{"log.1:1: key {2 0} is not greater", "log.1:2: key {2 3} is stored with global index 9",
+		"log.1:3: can not parse", "log.1:4: key {1 1}", "committed key {2 1} is not in logs", "log.1:2: key {2 3} is persisted"} {
+		found := false
+		for _, v := range problems {
+			found = found || strings.Contains(v, want)
+		}
+		if !found {
+			t.Errorf("no problem %q in %v", want, problems)
+		}
+	}
+}
+
+func TestOfflineTruncate(t *testing.T) {
+	m := newMedium()
+	o, _ := OpenOffline("conf", "log", m, nil)
+	if _, err := o.Truncate(Log.Key{Term: 1, Index: 1}, false); err == nil {
+		t.Fatal("truncate committed logs without force")
+	}
+	removed, err := o.Truncate(Log.Key{Term: 2, Index: 1}, false)
+	if err != nil || len(removed) != 1 || removed[0].K != (Log.Key{Term: 2, Index: 2}) {
+		t.Fatalf("removed %v, %v", removed, err)
+	}
+	if len(o.Verify()) != 0 {
+		t.Fatalf("problems after truncate: %v", o.Verify())
+	}
+	removed, err = o.Truncate(Log.Key{Term: 1, Index: 0}, true)
+	if err != nil || len(removed) != 3 {
+		t.Fatalf("removed %v, %v", removed, err)
+	}
+	if m["log"] != "1$0^a\n" || m["log.1"] != "" {
+		t.Fatalf("files are %q", m)
+	}
+	o, err = OpenOffline("conf", "log", m, nil)
+	if err != nil || o.Logs().GetLastIndex() != 0 || o.Meta().CommittedKeyTerm != 1 || o.Meta().CommittedKeyIndex != 0 {
+		t.Fatalf("reopen: %v, %v", o, err)
+	}
+	if problems := o.Verify(); len(problems) != 0 {
+		t.Fatalf("problems after truncate: %v", problems)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a, b := &Log.MemoryLogSet{}, &Log.MemoryLogSet{}
+	for i := 0; i < 5; i++ {
+		a.Append(Log.Log{K: Log.Key{Term: 1, Index: i}, V: fmt.Sprint(i)})
+		b.Append(Log.Log{K: Log.Key{Term: 1, Index: i}, V: fmt.Sprint(i)})
+	}
+	if i, differ := Diff(a, b); differ || i != 5 {
+		t.Fatalf("same logs differ at %d", i)
+	}
+	b.Append(Log.Log{K: Log.Key{Term: 2, Index: 0}, V: "x"})
+	if i, differ := Diff(a, b); !differ || i != 5 {
+		t.Fatalf("prefix differs at %d, %v", i, differ)
+	}
+	b.Remove(Log.Key{Term: 1, Index: 2})
+	b.Append(Log.Log{K: Log.Key{Term: 2, Index: 0}, V: "y"})
+	if i, differ := Diff(a, b); !differ || i != 3 {
+		t.Fatalf("fork differs at %d, %v", i, differ)
+	}
+}
+
+/*
+打开压缩之后追加的日志中可以压缩的被压缩，和之前没有压缩的日志混在同一个段文件中，重新加载时全部可读；
+解压失败的日志让加载报错并指出段文件和行号，不会跳过它让之后的日志错位。
+*/
+
+func TestStoreCompression(t *testing.T) {
+	m := newMedium()
+	m["conf"] = strings.Replace(m["conf"], "}", `,"logCodec":"flate"}`, 1)
+	o, err := OpenOffline("conf", "log", m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("write'key'value ", 20)
+	o.logs.Append(Log.Log{K: Log.Key{Term: 2, Index: 3}, V: long})
+	o.logs.Append(Log.Log{K: Log.Key{Term: 2, Index: 4}, V: "f"})
+	if err := o.store.appendLogs(Log.Key{Term: 2, Index: 3}, Log.Key{Term: 2, Index: 4}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(m["log.1"], "\n")
+	if !strings.Contains(lines[2], "~z^") || len(lines[2]) >= len(long) || m["log.2"] != "2$4#6^f\n" {
+		t.Fatalf("segments are %q and %q", m["log.1"], m["log.2"])
+	}
+	o, err = OpenOffline("conf", "log", m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := o.Logs().GetByIndex(5); err != nil || v.V != long || v.K != (Log.Key{Term: 2, Index: 3}) {
+		t.Fatalf("log 5 is %v, %v", v, err)
+	}
+	lines[2] = lines[2][:len(lines[2])-4]
+	corrupt := mapMedium{}
+	for k, v := range m {
+		corrupt[k] = v
+	}
+	corrupt["log.1"] = strings.Join(lines, "\n")
+	if _, err := OpenOffline("conf", "log", corrupt, nil); err == nil || !strings.Contains(err.Error(), "log.1:3") {
+		t.Fatalf("open a corrupt compressed log: %v", err)
+	}
+	m["conf"] = strings.Replace(m["conf"], "flate", "zip", 1)
+	if _, err := OpenOffline("conf", "log", m, nil); err == nil {
+		t.Fatal("open with an unknown codec")
+	}
+}
@@ -4,16 +4,34 @@ import (
 	"RaftDB/Kernel/Log"
 	"RaftDB/Kernel/Meta"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"strings"
+	"sync"
 )
 
+/*
+日志按顺序写入多个段文件：filePath、filePath.1、filePath.2……，每个段文件最多保存segmentSize条日志，写满后写下一个。
+只有一个段文件时和原来的单文件格式完全相同。
+*/
+
 type Store struct {
-	medium   Medium
-	confPath string
-	filePath string
+	medium      Medium
+	confPath    string
+	filePath    string
+	logs        Log.LogSet
+	segmentSize int           // 每个段文件最多保存的日志条数
+	segment     int           // 正在写入的段文件序号
+	count       int           // 正在写入的段文件中的日志条数
+	codec       Log.Codec     // 写入日志时使用的压缩方式
+	snapshot    *Log.Snapshot // 最近保存的App快照，启动时从快照文件加载，在线备份时更新，没有时为空
+	m           sync.Mutex    // Bottom写盘和在线备份在不同的协程中
+	lenient     bool          // 加载时跳过无法解析的行，只在离线检查时使用，由Verify报告这些行
 }
 
+const defaultSegmentSize = 100000
+
 /*
 存储介质接口需要实现初始化，读写和追加写功能
 */
@@ -29,40 +47,142 @@ type Medium interface {
 存储系统初始化，需要初始化存储介质，之后通过该介质读取磁盘中的配置信息和日志，并将其通过传出参数返回上层。
 */
 
-func (s *Store) initAndLoad(confPath string, filePath string, meta *Meta.Meta, logs *Log.LogSet,
+func (s *Store) initAndLoad(confPath string, filePath string, meta *Meta.Meta, logs Log.LogSet,
 	m Medium,
 	mediumParam interface{}) error {
-	s.medium, s.confPath, s.filePath = m, confPath, filePath
+	s.medium, s.confPath, s.filePath, s.logs = m, confPath, filePath, logs
 	if err := s.medium.Init(mediumParam); err != nil {
 		return err
 	}
 	if err := s.getMeta(confPath, meta); err != nil {
 		return err
 	}
-	if err := s.loadFrom0(filePath, logs); err != nil {
+	s.segmentSize = meta.LogSegmentSize
+	if s.segmentSize <= 0 {
+		s.segmentSize = defaultSegmentSize
+	}
+	codec, err := Log.ParseCodec(meta.LogCodec)
+	if err != nil {
+		return err
+	}
+	s.codec = codec
+	if spiller, ok := logs.(Log.Spiller); ok {
+		spiller.SetReader(m)
+	}
+	if err := s.loadFrom0(logs); err != nil {
+		return err
+	}
+	s.loadSnapshot(logs, Log.Key{Term: meta.CommittedKeyTerm, Index: meta.CommittedKeyIndex})
+	return nil
+}
+
+func (s *Store) snapshotPath() string {
+	return s.filePath + ".snapshot"
+}
+
+/*
+保存在线备份生成的App快照，比已保存的快照旧时忽略。快照文件写坏时启动会忽略它，从头重放日志。
+*/
+
+func (s *Store) saveSnapshot(snapshot *Log.Snapshot) error {
+	res, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.snapshot != nil && !snapshot.K.Greater(s.snapshot.K) {
+		return nil
+	}
+	if err := s.medium.Write(s.snapshotPath(), string(res)); err != nil {
 		return err
 	}
+	s.snapshot = snapshot
 	return nil
 }
 
 /*
-给出一组内存中的日志，将这一组日志按照顺序追加写入磁盘文件。为保证系统持续运行，如果追加失败，提示错误不会Panic。
+读取快照文件，快照文件不存在或者为空时没有快照。快照必须在一条已提交的日志处，否则忽略它，从头重放日志。
 */
 
-func (s *Store) appendLogs(logs *[]Log.Log) error {
-	for _, v := range *logs {
-		if err := s.medium.Append(s.filePath, Log.LogToString(v)+"\n"); err != nil {
+func (s *Store) loadSnapshot(logs Log.LogSet, committed Log.Key) {
+	s.snapshot = nil
+	var str string
+	if err := s.medium.Read(s.snapshotPath(), &str); err != nil || str == "" {
+		return
+	}
+	var snapshot Log.Snapshot
+	if err := json.Unmarshal([]byte(str), &snapshot); err != nil {
+		log.Println(err)
+		return
+	}
+	if v, err := logs.GetByIndex(snapshot.I); err != nil || !v.K.Equals(snapshot.K) || snapshot.K.Greater(committed) {
+		log.Printf("error: snapshot at %v#%d is not a committed log, ignore it\n", snapshot.K, snapshot.I)
+		return
+	}
+	s.snapshot = &snapshot
+}
+
+/*
+将[begin, end]内的日志按照codec压缩后顺序追加写入磁盘文件，日志通过迭代器逐条读取，当前段文件写满时新建下一个段文件。
+begin不在日志中时不写入。为保证系统持续运行，如果追加失败，提示错误不会Panic。
+写入成功的日志按段文件通知日志系统（如果它实现了Log.Spiller），第一次失败之后的日志不再通知，它们会一直留在内存中。
+*/
+
+func (s *Store) appendLogs(begin Log.Key, end Log.Key) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	spiller, _ := s.logs.(Log.Spiller)
+	var persisted []Log.Log
+	failed := false
+	it := s.logs.Iterator()
+	defer it.Close()
+	it.Seek(begin)
+	v, ok := it.Next()
+	if !ok || !v.K.Equals(begin) {
+		return errors.New("error: the first log to store is not in log set")
+	}
+	for ; ok && !v.K.Greater(end); v, ok = it.Next() {
+		if s.count >= s.segmentSize {
+			if spiller != nil && !failed {
+				spiller.Persisted(s.segmentPath(s.segment), persisted)
+			}
+			persisted = nil
+			if err := s.medium.Write(s.segmentPath(s.segment+1), ""); err != nil {
+				log.Println(err)
+				failed = true
+				continue
+			}
+			s.segment, s.count = s.segment+1, 0
+		}
+		if err := s.medium.Append(s.segmentPath(s.segment), Log.CompressedLogToString(v, s.codec)+"\n"); err != nil {
 			log.Println(err)
+			failed = true
+			continue
 		}
+		s.count++
+		persisted = append(persisted, v)
+	}
+	if spiller != nil && !failed {
+		spiller.Persisted(s.segmentPath(s.segment), persisted)
 	}
 	return nil
 }
 
+func (s *Store) segmentPath(i int) string {
+	if i == 0 {
+		return s.filePath
+	}
+	return fmt.Sprintf("%s.%d", s.filePath, i)
+}
+
 /*
 更新磁盘中的配置信息，写入失败报错。
 */
 
 func (s *Store) updateMeta(meta string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
 	return s.medium.Write(s.confPath, meta)
 }
 
@@ -79,19 +199,45 @@ func (s *Store) getMeta(metaPath string, meta *Meta.Meta) error {
 }
 
 /*
-加载磁盘中的历史记录，只有系统初始化的时候使用，获取不到报错。
+加载磁盘中的历史记录，只有系统初始化的时候使用，第一个段文件获取不到报错，之后依次读取段文件直到读取失败。
+每读完一个段文件就通知日志系统，DiskLogSet可以在加载过程中把它们移出内存。
+全局下标以日志系统按顺序分配的为准，文件中记录的下标不一致时只打印日志，旧格式的文件没有全局下标。
+无法解析的行（包括解压失败或者解压后超过MaxDecompressed的压缩日志）报错并指出段文件和行号，
+跳过它会让之后的日志全部错位。
 */
 
-func (s *Store) loadFrom0(logPath string, logs *Log.LogSet) error {
-	var str string
-	if err := s.medium.Read(logPath, &str); err != nil {
-		return err
-	}
-	tmp := strings.Split(str, "\n")
-	for _, v := range tmp {
-		if res, err := Log.StringToLog(v); err == nil {
+func (s *Store) loadFrom0(logs Log.LogSet) error {
+	spiller, _ := logs.(Log.Spiller)
+	for i := 0; ; i++ {
+		var str string
+		if err := s.medium.Read(s.segmentPath(i), &str); err != nil {
+			if i == 0 {
+				return err
+			}
+			return nil
+		}
+		var contents []Log.Log
+		for j, v := range strings.Split(str, "\n") {
+			if v == "" {
+				continue
+			}
+			res, err := Log.StringToLog(v)
+			if err != nil {
+				if s.lenient {
+					continue
+				}
+				return fmt.Errorf("%s:%d: can not parse the log: %v", s.segmentPath(i), j+1, err)
+			}
+			global := res.I
 			logs.Append(res)
+			if res.I = logs.GetLastIndex(); global != -1 && global != res.I {
+				log.Printf("log %v is stored with global index %d, but loaded as %d\n", res.K, global, res.I)
+			}
+			contents = append(contents, res)
+		}
+		s.segment, s.count = i, len(contents)
+		if spiller != nil {
+			spiller.Persisted(s.segmentPath(i), contents)
 		}
 	}
-	return nil
 }
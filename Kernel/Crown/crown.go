@@ -1,8 +1,11 @@
 package Crown
 
 import (
+	"RaftDB/Kernel/Feed"
 	"RaftDB/Kernel/Log"
 	"RaftDB/Kernel/Pipe/Something"
+	"errors"
+	"fmt"
 	"log"
 )
 
@@ -17,6 +20,10 @@ type Crown struct {
 	fromLogicChan <-chan Something.Something          // 上层接口
 	watchingMap   map[string][]int                    // 存储监听的事件
 	watchTrigger  func(string) (bool, string, string) // 监听触发函数，对于一个命令，他可能触发的key是什么，以及返回什么
+	done          chan struct{}                       // 关闭后Run退出，用于停止节点
+	base          *Log.Snapshot                       // 启动时加载的快照，没有时为空
+	sessions      *sessions                           // 客户端会话表，用于去掉重复执行的写入
+	hub           *Feed.Hub                           // 流式监听的事件来源，App没有实现Streamer和Snapshotter时为空
 }
 
 /*
@@ -32,57 +39,175 @@ type App interface {
 }
 
 /*
-crown初始化，保存获取Logic层和crown层的通讯管道，初始化APP，应用Logic层的日志。
+可选的快照接口，App实现了它之后，备份中会带上App在备份key处的状态，启动时可以从快照恢复，只重放快照之后的日志。
+Fork返回一个新的同类App，它不能读写当前App的状态，因为Fork在备份的协程中调用，和Run并发。
 */
 
-func (c *Crown) Init(logSet *Log.LogSet, app App,
+type Snapshotter interface {
+	Fork() App
+	Snapshot() (string, error)
+	Restore(snapshot string) error
+}
+
+/*
+可选的结果代码接口，App实现了它之后，Crown用ProcessResult代替Process执行命令，把结果代码交给Logic层带回客户端，
+客户端据此区分key不存在、版本被压缩和非法命令，不用比较回复的内容。
+*/
+
+type Resulter interface {
+	ProcessResult(in string) (out string, result Something.Result, agree bool, watching bool, err error)
+}
+
+func process(app App, in string) (string, Something.Result, bool, bool, error) {
+	if r, ok := app.(Resulter); ok {
+		return r.ProcessResult(in)
+	}
+	out, agree, watching, err := app.Process(in)
+	return out, Something.Done, agree, watching, err
+}
+
+/*
+crown初始化，保存获取Logic层和crown层的通讯管道，初始化APP，逐条应用Logic层的日志。
+有快照并且App实现了Snapshotter时先加载快照，只应用快照之后的日志，快照加载失败时重新初始化App，应用全部日志。
+*/
+
+func (c *Crown) Init(logSet Log.LogSet, snapshot *Log.Snapshot, app App,
 	fromLogicChan <-chan Something.Something, toLogicChan chan<- Something.Something) {
 
 	c.toLogicChan, c.fromLogicChan = toLogicChan, fromLogicChan
 	c.app, c.watchingMap = app, map[string][]int{}
+	c.done = make(chan struct{})
 	c.watchTrigger = c.app.Init()
-	for _, v := range logSet.GetAll() {
-		if _, ok, _, err := c.app.Process(v.V); err != nil || !ok {
+	c.base, c.sessions = nil, newSessions()
+	if s, ok := c.app.(Snapshotter); ok && snapshot != nil {
+		if err := restore(s, c.sessions, snapshot.V); err != nil {
+			log.Println(err)
+			c.watchTrigger, c.sessions = c.app.Init(), newSessions()
+		} else {
+			c.base = snapshot
+			log.Printf("Crown: restore app from the snapshot at %v\n", snapshot.K)
+		}
+	}
+	replay(c.app, c.sessions, logSet, c.base, Log.Key{Term: -1, Index: -1})
+	c.hub = nil
+	_, streamer := c.app.(Streamer)
+	if _, ok := c.app.(Snapshotter); ok && streamer {
+		c.hub = Feed.NewHub(logSet, &replica{origin: c.app, base: c.base})
+	}
+}
+
+/*
+流式监听的事件来源，App不支持时为空。
+*/
+
+func (c *Crown) Hub() *Feed.Hub {
+	return c.hub
+}
+
+func restore(s Snapshotter, sessions *sessions, snapshot string) error {
+	v, err := sessions.unwrap(snapshot)
+	if err != nil {
+		return err
+	}
+	return s.Restore(v)
+}
+
+/*
+把base之后直到end的日志应用到app上，end为-1-1时应用全部日志。
+*/
+
+func replay(app App, sessions *sessions, logSet Log.LogSet, base *Log.Snapshot, end Log.Key) {
+	it := logSet.Iterator()
+	defer it.Close()
+	if base != nil {
+		it.Seek(base.K)
+	}
+	for v, ok := it.Next(); ok && (end.Equals(Log.Key{Term: -1, Index: -1}) || !v.K.Greater(end)); v, ok = it.Next() {
+		if base != nil && !v.K.Greater(base.K) {
+			continue
+		}
+		if _, ok, _, err := sessions.process(app, v.V); err != nil || !ok {
 			log.Println("error: process history log error")
 		}
 	}
 }
 
+/*
+生成App在已提交的key处的快照，App没有实现Snapshotter时第二个返回值为假。
+正在运行的App里可能有还没提交、之后会被撤销的操作，所以在Fork出的新App上从base开始重放之后不大于key的日志，
+base是Bottom最近保存的快照，为空或者比key大时从启动时的快照开始。不影响正在运行的App，可以在任何协程中调用。
+*/
+
+func (c *Crown) Snapshot(logSet Log.LogSet, base *Log.Snapshot, key Log.Key) (string, bool, error) {
+	s, ok := c.app.(Snapshotter)
+	if !ok {
+		return "", false, nil
+	}
+	fork := s.Fork()
+	fork.Init()
+	f, ok := fork.(Snapshotter)
+	if !ok {
+		return "", false, errors.New("error: the forked app does not support snapshots")
+	}
+	if base == nil || base.K.Greater(key) {
+		base = c.base
+	}
+	sessions := newSessions()
+	if base != nil && base.K.Greater(key) {
+		base = nil
+	}
+	if base != nil {
+		if err := restore(f, sessions, base.V); err != nil {
+			return "", false, err
+		}
+	}
+	replay(fork, sessions, logSet, base, key)
+	res, err := f.Snapshot()
+	if err != nil {
+		return "", true, err
+	}
+	res, err = sessions.wrap(res)
+	return res, true, err
+}
+
 /*
 开始监听通讯管道，如果有消息处理，处理，如果该消息需要回复，将结果回复。
-在执行过程中发现通讯管道关闭，Panic返回。
+在执行过程中发现通讯管道关闭，Panic返回；调用Stop后正常返回。
 */
 
 func (c *Crown) Run() {
 	for {
 		select {
+		case <-c.done:
+			return
 		case sth, opened := <-c.fromLogicChan:
 			if !opened {
 				panic("logic chan closed")
 			}
 			if maybe, key, reply := c.watchTrigger(sth.Content); maybe && c.watchingMap[key] != nil {
 				for _, v := range c.watchingMap[key] {
-					c.toLogicChan <- Something.Something{Id: v, NeedSync: false, Agree: true, Content: reply}
+					c.toLogicChan <- Something.Something{Id: v, NeedSync: false, Agree: true, Content: reply,
+						Key: Log.Key{Term: -1, Index: -1}}
 					log.Printf("Crown: %d's watching event '%s' has been triggered\n", v, key)
 				}
 				delete(c.watchingMap, key)
 			}
 			if len(sth.Content) > 0 && sth.Content[0] == '!' {
-				if out, agree, err := c.app.UndoProcess(sth.Content); err != nil {
+				if out, agree, err := c.sessions.undoProcess(c.app, sth.Content); err != nil {
 					log.Println(err)
 				} else if sth.NeedReply {
 					sth.Content, sth.Agree = out, agree
 					c.toLogicChan <- sth
 				}
 			} else {
-				if out, agree, watching, err := c.app.Process(sth.Content); err != nil {
+				if out, result, agree, watching, err := c.sessions.processResult(c.app, sth.Content); err != nil {
 					log.Println(err)
 				} else {
 					if watching {
 						c.watchingMap[out] = append(c.watchingMap[out], sth.Id)
 						log.Printf("Crown: %d registers a watching event '%s'\n", sth.Id, out)
 					} else if sth.NeedReply {
-						sth.Content, sth.Agree = out, agree
+						sth.Content, sth.Agree, sth.Result = out, agree, result
 						c.toLogicChan <- sth
 					}
 				}
@@ -91,10 +216,18 @@ func (c *Crown) Run() {
 	}
 }
 
+/*
+停止上层模块，只能调用一次。
+*/
+
+func (c *Crown) Stop() {
+	close(c.done)
+}
+
 func (c *Crown) ChangeProcessDelay(delay int, random bool) {
 	c.app.ChangeProcessDelay(delay, random)
 }
 
 func (c *Crown) ToString() string {
-	return c.app.ToString()
+	return c.app.ToString() + fmt.Sprintf("\nsessions: %d, replicated time: %d", len(c.sessions.Table), c.sessions.Now)
 }
@@ -0,0 +1,77 @@
+package Crown
+
+import (
+	"RaftDB/Kernel/Feed"
+	"RaftDB/Kernel/Log"
+	"errors"
+)
+
+/*
+可选的流式监听接口，App同时实现了它和Snapshotter之后，客户端可以从任何节点按版本监听key的改变（见Feed）。
+Changes在执行command之前调用，给出command将要改变的key以及改变前后的值，不能改变App的状态；
+WatchFilter把监听命令转换成Feed.Filter，不能读写App的状态。
+*/
+
+type Streamer interface {
+	Changes(command string) []Feed.Change
+	WatchFilter(command string) (Feed.Filter, bool)
+}
+
+/*
+Feed使用的App副本：Fork出一个新的App，从启动时的快照开始，只执行已提交的日志，所以事件不会被撤销。
+副本和正在运行的App互不影响，内存中多一份App的状态。
+*/
+
+type replica struct {
+	origin   App
+	base     *Log.Snapshot
+	app      App
+	sessions *sessions
+	changes  []Feed.Change
+}
+
+/*
+副本通过recorder执行命令，会话表判断为重复的命令不会交给App，也就不产生事件。
+*/
+
+type recorder struct {
+	App
+	r *replica
+}
+
+func (x recorder) Process(in string) (out string, agree bool, watching bool, err error) {
+	changes := x.App.(Streamer).Changes(in)
+	if out, agree, watching, err = x.App.Process(in); err == nil && agree && !watching {
+		x.r.changes = append(x.r.changes, changes...)
+	}
+	return
+}
+
+func (r *replica) Init() (Log.Key, error) {
+	fork := r.origin.(Snapshotter).Fork()
+	fork.Init()
+	f, ok := fork.(Snapshotter)
+	if _, streamer := fork.(Streamer); !ok || !streamer {
+		return Log.Key{}, errors.New("Crown: the forked app does not support streaming watches")
+	}
+	r.app, r.sessions = fork, newSessions()
+	if r.base == nil {
+		return Log.Key{Term: -1, Index: -1}, nil
+	}
+	if err := restore(f, r.sessions, r.base.V); err != nil {
+		return Log.Key{}, err
+	}
+	return r.base.K, nil
+}
+
+func (r *replica) Apply(content string) []Feed.Change {
+	r.changes = nil
+	if _, _, _, err := r.sessions.process(recorder{App: r.app, r: r}, content); err != nil {
+		return nil
+	}
+	return r.changes
+}
+
+func (r *replica) Filter(command string) (Feed.Filter, bool) {
+	return r.origin.(Streamer).WatchFilter(command)
+}
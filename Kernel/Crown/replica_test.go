@@ -0,0 +1,62 @@
+package Crown
+
+import (
+	"RaftDB/Kernel/Feed"
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Pipe/Something"
+	"strconv"
+	"testing"
+)
+
+/*
+支持快照和流式监听的计数器，每条命令改变key n。
+*/
+
+type streamingCounter struct {
+	counter
+}
+
+func (c *streamingCounter) Fork() App {
+	return &streamingCounter{}
+}
+
+func (c *streamingCounter) Snapshot() (string, error) {
+	return strconv.Itoa(c.n), nil
+}
+
+func (c *streamingCounter) Restore(snapshot string) (err error) {
+	c.n, err = strconv.Atoi(snapshot)
+	return
+}
+
+func (c *streamingCounter) Changes(string) []Feed.Change {
+	return []Feed.Change{{Type: Feed.Put, Key: "n", Old: strconv.Itoa(c.n), Value: strconv.Itoa(c.n + 1), HasOld: true}}
+}
+
+func (c *streamingCounter) WatchFilter(command string) (Feed.Filter, bool) {
+	return Feed.Filter{Key: command}, command == "n"
+}
+
+/*
+副本从快照开始，重复的命令不产生事件。
+*/
+
+func TestReplica(t *testing.T) {
+	r := &replica{origin: &streamingCounter{}, base: &Log.Snapshot{K: Log.Key{Term: 1, Index: 4}, V: "5"}}
+	if base, err := r.Init(); err != nil || !base.Equals(Log.Key{Term: 1, Index: 4}) {
+		t.Fatalf("init at %v: %v", base, err)
+	}
+	want := []string{"5>6", "6>7", "", "7>8"}
+	for i, v := range []string{"inc", Something.Stamp("a", 1, 0, "inc"), Something.Stamp("a", 1, 0, "inc"), "inc"} {
+		got := ""
+		for _, c := range r.Apply(v) {
+			got += c.Old + ">" + c.Value
+		}
+		if got != want[i] {
+			t.Fatalf("command %d changes %q, want %q", i, got, want[i])
+		}
+	}
+	if _, ok := r.Filter("n"); !ok {
+		t.Fatal("filter a watch command")
+	}
+}
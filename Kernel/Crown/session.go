@@ -0,0 +1,204 @@
+package Crown
+
+import (
+	"RaftDB/Kernel/Pipe/Something"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+/*
+客户端会话表：记录每个客户端最近执行过的序号和回复，重试的命令直接返回记录的回复，不再交给App，保证写入只执行一次。
+会话表只由日志驱动，时间也是日志中leader写入的时间戳（复制时间），所以每个节点的会话表都相同，会话在复制时间上过期。
+会话过期之后，这个客户端的重试会被当作新的请求执行。
+撤销日志时会话表也按后进先出的顺序恢复。
+*/
+
+const (
+	sessionTimeout = 60 * 60 * 1000 // 会话在复制时间上超过这么多毫秒没有请求时过期
+	sessionWindow  = 128            // 每个会话保留最近这么多个序号的回复，更早的重试被拒绝
+	maxSessionUndo = 100000         // 只有还没提交的日志会被撤销，保留最近的记录就够了
+)
+
+type reply struct {
+	Out    string           `json:"out"`
+	Agree  bool             `json:"agree"`
+	Result Something.Result `json:"result,omitempty"`
+}
+
+type session struct {
+	Seq     int           `json:"seq"`     // 执行过的最大序号
+	Replies map[int]reply `json:"replies"` // 最近sessionWindow个序号的回复
+	Active  int64         `json:"active"`  // 最近一次请求的复制时间
+}
+
+type sessions struct {
+	Table map[string]*session `json:"table"`
+	Now   int64               `json:"now"` // 复制时间，已执行日志中时间戳的最大值，毫秒
+	undo  []sessionUndo
+}
+
+/*
+执行一条带会话头部的命令之前会话表的状态，用于撤销。
+*/
+
+type sessionUndo struct {
+	client    string
+	old       *session            // 执行之前这个客户端的会话，为空表示没有
+	expired   map[string]*session // 这次执行中过期删除的会话
+	now       int64
+	duplicate bool // 重复的命令，没有交给App执行
+}
+
+func newSessions() *sessions {
+	return &sessions{Table: map[string]*session{}}
+}
+
+func (s *session) clone() *session {
+	res := &session{Seq: s.Seq, Active: s.Active, Replies: make(map[int]reply, len(s.Replies))}
+	for k, v := range s.Replies {
+		res.Replies[k] = v
+	}
+	return res
+}
+
+/*
+执行一条日志中的命令，带有会话头部时先查会话表。只有App同意执行的命令会进入日志，
+所以App拒绝或者命令是监听时立即恢复会话表，不留撤销记录。
+*/
+
+func (s *sessions) process(app App, content string) (out string, agree bool, watching bool, err error) {
+	out, _, agree, watching, err = s.processResult(app, content)
+	return
+}
+
+/*
+和process一样执行命令，同时返回App给出的结果代码（见Resulter），重复的命令返回第一次执行时的结果代码。
+*/
+
+func (s *sessions) processResult(app App, content string) (out string, result Something.Result, agree bool, watching bool, err error) {
+	client, seq, at, cmd, ok := Something.Unstamp(content)
+	if !ok {
+		return process(app, content)
+	}
+	u := sessionUndo{client: client, now: s.Now, expired: map[string]*session{}}
+	if x, has := s.Table[client]; has {
+		u.old = x.clone()
+	}
+	if at > s.Now {
+		s.Now = at
+	}
+	for k, v := range s.Table {
+		if k != client && v.Active+sessionTimeout < s.Now {
+			u.expired[k] = v
+			delete(s.Table, k)
+		}
+	}
+	x := s.Table[client]
+	if x != nil {
+		if r, has := x.Replies[seq]; has {
+			x.Active, u.duplicate = s.Now, true
+			s.push(u)
+			return r.Out, r.Result, r.Agree, false, nil
+		}
+		if seq <= x.Seq-sessionWindow {
+			s.revert(u)
+			return "session: request is too old", Something.Done, false, false, nil
+		}
+	}
+	if out, result, agree, watching, err = process(app, cmd); err != nil || !agree || watching {
+		s.revert(u)
+		return
+	}
+	if x == nil {
+		x = &session{Replies: map[int]reply{}}
+		s.Table[client] = x
+	}
+	x.Replies[seq], x.Active = reply{Out: out, Agree: agree, Result: result}, s.Now
+	if seq > x.Seq {
+		x.Seq = seq
+	}
+	for k := range x.Replies {
+		if k <= x.Seq-sessionWindow {
+			delete(x.Replies, k)
+		}
+	}
+	s.push(u)
+	return
+}
+
+/*
+撤销一条日志中的命令，in是"!"加上原命令，带有会话头部时恢复会话表，原命令是重复的命令时不需要App撤销。
+*/
+
+func (s *sessions) undoProcess(app App, in string) (out string, agree bool, err error) {
+	if !Something.IsStamped(strings.TrimPrefix(in, "!")) {
+		return app.UndoProcess(in)
+	}
+	_, _, _, cmd, _ := Something.Unstamp(strings.TrimPrefix(in, "!"))
+	if len(s.undo) == 0 {
+		return in, false, errors.New("Crown: undo a session command without a record")
+	}
+	u := s.undo[len(s.undo)-1]
+	s.undo = s.undo[:len(s.undo)-1]
+	s.revert(u)
+	if u.duplicate {
+		return in, true, nil
+	}
+	return app.UndoProcess("!" + cmd)
+}
+
+func (s *sessions) push(u sessionUndo) {
+	if len(s.undo) == maxSessionUndo {
+		s.undo = append(s.undo[:0], s.undo[maxSessionUndo/2:]...)
+	}
+	s.undo = append(s.undo, u)
+}
+
+func (s *sessions) revert(u sessionUndo) {
+	s.Now = u.now
+	if u.old == nil {
+		delete(s.Table, u.client)
+	} else {
+		s.Table[u.client] = u.old
+	}
+	for k, v := range u.expired {
+		s.Table[k] = v
+	}
+}
+
+/*
+快照中的会话表放在App快照前面，写成sessionPrefix、会话表的JSON、换行，之后是App的快照；
+没有会话表的快照就是App的快照，所以旧的备份仍然可以恢复。
+*/
+
+const sessionSnapshotPrefix = "@sessions:"
+
+func (s *sessions) wrap(snapshot string) (string, error) {
+	if len(s.Table) == 0 && s.Now == 0 {
+		return snapshot, nil
+	}
+	res, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return sessionSnapshotPrefix + string(res) + "\n" + snapshot, nil
+}
+
+func (s *sessions) unwrap(snapshot string) (string, error) {
+	*s = *newSessions()
+	if !strings.HasPrefix(snapshot, sessionSnapshotPrefix) {
+		return snapshot, nil
+	}
+	i := strings.IndexByte(snapshot, '\n')
+	if i < 0 {
+		return "", errors.New("Crown: broken session snapshot")
+	}
+	if err := json.Unmarshal([]byte(snapshot[len(sessionSnapshotPrefix):i]), s); err != nil {
+		return "", err
+	}
+	if s.Table == nil {
+		s.Table = map[string]*session{}
+	}
+	return snapshot[i+1:], nil
+}
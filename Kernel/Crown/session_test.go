@@ -0,0 +1,83 @@
+package Crown
+
+import (
+	"RaftDB/Kernel/Pipe/Something"
+	"strconv"
+	"testing"
+)
+
+/*
+一个计数器App，每条命令加一，撤销时减一。
+*/
+
+type counter struct {
+	n int
+}
+
+func (c *counter) Process(in string) (string, bool, bool, error) {
+	c.n++
+	return strconv.Itoa(c.n), true, false, nil
+}
+
+func (c *counter) UndoProcess(in string) (string, bool, error) {
+	c.n--
+	return in, true, nil
+}
+
+func (c *counter) ChangeProcessDelay(int, bool) {}
+
+func (c *counter) Init() func(string) (bool, string, string) {
+	c.n = 0
+	return func(string) (bool, string, string) { return false, "", "" }
+}
+
+func (c *counter) ToString() string {
+	return strconv.Itoa(c.n)
+}
+
+/*
+重复的序号返回第一次的回复；撤销按后进先出恢复会话表和App；会话在复制时间上过期。
+*/
+
+func TestSessions(t *testing.T) {
+	app, s := &counter{}, newSessions()
+	process := func(client string, seq int, at int64, want string) {
+		t.Helper()
+		if out, agree, _, err := s.process(app, Something.Stamp(client, seq, at, "inc")); err != nil || !agree || out != want {
+			t.Fatalf("%s %d at %d: %q %v %v, want %q", client, seq, at, out, agree, err, want)
+		}
+	}
+	process("a", 1, 10, "1")
+	process("a", 2, 20, "2")
+	process("a", 1, 30, "1")
+	process("b", 1, 40, "3")
+	if app.n != 3 || s.Now != 40 {
+		t.Fatalf("counter %d, now %d", app.n, s.Now)
+	}
+	for _, v := range []string{Something.Stamp("b", 1, 40, "inc"), Something.Stamp("a", 1, 30, "inc")} {
+		if _, _, err := s.undoProcess(app, "!"+v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if app.n != 2 || s.Now != 20 || s.Table["b"] != nil || s.Table["a"].Active != 20 {
+		t.Fatalf("counter %d, now %d, sessions %v", app.n, s.Now, s.Table)
+	}
+	process("b", 1, 20+sessionTimeout+1, "3")
+	if s.Table["a"] != nil {
+		t.Fatal("session a does not expire")
+	}
+	if _, _, err := s.undoProcess(app, "!"+Something.Stamp("b", 1, 20+sessionTimeout+1, "inc")); err != nil || s.Table["a"] == nil {
+		t.Fatalf("undo does not bring back session a: %v", err)
+	}
+	snapshot, err := s.wrap("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newSessions()
+	if v, err := r.unwrap(snapshot); err != nil || v != "app" || r.Now != s.Now || r.Table["a"].Replies[2].Out != "2" {
+		t.Fatalf("unwrap %q: %q, %v, %+v", snapshot, v, err, r)
+	}
+	if v, err := r.unwrap("plain"); err != nil || v != "plain" || len(r.Table) != 0 {
+		t.Fatalf("unwrap a plain snapshot: %q, %v", v, err)
+	}
+}
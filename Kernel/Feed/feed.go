@@ -0,0 +1,276 @@
+package Feed
+
+import (
+	"RaftDB/Kernel/Log"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+流式监听：监听事件从已提交的日志中得到，不经过Logic层，所以任何节点都能提供，leader切换、客户端断线都不会丢失事件。
+Hub持有App在已提交日志处的副本（Replica），按顺序执行新提交的日志，记下每条日志改变了哪些key以及改变前后的值，
+最近的事件保存在内存中。事件的版本（Revision）是所在日志的key。
+监听有节点内唯一的id，创建之后一直有效，每次轮询返回上次之后的事件，直到取消或者太久没有轮询。
+节点重启或者监听过期之后，客户端带着最后收到的版本重新创建监听，从这个版本之后继续，只要这个版本之后的事件还保存着。
+只使用已提交的日志，所以事件不会被撤销。
+*/
+
+const (
+	DefaultLimit = 100                   // 一次最多返回的事件数，请求没有给出时使用
+	maxHistory   = 100000                // 内存中保存的事件数，更早的事件丢弃，从更早的版本续订会失败
+	watchIdle    = time.Minute           // 监听超过这个时间没有轮询时删除
+	pollInterval = 10 * time.Millisecond // 没有新事件时检查已提交日志的间隔
+)
+
+const (
+	Put    = "put"
+	Delete = "delete"
+)
+
+var (
+	ErrNoWatch   = errors.New("Feed: no such watch, it is cancelled, expired or the node restarted")
+	ErrCompacted = errors.New("Feed: events after the revision are compacted")
+)
+
+/*
+一条日志对一个key的改变，HasOld为假时key之前不存在。
+*/
+
+type Change struct {
+	Type   string `json:"type"` // Put或者Delete
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"` // 改变之后的值，删除时为空
+	Old    string `json:"old,omitempty"`   // 改变之前的值
+	HasOld bool   `json:"hasOld"`
+	Rev    int64  `json:"rev,omitempty"` // App自己的数据版本（例如KVDB的多版本号），没有时为0
+}
+
+type Event struct {
+	Change
+	Revision Log.Key `json:"revision"` // 事件所在日志的key
+}
+
+/*
+监听的key：Prefix为真时匹配以Key开头的key；否则End不为空时匹配[Key, End)，End为空时只匹配Key。
+*/
+
+type Filter struct {
+	Key    string `json:"key"`
+	End    string `json:"end,omitempty"`
+	Prefix bool   `json:"prefix,omitempty"`
+}
+
+func (f Filter) Match(key string) bool {
+	if f.Prefix {
+		return strings.HasPrefix(key, f.Key)
+	}
+	if f.End != "" {
+		return f.Key <= key && key < f.End
+	}
+	return key == f.Key
+}
+
+/*
+App在已提交日志处的副本，由Crown实现，只在Hub的锁内调用。
+Init加载副本，返回副本所在的key，-1-1表示从第一条日志开始；Apply执行一条日志，返回它改变的key；
+Filter把监听命令转换成Filter，不读写App的状态。
+*/
+
+type Replica interface {
+	Init() (Log.Key, error)
+	Apply(content string) []Change
+	Filter(command string) (Filter, bool)
+}
+
+type watch struct {
+	filter Filter
+	after  Log.Key // 已经返回过的最后一个版本
+	active time.Time
+}
+
+type Hub struct {
+	logs    Log.LogSet
+	replica Replica
+	loaded  bool
+	applied Log.Key // 副本已经执行到的key
+	floor   Log.Key // 不大于floor的事件可能已经丢弃
+	history []Event // 按版本排序的最近的事件
+	watches map[int64]*watch
+	next    int64
+	m       sync.Mutex
+}
+
+func NewHub(logs Log.LogSet, replica Replica) *Hub {
+	return &Hub{logs: logs, replica: replica, watches: map[int64]*watch{}}
+}
+
+/*
+创建监听，从after之后开始，after为空时从当前已提交的位置开始。
+*/
+
+func (h *Hub) Create(command string, after *Log.Key) (int64, error) {
+	filter, ok := h.replica.Filter(command)
+	if !ok {
+		return 0, errors.New("Feed: not a watch command")
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	if err := h.advance(); err != nil {
+		return 0, err
+	}
+	w := &watch{filter: filter, after: h.applied, active: time.Now()}
+	if after != nil {
+		if after.Less(h.floor) {
+			return 0, ErrCompacted
+		}
+		w.after = *after
+	}
+	h.expire()
+	h.next++
+	h.watches[h.next] = w
+	return h.next, nil
+}
+
+/*
+长轮询：返回监听上次之后的事件，最多limit个，没有事件时最多等待wait。一条日志的事件总是一起返回，所以可能超过limit。
+第二个返回值是最后检查到的版本，客户端记住它，重新创建监听时从它之后继续。
+*/
+
+func (h *Hub) Poll(id int64, limit int, wait time.Duration) ([]Event, Log.Key, error) {
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		events, after, err := h.collect(id, limit)
+		left := time.Until(deadline)
+		if err != nil || len(events) > 0 || left <= 0 {
+			return events, after, err
+		}
+		if left > pollInterval {
+			left = pollInterval
+		}
+		time.Sleep(left)
+	}
+}
+
+func (h *Hub) collect(id int64, limit int) ([]Event, Log.Key, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	w, has := h.watches[id]
+	if !has {
+		return nil, Log.Key{Term: -1, Index: -1}, ErrNoWatch
+	}
+	w.active = time.Now()
+	if err := h.advance(); err != nil {
+		return nil, w.after, err
+	}
+	if w.after.Less(h.floor) {
+		delete(h.watches, id)
+		return nil, w.after, ErrCompacted
+	}
+	left, right := 0, len(h.history)
+	for left < right {
+		mid := (left + right) / 2
+		if h.history[mid].Revision.Greater(w.after) {
+			right = mid
+		} else {
+			left = mid + 1
+		}
+	}
+	var events []Event
+	for _, e := range h.history[left:] {
+		if len(events) >= limit && !e.Revision.Equals(events[len(events)-1].Revision) {
+			w.after = events[len(events)-1].Revision
+			return events, w.after, nil
+		}
+		if w.filter.Match(e.Key) {
+			events = append(events, e)
+		}
+	}
+	if h.applied.Greater(w.after) {
+		w.after = h.applied
+	}
+	return events, w.after, nil
+}
+
+/*
+取消监听，监听不存在时返回假。
+*/
+
+func (h *Hub) Cancel(id int64) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	_, has := h.watches[id]
+	delete(h.watches, id)
+	return has
+}
+
+/*
+副本执行到当前已提交的日志，第一次调用时加载副本。
+*/
+
+func (h *Hub) advance() error {
+	if !h.loaded {
+		base, err := h.replica.Init()
+		if err != nil {
+			return err
+		}
+		h.loaded, h.applied, h.floor = true, base, base
+	}
+	committed := h.logs.GetCommitted()
+	if !committed.Greater(h.applied) {
+		return nil
+	}
+	it := h.logs.Iterator()
+	defer it.Close()
+	it.Seek(h.applied)
+	for v, ok := it.Next(); ok && !v.K.Greater(committed); v, ok = it.Next() {
+		if !v.K.Greater(h.applied) {
+			continue
+		}
+		for _, c := range h.replica.Apply(v.V) {
+			h.history = append(h.history, Event{Change: c, Revision: v.K})
+		}
+		h.applied = v.K
+	}
+	if len(h.history) > maxHistory {
+		drop := len(h.history) - maxHistory/2
+		h.floor = h.history[drop-1].Revision
+		h.history = append(h.history[:0], h.history[drop:]...)
+	}
+	return nil
+}
+
+func (h *Hub) expire() {
+	for id, w := range h.watches {
+		if time.Since(w.active) > watchIdle {
+			delete(h.watches, id)
+		}
+	}
+}
+
+/*
+版本的文本形式是term.index，用于HTTP的事件id和客户端的命令行。
+*/
+
+func FormatRevision(k Log.Key) string {
+	return fmt.Sprintf("%d.%d", k.Term, k.Index)
+}
+
+func ParseRevision(s string) (Log.Key, error) {
+	res := strings.Split(s, ".")
+	if len(res) != 2 {
+		return Log.Key{}, fmt.Errorf("Feed: illegal revision %q", s)
+	}
+	term, err1 := strconv.Atoi(res[0])
+	index, err2 := strconv.Atoi(res[1])
+	if err1 != nil || err2 != nil {
+		return Log.Key{}, fmt.Errorf("Feed: illegal revision %q", s)
+	}
+	return Log.Key{Term: term, Index: index}, nil
+}
@@ -0,0 +1,150 @@
+package Feed
+
+import (
+	"RaftDB/Kernel/Log"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+最简单的键值副本：命令是write'k'v，一条命令可以写入多个key：write'k1'v1'k2'v2。
+*/
+
+type testReplica struct {
+	data map[string]string
+}
+
+func (r *testReplica) Init() (Log.Key, error) {
+	r.data = map[string]string{}
+	return Log.Key{Term: -1, Index: -1}, nil
+}
+
+func (r *testReplica) Apply(content string) []Change {
+	res := strings.Split(content, "'")
+	if len(res) < 3 || len(res)%2 == 0 || res[0] != "write" {
+		return nil
+	}
+	var changes []Change
+	for i := 1; i < len(res); i += 2 {
+		old, existed := r.data[res[i]]
+		r.data[res[i]] = res[i+1]
+		changes = append(changes, Change{Type: Put, Key: res[i], Value: res[i+1], Old: old, HasOld: existed})
+	}
+	return changes
+}
+
+func (r *testReplica) Filter(command string) (Filter, bool) {
+	res := strings.Split(command, "'")
+	switch {
+	case len(res) == 2 && res[0] == "watch":
+		return Filter{Key: res[1]}, true
+	case len(res) == 2 && res[0] == "prefix":
+		return Filter{Key: res[1], Prefix: true}, true
+	case len(res) == 3 && res[0] == "range":
+		return Filter{Key: res[1], End: res[2]}, true
+	}
+	return Filter{}, false
+}
+
+func newTestHub(contents ...string) (*Hub, Log.LogSet) {
+	logs := &Log.MemoryLogSet{}
+	logs.Init(-1, -1)
+	for i, v := range contents {
+		logs.Append(Log.Log{K: Log.Key{Term: 1, Index: i}, V: v})
+	}
+	return NewHub(logs, &testReplica{}), logs
+}
+
+func values(events []Event) string {
+	var res []string
+	for _, e := range events {
+		res = append(res, e.Key+"="+e.Value)
+	}
+	return strings.Join(res, ",")
+}
+
+func TestPoll(t *testing.T) {
+	hub, logs := newTestHub("write'a'1", "write'b'2'c'0", "write'a'3", "read'a", "write'ab'4")
+	if _, err := hub.Create("read'a", nil); err == nil {
+		t.Fatal("create a watch with a read command")
+	}
+	start := Log.Key{Term: -1, Index: -1}
+	a, _ := hub.Create("watch'a", &start)
+	if events, next, _ := hub.Poll(a, 0, 0); len(events) != 0 || !next.Equals(start) {
+		t.Fatalf("uncommitted events %v, next %v", events, next)
+	}
+	logs.Commit(Log.Key{Term: 1, Index: 3})
+	events, next, _ := hub.Poll(a, 0, 0)
+	if values(events) != "a=1,a=3" || events[1].Old != "1" || !events[1].HasOld || events[0].HasOld ||
+		!next.Equals(Log.Key{Term: 1, Index: 3}) {
+		t.Fatalf("events %v, next %v", events, next)
+	}
+	if events, _, _ := hub.Poll(a, 0, 0); len(events) != 0 {
+		t.Fatalf("events are returned twice: %v", events)
+	}
+	limited, _ := hub.Create("watch'a", &start)
+	if events, next, _ := hub.Poll(limited, 1, 0); len(events) != 1 || !next.Equals(events[0].Revision) {
+		t.Fatalf("limited events %v, next %v", events, next)
+	}
+	batch, _ := hub.Create("prefix'", &start)
+	if events, next, _ := hub.Poll(batch, 2, 0); values(events) != "a=1,b=2,c=0" || !next.Equals(events[2].Revision) {
+		t.Fatalf("events of a log are split: %v, next %v", events, next)
+	}
+	if events, _, _ := hub.Poll(batch, 2, 0); values(events) != "a=3" {
+		t.Fatalf("events after a log with several changes %v", events)
+	}
+	prefix, _ := hub.Create("prefix'a", &start)
+	ranged, _ := hub.Create("range'b'c", &start)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		logs.Commit(Log.Key{Term: 1, Index: 4})
+	}()
+	if events, next, _ = hub.Poll(a, 0, time.Second); len(events) != 0 || !next.Equals(Log.Key{Term: 1, Index: 4}) {
+		t.Fatalf("waited events %v, next %v", events, next)
+	}
+	if events, _, _ := hub.Poll(prefix, 0, 0); values(events) != "a=1,a=3,ab=4" {
+		t.Fatalf("prefix events %v", events)
+	}
+	if events, _, _ := hub.Poll(ranged, 0, 0); values(events) != "b=2" {
+		t.Fatalf("range events %v", events)
+	}
+	if !hub.Cancel(a) || hub.Cancel(a) {
+		t.Fatal("cancel a watch twice")
+	}
+	if _, _, err := hub.Poll(a, 0, 0); err != ErrNoWatch {
+		t.Fatalf("poll a cancelled watch: %v", err)
+	}
+}
+
+func TestCompacted(t *testing.T) {
+	hub, logs := newTestHub()
+	start := Log.Key{Term: -1, Index: -1}
+	w, _ := hub.Create("watch'a", &start)
+	for i := 0; i <= maxHistory; i++ {
+		logs.Append(Log.Log{K: Log.Key{Term: 1, Index: i}, V: "write'b'" + string(rune('a'+i%26))})
+	}
+	logs.Commit(logs.GetLast())
+	if _, _, err := hub.Poll(w, 0, 0); err != ErrCompacted {
+		t.Fatalf("poll a compacted watch: %v", err)
+	}
+	if _, err := hub.Create("watch'a", &start); err != ErrCompacted {
+		t.Fatalf("create a watch from a compacted revision: %v", err)
+	}
+	last := logs.GetLast()
+	if _, err := hub.Create("watch'a", &last); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevision(t *testing.T) {
+	k := Log.Key{Term: 3, Index: 14}
+	if res, err := ParseRevision(FormatRevision(k)); err != nil || !res.Equals(k) {
+		t.Fatalf("%v, %v", res, err)
+	}
+	for _, v := range []string{"", "3", "3.x", "3.1.4"} {
+		if _, err := ParseRevision(v); err == nil {
+			t.Fatalf("parse %q", v)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package Log
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"errors"
+	"io"
+)
+
+/*
+日志内容的编码，每条记录带着自己的编码标记，所以同一个文件或者同一批消息中可以混合不同的编码，改变配置之后旧的记录仍然可读。
+压缩后的内容用base64编码，不会出现换行和分隔符。
+*/
+
+type Codec string
+
+const (
+	Plain Codec = ""  // 不压缩
+	Flate Codec = "z" // flate压缩后base64编码
+)
+
+const MaxDecompressed = 64 << 20 // 解压后的最大长度，防止很短的恶意数据解压出耗尽内存的内容
+
+/*
+配置文件中的编码名称，空字符串和"none"表示不压缩。
+*/
+
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "", "none":
+		return Plain, nil
+	case "flate":
+		return Flate, nil
+	}
+	return Plain, errors.New("error: unknown codec " + name)
+}
+
+/*
+用codec编码v，返回实际使用的编码和编码后的内容。压缩后不比原来短时不压缩，返回Plain。
+*/
+
+func Compress(v string, codec Codec) (Codec, string) {
+	if codec != Flate || v == "" {
+		return Plain, v
+	}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	_, _ = w.Write([]byte(v))
+	_ = w.Close()
+	if res := base64.StdEncoding.EncodeToString(buf.Bytes()); len(res) < len(v) {
+		return Flate, res
+	}
+	return Plain, v
+}
+
+func Decompress(v string, codec Codec) (string, error) {
+	switch codec {
+	case Plain:
+		return v, nil
+	case Flate:
+		data, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return "", err
+		}
+		res, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), MaxDecompressed+1))
+		if err == nil && len(res) > MaxDecompressed {
+			return "", errors.New("error: decompressed log is too large")
+		}
+		return string(res), err
+	}
+	return "", errors.New("error: unknown codec " + string(codec))
+}
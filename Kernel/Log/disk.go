@@ -0,0 +1,532 @@
+package Log
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+/*
+磁盘日志系统，内存中只保留最近的一段日志（窗口）和每个段文件的key范围（稀疏索引），更早的日志按需从段文件中读取，
+最近读过的段文件解析后放在LRU缓存中。
+只有已经持久化的日志才会移出内存，而只有已提交的日志才会持久化，所以移出内存的日志不会被删除，磁盘上的段文件只追加。
+不大于trimmed的日志只在磁盘上，大于trimmed的日志都在内存中。
+*/
+
+type segment struct {
+	path  string
+	first Key
+	last  Key
+	index int // 第一条日志的全局下标
+	count int
+}
+
+type cachedSegment struct {
+	path string
+	logs []Log
+}
+
+type DiskLogSet struct {
+	recent    MemoryLogSet // 最近的日志，包括所有未持久化的日志
+	segments  []segment    // 稀疏索引，按顺序记录每个段文件中日志的key范围
+	trimmed   Key          // 已经移出内存的最大的key
+	window    int          // 内存中至少保留的日志条数
+	reader    Reader
+	cache     map[string]*list.Element
+	lru       *list.List
+	cacheSize int // 缓存的段文件个数
+	m         sync.Mutex
+}
+
+/*
+新建磁盘日志系统，window是内存中至少保留的日志条数，cacheSize是缓存的段文件个数。
+*/
+
+func NewDiskLogSet(window int, cacheSize int) *DiskLogSet {
+	if window < 2 {
+		window = 2
+	}
+	if cacheSize < 1 {
+		cacheSize = 1
+	}
+	return &DiskLogSet{
+		trimmed:   Key{-1, -1},
+		window:    window,
+		cache:     map[string]*list.Element{},
+		lru:       list.New(),
+		cacheSize: cacheSize,
+	}
+}
+
+func (d *DiskLogSet) SetReader(reader Reader) {
+	d.m.Lock()
+	d.reader = reader
+	d.m.Unlock()
+}
+
+/*
+更新稀疏索引，同一个段文件的多次追加合并成一项，这个段文件的缓存失效。
+之后把已经持久化的日志移出内存，直到内存中只剩window条。
+*/
+
+func (d *DiskLogSet) Persisted(path string, logs []Log) {
+	if len(logs) == 0 {
+		return
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	if n := len(d.segments); n > 0 && d.segments[n-1].path == path {
+		d.segments[n-1].last = logs[len(logs)-1].K
+		d.segments[n-1].count += len(logs)
+	} else {
+		d.segments = append(d.segments, segment{path: path, first: logs[0].K, last: logs[len(logs)-1].K, index: logs[0].I, count: len(logs)})
+	}
+	if e, has := d.cache[path]; has {
+		d.lru.Remove(e)
+		delete(d.cache, path)
+	}
+	if d.reader == nil {
+		return
+	}
+	if last, ok := d.recent.trim(d.window, logs[len(logs)-1].K); ok {
+		d.trimmed = last
+	}
+}
+
+func (d *DiskLogSet) Init(committedKeyTerm int, committedKeyIndex int) {
+	d.recent.Init(committedKeyTerm, committedKeyIndex)
+}
+
+func (d *DiskLogSet) GetLast() Key {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.last()
+}
+
+func (d *DiskLogSet) GetSecondLast() Key {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if res := d.recent.GetSecondLast(); !res.Equals(Key{-1, -1}) {
+		return res
+	}
+	if !d.recent.GetLast().Equals(Key{-1, -1}) {
+		return d.trimmed
+	}
+	res, _ := d.previousOnDisk(d.trimmed)
+	return res
+}
+
+func (d *DiskLogSet) GetCommitted() Key {
+	return d.recent.GetCommitted()
+}
+
+func (d *DiskLogSet) Append(content Log) { // 幂等的增加日志
+	d.m.Lock()
+	if d.last().Less(content.K) {
+		d.recent.Append(content)
+	}
+	d.m.Unlock()
+}
+
+func (d *DiskLogSet) GetPrevious(key Key) (Key, error) { // 如果key不存在，报错，如果不存在上一个返回-1-1
+	d.m.Lock()
+	defer d.m.Unlock()
+	if !key.Greater(d.trimmed) {
+		return d.previousOnDisk(key)
+	}
+	res, err := d.recent.GetPrevious(key)
+	if err == nil && res.Equals(Key{-1, -1}) {
+		res = d.trimmed
+	}
+	return res, err
+}
+
+func (d *DiskLogSet) GetNext(key Key) (Key, error) { // 如果key不存在，报错，如果key没有下一个返回-1-1
+	d.m.Lock()
+	defer d.m.Unlock()
+	if key.Equals(Key{-1, -1}) && len(d.segments) > 0 && !d.trimmed.Equals(Key{-1, -1}) {
+		return d.segments[0].first, nil
+	}
+	if key.Greater(d.trimmed) || key.Equals(Key{-1, -1}) {
+		return d.recent.GetNext(key)
+	}
+	s, logs, i, err := d.find(key)
+	if err != nil {
+		return Key{-1, -1}, err
+	}
+	if i+1 < len(logs) {
+		return logs[i+1].K, nil
+	}
+	if s+1 < len(d.segments) {
+		return d.segments[s+1].first, nil
+	}
+	res, _ := d.recent.GetNext(Key{-1, -1})
+	return res, nil
+}
+
+func (d *DiskLogSet) GetVByK(key Key) (string, error) { // 通过Key寻找指定日志，找不到返回空
+	d.m.Lock()
+	defer d.m.Unlock()
+	if key.Greater(d.trimmed) {
+		return d.recent.GetVByK(key)
+	}
+	_, logs, i, err := d.find(key)
+	if err != nil {
+		return "", err
+	}
+	return logs[i].V, nil
+}
+
+func (d *DiskLogSet) GetByIndex(i int) (Log, error) { // 内存中的日志按偏移取，磁盘上的先按下标找到段文件，再按偏移取
+	d.m.Lock()
+	defer d.m.Unlock()
+	if i >= d.recent.base { // recent.base只在持有d.m时改变
+		return d.recent.GetByIndex(i)
+	}
+	left, right := 0, len(d.segments)
+	for left < right {
+		mid := (left + right) / 2
+		if d.segments[mid].index+d.segments[mid].count <= i {
+			left = mid + 1
+		} else {
+			right = mid
+		}
+	}
+	err := errors.New("error: can not find this log by index")
+	if left == len(d.segments) || d.segments[left].index > i {
+		return Log{}, err
+	}
+	logs, e := d.load(d.segments[left])
+	if e != nil {
+		return Log{}, e
+	}
+	if i-d.segments[left].index >= len(logs) {
+		return Log{}, err
+	}
+	return logs[i-d.segments[left].index], nil
+}
+
+func (d *DiskLogSet) GetLastIndex() int { // 内存窗口为空时也是trimmed的全局下标
+	return d.recent.GetLastIndex()
+}
+
+func (d *DiskLogSet) Commit(key Key) (previousCommitted Key) { // 只在内存中提交，移出内存的日志一定已经提交
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.recent.Commit(key)
+}
+
+func (d *DiskLogSet) Remove(key Key) ([]Log, error) { // 删除日志直到自己的日志Key不大于key
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.trimmed.Equals(Key{-1, -1}) {
+		return d.recent.Remove(key)
+	}
+	if key.Less(d.trimmed) || d.recent.GetCommitted().Greater(key) {
+		return nil, errors.New("error: remove committed log")
+	}
+	if first, err := d.recent.GetNext(Key{-1, -1}); err != nil || key.Less(first) {
+		return d.recent.clear(), nil
+	}
+	return d.recent.Remove(key)
+}
+
+/*
+返回[begin, end]闭区间内的所有日志信息，范围内的段文件都会读进内存。
+复制、提交、持久化和备份都通过GetByIndex和Iterator逐条读取，不再调用它。
+
+Deprecated: 用Iterator从begin开始逐条读取代替。
+*/
+
+func (d *DiskLogSet) GetLogsByRange(begin Key, end Key) []Log {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.rangeLogs(begin, end)
+}
+
+/*
+返回[begin, end]区间内的所有日志的key，和GetLogsByRange一样会读取范围内的段文件。
+
+Deprecated: 用Iterator从begin开始逐条读取代替。
+*/
+
+func (d *DiskLogSet) GetKsByRange(begin Key, end Key) []Key {
+	d.m.Lock()
+	logs := d.rangeLogs(begin, end)
+	d.m.Unlock()
+	res := make([]Key, len(logs))
+	for i, v := range logs {
+		res[i] = v.K
+	}
+	return res
+}
+
+/*
+返回全部日志，会读取所有段文件，只适合在初始化时使用。
+
+Deprecated: 全部日志都会读进内存，用Iterator逐条读取代替。
+*/
+
+func (d *DiskLogSet) GetAll() []Log {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.trimmed.Equals(Key{-1, -1}) {
+		return d.recent.GetAll()
+	}
+	return d.rangeLogs(d.segments[0].first, d.last())
+}
+
+func (d *DiskLogSet) ToString() string {
+	d.m.Lock()
+	defer d.m.Unlock()
+	onDisk := 0
+	for _, v := range d.segments {
+		onDisk += v.count
+	}
+	res := fmt.Sprintf("==== disk logs ====\nsegments: %d\non disk: %d\ntrimmed: %v\ncached: %d\n",
+		len(d.segments), onDisk, d.trimmed, d.lru.Len())
+	return res + d.recent.ToString() + "\n==== disk logs ===="
+}
+
+func (d *DiskLogSet) last() Key {
+	if res := d.recent.GetLast(); !res.Equals(Key{-1, -1}) {
+		return res
+	}
+	return d.trimmed
+}
+
+func (d *DiskLogSet) previousOnDisk(key Key) (Key, error) {
+	s, logs, i, err := d.find(key)
+	if err != nil {
+		return Key{-1, -1}, err
+	}
+	if i > 0 {
+		return logs[i-1].K, nil
+	}
+	if s > 0 {
+		return d.segments[s-1].last, nil
+	}
+	return Key{-1, -1}, nil
+}
+
+/*
+在段文件中寻找key，返回段的序号、段中的全部日志和key在段中的位置。
+*/
+
+func (d *DiskLogSet) find(key Key) (int, []Log, int, error) {
+	err := errors.New("error: can not find this log by key")
+	left, right := 0, len(d.segments)
+	for left < right {
+		mid := (left + right) / 2
+		if d.segments[mid].last.Less(key) {
+			left = mid + 1
+		} else {
+			right = mid
+		}
+	}
+	if left == len(d.segments) || d.segments[left].first.Greater(key) {
+		return 0, nil, 0, err
+	}
+	logs, e := d.load(d.segments[left])
+	if e != nil {
+		return 0, nil, 0, e
+	}
+	l, r := 0, len(logs)-1
+	for l <= r {
+		mid := (l + r) / 2
+		if logs[mid].K.Equals(key) {
+			return left, logs, mid, nil
+		} else if logs[mid].K.Greater(key) {
+			r = mid - 1
+		} else {
+			l = mid + 1
+		}
+	}
+	return 0, nil, 0, err
+}
+
+/*
+读取并解析一个段文件，使用LRU缓存。全局下标按段的第一条日志的下标和位置重新计算，兼容没有全局下标的旧格式。
+*/
+
+func (d *DiskLogSet) load(s segment) ([]Log, error) {
+	path := s.path
+	if e, has := d.cache[path]; has {
+		d.lru.MoveToFront(e)
+		return e.Value.(*cachedSegment).logs, nil
+	}
+	if d.reader == nil {
+		return nil, errors.New("error: disk log set has no reader")
+	}
+	var str string
+	if err := d.reader.Read(path, &str); err != nil {
+		return nil, err
+	}
+	var logs []Log
+	for _, v := range strings.Split(str, "\n") {
+		if res, err := StringToLog(v); err == nil {
+			res.I = s.index + len(logs)
+			logs = append(logs, res)
+		}
+	}
+	d.cache[path] = d.lru.PushFront(&cachedSegment{path: path, logs: logs})
+	for d.lru.Len() > d.cacheSize {
+		e := d.lru.Back()
+		d.lru.Remove(e)
+		delete(d.cache, e.Value.(*cachedSegment).path)
+	}
+	return logs, nil
+}
+
+/*
+begin和end都存在时返回[begin, end]内的日志，先从段文件中取出不大于trimmed的部分，再从内存中取出剩下的部分。
+*/
+
+func (d *DiskLogSet) rangeLogs(begin Key, end Key) []Log {
+	if begin.Greater(d.trimmed) {
+		return d.recent.GetLogsByRange(begin, end)
+	}
+	if begin.Greater(end) {
+		return []Log{}
+	}
+	if end.Greater(d.trimmed) {
+		if _, err := d.recent.GetVByK(end); err != nil {
+			return []Log{}
+		}
+	} else if _, _, _, err := d.find(end); err != nil {
+		return []Log{}
+	}
+	s, logs, i, err := d.find(begin)
+	if err != nil {
+		return []Log{}
+	}
+	res := []Log{}
+	for done := false; !done && s < len(d.segments); s, i = s+1, -1 {
+		if i == -1 {
+			if logs, err = d.load(d.segments[s]); err != nil {
+				return []Log{}
+			}
+			i = 0
+		}
+		for ; i < len(logs); i++ {
+			if logs[i].K.Greater(end) || logs[i].K.Greater(d.trimmed) {
+				done = true
+				break
+			}
+			res = append(res, logs[i])
+		}
+	}
+	if end.Greater(d.trimmed) {
+		first, _ := d.recent.GetNext(Key{-1, -1})
+		res = append(res, d.recent.GetLogsByRange(first, end)...)
+	}
+	return res
+}
+
+/*
+快照包括稀疏索引、trimmed和内存窗口的迭代器：不大于trimmed的日志已经提交，段文件只追加，之后再读也不会变化；
+大于trimmed的日志来自内存窗口的快照。段文件按需逐个读取，不会一次把整个范围读进内存。
+*/
+
+func (d *DiskLogSet) Iterator() Iterator {
+	d.m.Lock()
+	it := &diskIterator{
+		d:        d,
+		segments: append([]segment{}, d.segments...),
+		trimmed:  d.trimmed,
+		recent:   d.recent.Iterator(),
+	}
+	d.m.Unlock()
+	it.Seek(Key{-1, -1})
+	return it
+}
+
+type diskIterator struct {
+	d        *DiskLogSet
+	segments []segment
+	trimmed  Key
+	recent   Iterator
+	segment  int   // 正在读取的段文件，等于len(segments)时读取内存窗口
+	logs     []Log // 正在读取的段文件中的日志
+	pos      int
+}
+
+func (it *diskIterator) Seek(key Key) {
+	if it.recent == nil { // 已经关闭或者读取段文件失败
+		return
+	}
+	it.logs, it.pos = nil, 0
+	if it.trimmed.Equals(Key{-1, -1}) || key.Greater(it.trimmed) {
+		it.segment = len(it.segments)
+		it.recent.Seek(key)
+		return
+	}
+	it.recent.Seek(Key{-1, -1})
+	left, right := 0, len(it.segments)
+	for left < right {
+		mid := (left + right) / 2
+		if it.segments[mid].last.Less(key) {
+			left = mid + 1
+		} else {
+			right = mid
+		}
+	}
+	it.segment = left
+	if it.load() {
+		for it.pos < len(it.logs) && it.logs[it.pos].K.Less(key) {
+			it.pos++
+		}
+	}
+}
+
+func (it *diskIterator) Next() (Log, bool) {
+	for it.segment < len(it.segments) {
+		if it.logs == nil && !it.load() {
+			return Log{}, false
+		}
+		if it.pos < len(it.logs) && !it.logs[it.pos].K.Greater(it.trimmed) {
+			it.pos++
+			return it.logs[it.pos-1], true
+		}
+		if it.pos < len(it.logs) { // 之后的日志都在内存窗口中
+			it.segment = len(it.segments)
+			break
+		}
+		it.segment, it.logs, it.pos = it.segment+1, nil, 0
+	}
+	if it.recent == nil {
+		return Log{}, false
+	}
+	return it.recent.Next()
+}
+
+func (it *diskIterator) Close() {
+	if it.recent != nil {
+		it.recent.Close()
+	}
+	it.d, it.segments, it.logs, it.recent = nil, nil, nil, nil
+}
+
+/*
+读取当前段文件，读取失败时结束迭代。
+*/
+
+func (it *diskIterator) load() bool {
+	if it.segment >= len(it.segments) || it.d == nil {
+		return false
+	}
+	it.d.m.Lock()
+	logs, err := it.d.load(it.segments[it.segment])
+	it.d.m.Unlock()
+	if err != nil {
+		it.segment, it.recent = len(it.segments), nil
+		return false
+	}
+	if logs == nil { // 空的段文件
+		logs = []Log{}
+	}
+	it.logs, it.pos = logs, 0
+	return true
+}
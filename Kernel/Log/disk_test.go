@@ -0,0 +1,221 @@
+package Log
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+type mapReader map[string]string
+
+func (m mapReader) Read(path string, content *string) error {
+	if v, has := m[path]; has {
+		*content = v
+		return nil
+	}
+	return errors.New("no such file " + path)
+}
+
+/*
+模拟Bottom的存储：提交之后把新提交的日志按每段3条写入段文件，再通知日志系统。
+*/
+
+type diskHarness struct {
+	files     mapReader
+	segment   int
+	count     int
+	persisted Key
+}
+
+func (h *diskHarness) persist(d *DiskLogSet) {
+	committed := d.GetCommitted()
+	if !h.persisted.Less(committed) {
+		return
+	}
+	begin, _ := d.GetNext(h.persisted)
+	for _, v := range d.GetLogsByRange(begin, committed) {
+		if h.count == 3 {
+			h.segment, h.count = h.segment+1, 0
+		}
+		path := fmt.Sprintf("log.%d", h.segment)
+		h.files[path] += LogToString(v) + "\n"
+		h.count++
+		d.Persisted(path, []Log{v})
+	}
+	h.persisted = committed
+}
+
+/*
+同样的操作序列分别作用于MemoryLogSet和DiskLogSet，两者的每个返回值都必须相同。
+*/
+
+func TestDiskLogSetMatchesMemory(t *testing.T) {
+	spilled := 0
+	for seed := int64(1); seed <= 50; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		var m MemoryLogSet
+		m.Init(-1, -1)
+		d := NewDiskLogSet(2, 2)
+		h := &diskHarness{files: mapReader{}, persisted: Key{-1, -1}}
+		d.SetReader(h.files)
+		d.Init(-1, -1)
+		term, index := 0, 0
+		snapshots, expected := make([]Iterator, 30), make([][]Log, 30)
+		randomKey := func() Key {
+			return Key{Term: r.Intn(term+2) - 1, Index: r.Intn(index+3) - 1}
+		}
+		for step := 0; step < 400; step++ {
+			switch r.Intn(10) {
+			case 0, 1, 2:
+				if r.Intn(4) == 0 {
+					term, index = term+1, 0
+				}
+				v := Log{K: Key{term, index}, V: fmt.Sprint(step)}
+				index++
+				m.Append(v)
+				d.Append(v)
+			case 3:
+				k := randomKey()
+				a, errA := m.Remove(k)
+				b, errB := d.Remove(k)
+				if (errA == nil) != (errB == nil) || len(a) != len(b) {
+					t.Fatalf("seed %d step %d: remove %v gives %v %v and %v %v", seed, step, k, a, errA, b, errB)
+				}
+			case 4:
+				k := randomKey()
+				if a, b := m.Commit(k), d.Commit(k); a != b {
+					t.Fatalf("seed %d step %d: commit %v gives %v and %v", seed, step, k, a, b)
+				}
+				h.persist(d)
+			case 5:
+				k := randomKey()
+				a, errA := m.GetNext(k)
+				b, errB := d.GetNext(k)
+				if a != b || (errA == nil) != (errB == nil) {
+					t.Fatalf("seed %d step %d: next of %v is %v and %v", seed, step, k, a, b)
+				}
+				a, errA = m.GetPrevious(k)
+				b, errB = d.GetPrevious(k)
+				if a != b || (errA == nil) != (errB == nil) {
+					t.Fatalf("seed %d step %d: previous of %v is %v and %v", seed, step, k, a, b)
+				}
+			case 6:
+				k := randomKey()
+				a, errA := m.GetVByK(k)
+				b, errB := d.GetVByK(k)
+				if a != b || (errA == nil) != (errB == nil) {
+					t.Fatalf("seed %d step %d: value of %v is %q and %q", seed, step, k, a, b)
+				}
+			default:
+				begin, end := randomKey(), randomKey()
+				if a, b := m.GetLogsByRange(begin, end), d.GetLogsByRange(begin, end); !reflect.DeepEqual(a, b) {
+					t.Fatalf("seed %d step %d: range [%v, %v] is %v and %v", seed, step, begin, end, a, b)
+				}
+				if a, b := m.GetKsByRange(begin, end), d.GetKsByRange(begin, end); !reflect.DeepEqual(a, b) {
+					t.Fatalf("seed %d step %d: keys [%v, %v] are %v and %v", seed, step, begin, end, a, b)
+				}
+			}
+			if m.GetLast() != d.GetLast() || m.GetSecondLast() != d.GetSecondLast() || m.GetCommitted() != d.GetCommitted() {
+				t.Fatalf("seed %d step %d: last %v %v, second last %v %v", seed, step,
+					m.GetLast(), d.GetLast(), m.GetSecondLast(), d.GetSecondLast())
+			}
+			if m.GetLastIndex() != d.GetLastIndex() {
+				t.Fatalf("seed %d step %d: last index %d and %d", seed, step, m.GetLastIndex(), d.GetLastIndex())
+			}
+			at := r.Intn(m.GetLastIndex()+3) - 1
+			x, errX := m.GetByIndex(at)
+			y, errY := d.GetByIndex(at)
+			if x != y || (errX == nil) != (errY == nil) {
+				t.Fatalf("seed %d step %d: log %d is %v and %v", seed, step, at, x, y)
+			}
+			if a, b := m.GetAll(), d.GetAll(); len(a) != 0 && !reflect.DeepEqual(a, b) {
+				t.Fatalf("seed %d step %d: all logs are %v and %v", seed, step, a, b)
+			}
+			if step%10 == 0 {
+				k := randomKey()
+				a, b := m.Iterator(), d.Iterator()
+				a.Seek(k)
+				b.Seek(k)
+				if x, y := drain(a), drain(b); !reflect.DeepEqual(x, y) {
+					t.Fatalf("seed %d step %d: iterators from %v give %v and %v", seed, step, k, x, y)
+				}
+				if snapshots[step%30] != nil {
+					snapshots[step%30].Close()
+				}
+				snapshots[step%30], expected[step%30] = d.Iterator(), d.GetAll()
+			}
+		}
+		for i, it := range snapshots { // 创建之后又经过了删除、追加和移出内存，迭代结果仍然是创建时的日志
+			if it != nil {
+				if got := drain(it); len(expected[i]) != 0 && !reflect.DeepEqual(got, expected[i]) {
+					t.Fatalf("seed %d: snapshot %d gives %v, want %v", seed, i, got, expected[i])
+				}
+			}
+		}
+		if !d.trimmed.Equals(Key{-1, -1}) {
+			spilled++
+		}
+	}
+	if spilled < 25 {
+		t.Fatalf("only %d seeds move logs out of memory", spilled)
+	}
+}
+
+func drain(it Iterator) []Log {
+	res := []Log{}
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		res = append(res, v)
+	}
+	it.Close()
+	return res
+}
+
+/*
+重启时按段文件重新加载，移出内存的日志从磁盘读取。
+*/
+
+func TestDiskLogSetReload(t *testing.T) {
+	files := mapReader{}
+	var all []Log
+	for i := 0; i < 10; i++ {
+		v := Log{K: Key{1, i}, I: i, V: fmt.Sprint(i)}
+		all = append(all, v)
+		if i < 4 { // 第一个段文件是没有全局下标的旧格式
+			files["log.0"] += fmt.Sprintf("1$%d^%d\n", i, i)
+		} else {
+			files[fmt.Sprintf("log.%d", i/4)] += LogToString(v) + "\n"
+		}
+	}
+	d := NewDiskLogSet(2, 1)
+	d.SetReader(files)
+	for s := 0; s < 3; s++ {
+		var contents []Log
+		end := s*4 + 4
+		if end > len(all) {
+			end = len(all)
+		}
+		for _, v := range all[s*4 : end] {
+			d.Append(v)
+			contents = append(contents, v)
+		}
+		d.Persisted(fmt.Sprintf("log.%d", s), contents)
+	}
+	d.Init(1, 9)
+	if n := len(d.recent.GetAll()); n != 2 {
+		t.Fatalf("%d logs in memory, want 2", n)
+	}
+	if !reflect.DeepEqual(d.GetAll(), all) {
+		t.Fatalf("all logs are %v", d.GetAll())
+	}
+	if v, err := d.GetVByK(Key{1, 5}); err != nil || v != "5" {
+		t.Fatalf("value of {1 5} is %q, %v", v, err)
+	}
+	if v, err := d.GetByIndex(1); err != nil || v != all[1] {
+		t.Fatalf("log 1 is %v, %v", v, err)
+	}
+	if _, err := d.Remove(Key{1, 3}); err == nil {
+		t.Fatal("remove committed logs on disk")
+	}
+}
@@ -8,20 +8,85 @@ import (
 	"sync"
 )
 
-// 必须保证并发安全
-
 type Key struct {
 	Term  int
 	Index int
 }
 
+/*
+I是日志的全局下标，和标准Raft的log index相同：第一条日志为0，之后每条加一，不随任期重置。
+日志集合是连续的，I由Append按位置分配，所以前缀相同的两份日志中同一条日志的I也相同。
+*/
+
 type Log struct {
 	K Key
+	I int
 	V string
 }
 
-type LogSet struct {
+/*
+日志系统接口，Logic、Bottom和Crown都通过它访问日志，必须保证并发安全。
+MemoryLogSet把全部日志放在内存中，DiskLogSet只在内存中保留最近的日志，更早的日志从磁盘读取。
+*/
+
+type LogSet interface {
+	Init(committedKeyTerm int, committedKeyIndex int)
+	GetLast() Key
+	GetSecondLast() Key
+	GetCommitted() Key
+	Append(content Log)
+	GetPrevious(key Key) (Key, error)
+	GetNext(key Key) (Key, error)
+	GetVByK(key Key) (string, error)
+	GetByIndex(i int) (Log, error) // 按全局下标取日志，O(1)定位
+	GetLastIndex() int             // 最后一条日志的全局下标，没有日志时返回-1
+	Commit(key Key) (previousCommitted Key)
+	Remove(key Key) ([]Log, error)
+	GetLogsByRange(begin Key, end Key) []Log
+	GetKsByRange(begin Key, end Key) []Key
+	GetAll() []Log
+	Iterator() Iterator
+	ToString() string
+}
+
+/*
+日志迭代器，创建时取得日志的快照，之后的Append和Remove不影响迭代的结果，可以和它们并发执行。
+迭代器本身不能在多个协程中同时使用，用完后调用Close释放快照。
+*/
+
+type Iterator interface {
+	Seek(key Key)      // 定位到第一条不小于key的日志
+	Next() (Log, bool) // 返回当前日志并后移，没有更多日志时返回假
+	Close()
+}
+
+/*
+日志持久化后可以移出内存的日志系统实现这个接口，Bottom在加载日志之前给出读取磁盘的Reader，每次把日志写入磁盘文件后通知它。
+*/
+
+type Spiller interface {
+	SetReader(reader Reader)
+	Persisted(path string, logs []Log) // logs已经按顺序追加到了path文件的末尾
+}
+
+type Reader interface {
+	Read(path string, content *string) error
+}
+
+/*
+App在一条已提交日志处的状态，K和I是这条日志的key和全局下标，V是App给出的快照内容。
+加载快照之后只需要重放K之后的日志。
+*/
+
+type Snapshot struct {
+	K Key    `json:"key"`
+	I int    `json:"index"`
+	V string `json:"value"`
+}
+
+type MemoryLogSet struct {
 	logs         []Log
+	base         int // logs[0]的全局下标，logs为空时是下一条日志的全局下标
 	committedKey Key
 	m            sync.RWMutex
 }
@@ -44,8 +109,20 @@ func (k Key) Equals(key Key) bool {
 	return k.Term == key.Term && k.Index == key.Index
 }
 
+/*
+格式为term$index#global^value，旧的term$index^value格式仍然可以解析，这时全局下标为-1，由加载方按顺序补上。
+压缩的日志格式为term$index#global~codec^压缩后的value。
+*/
+
 func LogToString(content Log) string {
-	return fmt.Sprintf("%d$%d^%s", content.K.Term, content.K.Index, content.V)
+	return fmt.Sprintf("%d$%d#%d^%s", content.K.Term, content.K.Index, content.I, content.V)
+}
+
+func CompressedLogToString(content Log, codec Codec) string {
+	if codec, v := Compress(content.V, codec); codec != Plain {
+		return fmt.Sprintf("%d$%d#%d~%s^%s", content.K.Term, content.K.Index, content.I, codec, v)
+	}
+	return LogToString(content)
 }
 
 func StringToLog(v string) (content Log, err error) {
@@ -55,6 +132,12 @@ func StringToLog(v string) (content Log, err error) {
 		return
 	}
 	logStr := res[1]
+	if res = strings.SplitN(res[0], "~", 2); len(res) == 2 {
+		var e error
+		if logStr, e = Decompress(logStr, Codec(res[1])); e != nil {
+			return content, e
+		}
+	}
 	res = strings.SplitN(res[0], "$", 2)
 	if len(res) < 2 {
 		return
@@ -63,18 +146,25 @@ func StringToLog(v string) (content Log, err error) {
 	if err != nil {
 		return
 	}
-	index, err := strconv.Atoi(res[1])
+	global := -1
+	res = strings.SplitN(res[1], "#", 2)
+	if len(res) == 2 {
+		if global, err = strconv.Atoi(res[1]); err != nil {
+			return
+		}
+	}
+	index, err := strconv.Atoi(res[0])
 	if err != nil {
 		return
 	}
-	return Log{Key{Term: term, Index: index}, logStr}, nil
+	return Log{Key{Term: term, Index: index}, global, logStr}, nil
 }
 
-func (l *LogSet) Init(committedKeyTerm int, committedKeyIndex int) {
+func (l *MemoryLogSet) Init(committedKeyTerm int, committedKeyIndex int) {
 	l.committedKey = Key{Term: committedKeyTerm, Index: committedKeyIndex}
 }
 
-func (l *LogSet) GetLast() Key {
+func (l *MemoryLogSet) GetLast() Key {
 	res := Key{Term: -1, Index: -1}
 	l.m.RLock()
 	if len(l.logs) >= 1 {
@@ -84,7 +174,7 @@ func (l *LogSet) GetLast() Key {
 	return res
 }
 
-func (l *LogSet) GetSecondLast() Key {
+func (l *MemoryLogSet) GetSecondLast() Key {
 	res := Key{Term: -1, Index: -1}
 	l.m.RLock()
 	if len(l.logs) >= 2 {
@@ -94,22 +184,25 @@ func (l *LogSet) GetSecondLast() Key {
 	return res
 }
 
-func (l *LogSet) GetCommitted() Key {
+func (l *MemoryLogSet) GetCommitted() Key {
+	l.m.RLock()
+	defer l.m.RUnlock()
 	return l.committedKey
 }
 
-func (l *LogSet) Append(content Log) { // 幂等的增加日志
+func (l *MemoryLogSet) Append(content Log) { // 幂等的增加日志，全局下标按位置分配，忽略content.I
 	l.m.Lock()
 	if len(l.logs) == 0 || l.logs[len(l.logs)-1].K.Less(content.K) {
+		content.I = l.base + len(l.logs)
 		l.logs = append(l.logs, content)
 	}
 	l.m.Unlock()
 }
 
-func (l *LogSet) GetPrevious(key Key) (Key, error) { // 如果key不存在，报错，如果不存在上一个返回-1-1
+func (l *MemoryLogSet) GetPrevious(key Key) (Key, error) { // 如果key不存在，报错，如果不存在上一个返回-1-1
 	l.m.RLock()
 	res := Key{Term: -1, Index: -1}
-	if l.Iterator(key) == -1 {
+	if l.index(key) == -1 {
 		l.m.RUnlock()
 		return res, errors.New("there is no your key")
 	}
@@ -129,14 +222,14 @@ func (l *LogSet) GetPrevious(key Key) (Key, error) { // 如果key不存在，报
 	return res, nil
 }
 
-func (l *LogSet) GetNext(key Key) (Key, error) { // 如果key不存在，报错，如果key没有下一个返回-1-1
+func (l *MemoryLogSet) GetNext(key Key) (Key, error) { // 如果key不存在，报错，如果key没有下一个返回-1-1
 	l.m.RLock()
 	res := Key{Term: -1, Index: -1}
 	if key.Equals(Key{-1, -1}) && len(l.logs) > 0 {
 		l.m.RUnlock()
 		return l.logs[0].K, nil
 	}
-	if l.Iterator(key) == -1 {
+	if l.index(key) == -1 {
 		l.m.RUnlock()
 		return res, errors.New("there is no your key")
 	}
@@ -156,7 +249,7 @@ func (l *LogSet) GetNext(key Key) (Key, error) { // 如果key不存在，报错
 	return res, nil
 }
 
-func (l *LogSet) GetVByK(key Key) (string, error) { // 通过Key寻找指定日志，找不到返回空
+func (l *MemoryLogSet) GetVByK(key Key) (string, error) { // 通过Key寻找指定日志，找不到返回空
 	var res string
 	err := errors.New("error: can not find this log by key")
 	l.m.RLock()
@@ -181,9 +274,28 @@ func (l *LogSet) GetVByK(key Key) (string, error) { // 通过Key寻找指定日
 	}
 }
 
-func (l *LogSet) Commit(key Key) (previousCommitted Key) { // 提交所有小于等于key的日志，幂等的提交日志
+func (l *MemoryLogSet) GetByIndex(i int) (Log, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	if i < l.base || i-l.base >= len(l.logs) {
+		return Log{}, errors.New("error: can not find this log by index")
+	}
+	return l.logs[i-l.base], nil
+}
+
+func (l *MemoryLogSet) GetLastIndex() int {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	return l.base + len(l.logs) - 1
+}
+
+func (l *MemoryLogSet) Commit(key Key) (previousCommitted Key) { // 提交所有小于等于key的日志，幂等的提交日志
 	l.m.Lock()
 	previousCommitted = l.committedKey
+	if len(l.logs) == 0 {
+		l.m.Unlock()
+		return
+	}
 	left, right := 0, len(l.logs)-1
 	for left < right {
 		mid := (left + right + 1) / 2
@@ -200,10 +312,14 @@ func (l *LogSet) Commit(key Key) (previousCommitted Key) { // 提交所有小于
 	return
 }
 
-func (l *LogSet) Remove(key Key) ([]Log, error) { // 删除日志直到自己的日志Key不大于key
+func (l *MemoryLogSet) Remove(key Key) ([]Log, error) { // 删除日志直到自己的日志Key不大于key
 	l.m.Lock()
 	var ret []Log
 	err := errors.New("error: remove committed log")
+	if len(l.logs) == 0 {
+		l.m.Unlock()
+		return ret, nil
+	}
 	left, right := 0, len(l.logs)-1
 	for left < right {
 		mid := (left + right + 1) / 2
@@ -220,7 +336,7 @@ func (l *LogSet) Remove(key Key) ([]Log, error) { // 删除日志直到自己的
 		}
 		ret = make([]Log, len(l.logs)-left-1)
 		copy(ret, l.logs[left+1:len(l.logs)])
-		l.logs = l.logs[0 : left+1]
+		l.logs = l.logs[0 : left+1 : left+1] // 截断容量，之后的Append重新分配数组，不会覆盖迭代器快照中的日志
 	} else {
 		if !l.committedKey.Equals(Key{-1, -1}) {
 			l.m.Unlock()
@@ -233,7 +349,7 @@ func (l *LogSet) Remove(key Key) ([]Log, error) { // 删除日志直到自己的
 	return ret, nil
 }
 
-func (l *LogSet) Iterator(key Key) int { // 根据Key返回迭代器，没找到返回-1，线程不安全
+func (l *MemoryLogSet) index(key Key) int { // 根据Key返回下标，没找到返回-1，线程不安全
 	left, right := 0, len(l.logs)-1
 	for left <= right {
 		mid := (left + right) / 2
@@ -248,9 +364,9 @@ func (l *LogSet) Iterator(key Key) int { // 根据Key返回迭代器，没找到
 	return -1
 }
 
-func (l *LogSet) GetLogsByRange(begin Key, end Key) []Log { // 返回 [begin, end]闭区间内的所有日志信息
+func (l *MemoryLogSet) GetLogsByRange(begin Key, end Key) []Log { // 返回 [begin, end]闭区间内的所有日志信息
 	l.m.RLock()
-	beginIter, endIter := l.Iterator(begin), l.Iterator(end)
+	beginIter, endIter := l.index(begin), l.index(end)
 	if beginIter == -1 || endIter == -1 || beginIter > endIter {
 		l.m.RUnlock()
 		return []Log{}
@@ -262,9 +378,9 @@ func (l *LogSet) GetLogsByRange(begin Key, end Key) []Log { // 返回 [begin, en
 	}
 }
 
-func (l *LogSet) GetKsByRange(begin Key, end Key) []Key { // 返回 [begin, end]区间内的所有日志信息
+func (l *MemoryLogSet) GetKsByRange(begin Key, end Key) []Key { // 返回 [begin, end]区间内的所有日志信息
 	l.m.RLock()
-	beginIter, endIter := l.Iterator(begin), l.Iterator(end)
+	beginIter, endIter := l.index(begin), l.index(end)
 	if beginIter == -1 || endIter == -1 || beginIter > endIter {
 		l.m.RUnlock()
 		return []Key{}
@@ -278,13 +394,90 @@ func (l *LogSet) GetKsByRange(begin Key, end Key) []Key { // 返回 [begin, end]
 	}
 }
 
-func (l *LogSet) GetAll() []Log { // 线程不安全
-	return l.logs
+func (l *MemoryLogSet) GetAll() []Log { // 返回全部日志的副本
+	l.m.RLock()
+	res := make([]Log, len(l.logs))
+	copy(res, l.logs)
+	l.m.RUnlock()
+	return res
 }
 
-func (l *LogSet) ToString() string {
+/*
+快照是日志切片本身，截断了容量，Append只会写在快照之外，Remove截断后也会重新分配数组，所以不需要复制。
+*/
+
+func (l *MemoryLogSet) Iterator() Iterator {
 	l.m.RLock()
-	res := fmt.Sprintf("==== logs %d ====\ncontents: %v\ncommittedKey: %v\n==== logs ====", len(l.logs), l.logs, l.committedKey)
+	it := &memoryIterator{logs: l.logs[:len(l.logs):len(l.logs)]}
+	l.m.RUnlock()
+	return it
+}
+
+type memoryIterator struct {
+	logs []Log
+	pos  int
+}
+
+func (it *memoryIterator) Seek(key Key) {
+	left, right := 0, len(it.logs)
+	for left < right {
+		mid := (left + right) / 2
+		if it.logs[mid].K.Less(key) {
+			left = mid + 1
+		} else {
+			right = mid
+		}
+	}
+	it.pos = left
+}
+
+func (it *memoryIterator) Next() (Log, bool) {
+	if it.pos >= len(it.logs) {
+		return Log{}, false
+	}
+	it.pos++
+	return it.logs[it.pos-1], true
+}
+
+func (it *memoryIterator) Close() {
+	it.logs, it.pos = nil, 0
+}
+
+func (l *MemoryLogSet) ToString() string {
+	l.m.RLock()
+	res := fmt.Sprintf("==== logs %d ====\ncontents: %v\nlastIndex: %d\ncommittedKey: %v\n==== logs ====",
+		len(l.logs), l.logs, l.base+len(l.logs)-1, l.committedKey)
 	l.m.RUnlock()
 	return res
 }
+
+/*
+从头部移出不大于until的日志，至少保留keep条，返回最后一条被移出的日志的key，没有移出时第二个返回值为假。
+*/
+
+func (l *MemoryLogSet) trim(keep int, until Key) (Key, bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	n := 0
+	for len(l.logs)-n > keep && !l.logs[n].K.Greater(until) {
+		n++
+	}
+	if n == 0 {
+		return Key{-1, -1}, false
+	}
+	last := l.logs[n-1].K
+	l.logs, l.base = append([]Log{}, l.logs[n:]...), l.base+n
+	return last, true
+}
+
+/*
+删除全部日志，不检查是否提交，由调用方保证。
+*/
+
+func (l *MemoryLogSet) clear() []Log {
+	l.m.Lock()
+	ret := l.logs
+	l.logs = []Log{}
+	l.m.Unlock()
+	return ret
+}
@@ -2,10 +2,14 @@ package Log
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 )
 
 func TestLogToString(t *testing.T) {
+	if v, err := StringToLog("2$5^write'a'b"); err != nil || v != (Log{K: Key{2, 5}, I: -1, V: "write'a'b"}) {
+		t.Fatalf("old format decodes to %v, %v", v, err)
+	}
 	x := Log{
 		K: Key{-1, -1},
 		V: "cbuiabva b  boabobvab    ubaacbai  jadbabdaibtim",
@@ -13,3 +17,210 @@ func TestLogToString(t *testing.T) {
 	fmt.Println(LogToString(x))
 	fmt.Println(StringToLog(LogToString(x)))
 }
+
+/*
+合法的日志编码后一定能解码回原样；任意字符串（v本身，以及拼上term之后的v）如果能解码成x，
+StringToLog(LogToString(x))一定等于x。
+*/
+
+func FuzzStringToLog(f *testing.F) {
+	f.Add(3, 7, 12, "write'a'b")
+	f.Add(-1, -1, -1, "")
+	f.Add(0, 0, 0, "a^b$c#d")
+	f.Add(1, 2, 3, "2$5^write'a'b")
+	f.Add(0, 0, 0, "+1$-0#07^x^y")
+	f.Fuzz(func(t *testing.T, term int, index int, global int, v string) {
+		x := Log{K: Key{term, index}, I: global, V: v}
+		y, err := StringToLog(LogToString(x))
+		if err != nil || y != x {
+			t.Fatalf("%v round trips to %v, %v", x, y, err)
+		}
+		for _, s := range []string{v, fmt.Sprintf("%d$%s", term, v)} {
+			if z, err := StringToLog(s); err == nil {
+				if w, err := StringToLog(LogToString(z)); err != nil || w != z {
+					t.Fatalf("%q decodes to %v, which round trips to %v, %v", s, z, w, err)
+				}
+			}
+		}
+	})
+}
+
+/*
+用字节序列驱动LogSet的各个操作，每个操作之后检查：日志严格递增，已提交的key在日志中（或者没有提交），
+已提交的日志不会被删除或改变，GetNext和GetPrevious返回的key与所给的key相邻。
+*/
+
+func FuzzLogSet(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0, 1, 0, 2, 1, 0, 3, 1, 0, 1, 1, 0})
+	f.Add([]byte{0, 1, 1, 0, 2, 2, 2, 2, 2, 1, 0, 0, 4, 2, 2, 5, 0, 0})
+	f.Add([]byte{1, 0, 0, 2, 3, 3})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		var l MemoryLogSet
+		l.Init(-1, -1)
+		var committed []Log
+		for i := 0; i+2 < len(ops); i += 3 {
+			k := Key{Term: int(ops[i+1]%4) - 1, Index: int(ops[i+2]%4) - 1}
+			switch ops[i] % 6 {
+			case 0:
+				l.Append(Log{K: k, V: fmt.Sprint(i)})
+			case 1:
+				if _, err := l.Remove(k); err == nil && l.GetLast().Greater(k) {
+					t.Fatalf("logs after %v are not removed: %v", k, l.GetAll())
+				}
+			case 2:
+				before := l.GetCommitted()
+				l.Commit(k)
+				if c := l.GetCommitted(); c.Less(before) || c.Greater(k) && !c.Equals(before) {
+					t.Fatalf("commit %v moves committed key from %v to %v", k, before, c)
+				}
+			case 3:
+				if next, err := l.GetNext(k); err == nil && !next.Equals(Key{-1, -1}) {
+					if !next.Greater(k) || len(l.GetKsByRange(k, next)) > 2 {
+						t.Fatalf("next of %v is %v in %v", k, next, l.GetAll())
+					}
+				}
+			case 4:
+				if previous, err := l.GetPrevious(k); err == nil && !previous.Equals(Key{-1, -1}) {
+					if !previous.Less(k) || len(l.GetKsByRange(previous, k)) != 2 {
+						t.Fatalf("previous of %v is %v in %v", k, previous, l.GetAll())
+					}
+				}
+			case 5:
+				if _, err := l.GetVByK(k); err == nil && l.index(k) == -1 {
+					t.Fatalf("find %v which is not in %v", k, l.GetAll())
+				}
+			}
+			logs := l.GetAll()
+			for j := 1; j < len(logs); j++ {
+				if !logs[j-1].K.Less(logs[j].K) {
+					t.Fatalf("logs are not increasing: %v", logs)
+				}
+			}
+			for j, v := range logs {
+				if v.I != j {
+					t.Fatalf("log %d has global index %d in %v", j, v.I, logs)
+				}
+				if w, err := l.GetByIndex(j); err != nil || w != v {
+					t.Fatalf("log %d is %v, %v by index in %v", j, w, err, logs)
+				}
+			}
+			if n := l.GetLastIndex(); n != len(logs)-1 {
+				t.Fatalf("last index is %d in %v", n, logs)
+			}
+			if c := l.GetCommitted(); !c.Equals(Key{-1, -1}) {
+				if _, err := l.GetVByK(c); err != nil {
+					t.Fatalf("committed key %v is not in %v", c, logs)
+				}
+				committed = l.GetLogsByRange(logs[0].K, c)
+			}
+			for j, v := range committed {
+				if j >= len(logs) || logs[j] != v {
+					t.Fatalf("committed logs %v are changed to %v", committed, logs)
+				}
+			}
+		}
+	})
+}
+
+/*
+迭代器创建之后的Remove和Append不影响迭代结果，即使新日志写在被删除日志原来的位置上。
+*/
+
+func TestIteratorSnapshot(t *testing.T) {
+	var l MemoryLogSet
+	l.Init(-1, -1)
+	for i := 0; i < 10; i++ {
+		l.Append(Log{K: Key{1, i}, V: fmt.Sprint(i)})
+	}
+	it := l.Iterator()
+	defer it.Close()
+	if _, err := l.Remove(Key{1, 4}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		l.Append(Log{K: Key{2, i}, V: "new"})
+	}
+	it.Seek(Key{1, 3})
+	for i := 3; i < 10; i++ {
+		if v, ok := it.Next(); !ok || v.K != (Key{1, i}) || v.V != fmt.Sprint(i) {
+			t.Fatalf("got %v %v, want {1 %d}", v, ok, i)
+		}
+	}
+	if v, ok := it.Next(); ok {
+		t.Fatalf("got %v after the end of snapshot", v)
+	}
+}
+
+func TestIteratorConcurrent(t *testing.T) {
+	var l MemoryLogSet
+	l.Init(-1, -1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			l.Append(Log{K: Key{i / 10, i % 10}})
+			if i%7 == 0 {
+				_, _ = l.Remove(Key{i / 10, 0})
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		it := l.Iterator()
+		previous := Key{-1, -1}
+		for v, ok := it.Next(); ok; v, ok = it.Next() {
+			if !previous.Less(v.K) {
+				t.Fatalf("iterator goes from %v to %v", previous, v.K)
+			}
+			previous = v.K
+		}
+		it.Close()
+	}
+}
+
+/*
+压缩后的日志能解码回原样，可压缩的内容变短，不可压缩的内容不压缩，压缩和不压缩的日志可以混在一起解码。
+*/
+
+func TestCompressedLog(t *testing.T) {
+	long := Log{K: Key{3, 4}, I: 9, V: strings.Repeat(`{"op":"write","key":"user","value":"abc"}`, 20)}
+	short := Log{K: Key{3, 5}, I: 10, V: "a"}
+	if s := CompressedLogToString(long, Flate); len(s) >= len(LogToString(long)) || !strings.Contains(s, "~z^") {
+		t.Fatalf("%q is not compressed", s)
+	}
+	if s := CompressedLogToString(short, Flate); s != LogToString(short) {
+		t.Fatalf("%q is compressed", s)
+	}
+	file := CompressedLogToString(long, Flate) + "\n" + LogToString(short) + "\n" + "1$0^old\n"
+	for i, want := range []Log{long, short, {K: Key{1, 0}, I: -1, V: "old"}} {
+		if v, err := StringToLog(strings.Split(file, "\n")[i]); err != nil || v != want {
+			t.Fatalf("line %d decodes to %v, %v", i, v, err)
+		}
+	}
+	if _, err := StringToLog("3$4#9~z^not base64"); err == nil {
+		t.Fatal("broken compressed log decodes")
+	}
+	if _, err := StringToLog("3$4#9~x^a"); err == nil {
+		t.Fatal("unknown codec decodes")
+	}
+	codec, bomb := Compress(strings.Repeat("a", MaxDecompressed+1), Flate)
+	if _, err := Decompress(bomb, codec); codec != Flate || err == nil {
+		t.Fatalf("%d bytes of %q decompress beyond the limit", len(bomb), codec)
+	}
+}
+
+func FuzzCompressedLog(f *testing.F) {
+	f.Add(3, 7, 12, "write'a'b")
+	f.Add(0, 0, 0, "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa~^$#")
+	f.Fuzz(func(t *testing.T, term int, index int, global int, v string) {
+		x := Log{K: Key{term, index}, I: global, V: v}
+		y, err := StringToLog(CompressedLogToString(x, Flate))
+		if err != nil || y != x {
+			t.Fatalf("%v round trips to %v, %v", x, y, err)
+		}
+	})
+}
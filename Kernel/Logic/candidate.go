@@ -7,12 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"time"
 )
 
-var candidate Candidate
-
 type Candidate struct {
 	agree map[int]bool
 	state int // 0：预选举，1：预选举结束，第一次选举，2：选举结束，没有结果
@@ -108,18 +105,22 @@ func (c *Candidate) processPreVoteReply(msg Order.Message, me *Me) error {
 			c.agree = map[int]bool{}
 			c.state = 1
 			log.Println("Candidate: begin vote after a random time")
-			me.timer.Reset(time.Duration(rand.Intn(100)) * time.Millisecond)
+			me.timer.Reset(time.Duration(me.random.Intn(100)) * time.Millisecond)
 		}
 	}
 	return nil
 }
 
+func (c *Candidate) processHeartbeatReply(Order.Message, *Me) error {
+	return nil
+}
+
 func (c *Candidate) processFromClient(msg Order.Message, me *Me) error {
 	log.Printf("Candidate: a msg from client: %v\n", msg)
 	if msg.Agree {
 		return errors.New("warning: candidate refuses to sync")
 	}
-	me.toCrownChan <- Something.Something{Id: msg.From, NeedReply: true, Content: msg.Log}
+	me.toCrownChan <- Something.Something{Id: msg.From, NeedReply: true, Content: msg.Log, Key: me.logSet.GetLast()}
 	return nil
 }
 
@@ -132,17 +133,22 @@ func (c *Candidate) processClientSync(Order.Message, *Me) error {
 如果处于预选举状态（0），说明此时集群不满足多数派存活，继续试探。
 如果是预选举到选举的随机时间结束到期，则自己开始正式选举。
 如果是正式选举到期，说明支持和反对的票都没到达quorum，考虑是否集群不够多数派，回到预选举阶段。
+单节点集群的quorum为0，没有其他节点回复，预选举直接通过，正式选举开始时自己就是leader。
 */
 
 func (c *Candidate) processTimeout(me *Me) error {
 	log.Printf("Candidate: timeout, state: %v\n", c.state)
 	reply := Order.Message{
-		From:       me.meta.Id,
-		To:         me.members,
-		LastLogKey: me.logSet.GetLast(),
+		From:         me.meta.Id,
+		To:           me.members,
+		LastLogKey:   me.logSet.GetLast(),
+		LastLogIndex: me.logSet.GetLastIndex(),
 	}
 	if c.state == 0 {
 		reply.Type = Order.PreVote
+		if me.quorum == 0 {
+			c.state = 1
+		}
 	} else if c.state == 1 {
 		me.meta.Term++
 		c.state = 2
@@ -153,6 +159,9 @@ func (c *Candidate) processTimeout(me *Me) error {
 		}
 		reply.Type = Order.Vote
 		log.Printf("Candidate: voting ... , my term is %d\n", me.meta.Term)
+		if me.quorum == 0 {
+			return me.switchToLeader()
+		}
 	} else {
 		c.state = 0
 		reply.Type = Order.PreVote
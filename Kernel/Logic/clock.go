@@ -0,0 +1,58 @@
+package Logic
+
+import (
+	"math/rand"
+	"time"
+)
+
+/*
+Me和各个角色只通过这里的接口使用时间和随机数，默认实现直接使用time.Timer、time.Now和math/rand。
+确定性模拟时换成虚拟时钟和固定种子的随机数，同一个种子每次运行的结果都相同。
+*/
+
+type Clock interface {
+	NewTimer(d time.Duration) Timer
+	Now() time.Time
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+type Random interface {
+	Intn(n int) int
+}
+
+type realClock struct{}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+type realRandom struct{}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{t: time.NewTimer(d)}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (r realTimer) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r realTimer) Reset(d time.Duration) bool {
+	return r.t.Reset(d)
+}
+
+func (r realTimer) Stop() bool {
+	return r.t.Stop()
+}
+
+func (realRandom) Intn(n int) int {
+	return rand.Intn(n)
+}
@@ -6,11 +6,10 @@ import (
 	"RaftDB/Kernel/Pipe/Something"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 )
 
-var follower Follower
-
 type Follower struct {
 	voted int
 }
@@ -22,7 +21,7 @@ func (f *Follower) init(me *Me) error {
 }
 
 /*
-收到leader的心跳，重制定时器。
+收到leader的心跳，重制定时器，回复leader确认它仍是leader。
 如果发现自己的LastLogKey比心跳中携带的leader的LastLogKey小，那么转到processLogAppend触发日志缺失处理。
 这里如果自己的日志比leader大，不做处理，等到新消息到来时再删除。
 */
@@ -30,6 +29,13 @@ func (f *Follower) init(me *Me) error {
 func (f *Follower) processHeartbeat(msg Order.Message, me *Me) error {
 	me.timer.Reset(me.followerTimeout)
 	log.Printf("Follower: leader %d's heartbeat\n", msg.From)
+	me.toBottomChan <- Order.Order{Type: Order.NodeReply, Msg: Order.Message{
+		Type: Order.HeartbeatReply,
+		From: me.meta.Id,
+		To:   []int{msg.From},
+		Term: me.meta.Term,
+		Seq:  msg.Seq,
+	}}
 	if me.logSet.GetLast().Less(msg.LastLogKey) {
 		log.Println("Follower: my logSet are not complete")
 		return f.processAppendLog(msg, me)
@@ -38,9 +44,9 @@ func (f *Follower) processHeartbeat(msg Order.Message, me *Me) error {
 }
 
 /*
-追加日志申请，如果自己已提交的日志大于等于请求追加的日志，直接返回。
+追加日志申请，如果自己已提交的日志大于等于请求追加的日志，直接返回。请求的LastLogKey不大于SecondLastLogKey是非法消息，报错返回。
 到这里自己的已提交的日志LogKey一定小于等于请求中的SecondLastLogKey且小于请求中的LastLogKey
-如果自己日志对LastLogKey大于请求的SecondLastKey，那么删除日志直到自己的LastLogKey小于等于请求的SecondLastLogKey。
+如果自己日志对LastLogKey大于请求的SecondLastKey，那么删除日志直到自己的LastLogKey小于等于请求的SecondLastLogKey，要删除已提交的日志时报错返回。
 到这里，自己的最后一条日志一定比secondLastLogKey小或者等于它
 之后如果日志中有信息（不是从Heartbeat得到的）且自己此时的LastLogKey就是请求的SecondLastLogKey，直接添加日志。并回复成功。
 否则拒绝本次申请，同时在回复的SecondLastLogKey字段中给出自己的LastLogKey。
@@ -49,23 +55,28 @@ func (f *Follower) processHeartbeat(msg Order.Message, me *Me) error {
 
 func (f *Follower) processAppendLog(msg Order.Message, me *Me) error {
 	reply := Order.Message{
-		Type:       Order.AppendLogReply,
-		From:       me.meta.Id,
-		To:         []int{msg.From},
-		Term:       me.meta.Term,
-		LastLogKey: msg.LastLogKey,
+		Type:         Order.AppendLogReply,
+		From:         me.meta.Id,
+		To:           []int{msg.From},
+		Term:         me.meta.Term,
+		LastLogKey:   msg.LastLogKey,
+		LastLogIndex: msg.LastLogIndex,
 	}
 	if !me.logSet.GetCommitted().Less(msg.LastLogKey) {
 		return nil
 	}
+	if !msg.SecondLastLogKey.Less(msg.LastLogKey) {
+		return fmt.Errorf("error: illegal request %v after %v from %d", msg.LastLogKey, msg.SecondLastLogKey, msg.From)
+	}
 	if me.logSet.GetLast().Greater(msg.SecondLastLogKey) {
 		if contents, err := me.logSet.Remove(msg.SecondLastLogKey); err != nil {
-			panic("remove committed log")
+			return fmt.Errorf("error: %d asks me to remove committed logs after %v", msg.From, msg.SecondLastLogKey)
 		} else {
-			for _, v := range contents {
+			for i := len(contents) - 1; i >= 0; i-- { // 从最新的日志开始撤销
+				v := contents[i]
 				me.toCrownChan <- Something.Something{NeedReply: false, Content: "!" + v.V}
 				if id, has := me.syncKeyIdMap[v.K]; has {
-					me.syncIdMsgMap[id] = Order.Message{From: id, Log: "sync failed, rollback later"}
+					me.syncIdMsgMap[id] = Order.Message{From: id, Log: Order.Rollback}
 					me.syncFinishedChan <- id
 					delete(me.syncKeyIdMap, v.K)
 				}
@@ -77,10 +88,14 @@ func (f *Follower) processAppendLog(msg Order.Message, me *Me) error {
 	if me.logSet.GetLast().Equals(msg.SecondLastLogKey) && msg.Type == Order.AppendLog {
 		reply.Agree = true
 		me.logSet.Append(Log.Log{K: msg.LastLogKey, V: msg.Log})
+		if reply.LastLogIndex = me.logSet.GetLastIndex(); reply.LastLogIndex != msg.LastLogIndex {
+			log.Printf("Follower: %d's request %v has global index %d, mine is %d\n",
+				msg.From, msg.LastLogKey, msg.LastLogIndex, reply.LastLogIndex)
+		}
 		me.toCrownChan <- Something.Something{NeedReply: false, Content: msg.Log}
 		log.Printf("Follower: accept %d's request %v\n", msg.From, msg.LastLogKey)
 	} else {
-		reply.Agree, reply.SecondLastLogKey = false, me.logSet.GetLast()
+		reply.Agree, reply.SecondLastLogKey, reply.SecondLastLogIndex = false, me.logSet.GetLast(), me.logSet.GetLastIndex()
 		log.Printf("Follower: refuse %d's request %v, my last log is %v\n", msg.From, msg.LastLogKey, me.logSet.GetLast())
 	}
 	me.toBottomChan <- Order.Order{Type: Order.NodeReply, Msg: reply}
@@ -94,16 +109,22 @@ func (f *Follower) processAppendLogReply(Order.Message, *Me) error {
 
 /*
 follower将提交所有小于等于提交请求key的log。
+只有自己的日志中有这个key时才提交，此时自己到这个key为止的日志和leader一致；否则自己可能有和leader分叉的日志，等补齐日志后再提交。
 */
 
 func (f *Follower) processCommit(msg Order.Message, me *Me) error {
 	if !me.logSet.GetCommitted().Less(msg.LastLogKey) {
 		return nil
 	}
+	committed, err := me.getLog(msg.LastLogKey, msg.LastLogIndex)
+	if err != nil {
+		return nil
+	}
 	previousCommitted := me.logSet.Commit(msg.LastLogKey)
 	if me.logSet.GetCommitted().Equals(previousCommitted) {
 		return nil
 	}
+	me.appliedIndex = committed.I
 	me.meta.CommittedKeyTerm, me.meta.CommittedKeyIndex = me.logSet.GetCommitted().Term, me.logSet.GetCommitted().Index
 	if metaTmp, err := json.Marshal(*me.meta); err != nil {
 		return err
@@ -119,12 +140,15 @@ func (f *Follower) processCommit(msg Order.Message, me *Me) error {
 			SecondLastLogKey: k,
 		}}
 	me.timer.Reset(me.followerTimeout)
-	for _, v := range me.logSet.GetKsByRange(k, me.logSet.GetCommitted()) {
-		if id, has := me.syncKeyIdMap[v]; has {
+	it := me.logSet.Iterator()
+	it.Seek(k)
+	for v, ok := it.Next(); ok && !v.K.Greater(me.logSet.GetCommitted()); v, ok = it.Next() {
+		if id, has := me.syncKeyIdMap[v.K]; has {
 			me.syncFinishedChan <- id
-			delete(me.syncKeyIdMap, v)
+			delete(me.syncKeyIdMap, v.K)
 		}
 	}
+	it.Close()
 	log.Printf("Follower: commit logSet whose key from %v to %v\n",
 		k, me.logSet.GetCommitted())
 	return nil
@@ -175,12 +199,17 @@ func (f *Follower) processPreVoteReply(Order.Message, *Me) error {
 	return nil
 }
 
+func (f *Follower) processHeartbeatReply(Order.Message, *Me) error {
+	return nil
+}
+
 func (f *Follower) processFromClient(msg Order.Message, me *Me) error {
 	log.Printf("Follower: a msg from client: %v\n", msg)
 	if msg.Agree {
 		return errors.New("warning: follower refuses to sync")
 	}
-	me.toCrownChan <- Something.Something{Id: msg.From, NeedReply: true, NeedSync: false, Content: msg.Log}
+	me.toCrownChan <- Something.Something{Id: msg.From, NeedReply: true, NeedSync: false, Content: msg.Log,
+		Key: me.logSet.GetLast()}
 	return nil
 }
 
@@ -8,17 +8,20 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"time"
 )
 
 /*
-如果发现当前集群出现两个及其以上的leader，Panic退出，因为会造成数据不一致。
+如果发现当前集群出现两个及其以上的leader（同一任期收到了其他leader的消息），拒绝处理并报错，不修改任何状态。
 */
 
-var leader Leader
-
 type Leader struct {
-	agreeMap map[Log.Key]fc // 对于哪条记录，同意的follower集合和这个消息来自哪个client
-	index    int            // 当前日志的index
+	agreeMap map[Log.Key]fc        // 对于哪条记录，同意的follower集合和这个消息来自哪个client
+	index    int                   // 当前日志的index
+	since    time.Time             // 当选的时间，心跳的Seq是从这时起的纳秒数
+	acked    map[int]time.Duration // follower -> 它确认过的最晚发出的心跳的Seq
 }
 
 type fc struct {
@@ -31,24 +34,26 @@ type fc struct {
 
 func (l *Leader) init(me *Me) error {
 	l.agreeMap, l.index = map[Log.Key]fc{}, 0
+	l.since, l.acked = me.clock.Now(), map[int]time.Duration{}
 	return l.processTimeout(me)
 }
 
-func (l *Leader) processHeartbeat(Order.Message, *Me) error {
-	panic("maybe two leaders")
+func (l *Leader) processHeartbeat(msg Order.Message, _ *Me) error {
+	return fmt.Errorf("error: maybe two leaders, %d sends a heartbeat in my term", msg.From)
 }
 
-func (l *Leader) processAppendLog(Order.Message, *Me) error {
-	panic("maybe two leaders")
+func (l *Leader) processAppendLog(msg Order.Message, _ *Me) error {
+	return fmt.Errorf("error: maybe two leaders, %d sends a request in my term", msg.From)
 }
 
 func (l *Leader) processAppendLogReply(msg Order.Message, me *Me) error {
 	reply := Order.Message{
-		Type:       Order.Commit,
-		From:       me.meta.Id,
-		To:         []int{},
-		Term:       me.meta.Term,
-		LastLogKey: msg.LastLogKey,
+		Type:         Order.Commit,
+		From:         me.meta.Id,
+		To:           []int{},
+		Term:         me.meta.Term,
+		LastLogKey:   msg.LastLogKey,
+		LastLogIndex: msg.LastLogIndex,
 	}
 	if me.logSet.GetLast().Less(msg.LastLogKey) {
 		/*
@@ -68,30 +73,15 @@ func (l *Leader) processAppendLogReply(msg Order.Message, me *Me) error {
 				计票，如果发现票数已经达到quorum，同时回复的key的Term为当前任期，则提交该日志，包括：更新元数据、内存更新日志、持久化日志到磁盘（上一次提交的日志到本条日志）。
 				回复客户端数据提交成功。
 				同时广播，让各个follower提交该日志。
+				补发给落后follower的以前任期的日志不在agreeMap中，这里补上记录，它们随本任期的日志一起提交。
 			*/
+			if _, has := l.agreeMap[msg.LastLogKey]; !has {
+				l.agreeMap[msg.LastLogKey] = fc{followers: map[int]bool{}}
+			}
 			l.agreeMap[msg.LastLogKey].followers[msg.From] = true
 			if len(l.agreeMap[msg.LastLogKey].followers) >= me.quorum && me.meta.Term == msg.LastLogKey.Term {
-				me.meta.CommittedKeyTerm, me.meta.CommittedKeyIndex = msg.LastLogKey.Term, msg.LastLogKey.Index
-				if metaTmp, err := json.Marshal(*me.meta); err != nil {
+				if err := l.commit(msg.LastLogKey, me); err != nil {
 					return err
-				} else {
-					me.toBottomChan <- Order.Order{Type: Order.Store, Msg: Order.Message{Agree: true, Log: string(metaTmp)}}
-				}
-				previousCommitted := me.logSet.Commit(msg.LastLogKey)
-				secondLastKey, _ := me.logSet.GetNext(previousCommitted)
-				me.toBottomChan <- Order.Order{Type: Order.Store, Msg: Order.Message{
-					Agree:            false,
-					LastLogKey:       msg.LastLogKey,
-					SecondLastLogKey: secondLastKey,
-				}}
-				for _, v := range me.logSet.GetKsByRange(secondLastKey, msg.LastLogKey) {
-					if id, has := me.syncKeyIdMap[v]; has {
-						me.syncFinishedChan <- id
-						delete(me.syncKeyIdMap, v)
-					}
-					if _, has := l.agreeMap[v]; has {
-						delete(l.agreeMap, v)
-					}
 				}
 				reply.To = me.members
 				me.timer.Reset(me.leaderHeartbeat)
@@ -101,41 +91,39 @@ func (l *Leader) processAppendLogReply(msg Order.Message, me *Me) error {
 		/*
 			如果这条日志不是leader最新的日志，则尝试发送这条日志的下一条给源follower
 		*/
-		nextKey, _ := me.logSet.GetNext(msg.LastLogKey)
-		if nextKey.Term != -1 {
-			req, err := me.logSet.GetVByK(nextKey)
-			if err != nil {
-				return err
-			}
+		next, _ := me.getNextLog(msg.LastLogKey, msg.LastLogIndex)
+		if next.K.Term != -1 {
 			me.toBottomChan <- Order.Order{Type: Order.NodeReply, Msg: Order.Message{
-				Type:             Order.AppendLog,
-				From:             reply.From,
-				To:               []int{msg.From},
-				Term:             reply.Term,
-				LastLogKey:       nextKey,
-				SecondLastLogKey: msg.LastLogKey,
-				Log:              req,
+				Type:               Order.AppendLog,
+				From:               reply.From,
+				To:                 []int{msg.From},
+				Term:               reply.Term,
+				LastLogKey:         next.K,
+				SecondLastLogKey:   msg.LastLogKey,
+				LastLogIndex:       next.I,
+				SecondLastLogIndex: next.I - 1,
+				Log:                next.V,
 			}}
-			log.Printf("Leader: %d accept my request %v, but %d's logSet is not complete, send request %v\n",
-				msg.From, msg.LastLogKey, msg.From, nextKey)
+			log.Printf("Leader: %d accept my request %v, but %d's logSet is not complete, send request %v#%d\n",
+				msg.From, msg.LastLogKey, msg.From, next.K, next.I)
 		}
 	} else {
 		/*
 			如果不同意这条消息，发送follower回复的最新消息的下一条（follower的最新消息在msg.SecondLastLogKey中携带）
 		*/
-		var err error
 		reply.SecondLastLogKey = msg.SecondLastLogKey
-		reply.LastLogKey, err = me.logSet.GetNext(reply.SecondLastLogKey)
+		next, err := me.getNextLog(msg.SecondLastLogKey, msg.SecondLastLogIndex)
 		if err != nil { // 如果无法获得返回值的key，也就是客户端存在有差错的key，那么leader将尝试自己的上一个key
-			reply.LastLogKey, _ = me.logSet.GetPrevious(msg.LastLogKey)
-			reply.SecondLastLogKey, _ = me.logSet.GetPrevious(reply.LastLogKey)
+			previous, _ := me.logSet.GetPrevious(msg.LastLogKey)
+			reply.SecondLastLogKey, _ = me.logSet.GetPrevious(previous)
+			if next, err = me.getLog(previous, -1); err != nil {
+				return err
+			}
+		} else if next.K.Term == -1 {
+			return errors.New("error: can not find this log by key")
 		}
 		reply.Type, reply.To = Order.AppendLog, []int{msg.From}
-		if req, err := me.logSet.GetVByK(reply.LastLogKey); err != nil {
-			return err
-		} else {
-			reply.Log = req
-		}
+		reply.LastLogKey, reply.LastLogIndex, reply.SecondLastLogIndex, reply.Log = next.K, next.I, next.I-1, next.V
 		log.Printf("Leader: %d refuse my request %v, his logSet are not complete, which is %v, send request %v\n",
 			msg.From, msg.LastLogKey, msg.SecondLastLogKey, reply.LastLogKey)
 	}
@@ -145,8 +133,42 @@ func (l *Leader) processAppendLogReply(msg Order.Message, me *Me) error {
 	return nil
 }
 
-func (l *Leader) processCommit(Order.Message, *Me) error {
-	panic("maybe two leaders")
+/*
+提交所有不大于key的日志：更新元数据、内存中提交日志、持久化日志到磁盘（上一次提交的日志到本条日志），回复等待同步的客户端。
+*/
+
+func (l *Leader) commit(key Log.Key, me *Me) error {
+	me.meta.CommittedKeyTerm, me.meta.CommittedKeyIndex = key.Term, key.Index
+	if metaTmp, err := json.Marshal(*me.meta); err != nil {
+		return err
+	} else {
+		me.toBottomChan <- Order.Order{Type: Order.Store, Msg: Order.Message{Agree: true, Log: string(metaTmp)}}
+	}
+	previousCommitted := me.logSet.Commit(key)
+	secondLastKey, _ := me.logSet.GetNext(previousCommitted)
+	me.toBottomChan <- Order.Order{Type: Order.Store, Msg: Order.Message{
+		Agree:            false,
+		LastLogKey:       key,
+		SecondLastLogKey: secondLastKey,
+	}}
+	it := me.logSet.Iterator()
+	it.Seek(secondLastKey)
+	for v, ok := it.Next(); ok && !v.K.Greater(key); v, ok = it.Next() {
+		if id, has := me.syncKeyIdMap[v.K]; has {
+			me.syncFinishedChan <- id
+			delete(me.syncKeyIdMap, v.K)
+		}
+		if _, has := l.agreeMap[v.K]; has {
+			delete(l.agreeMap, v.K)
+		}
+		me.appliedIndex = v.I
+	}
+	it.Close()
+	return nil
+}
+
+func (l *Leader) processCommit(msg Order.Message, _ *Me) error {
+	return fmt.Errorf("error: maybe two leaders, %d sends a commit in my term", msg.From)
 }
 
 func (l *Leader) processVote(_ Order.Message, me *Me) error {
@@ -168,9 +190,16 @@ func (l *Leader) processPreVoteReply(Order.Message, *Me) error {
 func (l *Leader) processFromClient(msg Order.Message, me *Me) error {
 	log.Printf("Leader: a msg from client: %v\n", msg)
 	if msg.Agree {
+		if msg.Client != "" { // 带有会话的同步请求，加上会话头部和时间戳，Crown据此去重并推进复制时间
+			if strings.Contains(msg.Client, "'") {
+				return errors.New("warning: illegal client id " + msg.Client)
+			}
+			msg.Log = Something.Stamp(msg.Client, msg.Seq, me.clock.Now().UnixMilli(), msg.Log)
+		}
 		me.syncIdMsgMap[msg.From] = msg
 	}
-	me.toCrownChan <- Something.Something{Id: msg.From, NeedReply: true, NeedSync: msg.Agree, Content: msg.Log}
+	me.toCrownChan <- Something.Something{Id: msg.From, NeedReply: true, NeedSync: msg.Agree, Content: msg.Log,
+		Key: me.logSet.GetLast()}
 	return nil
 }
 
@@ -186,35 +215,78 @@ func (l *Leader) processClientSync(msg Order.Message, me *Me) error {
 	me.logSet.Append(Log.Log{K: lastLogKey, V: msg.Log})
 	l.agreeMap[lastLogKey] = fc{followers: map[int]bool{}}
 	me.toBottomChan <- Order.Order{Type: Order.NodeReply, Msg: Order.Message{
-		Type:             Order.AppendLog,
-		From:             me.meta.Id,
-		To:               me.members,
-		Term:             me.meta.Term,
-		Agree:            false,
-		LastLogKey:       lastLogKey,
-		SecondLastLogKey: secondLastKey,
-		Log:              msg.Log,
+		Type:               Order.AppendLog,
+		From:               me.meta.Id,
+		To:                 me.members,
+		Term:               me.meta.Term,
+		Agree:              false,
+		LastLogKey:         lastLogKey,
+		SecondLastLogKey:   secondLastKey,
+		LastLogIndex:       me.logSet.GetLastIndex(),
+		SecondLastLogIndex: me.logSet.GetLastIndex() - 1,
+		Log:                msg.Log,
 	}}
 	me.timer.Reset(me.leaderHeartbeat)
 	l.index++
 	log.Printf("Leader: reveive a client's request whose key: %v, log: %v, now I will broadcast it\n", lastLogKey, msg.Log)
+	if me.quorum == 0 { // 单节点集群不会收到回复，自己就是多数派
+		return l.commit(lastLogKey, me)
+	}
 	return nil
 }
 
 func (l *Leader) processTimeout(me *Me) error {
 	me.toBottomChan <- Order.Order{Type: Order.NodeReply, Msg: Order.Message{
-		Type:             Order.Heartbeat,
-		From:             me.meta.Id,
-		To:               me.members,
-		Term:             me.meta.Term,
-		LastLogKey:       me.logSet.GetLast(),
-		SecondLastLogKey: me.logSet.GetSecondLast(),
+		Type:               Order.Heartbeat,
+		From:               me.meta.Id,
+		To:                 me.members,
+		Term:               me.meta.Term,
+		LastLogKey:         me.logSet.GetLast(),
+		SecondLastLogKey:   me.logSet.GetSecondLast(),
+		LastLogIndex:       me.logSet.GetLastIndex(),
+		SecondLastLogIndex: me.logSet.GetLastIndex() - 1,
+		Seq:                int(me.clock.Now().Sub(l.since)),
 	}}
 	me.timer.Reset(me.leaderHeartbeat)
 	log.Println("Leader: timeout")
 	return nil
 }
 
+/*
+follower确认了自己在Seq时发出的心跳，说明那时它还没有进入更高的任期。
+*/
+
+func (l *Leader) processHeartbeatReply(msg Order.Message, me *Me) error {
+	sent := time.Duration(msg.Seq)
+	if msg.From < 0 || msg.From >= len(me.members) || sent < 0 || sent > me.clock.Now().Sub(l.since) {
+		return fmt.Errorf("error: illegal heartbeat reply %d from %d", msg.Seq, msg.From)
+	}
+	if v, has := l.acked[msg.From]; !has || sent > v {
+		l.acked[msg.From] = sent
+	}
+	return nil
+}
+
+/*
+多数派最近一次确认自己是leader的时间：quorum个follower都确认过的心跳中最晚发出的那个的时间。
+更高任期的leader需要多数派的投票，其中至少一个节点在这个时间之后还确认过自己，所以这时还没有更新的leader。
+*/
+
+func (l *Leader) confirmed(me *Me) (time.Time, bool) {
+	if me.quorum == 0 {
+		return me.clock.Now(), true
+	}
+	if len(l.acked) < me.quorum {
+		return time.Time{}, false
+	}
+	acked := make([]time.Duration, 0, len(l.acked))
+	for _, v := range l.acked {
+		acked = append(acked, v)
+	}
+	sort.Slice(acked, func(i, j int) bool { return acked[i] > acked[j] })
+	return l.since.Add(acked[me.quorum-1]), true
+}
+
 func (l *Leader) processExpansion(Order.Message, *Me) error {
 	return nil
 }
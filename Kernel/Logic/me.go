@@ -7,6 +7,7 @@ import (
 	"RaftDB/Kernel/Pipe/Something"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"time"
 )
@@ -46,7 +47,12 @@ type Me struct {
 	members                 []int                      // 维护的成员数量
 	quorum                  int                        // 最小选举人数
 	role                    Role                       // 当前角色
-	timer                   *time.Timer                // 计时器
+	follower                Follower                   // follower角色的状态，每个Me独享，保证同一进程内可以运行多个节点
+	leader                  Leader                     // leader角色的状态
+	candidate               Candidate                  // candidate角色的状态
+	timer                   Timer                      // 计时器
+	clock                   Clock                      // 时钟，用于创建计时器，默认使用系统时钟
+	random                  Random                     // 随机数来源，默认使用math/rand
 	fromBottomChan          <-chan Order.Order         // 接收bottom消息的管道
 	toBottomChan            chan<- Order.Order         // 发送消息给bottom的管道
 	fromCrownChan           <-chan Something.Something // 上层接口
@@ -54,11 +60,17 @@ type Me struct {
 	syncFinishedChan        chan int                   // 客户端同步处理完成通知
 	syncIdMsgMap            map[int]Order.Message      // clientSyncMap是clientId -> msg的映射
 	syncKeyIdMap            map[Log.Key]int            // clientSyncKeyIdMap是成功进入同步处理的logKsy -> clientId的映射
-	logSet                  *Log.LogSet                // 日志指针
+	logSet                  Log.LogSet                 // 日志系统
 	leaderHeartbeat         time.Duration              // leader心跳间隔
 	followerTimeout         time.Duration              // follower超时时间
 	candidatePreVoteTimeout time.Duration              // candidate预选举超时
 	candidateVoteTimeout    time.Duration              // candidate选举超时
+	done                    chan struct{}              // 关闭后Run退出，用于停止节点
+	leaderId                int                        // 当前任期已知的leader，-1表示不知道，拒绝客户端时告诉客户端
+	leaderIndex             int                        // 当前任期从leader的消息中知道的leader最后一条日志的全局下标
+	leaderIndexAt           time.Time                  // leader最近一次告诉自己leaderIndex（或者更大的下标）的时间
+	leaderContact           time.Time                  // 最近一次收到当前任期leader消息的时间
+	appliedIndex            int                        // 已提交的最后一条日志的全局下标，上层已经执行并且不会再撤销，-1表示没有
 }
 
 /*
@@ -76,6 +88,7 @@ type Role interface {
 	processVoteReply(msg Order.Message, me *Me) error
 	processPreVote(msg Order.Message, me *Me) error
 	processPreVoteReply(msg Order.Message, me *Me) error
+	processHeartbeatReply(msg Order.Message, me *Me) error
 	processExpansion(msg Order.Message, me *Me) error      // 节点变更，未实现
 	processExpansionReply(msg Order.Message, me *Me) error // 节点变更回复，未实现
 	processFromClient(msg Order.Message, me *Me) error
@@ -84,21 +97,33 @@ type Role interface {
 	ToString() string
 }
 
+/*
+替换时钟和随机数来源，必须在Init之前调用，用于确定性模拟测试。
+*/
+
+func (m *Me) SetClock(clock Clock, random Random) {
+	m.clock, m.random = clock, random
+}
+
 /*
 初始化，设置元数据信息，设置日志信息，设置超时时间，设置通讯管道（包括通向bottom端的和通向crown端的）
 */
 
-func (m *Me) Init(meta *Meta.Meta, logSet *Log.LogSet,
+func (m *Me) Init(meta *Meta.Meta, logSet Log.LogSet,
 	fromBottomChan <-chan Order.Order, toBottomChan chan<- Order.Order,
 	fromCrownChan <-chan Something.Something, toCrownChan chan<- Something.Something) {
 	m.meta, m.logSet = meta, logSet
 	m.fromBottomChan, m.toBottomChan = fromBottomChan, toBottomChan
 	m.fromCrownChan, m.toCrownChan = fromCrownChan, toCrownChan
 	m.syncFinishedChan = make(chan int, 100000)
+	m.done = make(chan struct{})
 	m.syncIdMsgMap = map[int]Order.Message{}
 	m.syncKeyIdMap = map[Log.Key]int{}
+	m.leaderId, m.leaderIndex, m.appliedIndex = -1, -1, -1
+	if v, err := m.getLog(logSet.GetCommitted(), -1); err == nil {
+		m.appliedIndex = v.I
+	}
 	m.members, m.quorum = make([]int, meta.Num), meta.Num/2
-	m.timer = time.NewTimer(m.followerTimeout)
 	for i := 0; i < meta.Num; i++ {
 		m.members[i] = i
 	}
@@ -106,6 +131,13 @@ func (m *Me) Init(meta *Meta.Meta, logSet *Log.LogSet,
 	m.followerTimeout = time.Duration(meta.FollowerTimeout) * time.Millisecond
 	m.candidateVoteTimeout = time.Duration(meta.CandidateVoteTimeout) * time.Millisecond
 	m.candidatePreVoteTimeout = time.Duration(meta.CandidatePreVoteTimeout) * time.Millisecond
+	if m.clock == nil {
+		m.clock = realClock{}
+	}
+	if m.random == nil {
+		m.random = realRandom{}
+	}
+	m.timer = m.clock.NewTimer(m.followerTimeout)
 	if err := m.switchToFollower(m.meta.Term, false, Order.Message{}); err != nil {
 		log.Println(err)
 	}
@@ -116,97 +148,179 @@ Logic层的主体函数，不断获取来自bottom的消息和定时器超时的
 收到服务节点的消息后转到process函数。
 收到客户端消息，说明自己是leader，直接调用processClient函数。
 计时器到期后调用计时器到期处理函数。
-在执行过程中发现通讯管道关闭，Panic返回。
+在执行过程中发现通讯管道关闭，Panic返回；调用Stop后正常返回。
+每一类事件的处理都在单独的handle函数中完成，确定性模拟器可以不经过Run，直接按自己的顺序调用它们。
 */
 
 func (m *Me) Run() {
 	for {
 		select {
+		case <-m.done:
+			m.timer.Stop()
+			return
 		case order, opened := <-m.fromBottomChan:
 			if !opened {
 				panic("bottom chan is closed")
-				return
-			}
-			if order.Type == Order.FromNode {
-				if err := m.processFromNode(order.Msg); err != nil {
-					log.Println(err)
-				}
-			}
-			if order.Type == Order.FromClient {
-				if err := m.role.processFromClient(order.Msg, m); err != nil {
-					/*
-						如果处理客户端请求失败，立即回复客户端，并且这个请求被Logic层拦截，不会有后续处理。
-						很可能client把同步请求发送给了follower
-					*/
-					log.Println(err)
-					m.toBottomChan <- Order.Order{Type: Order.ClientReply,
-						Msg: Order.Message{From: order.Msg.From, Log: "logic refuses to operate"}}
-				}
-			}
-		case <-m.timer.C:
-			if err := m.role.processTimeout(m); err != nil {
-				log.Println(err)
 			}
+			m.handleOrder(order)
+		case <-m.timer.C():
+			m.handleTimeout()
 		case sth, opened := <-m.fromCrownChan:
 			if !opened {
 				panic("crown chan is closed")
 			}
-			id := sth.Id
-			if !sth.Agree {
-				/*
-					如果Crown层返回不允许执行，则说明客户端的指令有问题,会把错误信息报告回客户端。
-					Logic对其拦截，不会有后续处理，如果是同步请求，释放Logic层为其分配的资源。
-				*/
-				m.toBottomChan <- Order.Order{Type: Order.ClientReply,
-					Msg: Order.Message{From: id, Log: sth.Content}}
-				if _, has := m.syncIdMsgMap[id]; has {
-					delete(m.syncIdMsgMap, id)
-				}
-				continue
-			}
-			if !sth.NeedSync {
-				m.toBottomChan <- Order.Order{Type: Order.ClientReply, Msg: Order.Message{From: id, Log: sth.Content}}
-				continue
-			}
-			if msg, has := m.syncIdMsgMap[id]; has {
-				if err := m.role.processClientSync(msg, m); err != nil {
-					log.Println(err)
-					m.toBottomChan <- Order.Order{Type: Order.ClientReply,
-						Msg: Order.Message{From: id, Log: "operated but logic refuses to sync, rollback later"}}
-					delete(m.syncIdMsgMap, id)
-				} else {
-					m.syncIdMsgMap[id] = Order.Message{From: id, Log: sth.Content}
-				}
-			} else {
-				panic("lose client msg")
-			}
+			m.handleCrown(sth)
 		case id, opened := <-m.syncFinishedChan:
 			if !opened {
 				panic("me.syncFinishedChan closed")
 			}
-			if msg, has := m.syncIdMsgMap[id]; has {
-				m.toBottomChan <- Order.Order{Type: Order.ClientReply, Msg: msg}
-				delete(m.syncIdMsgMap, id)
-			} else {
-				panic("lose client msg")
-			}
+			m.handleSyncFinished(id)
 		}
 	}
 }
 
+func (m *Me) handleOrder(order Order.Order) {
+	if order.Type == Order.FromNode {
+		if err := m.processFromNode(order.Msg); err != nil {
+			log.Println(err)
+		}
+	}
+	if order.Type == Order.FromClient {
+		if Something.IsStamped(order.Msg.Log) {
+			m.replyClient(Order.Message{From: order.Msg.From, Log: "session header is reserved"})
+			return
+		}
+		if order.Msg.Bound != nil && !m.fresh(*order.Msg.Bound) {
+			m.replyClient(Order.Message{From: order.Msg.From, Log: Order.Stale})
+			return
+		}
+		if err := m.role.processFromClient(order.Msg, m); err != nil {
+			/*
+				如果处理客户端请求失败，立即回复客户端，并且这个请求被Logic层拦截，不会有后续处理。
+				很可能client把同步请求发送给了follower
+			*/
+			log.Println(err)
+			m.replyClient(Order.Message{From: order.Msg.From, Log: Order.Refused})
+		}
+	}
+}
+
+/*
+回复客户端，带上已知的leader，Agree为真表示操作成功。
+*/
+
+func (m *Me) replyClient(msg Order.Message) {
+	msg.Leader = m.leaderId
+	m.toBottomChan <- Order.Order{Type: Order.ClientReply, Msg: msg}
+}
+
+/*
+有界陈旧读的检查，满足一个界限即可。其他节点必须知道leader，并且已执行的日志落后leader最近一次告诉自己的日志不超过bound.Entries条，
+或者最近一次收到leader消息不超过bound.Millis毫秒。leader的日志下标在节点被隔离之后不会再变大，
+所以超过一个选举超时没有被leader确认时，日志条数的界限不再成立，只剩时间的界限。
+leader被隔离时自己并不知道，所以leader只用时间的界限：bound.Millis毫秒内多数派确认过它的心跳（租约），
+那时还没有更新的leader，读到的内容最多陈旧到那时。单节点集群的leader总是可以读。
+*/
+
+func (m *Me) fresh(bound Order.Bound) bool {
+	stale := time.Duration(bound.Millis) * time.Millisecond
+	if m.role == &m.leader {
+		if m.quorum == 0 {
+			return true
+		}
+		at, ok := m.leader.confirmed(m)
+		return ok && bound.Millis > 0 && m.clock.Now().Sub(at) <= stale
+	}
+	if m.leaderId < 0 {
+		return false
+	}
+	now := m.clock.Now()
+	if bound.Entries >= 0 && now.Sub(m.leaderIndexAt) <= m.followerTimeout && m.leaderIndex-m.appliedIndex <= bound.Entries {
+		return true
+	}
+	return bound.Millis > 0 && now.Sub(m.leaderContact) <= stale
+}
+
+/*
+当前任期已知的leader，-1表示不知道。
+*/
+
+func (m *Me) LeaderId() int {
+	return m.leaderId
+}
+
+func (m *Me) handleTimeout() {
+	if err := m.role.processTimeout(m); err != nil {
+		log.Println(err)
+	}
+}
+
+func (m *Me) handleCrown(sth Something.Something) {
+	id := sth.Id
+	if !sth.Agree {
+		/*
+			如果Crown层返回不允许执行，则说明客户端的指令有问题,会把错误信息报告回客户端。
+			Logic对其拦截，不会有后续处理，如果是同步请求，释放Logic层为其分配的资源。
+		*/
+		m.replyClient(Order.Message{From: id, Log: sth.Content, Result: sth.Result})
+		if _, has := m.syncIdMsgMap[id]; has {
+			delete(m.syncIdMsgMap, id)
+		}
+		return
+	}
+	if !sth.NeedSync {
+		m.replyClient(Order.Message{From: id, Log: sth.Content, Agree: true, LastLogKey: sth.Key, Result: sth.Result})
+		return
+	}
+	if msg, has := m.syncIdMsgMap[id]; has {
+		if err := m.role.processClientSync(msg, m); err != nil {
+			/*
+				上层已经执行了这个操作，但是自己已经不是leader，这个操作不会进入日志，通知上层撤销。
+			*/
+			log.Println(err)
+			m.toCrownChan <- Something.Something{NeedReply: false, Content: "!" + msg.Log}
+			m.replyClient(Order.Message{From: id, Log: Order.Unsynced})
+			delete(m.syncIdMsgMap, id)
+		} else {
+			m.syncIdMsgMap[id] = Order.Message{From: id, Log: sth.Content, Agree: true, LastLogKey: m.logSet.GetLast(), Result: sth.Result}
+		}
+	} else {
+		panic("lose client msg")
+	}
+}
+
+func (m *Me) handleSyncFinished(id int) {
+	if msg, has := m.syncIdMsgMap[id]; has {
+		m.replyClient(msg)
+		delete(m.syncIdMsgMap, id)
+	} else {
+		panic("lose client msg")
+	}
+}
+
 /*
 processFromNode方法是处理OrderType为FromNode所有命令中msg的共同逻辑。
 首先会进行消息Term判断，如果发现收到了一则比自己Term大的消息，会转成follower之后继续处理这个消息。
-如果发现消息的Term比自己小，说明是一个过期的消息，不予处理。
+如果发现消息的Term比自己小，说明是一个过期的消息，不予处理。处理之前先解压压缩过的消息正文。
 之后会根据消息的Type分类处理。
 */
 
 func (m *Me) processFromNode(msg Order.Message) error {
+	if err := msg.Decompress(); err != nil {
+		return err
+	}
 	if m.meta.Term > msg.Term || m.meta.Id == msg.From {
 		return nil
 	} else if m.meta.Term < msg.Term {
 		return m.switchToFollower(msg.Term, true, msg)
 	}
+	if msg.Type == Order.Heartbeat || msg.Type == Order.AppendLog || msg.Type == Order.Commit {
+		m.leaderId = msg.From // 同一任期只有一个leader，只有leader发送这三种消息
+		m.leaderContact = m.clock.Now()
+		if msg.LastLogIndex >= m.leaderIndex {
+			m.leaderIndex, m.leaderIndexAt = msg.LastLogIndex, m.leaderContact
+		}
+	}
 	switch msg.Type {
 	case Order.Heartbeat:
 		return m.role.processHeartbeat(msg, m)
@@ -224,6 +338,8 @@ func (m *Me) processFromNode(msg Order.Message) error {
 		return m.role.processPreVote(msg, m)
 	case Order.PreVoteReply:
 		return m.role.processPreVoteReply(msg, m)
+	case Order.HeartbeatReply:
+		return m.role.processHeartbeatReply(msg, m)
 	default:
 		return errors.New("error: illegal msg type")
 	}
@@ -236,14 +352,14 @@ func (m *Me) processFromNode(msg Order.Message) error {
 func (m *Me) switchToFollower(term int, has bool, msg Order.Message) error {
 	log.Printf("==== switch to follower, my term is %d, has remain msg to process: %v ====\n", term, has)
 	if m.meta.Term < term {
-		m.meta.Term = term
+		m.meta.Term, m.leaderId, m.leaderIndex = term, -1, -1
 		if metaTmp, err := json.Marshal(*m.meta); err != nil {
 			return err
 		} else {
 			m.toBottomChan <- Order.Order{Type: Order.Store, Msg: Order.Message{Agree: true, Log: string(metaTmp)}}
 		}
 	}
-	m.role = &follower
+	m.role = &m.follower
 	if err := m.role.init(m); err != nil {
 		return err
 	}
@@ -259,7 +375,7 @@ func (m *Me) switchToFollower(term int, has bool, msg Order.Message) error {
 
 func (m *Me) switchToLeader() error {
 	log.Printf("==== switch to leader, my term is %d ====\n", m.meta.Term)
-	m.role = &leader
+	m.role, m.leaderId = &m.leader, m.meta.Id
 	return m.role.init(m)
 }
 
@@ -269,10 +385,55 @@ func (m *Me) switchToLeader() error {
 
 func (m *Me) switchToCandidate() error {
 	log.Printf("==== switch to candidate, my term is %d ====\n", m.meta.Term)
-	m.role = &candidate
+	m.role, m.leaderId = &m.candidate, -1
 	return m.role.init(m)
 }
 
+/*
+取key对应的日志，先按消息中携带的全局下标O(1)定位，下标和key对不上（比如消息来自旧版本的节点）时再按key查找。
+*/
+
+func (m *Me) getLog(key Log.Key, index int) (Log.Log, error) {
+	if v, err := m.logSet.GetByIndex(index); err == nil && v.K.Equals(key) {
+		return v, nil
+	}
+	it := m.logSet.Iterator()
+	defer it.Close()
+	it.Seek(key)
+	if v, ok := it.Next(); ok && v.K.Equals(key) {
+		return v, nil
+	}
+	return Log.Log{}, errors.New("error: can not find this log by key")
+}
+
+/*
+取key的下一条日志，key为-1-1时取第一条，没有下一条时返回的日志key为-1-1，key不存在时报错。
+*/
+
+func (m *Me) getNextLog(key Log.Key, index int) (Log.Log, error) {
+	if !key.Equals(Log.Key{Term: -1, Index: -1}) {
+		v, err := m.getLog(key, index)
+		if err != nil {
+			return Log.Log{K: Log.Key{Term: -1, Index: -1}, I: -1}, err
+		}
+		index = v.I
+	} else {
+		index = -1
+	}
+	if v, err := m.logSet.GetByIndex(index + 1); err == nil {
+		return v, nil
+	}
+	return Log.Log{K: Log.Key{Term: -1, Index: -1}, I: -1}, nil
+}
+
+/*
+停止Logic层，Run会在处理完当前消息后返回，只能调用一次。
+*/
+
+func (m *Me) Stop() {
+	close(m.done)
+}
+
 func (m *Me) ToString() string {
-	return m.meta.ToString() + "\n" + m.role.ToString()
+	return m.meta.ToString() + fmt.Sprintf("\nleader: %d\n", m.leaderId) + m.role.ToString()
 }
@@ -0,0 +1,182 @@
+package Logic
+
+import (
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Pipe/Order"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+/*
+把随机的节点消息、超时和客户端写入交给一个节点处理，其他节点不运行，随机消息可以伪造任意的leader和投票。
+检查：不会panic，任期和已提交的key不会减小，日志严格递增且全局下标等于位置，已提交的日志不会被删除或改变。
+每条消息由8个字节解码，取值范围很小，这样才容易凑出key相互匹配的消息。
+*/
+
+func FuzzProcessFromNode(f *testing.F) {
+	f.Add([]byte{6, 1, 0, 0, 0, 0, 0, 0, 7, 1, 0, 0, 0, 0, 0, 2})
+	f.Add([]byte{1, 1, 1, 1, 1, 0, 0, 0, 2, 1, 1, 1, 1, 0, 0, 0, 0, 1, 2, 2, 2, 1, 1, 0})
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 2, 5, 1, 1, 0, 0, 0, 0, 1, 3, 2, 1, 1, 1, 0, 0, 5})
+	f.Add([]byte{ // 当选leader，提交一条日志，然后收到同任期其他leader的心跳，再被新任期的leader要求删除已提交的日志
+		0, 0, 0, 0, 0, 0, 0, 2,
+		7, 1, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 2,
+		5, 1, 1, 0, 0, 0, 0, 1,
+		0, 0, 0, 0, 0, 0, 0, 5,
+		3, 1, 1, 2, 1, 0, 0, 1,
+		0, 2, 1, 1, 1, 0, 0, 0,
+		1, 2, 2, 2, 2, 0, 0, 0,
+	})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		defer log.SetOutput(log.Writer())
+		log.SetOutput(io.Discard)
+		s := newSimulator(t, 3, 1)
+		n := s.nodes[0]
+		term, committed := n.meta.Term, n.logSet.GetCommitted()
+		var committedLogs []Log.Log
+		for i := 0; i+7 < len(data); i += 8 {
+			b := data[i : i+8]
+			switch {
+			case b[7]&2 != 0:
+				n.me.handleTimeout()
+			case b[7]&4 != 0:
+				n.me.handleOrder(Order.Order{Type: Order.FromClient, Msg: Order.Message{
+					From: i, Agree: b[7]&1 != 0, Log: fmt.Sprintf("write'k'%d", i)}})
+			default:
+				n.me.handleOrder(Order.Order{Type: Order.FromNode, Msg: Order.Message{
+					Type:             Order.MsgType(b[0] % 12),
+					From:             int(b[1] % 4),
+					To:               []int{0},
+					Term:             int(b[2] % 4),
+					Agree:            b[7]&1 != 0,
+					LastLogKey:       Log.Key{Term: int(b[3]%4) - 1, Index: int(b[4]%4) - 1},
+					SecondLastLogKey: Log.Key{Term: int(b[5]%4) - 1, Index: int(b[6]%4) - 1},
+					Log:              fmt.Sprint(i),
+				}})
+			}
+			s.network = s.network[:0]
+			s.drain()
+			if n.meta.Term < term {
+				t.Fatalf("term decreases from %d to %d", term, n.meta.Term)
+			}
+			if n.logSet.GetCommitted().Less(committed) {
+				t.Fatalf("committed key decreases from %v to %v", committed, n.logSet.GetCommitted())
+			}
+			term, committed = n.meta.Term, n.logSet.GetCommitted()
+			logs := n.logSet.GetAll()
+			for j := 1; j < len(logs); j++ {
+				if !logs[j-1].K.Less(logs[j].K) {
+					t.Fatalf("logs are not increasing: %v", logs)
+				}
+			}
+			for j, v := range logs {
+				if v.I != j {
+					t.Fatalf("log %v is at %d: %v", v, j, logs)
+				}
+			}
+			for j, v := range committedLogs {
+				if j >= len(logs) || logs[j] != v {
+					t.Fatalf("committed logs %v are changed to %v", committedLogs, logs)
+				}
+			}
+			if !committed.Equals(Log.Key{Term: -1, Index: -1}) {
+				committedLogs = n.logSet.GetLogsByRange(logs[0].K, committed)
+				if len(committedLogs) == 0 {
+					t.Fatalf("committed key %v is not in %v", committed, logs)
+				}
+			}
+		}
+	})
+}
+
+/*
+有界陈旧读：follower满足日志条数或者时间的一个界限即可；leader只有在多数派确认过它的心跳之后的maxStale内才能读。
+*/
+
+func TestFresh(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	s := newSimulator(t, 3, 1)
+	leader, follower := s.nodes[0], s.nodes[1]
+	leader.meta.Term = 1
+	if err := leader.me.switchToLeader(); err != nil {
+		t.Fatal(err)
+	}
+	s.drain()
+	s.now += 100 * time.Millisecond
+	if leader.me.fresh(Order.Bound{Entries: 0, Millis: 1000}) {
+		t.Fatal("a leader no follower has confirmed serves bounded reads")
+	}
+	deliver := func(to *simNode, typ Order.MsgType) {
+		for i, e := range s.network {
+			if e.to == to.id && e.msg.Type == typ {
+				s.network = append(s.network[:i], s.network[i+1:]...)
+				to.me.handleOrder(Order.Order{Type: Order.FromNode, Msg: e.msg})
+				s.drain()
+				return
+			}
+		}
+		t.Fatalf("no %v to %d in %v", typ, to.id, s.network)
+	}
+	deliver(follower, Order.Heartbeat)
+	deliver(leader, Order.HeartbeatReply)
+	for _, c := range []struct {
+		n     *simNode
+		bound Order.Bound
+		fresh bool
+	}{
+		{leader, Order.Bound{Entries: -1, Millis: 1000}, true}, // 心跳在100ms前发出
+		{leader, Order.Bound{Entries: -1, Millis: 50}, false},
+		{leader, Order.Bound{Entries: 0, Millis: 0}, false}, // leader不用日志条数的界限
+		{follower, Order.Bound{Entries: 0, Millis: 0}, true},
+		{follower, Order.Bound{Entries: -1, Millis: 1}, true},
+	} {
+		if c.n.me.fresh(c.bound) != c.fresh {
+			t.Fatalf("node %d with %+v should be fresh: %v", c.n.id, c.bound, c.fresh)
+		}
+	}
+	send := func(typ Order.MsgType) {
+		if err := follower.me.processFromNode(Order.Message{Type: typ, From: 0, Term: 1, LastLogKey: Log.Key{Term: 1, Index: 0},
+			SecondLastLogKey: Log.Key{Term: -1, Index: -1}, LastLogIndex: 0, SecondLastLogIndex: -1, Log: "write'a'1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(Order.AppendLog)
+	if follower.me.fresh(Order.Bound{Entries: 0, Millis: 0}) || !follower.me.fresh(Order.Bound{Entries: 1, Millis: 0}) {
+		t.Fatal("the entries bound should count the applied logs, not the appended ones")
+	}
+	send(Order.Commit)
+	if !follower.me.fresh(Order.Bound{Entries: 0, Millis: 0}) {
+		t.Fatal("a follower having applied the leader's last log is not fresh")
+	}
+	s.now += 60 * time.Millisecond // 被隔离超过一个选举超时，不知道leader之后有没有新的日志
+	for _, c := range []struct {
+		bound Order.Bound
+		fresh bool
+	}{
+		{Order.Bound{Entries: 0, Millis: 0}, false},
+		{Order.Bound{Entries: 100, Millis: 0}, false},
+		{Order.Bound{Entries: 0, Millis: 1000}, true},
+	} {
+		if follower.me.fresh(c.bound) != c.fresh {
+			t.Fatalf("partitioned follower with %+v should be fresh: %v", c.bound, c.fresh)
+		}
+	}
+	s.now += 10 * time.Second
+	for _, c := range []struct {
+		n     *simNode
+		bound Order.Bound
+		fresh bool
+	}{
+		{leader, Order.Bound{Entries: -1, Millis: 1000}, false},
+		{follower, Order.Bound{Entries: -1, Millis: 1000}, false},
+		{follower, Order.Bound{Entries: 0, Millis: 1000}, false}, // 10s没有收到leader的消息，两个界限都不满足
+	} {
+		if c.n.me.fresh(c.bound) != c.fresh {
+			t.Fatalf("after 10s node %d with %+v should be fresh: %v", c.n.id, c.bound, c.fresh)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package Logic
+
+import (
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Meta"
+	"RaftDB/Kernel/Pipe/Order"
+	"RaftDB/Kernel/Pipe/Something"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"testing"
+)
+
+/*
+3节点集群中的一个节点，不运行Run，直接调用消息处理函数，输出都留在带缓冲的管道里，返回发往上层的管道。
+*/
+
+func newTestMe(id int, term int, logs ...Log.Log) (*Me, chan Something.Something) {
+	meta := &Meta.Meta{Id: id, Num: 3, Term: term, CommittedKeyTerm: -1, CommittedKeyIndex: -1,
+		LeaderHeartbeat: 15, FollowerTimeout: 50, CandidatePreVoteTimeout: 30, CandidateVoteTimeout: 30}
+	logSet := &Log.MemoryLogSet{}
+	logSet.Init(-1, -1)
+	for _, v := range logs {
+		logSet.Append(v)
+	}
+	me, toCrown := &Me{}, make(chan Something.Something, 1000)
+	me.Init(meta, logSet, nil, make(chan Order.Order, 1000), make(chan Something.Something, 1000), toCrown)
+	return me, toCrown
+}
+
+/*
+follower有旧leader留下的、没有提交的日志(1,0)(1,1)，新leader提交了(2,0)。
+follower没有(2,0)，不能提交：(1,1)不在新leader的日志里，提交它会和leader分叉。
+*/
+
+func TestFollowerCommitUnknownKey(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	me, _ := newTestMe(1, 2, Log.Log{K: Log.Key{Term: 1, Index: 0}, V: "write'a'1"},
+		Log.Log{K: Log.Key{Term: 1, Index: 1}, V: "write'a'2"})
+	commit := func(key Log.Key) {
+		if err := me.processFromNode(Order.Message{Type: Order.Commit, From: 0, Term: 2, LastLogKey: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit(Log.Key{Term: 2, Index: 0})
+	if committed := me.logSet.GetCommitted(); !committed.Equals(Log.Key{Term: -1, Index: -1}) {
+		t.Fatalf("follower commits %v without having the leader's log", committed)
+	}
+	commit(Log.Key{Term: 1, Index: 0})
+	if committed := me.logSet.GetCommitted(); !committed.Equals(Log.Key{Term: 1, Index: 0}) {
+		t.Fatalf("follower should commit (1,0), got %v", committed)
+	}
+}
+
+/*
+新leader把以前任期的日志(1,0)补发给落后的follower，follower的同意回复不在agreeMap中。
+leader要记下这票而不是崩溃，(1,0)不能单独提交，等本任期的(2,0)达到多数派时一起提交。
+*/
+
+func TestLeaderCountsOlderTermReply(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	me, _ := newTestMe(0, 2, Log.Log{K: Log.Key{Term: 1, Index: 0}, V: "write'a'1"},
+		Log.Log{K: Log.Key{Term: 2, Index: 0}, V: "write'a'2"})
+	if err := me.switchToLeader(); err != nil {
+		t.Fatal(err)
+	}
+	agree := func(key Log.Key) {
+		if err := me.processFromNode(Order.Message{Type: Order.AppendLogReply, From: 1, Term: 2, Agree: true,
+			LastLogKey: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	agree(Log.Key{Term: 1, Index: 0})
+	if committed := me.logSet.GetCommitted(); !committed.Equals(Log.Key{Term: -1, Index: -1}) {
+		t.Fatalf("leader commits %v of an older term by counting replicas", committed)
+	}
+	agree(Log.Key{Term: 2, Index: 0})
+	if committed := me.logSet.GetCommitted(); !committed.Equals(Log.Key{Term: 2, Index: 0}) {
+		t.Fatalf("leader should commit (2,0), got %v", committed)
+	}
+}
+
+/*
+读出发往上层的所有撤销命令。
+*/
+
+func undone(toCrown chan Something.Something) (res []string) {
+	for {
+		select {
+		case sth := <-toCrown:
+			if strings.HasPrefix(sth.Content, "!") {
+				res = append(res, sth.Content)
+			}
+		default:
+			return
+		}
+	}
+}
+
+/*
+新leader要求follower删除旧任期没提交的日志，上层必须从最新的日志开始撤销，否则同一个key的旧值会被更早的写入覆盖。
+*/
+
+func TestFollowerRollbackOrder(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	me, toCrown := newTestMe(1, 2, Log.Log{K: Log.Key{Term: 1, Index: 0}, V: "write'a'1"},
+		Log.Log{K: Log.Key{Term: 1, Index: 1}, V: "write'a'2"})
+	if err := me.processFromNode(Order.Message{Type: Order.AppendLog, From: 0, Term: 2,
+		LastLogKey: Log.Key{Term: 2, Index: 0}, SecondLastLogKey: Log.Key{Term: -1, Index: -1}, Log: "write'b'1"}); err != nil {
+		t.Fatal(err)
+	}
+	if res := undone(toCrown); fmt.Sprint(res) != "[!write'a'2 !write'a'1]" {
+		t.Fatalf("rollback order is %v", res)
+	}
+}
+
+/*
+上层执行完写入时自己已经不是leader，写入不会进入日志，上层必须撤销它。
+*/
+
+func TestUndoRefusedSync(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	me, toCrown := newTestMe(1, 2)
+	me.syncIdMsgMap[7] = Order.Message{From: 7, Agree: true, Log: "write'a'1"}
+	me.handleCrown(Something.Something{Id: 7, NeedReply: true, NeedSync: true, Agree: true, Content: "write successfully: a, 1"})
+	if res := undone(toCrown); fmt.Sprint(res) != "[!write'a'1]" {
+		t.Fatalf("undo %v", res)
+	}
+	if _, has := me.syncIdMsgMap[7]; has {
+		t.Fatal("refused sync is not released")
+	}
+}
+
+/*
+不允许一次取出一段日志的日志系统，复制和提交只能逐条读取。
+*/
+
+type rangeless struct {
+	Log.LogSet
+}
+
+func (r rangeless) GetLogsByRange(begin Log.Key, end Log.Key) []Log.Log {
+	panic("GetLogsByRange in replication")
+}
+
+func (r rangeless) GetKsByRange(begin Log.Key, end Log.Key) []Log.Key {
+	panic("GetKsByRange in replication")
+}
+
+func (r rangeless) GetAll() []Log.Log {
+	panic("GetAll in replication")
+}
+
+/*
+leader给落后的follower逐条补发日志并提交，补发和提交都通过GetByIndex和迭代器读取，不构造日志的切片。
+*/
+
+func TestLeaderCatchUpWithoutRange(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	me, _ := newTestMe(0, 2, Log.Log{K: Log.Key{Term: 1, Index: 0}, V: "write'a'1"},
+		Log.Log{K: Log.Key{Term: 1, Index: 1}, V: "write'a'2"}, Log.Log{K: Log.Key{Term: 2, Index: 0}, V: "write'a'3"})
+	toBottom := make(chan Order.Order, 1000)
+	me.logSet, me.toBottomChan = rangeless{me.logSet}, toBottom
+	if err := me.switchToLeader(); err != nil {
+		t.Fatal(err)
+	}
+	sent := func() (res []Log.Key) {
+		for {
+			select {
+			case o := <-toBottom:
+				if o.Msg.Type == Order.AppendLog && len(o.Msg.To) == 1 && o.Msg.To[0] == 1 {
+					res = append(res, o.Msg.LastLogKey)
+				}
+			default:
+				return
+			}
+		}
+	}
+	sent()
+	if err := me.processFromNode(Order.Message{Type: Order.AppendLogReply, From: 1, Term: 2,
+		LastLogKey: Log.Key{Term: 2, Index: 0}, SecondLastLogKey: Log.Key{Term: 1, Index: 0}, SecondLastLogIndex: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if res := sent(); fmt.Sprint(res) != "[{1 1}]" {
+		t.Fatalf("leader sends %v to a follower stopping at (1,0)", res)
+	}
+	for i, key := range []Log.Key{{Term: 1, Index: 1}, {Term: 2, Index: 0}} {
+		if err := me.processFromNode(Order.Message{Type: Order.AppendLogReply, From: 1, Term: 2, Agree: true,
+			LastLogKey: key, LastLogIndex: i + 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res := sent(); fmt.Sprint(res) != "[{2 0}]" {
+		t.Fatalf("leader sends %v after (1,1) is agreed", res)
+	}
+	if committed := me.logSet.GetCommitted(); !committed.Equals(Log.Key{Term: 2, Index: 0}) {
+		t.Fatalf("leader should commit (2,0), got %v", committed)
+	}
+}
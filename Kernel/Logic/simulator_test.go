@@ -0,0 +1,334 @@
+package Logic
+
+import (
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Meta"
+	"RaftDB/Kernel/Pipe/Order"
+	"RaftDB/Kernel/Pipe/Something"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+/*
+确定性模拟器：单线程驱动N个Me，不经过Run，也不启动Bottom和Crown。
+网络是一个消息池，每一步由种子决定投递哪条消息（乱序）、是否丢弃或重复，或者把虚拟时间推进到最早的计时器到期。
+每一步之后检查Raft的安全性：选举安全、日志匹配、leader完整性和状态机安全。
+同一个种子每次运行的过程完全相同，失败时打印种子和步数即可复现。
+*/
+
+type simTimer struct {
+	sim      *simulator
+	deadline time.Duration
+	active   bool
+}
+
+func (t *simTimer) C() <-chan time.Time {
+	return nil
+}
+
+func (t *simTimer) Reset(d time.Duration) bool {
+	active := t.active
+	t.deadline, t.active = t.sim.now+d, true
+	return active
+}
+
+func (t *simTimer) Stop() bool {
+	active := t.active
+	t.active = false
+	return active
+}
+
+type simClock struct {
+	sim  *simulator
+	node *simNode
+}
+
+func (c simClock) NewTimer(d time.Duration) Timer {
+	c.node.timer = &simTimer{sim: c.sim}
+	c.node.timer.Reset(d)
+	return c.node.timer
+}
+
+func (c simClock) Now() time.Time {
+	return time.Unix(0, 0).Add(c.sim.now)
+}
+
+type simNode struct {
+	id        int
+	me        Me
+	meta      Meta.Meta
+	logSet    Log.MemoryLogSet
+	timer     *simTimer
+	toBottom  chan Order.Order
+	toCrown   chan Something.Something
+	fromCrown chan Something.Something
+}
+
+type envelope struct {
+	to  int
+	msg Order.Message
+}
+
+type simulator struct {
+	t           *testing.T
+	seed        int64
+	step        int
+	rand        *rand.Rand
+	now         time.Duration
+	nodes       []*simNode
+	network     []envelope
+	leaders     map[int]int     // term -> 这个任期的leader
+	committed   []Log.Log       // 所有节点中最长的已提交日志
+	committedAt map[Log.Key]int // 日志第一次被提交时提交者的任期
+	replies     int
+}
+
+func newSimulator(t *testing.T, num int, seed int64) *simulator {
+	s := &simulator{
+		t:           t,
+		seed:        seed,
+		rand:        rand.New(rand.NewSource(seed)),
+		leaders:     map[int]int{},
+		committedAt: map[Log.Key]int{},
+	}
+	for i := 0; i < num; i++ {
+		n := &simNode{
+			id:        i,
+			toBottom:  make(chan Order.Order, 1000),
+			toCrown:   make(chan Something.Something, 1000),
+			fromCrown: make(chan Something.Something, 1000),
+		}
+		n.meta = Meta.Meta{Id: i, Num: num, CommittedKeyTerm: -1, CommittedKeyIndex: -1,
+			LeaderHeartbeat: 15, FollowerTimeout: 50, CandidatePreVoteTimeout: 30, CandidateVoteTimeout: 30}
+		n.logSet.Init(-1, -1)
+		n.me.SetClock(simClock{sim: s, node: n}, rand.New(rand.NewSource(seed*31+int64(i))))
+		n.me.Init(&n.meta, &n.logSet, nil, n.toBottom, n.fromCrown, n.toCrown)
+		s.nodes = append(s.nodes, n)
+	}
+	s.drain()
+	return s
+}
+
+/*
+执行一步：大概率投递一条随机的消息，其余情况推进时间触发最早的计时器，偶尔有客户端向随机节点写入。
+*/
+
+func (s *simulator) run(steps int) {
+	for s.step = 0; s.step < steps; s.step++ {
+		r := s.rand.Float64()
+		switch {
+		case r < 0.05:
+			n := s.nodes[s.rand.Intn(len(s.nodes))]
+			n.me.handleOrder(Order.Order{Type: Order.FromClient, Msg: Order.Message{
+				From: s.step, Agree: true, Log: fmt.Sprintf("write'k%d'%d", s.rand.Intn(5), s.step)}})
+		case r < 0.85 && len(s.network) > 0:
+			i := s.rand.Intn(len(s.network))
+			e := s.network[i]
+			if s.rand.Float64() >= 0.03 { // 重复投递时消息留在消息池中
+				s.network = append(s.network[:i], s.network[i+1:]...)
+			}
+			if s.rand.Float64() < 0.05 { // 丢包
+				break
+			}
+			s.nodes[e.to].me.handleOrder(Order.Order{Type: Order.FromNode, Msg: e.msg})
+		default:
+			var next *simNode
+			for _, n := range s.nodes {
+				if n.timer.active && (next == nil || n.timer.deadline < next.timer.deadline) {
+					next = n
+				}
+			}
+			if next == nil {
+				s.t.Fatalf("seed %d step %d: no timer is active", s.seed, s.step)
+			}
+			if next.timer.deadline > s.now {
+				s.now = next.timer.deadline
+			}
+			next.timer.active = false
+			next.me.handleTimeout()
+		}
+		s.drain()
+		s.check()
+	}
+}
+
+/*
+处理所有节点产生的输出，直到没有新的输出：节点消息放入消息池，同步请求由模拟的Crown直接同意。
+*/
+
+func (s *simulator) drain() {
+	for busy := true; busy; {
+		busy = false
+		for _, n := range s.nodes {
+			for more := true; more; {
+				select {
+				case order := <-n.toBottom:
+					busy = true
+					if order.Type == Order.NodeReply {
+						for _, to := range order.Msg.To {
+							if to != n.id {
+								s.network = append(s.network, envelope{to: to, msg: order.Msg})
+							}
+						}
+					} else if order.Type == Order.ClientReply {
+						s.replies++
+					}
+				case sth := <-n.toCrown:
+					busy = true
+					if sth.NeedReply {
+						sth.Agree = true
+						n.me.handleCrown(sth)
+					}
+				case id := <-n.me.syncFinishedChan:
+					busy = true
+					n.me.handleSyncFinished(id)
+				default:
+					more = false
+				}
+			}
+		}
+	}
+}
+
+func (s *simulator) fail(format string, args ...interface{}) {
+	s.t.Fatalf("seed %d step %d: %s", s.seed, s.step, fmt.Sprintf(format, args...))
+}
+
+func (s *simulator) check() {
+	/*
+		选举安全：一个任期内最多只有一个leader。
+	*/
+	for _, n := range s.nodes {
+		if n.me.role == &n.me.leader {
+			if id, has := s.leaders[n.meta.Term]; has && id != n.id {
+				s.fail("two leaders %d and %d in term %d", id, n.id, n.meta.Term)
+			}
+			s.leaders[n.meta.Term] = n.id
+		}
+	}
+	/*
+		节点知道的leader就是这个任期的leader。
+	*/
+	for _, n := range s.nodes {
+		if l, has := s.leaders[n.meta.Term]; n.me.LeaderId() >= 0 && (!has || l != n.me.LeaderId()) {
+			s.fail("node %d follows %d in term %d, the leader is %d", n.id, n.me.LeaderId(), n.meta.Term, l)
+		}
+	}
+	/*
+		日志匹配：两个节点的日志中如果有相同的key，那么这条日志的内容、全局下标和它之前的日志都相同。
+		逐条检查相同key的内容和前一个key，归纳可得整个前缀相同。全局下标必须等于日志的位置。
+	*/
+	type entry struct {
+		v        string
+		i        int
+		previous Log.Key
+	}
+	indexes := make([]map[Log.Key]entry, len(s.nodes))
+	for i, n := range s.nodes {
+		indexes[i] = map[Log.Key]entry{}
+		previous := Log.Key{Term: -1, Index: -1}
+		for j, v := range n.logSet.GetAll() {
+			if v.I != j {
+				s.fail("global index: node %d stores %v at %d", i, v, j)
+			}
+			indexes[i][v.K] = entry{v: v.V, i: v.I, previous: previous}
+			previous = v.K
+		}
+	}
+	for i := range s.nodes {
+		for j := i + 1; j < len(s.nodes); j++ {
+			for k, a := range indexes[i] {
+				if b, has := indexes[j][k]; has && a != b {
+					s.fail("log matching: %d and %d differ at or before %v", i, j, k)
+				}
+			}
+		}
+	}
+	/*
+		状态机安全：每个节点已提交的日志都是同一个序列的前缀，记录最长的已提交序列。
+	*/
+	for _, n := range s.nodes {
+		var committed []Log.Log
+		for _, v := range n.logSet.GetAll() {
+			if v.K.Greater(n.logSet.GetCommitted()) {
+				break
+			}
+			committed = append(committed, v)
+		}
+		for i, v := range committed {
+			if i < len(s.committed) {
+				if s.committed[i] != v {
+					s.fail("state machine safety: node %d commits %v at %d, others commit %v", n.id, v, i, s.committed[i])
+				}
+			} else {
+				s.committed = append(s.committed, v)
+				s.committedAt[v.K] = n.meta.Term
+			}
+		}
+	}
+	/*
+		leader完整性：在某个任期或者更早提交的日志，一定出现在这个任期的leader的日志中。
+	*/
+	for i, n := range s.nodes {
+		if n.me.role != &n.me.leader {
+			continue
+		}
+		for _, v := range s.committed {
+			if s.committedAt[v.K] > n.meta.Term {
+				continue
+			}
+			if e, has := indexes[i][v.K]; !has || e.v != v.V {
+				s.fail("leader completeness: leader %d of term %d lost committed log %v", n.id, n.meta.Term, v)
+			}
+		}
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	progressed := 0
+	for seed := int64(1); seed <= 30; seed++ {
+		s := newSimulator(t, 5, seed)
+		s.run(3000)
+		if len(s.committed) > 0 {
+			progressed++
+		}
+	}
+	if progressed < 15 { // 丢包和乱序下不保证每个种子都能提交，但大多数种子应该有进展，否则模拟器本身有问题
+		t.Fatalf("only %d seeds commit logs", progressed)
+	}
+}
+
+/*
+单节点集群没有其他节点投票和回复，自己当选leader并提交日志。
+*/
+
+func TestSingleNode(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	s := newSimulator(t, 1, 1)
+	s.run(1000)
+	if s.nodes[0].me.role != &s.nodes[0].me.leader || len(s.committed) == 0 {
+		t.Fatalf("single node is %s and commits %d logs", s.nodes[0].me.role.ToString(), len(s.committed))
+	}
+}
+
+/*
+同一个种子的两次模拟必须完全相同。
+*/
+
+func TestSimulationIsDeterministic(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	a, b := newSimulator(t, 3, 7), newSimulator(t, 3, 7)
+	a.run(2000)
+	b.run(2000)
+	if fmt.Sprint(a.committed) != fmt.Sprint(b.committed) || a.now != b.now || a.replies != b.replies {
+		t.Fatal("the same seed gives different histories")
+	}
+}
@@ -13,6 +13,22 @@ type Meta struct {
 	FollowerTimeout         int      `json:"followerTimeout"`
 	CandidatePreVoteTimeout int      `json:"candidatePreVoteTimeout"`
 	CandidateVoteTimeout    int      `json:"candidateVoteTimeout"`
+	LogSegmentSize          int      `json:"logSegmentSize"` // 每个日志段文件最多保存的日志条数，为0时使用默认值
+	LogCodec                string   `json:"logCodec"`       // 日志文件中每条日志的压缩方式，none或flate，为空时不压缩
+	MsgCodec                string   `json:"msgCodec"`       // 节点间AppendLog消息正文的压缩方式，none或flate，为空时不压缩
+	TLSCert                 string   `json:"tlsCert"`        // 本节点证书文件，和tlsKey、tlsCA都设置时开启双向TLS
+	TLSKey                  string   `json:"tlsKey"`         // 本节点私钥文件
+	TLSCA                   string   `json:"tlsCA"`          // 签发全部节点和客户端证书的CA证书文件
+	TLSNodeName             string   `json:"tlsNodeName"`    // 节点证书中的DNS名称格式，%d是节点id，为空时是node%d.raftdb
+	ClientDns               []string `json:"clientDns"`      // 每个节点服务客户端的地址，为空或者和dns相同时客户端和节点共用一个地址
+	PeerMaxConns            int      `json:"peerMaxConns"`   // 节点地址上同时保持的最大连接数，为0时不限制
+	ClientMaxConns          int      `json:"clientMaxConns"` // 客户端地址上同时保持的最大连接数，为0时不限制
+	ClientTLSCert           string   `json:"clientTlsCert"`  // 客户端地址使用的证书、私钥和CA，都为空时和节点地址相同
+	ClientTLSKey            string   `json:"clientTlsKey"`
+	ClientTLSCA             string   `json:"clientTlsCA"`
+	HttpDns                 []string `json:"httpDns"`       // 每个节点HTTP网关的地址，为空时不开启网关
+	BackupDir               string   `json:"backupDir"`     // 远程备份写入的目录，为空时不接受远程备份
+	ClusterSecret           string   `json:"clusterSecret"` // 流式信道的节点连接握手时携带的共享密钥，为空时只检查对方地址
 }
 
 func (m *Meta) ToString() string {
@@ -0,0 +1,86 @@
+package Node
+
+import (
+	"RaftDB/Kernel/Bottom"
+	"RaftDB/Kernel/Crown"
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Logic"
+	"RaftDB/Kernel/Meta"
+	"RaftDB/Kernel/Pipe/Order"
+	"RaftDB/Kernel/Pipe/Something"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+一个完整的服务节点，把底座、Raft层和上层应用按固定的方式组装在一起。
+同一个进程里可以同时运行多个Node（例如进程内集群测试），Stop之后可以用同一个存储介质重新Init一个新的Node，模拟节点重启。
+*/
+
+type Node struct {
+	Bottom Bottom.Bottom // 通信和存储底座，内部数据结构线程安全
+	Meta   Meta.Meta     // 元数据，线程不安全，只允许Logic层访问
+	LogSet Log.LogSet    // 日志系统，线程安全，Init之前可以设置为DiskLogSet，为空时使用MemoryLogSet
+	Me     Logic.Me      // Raft层
+	Crown  Crown.Crown   // 上层应用服务
+	wg     sync.WaitGroup
+}
+
+/*
+初始化节点，创建各层之间的通讯管道，依次初始化底座、Raft层和上层应用。
+cable的初始化参数是发往Logic层的管道，底座初始化失败会Panic。
+*/
+
+func (n *Node) Init(confPath string, logPath string, medium Bottom.Medium, cable Bottom.Cable, app Crown.App) {
+	fromBottomChan := make(chan Order.Order, 10000)        // 创建下层通讯管道，管道线程安全
+	toBottomChan := make(chan Order.Order, 10000)          // 创建下层通讯管道，管道线程安全
+	toCrownChan := make(chan Something.Something, 10000)   // 创建上层管道
+	fromCrownChan := make(chan Something.Something, 10000) // 创建上层通讯管道
+	if n.LogSet == nil {
+		n.LogSet = &Log.MemoryLogSet{}
+	}
+	n.Bottom.Init(confPath, logPath, &n.Meta, n.LogSet, medium, cable,
+		toBottomChan, fromBottomChan, nil, fromBottomChan) // 初始化系统底座，初始化meta和logs（传入传出参数）
+	rand.Seed(time.Now().UnixNano() + int64(n.Meta.Id)%1024) // 设置随机因子
+	log.Printf("\n%s\n", n.Meta.ToString())                  // 输出元数据信息
+	log.Printf("\n%s\n", n.LogSet.ToString())                // 输出日志信息
+	n.Me.Init(&n.Meta, n.LogSet, fromBottomChan, toBottomChan, fromCrownChan, toCrownChan)
+	n.Crown.Init(n.LogSet, n.Bottom.Snapshot(), app, toCrownChan, fromCrownChan)
+	n.Bottom.SetSnapshotSource(&n.Crown) // 在线备份时由Crown生成App快照
+	if hub := n.Crown.Hub(); hub != nil {
+		n.Bottom.SetWatchSource(hub) // 流式监听直接读已提交的日志
+	}
+}
+
+/*
+运行节点的三个层次，每一层都在自己的协程中运行，Run本身不阻塞。
+*/
+
+func (n *Node) Run() {
+	n.wg.Add(3)
+	go func() {
+		defer n.wg.Done()
+		n.Bottom.Run()
+	}()
+	go func() {
+		defer n.wg.Done()
+		n.Crown.Run()
+	}()
+	go func() {
+		defer n.wg.Done()
+		n.Me.Run()
+	}()
+}
+
+/*
+停止节点，等待三个层次全部退出后返回，返回后节点不会再读写存储介质。
+*/
+
+func (n *Node) Stop() {
+	n.Me.Stop()
+	n.Crown.Stop()
+	n.Bottom.Stop()
+	n.wg.Wait()
+}
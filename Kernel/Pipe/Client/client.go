@@ -0,0 +1,273 @@
+package Client
+
+import (
+	"RaftDB/Kernel/Feed"
+	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Pipe/Order"
+	"RaftDB/Kernel/Pipe/Something"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+客户端协议：RPC、HTTP和流式信道的客户端都用Request发出请求、用Response接收回复。
+信道把Request转换成交给Logic层的Order.Message，把Logic层的回复转换成Response，Logic层和Crown层不知道这个协议。
+协议带有版本号，节点拒绝自己不认识的版本。
+*/
+
+const Version = 1
+
+const DefaultTimeout = 1000 // 请求没有给出超时时间时使用的毫秒数
+
+type Op int
+
+const (
+	Read   Op = iota // 只读，按一致性级别决定是否经过日志
+	Write            // 写入，总是经过日志，只有leader能处理
+	Watch            // 一次性监听，由收到请求的节点在写入发生时回复
+	Stream           // 流式监听的长轮询，任何节点都能处理：WatchId为0时按Command和From创建监听，否则轮询这个监听
+	Cancel           // 取消WatchId对应的流式监听
+)
+
+var opNames = []string{"read", "write", "watch", "stream", "cancel"}
+
+type Consistency int
+
+const (
+	Linearizable Consistency = iota // 读经过日志，只有leader能处理，一定读到最新的已提交写入
+	Local                           // 读本节点的状态，任何节点都能处理，可能读到旧值或者还没提交的值
+	Bounded                         // 有界陈旧：节点落后leader不超过MaxLag条日志，或者MaxStale毫秒内收到过leader的消息
+)
+
+var consistencyNames = []string{"linearizable", "local", "bounded"}
+
+type Code int
+
+const (
+	OK         Code = iota // 成功，Result是App的回复
+	NotLeader              // 节点不能处理这个请求，Leader是节点知道的leader
+	Unsynced               // 执行之后发现自己已经不是leader，操作会被撤销
+	RolledBack             // 日志被新的leader覆盖，操作会被撤销
+	Timeout                // 超时没有结果，写入可能已经执行
+	Rejected               // App或者Logic层拒绝执行，Result是原因
+	BadRequest             // 请求不合法，比如版本不对，Result是原因
+	Stale                  // 节点落后leader超过有界陈旧读的界限，可以换一个节点或者读leader
+	Gone                   // 流式监听不存在（取消、过期或者节点重启），用最后收到的版本重新创建
+	Compacted              // 节点已经丢弃了From之后的一部分事件，需要重新读取之后从新的版本监听；读取的数据版本已经被压缩
+	NotFound               // 读取的key不存在，Result是App的回复，Key和OK时一样
+)
+
+var codeNames = []string{"ok", "not leader", "unsynced", "rolled back", "timeout", "rejected", "bad request", "stale",
+	"gone", "compacted", "not found"}
+
+type Request struct {
+	Version     int         `json:"version"`          // 协议版本，必须是Version
+	Id          uint64      `json:"id"`               // 客户端给出的请求id，回复中原样返回
+	Op          Op          `json:"op"`               // 操作类型
+	Consistency Consistency `json:"consistency"`      // 读操作的一致性级别
+	MaxLag      *int        `json:"maxLag,omitempty"` // 有界陈旧读允许落后leader的日志条数，为空时不用这个界限
+	MaxStale    int         `json:"maxStale"`         // 有界陈旧读允许距离最近一次收到leader消息的毫秒数，为0时不用这个界限
+	Timeout     int         `json:"timeout"`          // 超时毫秒数，为0时使用DefaultTimeout
+	Client      string      `json:"client"`           // 客户端会话id，只对写入有效，为空时不去重
+	Seq         int         `json:"seq"`              // 会话中的请求序号，重试时使用同一个序号
+	Command     string      `json:"command"`          // 交给App的命令
+	From        *Log.Key    `json:"from,omitempty"`   // 创建流式监听时从这个版本之后开始，为空时从节点当前已提交的位置开始
+	WatchId     int64       `json:"watchId"`          // 流式监听的id，只在创建它的节点上有效
+	Limit       int         `json:"limit"`            // 流式监听一次最多返回的事件数，为0时使用Feed.DefaultLimit
+}
+
+type Response struct {
+	Version int     `json:"version"`
+	Id      uint64  `json:"id"`     // 对应请求的id
+	Code    Code    `json:"code"`   // 结果
+	Result  string  `json:"result"` // 成功时是App的回复，失败时是原因
+	Leader  int     `json:"leader"` // 节点知道的leader，-1表示不知道
+	Key     Log.Key `json:"key"`    // 成功时读取所在的key：线性一致的读和写入是自己的日志key，其他读是节点当时最后一条日志的key；未知时是-1 -1
+	// 流式监听的id和事件，Key是最后检查到的版本，重新创建监听时作为From
+	WatchId int64        `json:"watchId,omitempty"`
+	Events  []Feed.Event `json:"events,omitempty"`
+}
+
+func (o Op) String() string {
+	if o < 0 || int(o) >= len(opNames) {
+		return fmt.Sprintf("op(%d)", int(o))
+	}
+	return opNames[o]
+}
+
+func (c Consistency) String() string {
+	if c < 0 || int(c) >= len(consistencyNames) {
+		return fmt.Sprintf("consistency(%d)", int(c))
+	}
+	return consistencyNames[c]
+}
+
+func (c Code) String() string {
+	if c < 0 || int(c) >= len(codeNames) {
+		return fmt.Sprintf("code(%d)", int(c))
+	}
+	return codeNames[c]
+}
+
+func (r *Request) Check() error {
+	if r.Version != Version {
+		return fmt.Errorf("unsupported version %d, the node speaks %d", r.Version, Version)
+	}
+	if r.Op < Read || r.Op > Cancel {
+		return fmt.Errorf("unknown %v", r.Op)
+	}
+	if r.Consistency < Linearizable || r.Consistency > Bounded {
+		return fmt.Errorf("unknown %v", r.Consistency)
+	}
+	if r.MaxLag != nil && *r.MaxLag < 0 || r.MaxStale < 0 {
+		return errors.New("negative maxLag or maxStale")
+	}
+	if r.Op == Read && r.Consistency == Bounded && r.MaxLag == nil && r.MaxStale == 0 {
+		return errors.New("bounded reads need maxLag or maxStale")
+	}
+	if r.Timeout < 0 {
+		return errors.New("negative timeout")
+	}
+	if r.Limit < 0 {
+		return errors.New("negative limit")
+	}
+	return nil
+}
+
+/*
+有界陈旧读的日志条数界限，用来填写Request.MaxLag。
+*/
+
+func Lag(n int) *int {
+	return &n
+}
+
+/*
+是否需要经过日志：写入和线性一致的读。
+*/
+
+func (r *Request) Sync() bool {
+	return r.Op == Write || r.Op == Read && r.Consistency == Linearizable
+}
+
+/*
+流式监听和取消请求不经过Logic层，由信道直接交给Source处理。
+*/
+
+func (r *Request) Streaming() bool {
+	return r.Op == Stream || r.Op == Cancel
+}
+
+func (r *Request) Duration() time.Duration {
+	if r.Timeout == 0 {
+		return DefaultTimeout * time.Millisecond
+	}
+	return time.Duration(r.Timeout) * time.Millisecond
+}
+
+/*
+交给Logic层的消息，From由信道填写。
+*/
+
+func (r *Request) Message() Order.Message {
+	msg := Order.Message{Agree: r.Sync(), Log: r.Command}
+	if r.Op == Write {
+		msg.Client, msg.Seq = r.Client, r.Seq
+	}
+	if r.Op == Read && r.Consistency == Bounded {
+		msg.Bound = &Order.Bound{Entries: -1, Millis: r.MaxStale}
+		if r.MaxLag != nil {
+			msg.Bound.Entries = *r.MaxLag
+		}
+	}
+	return msg
+}
+
+/*
+把Logic层的回复转换成Response。
+*/
+
+func Reply(req Request, msg Order.Message) Response {
+	res := Response{Version: Version, Id: req.Id, Result: msg.Log, Leader: msg.Leader, Key: Log.Key{Term: -1, Index: -1}}
+	switch {
+	case msg.Agree && msg.Result == Something.Missing:
+		res.Code, res.Key = NotFound, msg.LastLogKey
+	case msg.Agree:
+		res.Code, res.Key = OK, msg.LastLogKey
+	case msg.Log == Order.Timeout:
+		res.Code = Timeout
+	case msg.Log == Order.Refused:
+		res.Code = NotLeader
+	case msg.Log == Order.Unsynced:
+		res.Code = Unsynced
+	case msg.Log == Order.Rollback:
+		res.Code = RolledBack
+	case msg.Log == Order.Stale:
+		res.Code = Stale
+	case msg.Result == Something.Expired:
+		res.Code = Compacted
+	case msg.Result == Something.Illegal:
+		res.Code = BadRequest
+	default:
+		res.Code = Rejected
+	}
+	return res
+}
+
+/*
+流式监听的事件来源，由Feed.Hub实现。
+*/
+
+type Source interface {
+	Create(command string, after *Log.Key) (int64, error)
+	Poll(id int64, limit int, wait time.Duration) ([]Feed.Event, Log.Key, error)
+	Cancel(id int64) bool
+}
+
+/*
+处理流式监听和取消请求，流式监听请求的超时时间是长轮询最多等待的时间，没有事件时也回复OK。
+会阻塞，信道应该在请求自己的协程中调用。
+*/
+
+func Follow(req Request, source Source) Response {
+	if source == nil {
+		return Fail(req, BadRequest, "the node does not support streaming watches")
+	}
+	res := Response{Version: Version, Id: req.Id, Code: OK, Leader: -1, Key: Log.Key{Term: -1, Index: -1}, WatchId: req.WatchId}
+	if req.Op == Cancel {
+		if !source.Cancel(req.WatchId) {
+			return feedFail(req, Feed.ErrNoWatch)
+		}
+		return res
+	}
+	if res.WatchId == 0 {
+		id, err := source.Create(req.Command, req.From)
+		if err != nil {
+			return feedFail(req, err)
+		}
+		res.WatchId = id
+	}
+	events, next, err := source.Poll(res.WatchId, req.Limit, req.Duration())
+	if err != nil {
+		res = feedFail(req, err)
+		res.Key = next
+		return res
+	}
+	res.Key, res.Events = next, events
+	return res
+}
+
+func feedFail(req Request, err error) Response {
+	switch err {
+	case Feed.ErrNoWatch:
+		return Fail(req, Gone, err.Error())
+	case Feed.ErrCompacted:
+		return Fail(req, Compacted, err.Error())
+	}
+	return Fail(req, Rejected, err.Error())
+}
+
+func Fail(req Request, code Code, reason string) Response {
+	return Response{Version: Version, Id: req.Id, Code: code, Result: reason, Leader: -1, Key: Log.Key{Term: -1, Index: -1}}
+}
@@ -2,6 +2,7 @@ package Order
 
 import (
 	"RaftDB/Kernel/Log"
+	"RaftDB/Kernel/Pipe/Something"
 	"fmt"
 )
 
@@ -42,6 +43,7 @@ const (
 	PreVoteReply
 	Expansion
 	ExpansionReply
+	HeartbeatReply // follower确认收到当前任期leader的心跳，Seq原样带回心跳的Seq
 )
 
 var msgTypes []string = []string{
@@ -55,28 +57,75 @@ var msgTypes []string = []string{
 	"PreVoteReply",
 	"Expansion",
 	"ExpansionReply",
+	"HeartbeatReply",
 }
 
 type Message struct {
-	Type             MsgType `json:"type"`                // 消息类型
-	From             int     `json:"from"`                // 消息来源
-	To               []int   `json:"to"`                  // 消息去向
-	Term             int     `json:"term"`                // 消息发送方的任期/客户端设置的超时微秒数
-	Agree            bool    `json:"agree"`               // relay消息的回复/客户端消息确认/是否释放客户端应答权限/存储日志还是元数据（配置）
-	LastLogKey       Log.Key `json:"last_log_key"`        // 要commit的消息/要请求的消息/存储日志的最后一条消息
-	SecondLastLogKey Log.Key `json:"second_last_log_key"` // 要请求消息的前一条消息/存储日志的第一条消息
-	Log              string  `json:"log"`                 // 消息正文
+	Type               MsgType          `json:"type"`                  // 消息类型
+	From               int              `json:"from"`                  // 消息来源
+	To                 []int            `json:"to"`                    // 消息去向
+	Term               int              `json:"term"`                  // 消息发送方的任期
+	Agree              bool             `json:"agree"`                 // relay消息的回复/客户端请求是否需要同步/回复客户端时是否成功/存储日志还是元数据（配置）
+	LastLogKey         Log.Key          `json:"last_log_key"`          // 要commit的消息/要请求的消息/存储日志的最后一条消息/回复客户端时读取所在的key
+	SecondLastLogKey   Log.Key          `json:"second_last_log_key"`   // 要请求消息的前一条消息/存储日志的第一条消息
+	LastLogIndex       int              `json:"last_log_index"`        // LastLogKey对应日志的全局下标，只用来加速查找，和key对不上时以key为准
+	SecondLastLogIndex int              `json:"second_last_log_index"` // SecondLastLogKey对应日志的全局下标
+	Log                string           `json:"log"`                   // 消息正文
+	Codec              Log.Codec        `json:"codec"`                 // 消息正文的编码，Plain表示没有压缩
+	Leader             int              `json:"leader"`                // 回复客户端时已知的leader，-1表示不知道
+	Client             string           `json:"client"`                // 客户端会话id，为空时不去重
+	Seq                int              `json:"seq"`                   // 客户端会话中的请求序号，重试时使用同一个序号
+	Bound              *Bound           `json:"bound,omitempty"`       // 客户端读请求的陈旧界限，为空时不检查
+	Result             Something.Result `json:"result,omitempty"`      // 回复客户端时App给出的结果代码
 }
 
+/*
+有界陈旧读的界限，满足其中一个即可：节点知道的leader日志比自己多不超过Entries条，或者距离最近一次收到leader的消息不超过Millis毫秒。
+Entries小于0时没有日志条数的界限，Millis不大于0时没有时间的界限。
+*/
+
+type Bound struct {
+	Entries int `json:"entries"`
+	Millis  int `json:"millis"`
+}
+
+/*
+回复客户端的固定内容，回复的Agree为真表示操作成功，为假时客户端可以据此区分失败的原因。
+*/
+
+const (
+	Refused  = "logic refuses to operate"                           // 节点不能处理这个请求（比如不是leader），回复中的Leader是已知的leader
+	Unsynced = "operated but logic refuses to sync, rollback later" // 执行之后发现自己已经不是leader，操作会被撤销
+	Rollback = "sync failed, rollback later"                        // 日志被新的leader覆盖，操作会被撤销
+	Timeout  = "timeout"                                            // 超时没有结果，操作可能已经执行
+	Stale    = "too stale to serve the read"                        // 节点落后leader超过读请求的界限
+)
+
 func (o *Order) ToString() string {
 	return fmt.Sprintf("{\n OrderType: %s\n Message:{\n"+
-		"  Type: %s\n  From: %d\n  To: %v\n  Term: %d\n  Agree: %v\n  LastLogKey: %v\n  SecondLastLogKey: %v\n  V: %s\n }\n"+
+		"  Type: %s\n  From: %d\n  To: %v\n  Term: %d\n  Agree: %v\n  LastLogKey: %v#%d\n  SecondLastLogKey: %v#%d\n  V: %s\n }\n"+
 		"}",
-		orderTypes[o.Type], msgTypes[o.Msg.Type], o.Msg.From, o.Msg.To, o.Msg.Term,
-		o.Msg.Agree, o.Msg.LastLogKey, o.Msg.SecondLastLogKey, o.Msg.Log)
+		orderTypes[o.Type], msgTypes[o.Msg.Type], o.Msg.From, o.Msg.To, o.Msg.Term, o.Msg.Agree,
+		o.Msg.LastLogKey, o.Msg.LastLogIndex, o.Msg.SecondLastLogKey, o.Msg.SecondLastLogIndex, o.Msg.Log)
+}
+
+/*
+解压消息正文，之后Codec为Plain。
+*/
+
+func (m *Message) Decompress() error {
+	if m.Codec == Log.Plain {
+		return nil
+	}
+	v, err := Log.Decompress(m.Log, m.Codec)
+	if err != nil {
+		return err
+	}
+	m.Log, m.Codec = v, Log.Plain
+	return nil
 }
 
 func (m *Message) ToString() string {
-	return fmt.Sprintf("{\n Type: %s\n From: %d\n To: %v\n Term: %d\n Agree: %v\n LastLogKey: %v\n SecondLastLogKey: %v\n V: %s\n}",
-		msgTypes[m.Type], m.From, m.To, m.Term, m.Agree, m.LastLogKey, m.SecondLastLogKey, m.Log)
+	return fmt.Sprintf("{\n Type: %s\n From: %d\n To: %v\n Term: %d\n Agree: %v\n LastLogKey: %v#%d\n SecondLastLogKey: %v#%d\n V: %s\n}",
+		msgTypes[m.Type], m.From, m.To, m.Term, m.Agree, m.LastLogKey, m.LastLogIndex, m.SecondLastLogKey, m.SecondLastLogIndex, m.Log)
 }
@@ -0,0 +1,47 @@
+package Something
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+客户端会话的头部：leader把带有客户端id和序号的同步请求写进日志之前，在命令前面加上会话头部和自己的时间戳，
+Crown据此去掉重复执行的命令，并用日志中的时间推进复制时间。格式是 @session'客户端id'序号'毫秒时间戳'命令。
+*/
+
+const sessionPrefix = "@session'"
+
+func Stamp(client string, seq int, at int64, content string) string {
+	return sessionPrefix + client + "'" + strconv.Itoa(seq) + "'" + strconv.FormatInt(at, 10) + "'" + content
+}
+
+/*
+拆出会话头部，content没有会话头部时ok为假。
+*/
+
+func Unstamp(content string) (client string, seq int, at int64, rest string, ok bool) {
+	if !strings.HasPrefix(content, sessionPrefix) {
+		return "", 0, 0, content, false
+	}
+	res := strings.SplitN(content[len(sessionPrefix):], "'", 4)
+	if len(res) != 4 {
+		return "", 0, 0, content, false
+	}
+	var err error
+	if seq, err = strconv.Atoi(res[1]); err != nil {
+		return "", 0, 0, content, false
+	}
+	if at, err = strconv.ParseInt(res[2], 10, 64); err != nil {
+		return "", 0, 0, content, false
+	}
+	return res[0], seq, at, res[3], true
+}
+
+/*
+客户端不能自己写会话头部，否则可以伪造时间戳让全部会话过期。
+*/
+
+func IsStamped(content string) bool {
+	return strings.HasPrefix(content, sessionPrefix)
+}
@@ -1,9 +1,26 @@
 package Something
 
+import "RaftDB/Kernel/Log"
+
 type Something struct {
-	Id        int    // 标识消息Id，全局唯一，crown禁止修改
-	NeedReply bool   // 是否需要回复，crown禁止修改
-	NeedSync  bool   // 需要同步，crown禁止修改
-	Agree     bool   // 命令是否合法，如果合法且有同步任务需要继续执行，crown必须修改
-	Content   string // 消息正文，crown接受信息并在这里给出回复
+	Id        int     // 标识消息Id，全局唯一，crown禁止修改
+	NeedReply bool    // 是否需要回复，crown禁止修改
+	NeedSync  bool    // 需要同步，crown禁止修改
+	Agree     bool    // 命令是否合法，如果合法且有同步任务需要继续执行，crown必须修改
+	Content   string  // 消息正文，crown接受信息并在这里给出回复
+	Key       Log.Key // 读请求交给crown时本节点最后一条日志的key，也就是读取所在的key，crown原样返回
+	Result    Result  // App给出的结果代码，crown在回复时填写
 }
+
+/*
+App给出的命令结果，Crown原样交给Logic层带回客户端，客户端据此区分结果，不用比较回复的内容。
+*/
+
+type Result int
+
+const (
+	Done    Result = iota // 正常执行或者被拒绝，App没有给出更具体的结果
+	Missing               // 读取的key不存在
+	Expired               // 读取的版本已经被压缩
+	Illegal               // 命令不合法
+)
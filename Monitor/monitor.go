@@ -10,7 +10,7 @@ import (
 	"strings"
 )
 
-func Monitor(me *Logic.Me, logs *Log.LogSet, bottom *Bottom.Bottom, crown *Crown.Crown) { // 禁止修改参数
+func Monitor(me *Logic.Me, logs Log.LogSet, bottom *Bottom.Bottom, crown *Crown.Crown) { // 禁止修改参数
 	for {
 		var x string
 		fmt.Scanln(&x)
@@ -20,12 +20,44 @@ func Monitor(me *Logic.Me, logs *Log.LogSet, bottom *Bottom.Bottom, crown *Crown
 		} else if x == "log" {
 			fmt.Println(logs.ToString())
 			continue
+		} else if x == "net" {
+			if res, err := bottom.CableStatus(); err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println(res)
+			}
+			continue
 		} else if x == "app" {
 			fmt.Println(crown.ToString())
 			continue
 		} else {
 			tmp := strings.Split(x, ",")
-			if len(tmp) == 3 && tmp[0] == "netdelay" {
+			if len(tmp) == 2 && tmp[0] == "log" {
+				if i, err := strconv.Atoi(tmp[1]); err == nil {
+					if v, err := logs.GetByIndex(i); err != nil {
+						fmt.Println(err)
+					} else {
+						fmt.Printf("#%d %v committed: %v\n%s\n", v.I, v.K, !v.K.Greater(logs.GetCommitted()), v.V)
+					}
+					continue
+				}
+			} else if (len(tmp) == 2 || len(tmp) == 4) && tmp[0] == "backup" {
+				key := Log.Key{Term: -1, Index: -1}
+				var err error
+				if len(tmp) == 4 {
+					if key.Term, err = strconv.Atoi(tmp[2]); err == nil {
+						key.Index, err = strconv.Atoi(tmp[3])
+					}
+				}
+				if err == nil {
+					if key, err = bottom.Backup(tmp[1], key); err != nil {
+						fmt.Println(err)
+					} else {
+						fmt.Printf("backup at %v\n", key)
+					}
+					continue
+				}
+			} else if len(tmp) == 3 && tmp[0] == "netdelay" {
 				delay, err := strconv.Atoi(tmp[1])
 				if err == nil {
 					random, err := strconv.Atoi(tmp[2])
@@ -35,6 +67,13 @@ func Monitor(me *Logic.Me, logs *Log.LogSet, bottom *Bottom.Bottom, crown *Crown
 						continue
 					}
 				}
+			} else if tmp[0] == "partition" || tmp[0] == "cut" || tmp[0] == "link" || tmp[0] == "heal" {
+				if res, err := bottom.InjectFault(tmp); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println(res)
+				}
+				continue
 			} else if len(tmp) == 3 && tmp[0] == "appdelay" {
 				delay, err := strconv.Atoi(tmp[1])
 				if err == nil {
@@ -49,8 +88,16 @@ func Monitor(me *Logic.Me, logs *Log.LogSet, bottom *Bottom.Bottom, crown *Crown
 		}
 		fmt.Println("use 'me' to get node info, " +
 			"use 'log' to get log info, " +
+			"use 'log,[index]' to get the log at this global index, " +
+			"use 'net' to get the connections to other nodes, " +
+			"use 'backup,[path]' or 'backup,[path],[term],[index]' to back up committed logs, " +
 			"use 'netdelay,[ms],[randn]' to imitate network delay, " +
 			"use 'appdelay,[ms],[randn]' to imitate app's process delay, " +
+			"when the cable injects faults (tests and simulations), " +
+			"use 'partition,0|1,2|3|4' to split my group from the others, " +
+			"use 'cut,2|3' to drop my messages to these nodes, " +
+			"use 'link,[to|*],[drop],[dup],[reorder],[constant|uniform|normal|exponential],[base ms],[jitter ms]' to set a link rule, " +
+			"use 'heal' to clear all fault rules, " +
 			"use app to get app info")
 	}
 }
@@ -1,56 +1,206 @@
 package KVDB
 
 import (
+	DB "RaftDB/Custom/DB/KVDB"
+	"RaftDB/Kernel/Pipe/Client"
+	"bytes"
+	"encoding/json"
+	"strconv"
 	"strings"
 )
 
 type KVDBClient struct{}
 
 func (k *KVDBClient) Parser(order string) (string, bool) {
-	if strings.Count(order, "'")%2 == 1 {
-		return "", false
+	content, _, ok := k.parse(order)
+	return content, ok
+}
+
+/*
+把终端命令解析成请求，操作类型由命令决定，读默认线性一致。
+监听使用流式监听：watch 'key' 监听一个key，watch prefix 'p' 监听以p开头的key，watch range 'a' 'b' 监听[a, b)中的key。
+读命令前面可以加上一致性级别：local read 'key' 读本节点；bounded:LAG:MS read 'key' 要求节点落后leader
+不超过LAG条日志，或者MS毫秒内收到过leader的消息，LAG为-1或者MS为0时不用那个界限。
+*/
+
+func (k *KVDBClient) Request(order string) (Client.Request, bool) {
+	req := Client.Request{Version: Client.Version}
+	trimmed := strings.TrimSpace(order)
+	if i := strings.IndexAny(trimmed, " '"); i > 0 && k.consistency(trimmed[:i], &req) {
+		order = trimmed[i:]
 	}
-	var res []string
-	tmp := strings.Split(order, "'")
-	for _, v := range tmp {
-		v := strings.TrimSpace(v)
-		if len(v) > 0 {
-			res = append(res, v)
-		}
+	content, op, ok := k.parse(order)
+	req.Op, req.Command = op, content
+	if req.Consistency != Client.Linearizable && op != Client.Read {
+		return req, false
 	}
-Again:
-	if len(res) == 3 && res[0] == "write" {
-		return "write'" + res[1] + "'" + res[2], true
-	} else if len(res) == 2 {
-		if res[0] == "watch" {
-			return "watch'write'" + res[1], true
-		} else if res[0] == "read" {
-			return "read'" + res[1], true
-		}
-		var res2 []string
-		tmp := strings.Split(res[0], " ")
-		for _, v := range tmp {
-			v := strings.TrimSpace(v)
-			if len(v) > 0 {
-				res2 = append(res2, v)
+	return req, ok && req.Check() == nil
+}
+
+func (k *KVDBClient) consistency(word string, req *Client.Request) bool {
+	if word == Client.Local.String() {
+		req.Consistency = Client.Local
+		return true
+	}
+	parts := strings.Split(word, ":")
+	if len(parts) != 3 || parts[0] != Client.Bounded.String() {
+		return false
+	}
+	lag, err1 := strconv.Atoi(parts[1])
+	stale, err2 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	req.Consistency, req.MaxStale = Client.Bounded, stale
+	if lag >= 0 {
+		req.MaxLag = &lag
+	}
+	return true
+}
+
+/*
+命令和数据库中的命令一一对应：
+	read k、write k v、delete k、exists k、count [p]
+	read k at R            k在数据版本R时的值
+	revision、compact R    当前的数据版本；丢弃早于版本R的历史
+	list p [limit [next]]  以p开头的key，next是上一页回复中的next
+	scan a b [limit]       [a, b)中的key和值，b写成''时一直到最后
+	version k、cas k old new
+	watch k、watch prefix p、watch range a b
+	txn [if 条件 [and 条件]...] [then 操作...] [else 操作...]
+事务的条件是k [value|version] =|!=|<|> x，没有写value或者version时比较值；操作是read k、write k v或者delete k，
+例如txn if a version = 0 and b = 1 then write a 1 read b else read a。
+*/
+
+func (k *KVDBClient) parse(order string) (string, Client.Op, bool) {
+	res, ok := tokens(order)
+	if !ok || len(res) == 0 {
+		return "", Client.Read, false
+	}
+	args, n := res[1:], len(res)-1
+	switch {
+	case res[0] == "read" && n == 1, res[0] == "exists" && n == 1, res[0] == "count" && n <= 1, res[0] == "version" && n == 1,
+		res[0] == "revision" && n == 0:
+		return strings.Join(res, "'"), Client.Read, true
+	case res[0] == "read" && n == 3 && args[1] == "at":
+		return "read'" + args[0] + "'" + args[2], Client.Read, isNumber(args[2])
+	case res[0] == "compact" && n == 1:
+		return "compact'" + args[0], Client.Write, isNumber(args[0])
+	case res[0] == "list" && n >= 1 && n <= 3:
+		return strings.Join(res, "'"), Client.Read, n < 2 || isNumber(args[1])
+	case res[0] == "scan" && n >= 2 && n <= 3:
+		return strings.Join(res, "'"), Client.Read, n < 3 || isNumber(args[2])
+	case res[0] == "write" && n == 2, res[0] == "delete" && n == 1, res[0] == "cas" && n == 3:
+		return strings.Join(res, "'"), Client.Write, true
+	case res[0] == "txn":
+		content, ok := txn(args)
+		return content, Client.Write, ok
+	case res[0] == "watch" && n == 1:
+		return "watch'write'" + args[0], Client.Stream, true
+	case res[0] == "watch" && n == 2 && args[0] == "prefix":
+		return "watch'prefix'" + args[1], Client.Stream, true
+	case res[0] == "watch" && n == 3 && args[0] == "range":
+		return "watch'range'" + args[1] + "'" + args[2], Client.Stream, true
+	}
+	return "", Client.Read, false
+}
+
+/*
+把事务的词组装成txn'加上事务的JSON。
+*/
+
+func txn(args []string) (string, bool) {
+	t, i := DB.Txn{}, 0
+	if i < len(args) && args[i] == "if" {
+		for i++; ; i++ {
+			c, n, ok := compare(args[i:])
+			if !ok {
+				return "", false
+			}
+			if t.If, i = append(t.If, c), i+n; i == len(args) || args[i] != "and" {
+				break
 			}
 		}
-		if len(res2) == 2 && res2[0] == "write" {
-			return "write'" + res2[1] + "'" + res[1], true
+	}
+	for _, branch := range []struct {
+		word string
+		ops  *[]DB.TxnOp
+	}{{"then", &t.Then}, {"else", &t.Else}} {
+		if i == len(args) || args[i] != branch.word {
+			continue
 		}
-	} else if len(res) == 1 {
-		var res2 []string
-		tmp := strings.Split(res[0], " ")
-		for _, v := range tmp {
-			v := strings.TrimSpace(v)
-			if len(v) > 0 {
-				res2 = append(res2, v)
+		for i++; i < len(args) && (branch.word == "else" || args[i] != "else"); {
+			o, n, ok := txnOp(args[i:])
+			if !ok {
+				return "", false
 			}
+			*branch.ops, i = append(*branch.ops, o), i+n
 		}
-		res = res2
-		if len(res) > 1 {
-			goto Again
+	}
+	if i != len(args) {
+		return "", false
+	}
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(t); err != nil {
+		return "", false
+	}
+	return "txn'" + strings.TrimSpace(buf.String()), true
+}
+
+func compare(args []string) (DB.Compare, int, bool) {
+	c, n := DB.Compare{Target: "value"}, 3
+	if len(args) >= 4 && (args[1] == "value" || args[1] == "version") && isResult(args[2]) {
+		c.Target, args, n = args[1], append([]string{args[0]}, args[2:]...), 4
+	}
+	if len(args) < 3 || !isResult(args[1]) {
+		return c, 0, false
+	}
+	c.Key, c.Result = args[0], args[1]
+	if c.Target == "value" {
+		c.Value = args[2]
+		return c, n, true
+	}
+	version, err := strconv.Atoi(args[2])
+	c.Version = version
+	return c, n, err == nil
+}
+
+func isResult(s string) bool {
+	return s == "=" || s == "!=" || s == "<" || s == ">"
+}
+
+func txnOp(args []string) (DB.TxnOp, int, bool) {
+	switch {
+	case len(args) >= 2 && (args[0] == "read" || args[0] == "delete"):
+		return DB.TxnOp{Type: args[0], Key: args[1]}, 2, true
+	case len(args) >= 3 && args[0] == "write":
+		return DB.TxnOp{Type: args[0], Key: args[1], Value: args[2]}, 3, true
+	}
+	return DB.TxnOp{}, 0, false
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+/*
+把命令切成词：引号中的内容是一个词，去掉两边的空白，可以包含空格，也可以为空；引号外按空白切分。引号不成对时不合法。
+*/
+
+func tokens(order string) ([]string, bool) {
+	if strings.Count(order, "'")%2 == 1 {
+		return nil, false
+	}
+	var res []string
+	for i, v := range strings.Split(order, "'") {
+		if i%2 == 1 {
+			res = append(res, strings.TrimSpace(v))
+		} else {
+			res = append(res, strings.Fields(v)...)
 		}
 	}
-	return "", false
+	return res, true
 }
@@ -1,7 +1,9 @@
 package KVDB
 
 import (
+	"RaftDB/Kernel/Pipe/Client"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -11,3 +13,65 @@ func TestKVDBClient_Parser(t *testing.T) {
 	u, _ := db.Parser("write   ' hello tim   '    12222   ")
 	fmt.Println(len(strings.Split(u, "'")))
 }
+
+func TestKVDBClient_Consistency(t *testing.T) {
+	db := KVDBClient{}
+	cases := []struct {
+		order string
+		ok    bool
+		want  Client.Request
+	}{
+		{"read 'a'", true, Client.Request{Op: Client.Read, Consistency: Client.Linearizable, Command: "read'a"}},
+		{"local read 'a'", true, Client.Request{Op: Client.Read, Consistency: Client.Local, Command: "read'a"}},
+		{"bounded:3:500 read 'a'", true, Client.Request{Op: Client.Read, Consistency: Client.Bounded, MaxLag: Client.Lag(3), MaxStale: 500, Command: "read'a"}},
+		{"read local", true, Client.Request{Op: Client.Read, Consistency: Client.Linearizable, Command: "read'local"}},
+		{"bounded:3:0 read 'a'", true, Client.Request{Op: Client.Read, Consistency: Client.Bounded, MaxLag: Client.Lag(3), Command: "read'a"}},
+		{"bounded:-1:500 read 'a'", true, Client.Request{Op: Client.Read, Consistency: Client.Bounded, MaxStale: 500, Command: "read'a"}},
+		{"bounded:-1:0 read 'a'", false, Client.Request{}},
+		{"local write 'a' '1'", false, Client.Request{}},
+		{"watch 'a'", true, Client.Request{Op: Client.Stream, Command: "watch'write'a"}},
+		{"watch prefix 'a'", true, Client.Request{Op: Client.Stream, Command: "watch'prefix'a"}},
+		{"watch prefix a", true, Client.Request{Op: Client.Stream, Command: "watch'prefix'a"}},
+		{"watch range 'a' 'c'", true, Client.Request{Op: Client.Stream, Command: "watch'range'a'c"}},
+		{"watch range a c", true, Client.Request{Op: Client.Stream, Command: "watch'range'a'c"}},
+		{"delete 'a b'", true, Client.Request{Op: Client.Write, Command: "delete'a b"}},
+		{"local exists a", true, Client.Request{Op: Client.Read, Consistency: Client.Local, Command: "exists'a"}},
+		{"list 'user' 10 'user7'", true, Client.Request{Op: Client.Read, Command: "list'user'10'user7"}},
+		{"list user ten", false, Client.Request{}},
+		{"scan a '' 5", true, Client.Request{Op: Client.Read, Command: "scan'a''5"}},
+		{"scan a", false, Client.Request{}},
+		{"count", true, Client.Request{Op: Client.Read, Command: "count"}},
+		{"count 'user'", true, Client.Request{Op: Client.Read, Command: "count'user"}},
+		{"local delete a", false, Client.Request{}},
+		{"version a", true, Client.Request{Op: Client.Read, Command: "version'a"}},
+		{"local read 'a' at 12", true, Client.Request{Op: Client.Read, Consistency: Client.Local, Command: "read'a'12"}},
+		{"read a at x", false, Client.Request{}},
+		{"read a 12", false, Client.Request{}},
+		{"revision", true, Client.Request{Op: Client.Read, Command: "revision"}},
+		{"compact 12", true, Client.Request{Op: Client.Write, Command: "compact'12"}},
+		{"compact", false, Client.Request{}},
+		{"cas a '1' '2'", true, Client.Request{Op: Client.Write, Command: "cas'a'1'2"}},
+		{"cas a 1", false, Client.Request{}},
+		{"txn if a version = 0 and b > 'x y' then write a 1 read b else read else", true, Client.Request{Op: Client.Write,
+			Command: `txn'{"if":[{"key":"a","target":"version","result":"="},{"key":"b","target":"value","result":">","value":"x y"}],` +
+				`"then":[{"type":"write","key":"a","value":"1"},{"type":"read","key":"b"}],"else":[{"type":"read","key":"else"}]}`}},
+		{"txn then delete a", true, Client.Request{Op: Client.Write, Command: `txn'{"then":[{"type":"delete","key":"a"}]}`}},
+		{"txn if a version = x then read a", false, Client.Request{}},
+		{"txn if a = 1 and then read a", false, Client.Request{}},
+		{"txn then write a", false, Client.Request{}},
+		{"local txn then read a", false, Client.Request{}},
+	}
+	for _, c := range cases {
+		req, ok := db.Request(c.order)
+		if ok != c.ok {
+			t.Fatalf("%q: ok = %v, want %v", c.order, ok, c.ok)
+		}
+		if !ok {
+			continue
+		}
+		c.want.Version = Client.Version
+		if !reflect.DeepEqual(req, c.want) {
+			t.Fatalf("%q: got %+v, want %+v", c.order, req, c.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package Linearizability
+
+import "fmt"
+
+/*
+KVDB的模型：每个key是一个独立的寄存器，按key切分历史。
+读到"(empty)"表示key不存在，和KVDB的回复一致。
+*/
+
+const (
+	Get KvOp = iota
+	Put
+)
+
+type KvOp int
+
+type KvInput struct {
+	Op    KvOp
+	Key   string
+	Value string
+}
+
+type KvOutput struct {
+	Value   string
+	Unknown bool // 写入结果未知，可能执行也可能没有执行
+}
+
+const Empty = "(empty)"
+
+var KvModel = Model{
+	Partition: func(history []Operation) [][]Operation {
+		var keys []string
+		parts := map[string][]Operation{}
+		for _, v := range history {
+			key := v.Input.(KvInput).Key
+			if _, has := parts[key]; !has {
+				keys = append(keys, key)
+			}
+			parts[key] = append(parts[key], v)
+		}
+		res := make([][]Operation, 0, len(keys))
+		for _, k := range keys {
+			res = append(res, parts[k])
+		}
+		return res
+	},
+	Init: func() interface{} {
+		return Empty
+	},
+	Step: func(state interface{}, input interface{}, output interface{}) (bool, interface{}) {
+		in, out := input.(KvInput), output.(KvOutput)
+		if in.Op == Put {
+			return true, in.Value
+		}
+		return out.Value == state.(string), state
+	},
+	Equal: func(a interface{}, b interface{}) bool {
+		return a.(string) == b.(string)
+	},
+	DescribeOperation: func(input interface{}, output interface{}) string {
+		in, out := input.(KvInput), output.(KvOutput)
+		if in.Op == Put {
+			if out.Unknown {
+				return fmt.Sprintf("put(%s, %s) -> ?", in.Key, in.Value)
+			}
+			return fmt.Sprintf("put(%s, %s)", in.Key, in.Value)
+		}
+		return fmt.Sprintf("get(%s) -> %s", in.Key, out.Value)
+	},
+	DescribeState: func(state interface{}) string {
+		return state.(string)
+	},
+}
@@ -0,0 +1,247 @@
+package Linearizability
+
+import (
+	"math"
+	"sort"
+)
+
+/*
+线性一致性检查器，算法和Porcupine相同（Wing & Gong算法加上Lowe的缓存优化）：
+把所有操作的调用和返回事件按时间排成链表，深度优先地尝试每一个可以线性化的调用，
+用（已线性化的操作集合，状态）作为缓存剪枝，回溯到空栈仍然失败说明历史不满足线性一致性。
+历史先按模型的Partition切分成互不影响的子历史（例如KV按key切分），分别检查。
+*/
+
+type Operation struct {
+	ClientId int
+	Input    interface{}
+	Call     int64       // 调用时间
+	Output   interface{} // 结果未知的操作（例如超时的写）Return设为Pending
+	Return   int64
+}
+
+const Pending int64 = math.MaxInt64 // 结果未知的操作的返回时间，它可以线性化在调用之后的任何位置
+
+type Model struct {
+	Partition         func(history []Operation) [][]Operation
+	Init              func() interface{}
+	Step              func(state interface{}, input interface{}, output interface{}) (bool, interface{})
+	Equal             func(a interface{}, b interface{}) bool
+	DescribeOperation func(input interface{}, output interface{}) string
+	DescribeState     func(state interface{}) string
+}
+
+/*
+一个子历史的检查结果。Ok为假时，Longest是能找到的最长的部分线性化（操作在子历史中的下标顺序），用于生成报告。
+*/
+
+type Result struct {
+	Ok         bool
+	History    []Operation
+	Longest    []int
+	States     []interface{} // Longest中每一步之后的状态
+	Unfinished []int         // 无法继续线性化的操作
+}
+
+/*
+检查整个历史，所有子历史都可以线性化时返回真。
+*/
+
+func Check(model Model, history []Operation) (bool, []Result) {
+	parts := [][]Operation{history}
+	if model.Partition != nil {
+		parts = model.Partition(history)
+	}
+	ok, results := true, make([]Result, 0, len(parts))
+	for _, part := range parts {
+		res := checkSingle(model, part)
+		ok = ok && res.Ok
+		results = append(results, res)
+	}
+	return ok, results
+}
+
+type event struct {
+	id    int
+	call  bool
+	time  int64
+	match *event // 调用事件指向自己的返回事件
+	prev  *event
+	next  *event
+}
+
+type frame struct {
+	e     *event
+	state interface{}
+}
+
+type cacheEntry struct {
+	linearized bitset
+	state      interface{}
+}
+
+func checkSingle(model Model, history []Operation) Result {
+	res := Result{History: history}
+	head := buildList(history)
+	state := model.Init()
+	linearized := newBitset(len(history))
+	cache := map[uint64][]cacheEntry{}
+	var calls []frame
+	longest := 0
+	e := head.next
+	for head.next != nil {
+		if e.call {
+			op := history[e.id]
+			ok, next := model.Step(state, op.Input, op.Output)
+			if ok {
+				newLinearized := linearized.clone().set(e.id)
+				if !cacheContains(model, cache, newLinearized, next) {
+					h := newLinearized.hash()
+					cache[h] = append(cache[h], cacheEntry{linearized: newLinearized, state: next})
+					calls = append(calls, frame{e: e, state: state})
+					state = next
+					linearized.set(e.id)
+					lift(e)
+					if len(calls) > longest {
+						longest = len(calls)
+						res.Longest, res.States = res.Longest[:0], res.States[:0]
+						for j, f := range calls { // calls中保存的是执行这个操作之前的状态
+							res.Longest = append(res.Longest, f.e.id)
+							if j+1 < len(calls) {
+								res.States = append(res.States, calls[j+1].state)
+							} else {
+								res.States = append(res.States, state)
+							}
+						}
+					}
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+		} else {
+			if len(calls) == 0 {
+				done := newBitset(len(history))
+				for _, v := range res.Longest {
+					done.set(v)
+				}
+				for i := range history {
+					if !done.get(i) {
+						res.Unfinished = append(res.Unfinished, i)
+					}
+				}
+				return res
+			}
+			top := calls[len(calls)-1]
+			calls = calls[:len(calls)-1]
+			state = top.state
+			linearized.clear(top.e.id)
+			unlift(top.e)
+			e = top.e.next
+		}
+	}
+	res.Ok = true
+	return res
+}
+
+/*
+按时间把调用和返回事件排成双向链表，时间相同时调用排在返回之前。
+*/
+
+func buildList(history []Operation) *event {
+	events := make([]*event, 0, 2*len(history))
+	for i, op := range history {
+		ret := &event{id: i, time: op.Return}
+		call := &event{id: i, call: true, time: op.Call, match: ret}
+		events = append(events, call, ret)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].call && !events[j].call
+	})
+	head := &event{}
+	prev := head
+	for _, v := range events {
+		prev.next, v.prev = v, prev
+		prev = v
+	}
+	return head
+}
+
+func lift(e *event) {
+	e.prev.next = e.next
+	if e.next != nil {
+		e.next.prev = e.prev
+	}
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+func unlift(e *event) {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	if e.next != nil {
+		e.next.prev = e
+	}
+}
+
+func cacheContains(model Model, cache map[uint64][]cacheEntry, linearized bitset, state interface{}) bool {
+	for _, v := range cache[linearized.hash()] {
+		if linearized.equals(v.linearized) && model.Equal(state, v.state) {
+			return true
+		}
+	}
+	return false
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) clone() bitset {
+	res := make(bitset, len(b))
+	copy(res, b)
+	return res
+}
+
+func (b bitset) set(i int) bitset {
+	b[i/64] |= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) clear(i int) bitset {
+	b[i/64] &^= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) get(i int) bool {
+	return b[i/64]&(1<<uint(i%64)) != 0
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, v := range b {
+		h = (h ^ v) * 1099511628211
+	}
+	return h
+}
+
+func (b bitset) equals(c bitset) bool {
+	for i := range b {
+		if b[i] != c[i] {
+			return false
+		}
+	}
+	return true
+}
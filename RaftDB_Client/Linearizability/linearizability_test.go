@@ -0,0 +1,73 @@
+package Linearizability
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func put(client int, key string, value string, call int64, ret int64) Operation {
+	return Operation{ClientId: client, Input: KvInput{Op: Put, Key: key, Value: value}, Call: call,
+		Output: KvOutput{Unknown: ret == Pending}, Return: ret}
+}
+
+func get(client int, key string, value string, call int64, ret int64) Operation {
+	return Operation{ClientId: client, Input: KvInput{Op: Get, Key: key}, Call: call, Output: KvOutput{Value: value}, Return: ret}
+}
+
+func TestLinearizable(t *testing.T) {
+	history := []Operation{
+		put(0, "a", "1", 0, 10),
+		get(1, "a", Empty, 1, 3), // 和写入并发，可以读到旧值
+		get(2, "a", "1", 5, 15),
+		put(0, "b", "2", 11, 20),
+		get(1, "b", "2", 12, 13), // 和写入并发，可以读到新值
+		get(2, "b", "2", 21, 22),
+	}
+	if ok, _ := Check(KvModel, history); !ok {
+		t.Fatal("linearizable history is rejected")
+	}
+}
+
+func TestNotLinearizable(t *testing.T) {
+	history := []Operation{
+		put(0, "a", "1", 0, 10),
+		get(1, "a", "1", 11, 12),
+		get(2, "a", Empty, 13, 14), // 写入完成并且已经被读到之后又读到了旧值
+	}
+	ok, results := Check(KvModel, history)
+	if ok {
+		t.Fatal("stale read is accepted")
+	}
+	if len(results) != 1 || len(results[0].Longest) != 2 || len(results[0].Unfinished) != 1 {
+		t.Fatalf("unexpected result %+v", results)
+	}
+	path := filepath.Join(t.TempDir(), "report.html")
+	if err := Visualize(KvModel, results, path); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "get(a) -&gt; (empty)") {
+		t.Fatal("report does not show the failed operation")
+	}
+}
+
+func TestPendingWrite(t *testing.T) {
+	history := []Operation{
+		put(0, "a", "1", 0, Pending), // 超时的写入，结果未知
+		get(1, "a", Empty, 1, 2),
+		get(1, "a", "1", 3, 4),
+		get(2, "a", "1", 5, 6),
+	}
+	if ok, _ := Check(KvModel, history); !ok {
+		t.Fatal("a pending write can take effect at any time after its call")
+	}
+	history = append(history, get(2, "a", Empty, 7, 8))
+	if ok, _ := Check(KvModel, history); ok {
+		t.Fatal("a pending write can not be undone")
+	}
+}
@@ -0,0 +1,108 @@
+package Linearizability
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+把检查结果画成一个可以直接用浏览器打开的HTML报告。
+每个不满足线性一致性的子历史画一张时间线：每个客户端一行，每个操作是一根从调用到返回的横条，
+绿色是能找到的最长部分线性化中的操作，并标出它的线性化顺序和执行后的状态，红色是无法继续线性化的操作，结果未知的操作延伸到最右边。
+*/
+
+func Visualize(model Model, results []Result, path string) error {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>linearizability report</title>\n" +
+		"<style>body{font-family:monospace} rect.ok{fill:#9c6} rect.bad{fill:#e66} text{font-size:11px}</style></head><body>\n")
+	failed := 0
+	for _, res := range results {
+		if res.Ok {
+			continue
+		}
+		failed++
+		writePart(&b, model, res)
+	}
+	if failed == 0 {
+		b.WriteString("<h2>all histories are linearizable</h2>\n")
+	}
+	b.WriteString("</body></html>\n")
+	return os.WriteFile(path, []byte(b.String()), 0666)
+}
+
+func writePart(b *strings.Builder, model Model, res Result) {
+	const width, rowHeight, left = 1200.0, 28, 80
+	history := res.History
+	begin, end := int64(-1), int64(0)
+	for _, op := range history {
+		if begin == -1 || op.Call < begin {
+			begin = op.Call
+		}
+		if op.Return != Pending && op.Return > end {
+			end = op.Return
+		}
+		if op.Call > end {
+			end = op.Call
+		}
+	}
+	if end <= begin {
+		end = begin + 1
+	}
+	x := func(t int64) float64 {
+		if t == Pending {
+			t = end
+		}
+		return left + float64(t-begin)/float64(end-begin)*(width-left-10)
+	}
+	var clients []int
+	rows := map[int]int{}
+	for _, op := range history {
+		if _, has := rows[op.ClientId]; !has {
+			rows[op.ClientId] = 0
+			clients = append(clients, op.ClientId)
+		}
+	}
+	sort.Ints(clients)
+	for i, v := range clients {
+		rows[v] = i
+	}
+	order, states := map[int]int{}, map[int]interface{}{}
+	for i, v := range res.Longest {
+		order[v], states[v] = i+1, res.States[i]
+	}
+	b.WriteString(fmt.Sprintf("<h2>%d operations, longest linearizable prefix %d</h2>\n", len(history), len(res.Longest)))
+	b.WriteString(fmt.Sprintf("<svg width=\"%.0f\" height=\"%d\">\n", width, len(clients)*rowHeight+10))
+	for _, c := range clients {
+		b.WriteString(fmt.Sprintf("<text x=\"0\" y=\"%d\">client %d</text>\n", rows[c]*rowHeight+18, c))
+	}
+	for i, op := range history {
+		class, label := "bad", model.DescribeOperation(op.Input, op.Output)
+		if n, has := order[i]; has {
+			class = "ok"
+			label = fmt.Sprintf("#%d %s => %s", n, label, model.DescribeState(states[i]))
+		}
+		x0, x1 := x(op.Call), x(op.Return)
+		if x1-x0 < 2 {
+			x1 = x0 + 2
+		}
+		y := rows[op.ClientId]*rowHeight + 4
+		b.WriteString(fmt.Sprintf("<g><title>%s</title><rect class=\"%s\" x=\"%.1f\" y=\"%d\" width=\"%.1f\" height=\"20\"/>"+
+			"<text x=\"%.1f\" y=\"%d\">%s</text></g>\n", html.EscapeString(label), class, x0, y, x1-x0, x0+2, y+14,
+			html.EscapeString(label)))
+	}
+	b.WriteString("</svg>\n<ol>\n")
+	for i, v := range res.Longest {
+		op := history[v]
+		b.WriteString(fmt.Sprintf("<li>%s => %s</li>\n", html.EscapeString(model.DescribeOperation(op.Input, op.Output)),
+			html.EscapeString(model.DescribeState(res.States[i]))))
+	}
+	b.WriteString("</ol>\n<p>cannot linearize:</p>\n<ul>\n")
+	for _, v := range res.Unfinished {
+		op := history[v]
+		b.WriteString(fmt.Sprintf("<li>client %d: %s</li>\n", op.ClientId, html.EscapeString(model.DescribeOperation(op.Input, op.Output))))
+	}
+	b.WriteString("</ul>\n")
+}
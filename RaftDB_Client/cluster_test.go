@@ -0,0 +1,146 @@
+package main
+
+import (
+	"RaftDB/Custom/Cluster"
+	"RaftDB/Custom/Communicate/Fault"
+	KVDB_Server "RaftDB/Custom/DB/KVDB"
+	"RaftDB/Kernel/Crown"
+	"RaftDB/Kernel/Pipe/Client"
+	"RaftDB_Client/DB/KVDB"
+	"RaftDB_Client/Linearizability"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+在进程内集群上运行几个并发客户端，集群有丢包、乱序、延迟，并且中途杀死再重启节点。
+记录每个读写操作的调用和返回时间，最后用线性一致性检查器验证历史，失败时生成HTML报告。
+读操作也通过日志同步，这样读到的值才有线性一致性的保证。
+*/
+
+type recorder struct {
+	start   time.Time
+	history []Linearizability.Operation
+	m       sync.Mutex
+}
+
+func (r *recorder) now() int64 {
+	return int64(time.Since(r.start))
+}
+
+func (r *recorder) add(op Linearizability.Operation) {
+	r.m.Lock()
+	r.history = append(r.history, op)
+	r.m.Unlock()
+}
+
+/*
+执行一个操作直到得到确定的结果，返回值决定了这个操作是否记入历史：
+被Logic层拦截的请求一定没有执行，换一个节点重试；超时或者同步失败的写入结果未知，记为Pending。
+*/
+
+func runOp(c *Cluster.Cluster, r *recorder, client int, hint *int, in Linearizability.KvInput) {
+	db := KVDB.KVDBClient{}
+	var req Client.Request
+	if in.Op == Linearizability.Put {
+		req, _ = db.Request(fmt.Sprintf("write '%s' '%s'", in.Key, in.Value))
+	} else {
+		req, _ = db.Request(fmt.Sprintf("read '%s'", in.Key))
+	}
+	req.Timeout = 300
+	for attempt := 0; attempt < 20; attempt++ {
+		node := *hint
+		call := r.now()
+		res, err := c.Do(node, req)
+		ret := r.now()
+		switch {
+		case err != nil || res.Code == Client.NotLeader || res.Code == Client.Unsynced:
+			*hint = (node + 1) % 5
+			if err == nil && res.Leader >= 0 {
+				*hint = res.Leader
+			}
+			time.Sleep(5 * time.Millisecond)
+			continue
+		case res.Code == Client.Timeout || res.Code == Client.RolledBack:
+			if in.Op == Linearizability.Put {
+				r.add(Linearizability.Operation{ClientId: client, Input: in, Call: call,
+					Output: Linearizability.KvOutput{Unknown: true}, Return: Linearizability.Pending})
+			}
+			*hint = (node + 1) % 5
+			return
+		case in.Op == Linearizability.Put:
+			r.add(Linearizability.Operation{ClientId: client, Input: in, Call: call, Output: Linearizability.KvOutput{}, Return: ret})
+			return
+		default:
+			r.add(Linearizability.Operation{ClientId: client, Input: in, Call: call,
+				Output: Linearizability.KvOutput{Value: res.Result}, Return: ret})
+			return
+		}
+	}
+}
+
+func TestLinearizabilityUnderFaults(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	c, err := Cluster.New(5, func() Crown.App { return &KVDB_Server.KVDB{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		c.Fault(i).SetOutbound(-1, Fault.Rule{Drop: 0.03, Duplicate: 0.02, Reorder: 0.05, ReorderWindow: 5 * time.Millisecond,
+			Latency: Fault.Latency{Kind: Fault.Uniform, Jitter: 2 * time.Millisecond}})
+	}
+	c.Start()
+	defer c.Shutdown()
+	r := &recorder{start: time.Now()}
+	var wg sync.WaitGroup
+	for client := 0; client < 4; client++ {
+		client := client
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rd, hint := rand.New(rand.NewSource(int64(client))), client%5
+			for i := 0; i < 30; i++ {
+				in := Linearizability.KvInput{Op: Linearizability.Get, Key: fmt.Sprintf("k%d", rd.Intn(3))}
+				if rd.Intn(2) == 0 {
+					in.Op, in.Value = Linearizability.Put, fmt.Sprintf("%d-%d", client, i)
+				}
+				runOp(c, r, client, &hint, in)
+			}
+		}()
+	}
+	stop, faulted := make(chan struct{}), make(chan struct{})
+	go func() { // 客户端都结束后不再杀节点，已经杀掉的节点总会被重启，Shutdown之前等它退出
+		defer close(faulted)
+		for _, v := range []int{1, 3} {
+			select {
+			case <-stop:
+				return
+			case <-time.After(300 * time.Millisecond):
+			}
+			c.Kill(v)
+			time.Sleep(200 * time.Millisecond)
+			c.Restart(v)
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	<-faulted
+	if len(r.history) < 60 {
+		t.Fatalf("only %d operations finished", len(r.history))
+	}
+	if ok, results := Linearizability.Check(Linearizability.KvModel, r.history); !ok {
+		path := filepath.Join(os.TempDir(), fmt.Sprintf("raftdb-linearizability-%d.html", time.Now().UnixNano()))
+		if err := Linearizability.Visualize(Linearizability.KvModel, results, path); err != nil {
+			t.Log(err)
+		}
+		t.Fatalf("history is not linearizable, see %s", path)
+	}
+}
@@ -1,3 +1,7 @@
 module RaftDB_Client
 
 go 1.20
+
+require RaftDB v0.0.0
+
+replace RaftDB => ../
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"RaftDB/Custom/Communicate/RPC"
+	"RaftDB/Kernel/Feed"
+	"RaftDB/Kernel/Pipe/Client"
 	"RaftDB_Client/DB/KVDB"
-	"RaftDB_Client/Msg"
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"net/rpc"
 	"os"
+	"time"
 )
 
 func main() {
@@ -16,24 +20,103 @@ func main() {
 		return
 	}
 	addr := os.Args[1]
+	session, seq := newSession(), 0
 	for {
 		fmt.Printf("> ")
 		order, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-		content, ok := db.Parser(order)
+		req, ok := db.Request(order)
 		if !ok {
 			fmt.Println("illegal operation")
 			continue
 		}
-		client, err := rpc.Dial("tcp", addr)
+		if req.Op == Client.Stream {
+			follow(addr, req)
+			continue
+		}
+		client, err := RPC.Dial(addr) // 设置了RAFTDB_TLS_CERT、RAFTDB_TLS_KEY和RAFTDB_TLS_CA时使用双向TLS
 		if err != nil {
 			fmt.Println(err)
+			continue
 		}
-		req := Msg.Msg{Log: Msg.LogType(content), Term: 50000000, Agree: content[1] == 'r'}
-		rep := ""
-		if err := client.Call("RPC.Write", req, &rep); err != nil {
-			fmt.Println(err)
-			return
+		req.Timeout = timeout
+		if req.Op == Client.Write { // 写入带上会话，超时重试时使用同一个序号，节点不会重复执行
+			seq++
+			req.Client, req.Seq = session, seq
+		}
+		var res Client.Response
+		for retry := 0; ; retry++ {
+			if err := client.Call("RPC.Do", req, &res); err != nil {
+				fmt.Println(err)
+				return
+			}
+			if res.Code != Client.Timeout || req.Op != Client.Write || retry == maxRetry {
+				break
+			}
+			fmt.Println("timeout, retry")
+		}
+		_ = client.Close()
+		if res.Code == Client.OK && res.Key.Index >= 0 {
+			fmt.Printf("%s\t(served at term %d index %d)\n", res.Result, res.Key.Term, res.Key.Index)
+		} else if res.Code == Client.OK {
+			fmt.Println(res.Result)
+		} else if res.Code == Client.NotLeader && res.Leader >= 0 {
+			fmt.Printf("%v: %s, the leader is node %d\n", res.Code, res.Result, res.Leader)
+		} else {
+			fmt.Printf("%v: %s\n", res.Code, res.Result)
 		}
-		fmt.Println(rep)
 	}
 }
+
+const (
+	maxRetry     = 3
+	timeout      = 5000  // 读写的超时毫秒数
+	watchTimeout = 30000 // 流式监听一次长轮询的毫秒数
+	reconnect    = time.Second
+)
+
+/*
+流式监听，一直打印事件直到程序退出。连接断开或者节点忘记了监听（节点重启）时，从最后收到的版本之后重新创建监听，不会丢失改变。
+*/
+
+func follow(addr string, req Client.Request) {
+	req.Timeout = watchTimeout
+	for {
+		client, err := RPC.Dial(addr)
+		for err == nil {
+			var res Client.Response
+			if err = client.Call("RPC.Do", req, &res); err != nil {
+				break
+			}
+			if res.Code == Client.Gone {
+				req.WatchId = 0
+				continue
+			}
+			if res.Code != Client.OK {
+				fmt.Printf("%v: %s\n", res.Code, res.Result)
+				_ = client.Close()
+				return
+			}
+			for _, e := range res.Events {
+				if e.HasOld {
+					fmt.Printf("%s %s: %s -> %s\t(revision %s, data revision %d)\n", e.Type, e.Key, e.Old, e.Value, Feed.FormatRevision(e.Revision), e.Rev)
+				} else {
+					fmt.Printf("%s %s: %s\t(revision %s, data revision %d)\n", e.Type, e.Key, e.Value, Feed.FormatRevision(e.Revision), e.Rev)
+				}
+			}
+			next := res.Key
+			req.WatchId, req.From = res.WatchId, &next
+		}
+		if client != nil {
+			_ = client.Close()
+		}
+		req.WatchId = 0
+		fmt.Printf("%v, reconnect\n", err)
+		time.Sleep(reconnect)
+	}
+}
+
+func newSession() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
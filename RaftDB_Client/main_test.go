@@ -1,8 +1,8 @@
 package main
 
 import (
+	"RaftDB/Kernel/Pipe/Client"
 	"RaftDB_Client/DB/KVDB"
-	"RaftDB_Client/Msg"
 	"fmt"
 	"net/rpc"
 	"sync"
@@ -23,20 +23,20 @@ func Test(t *testing.T) {
 	for i := 500000; i < 600000; i++ {
 		i := i
 		//go func() {
-		content, _ := db.Parser(fmt.Sprintf("write %d %d", i, i+1))
+		req, _ := db.Request(fmt.Sprintf("write %d %d", i, i+1))
 		client, ok := pool.Get().(*rpc.Client)
 		if !ok {
 			fmt.Println("fuck")
 			break
 		}
-		req := Msg.Msg{Log: Msg.LogType(content), Term: 50000000, Agree: content[1] == 'r'}
-		rep := ""
-		if err := client.Call("RPC.Write", req, &rep); err != nil {
+		req.Timeout = 50000000
+		var res Client.Response
+		if err := client.Call("RPC.Do", req, &res); err != nil {
 			fmt.Println(err)
 			return
 		}
 		pool.Put(client)
-		fmt.Println(rep)
+		fmt.Println(res.Result)
 
 		//}()
 	}